@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"relay/relay"
+)
+
+var (
+	// backplaneURL is the Redis server whose backplaneChannel carries rooms'
+	// broadcasts between relay instances.
+	backplaneURL     = flag.String("backplane-url", "", "Redis URL, e.g. redis://host:6379/0, whose pub/sub channel shares rooms' broadcasts with the other relay instances using it")
+	backplaneChannel = flag.String("backplane-channel", "relay", "Redis pub/sub channel of -backplane-url")
+)
+
+// bindOptions defines a flag for each of the relay's options, with the
+// option's current value as its default.
+func bindOptions(opts *relay.Options) {
+	flag.IntVar(&opts.ReadBufferSize, "read-buffer", opts.ReadBufferSize, "WebSocket read buffer size in bytes")
+	flag.IntVar(&opts.WriteBufferSize, "write-buffer", opts.WriteBufferSize, "WebSocket write buffer size in bytes")
+	flag.BoolVar(&opts.WriteBufferPool, "write-buffer-pool", opts.WriteBufferPool, "share WebSocket write buffers between connections, which hold one only while writing")
+	flag.BoolVar(&opts.AllowAnyOrigin, "allow-any-origin", opts.AllowAnyOrigin, "allow WebSockets and publishes from any origin, for development")
+	flag.BoolVar(&opts.AllowMissingOrigin, "allow-missing-origin", opts.AllowMissingOrigin, "accept WebSocket upgrades that send no Origin header")
+	flag.StringVar(&opts.AllowedOrigins, "allowed-origins", opts.AllowedOrigins, "comma-separated origins allowed to open WebSockets and publish from browsers, e.g. https://*.example.com (empty for the relay's own origin, * for any)")
+	flag.BoolVar(&opts.Presence, "presence", opts.Presence, "broadcast the subscriber count to a room on join/leave")
+	flag.BoolVar(&opts.PresenceBaseline, "presence-baseline", opts.PresenceBaseline, "send joining subscribers the presence count before their own join")
+	flag.BoolVar(&opts.PresenceEvents, "presence-events", opts.PresenceEvents, "broadcast join and leave events, with the subscriber's ID and ?name=, whenever a subscriber joins or leaves a room")
+	flag.BoolVar(&opts.PresenceSelfJoin, "presence-self-join", opts.PresenceSelfJoin, "deliver a subscriber's own join presence update to it")
+	flag.StringVar(&opts.StaticDir, "static-dir", opts.StaticDir, "directory to serve the frontend's static files from instead of the copy embedded in the binary, for development")
+	flag.IntVar(&opts.MaxConnections, "max-connections", opts.MaxConnections, "maximum concurrent subscriber connections across WebSocket and SSE (0 for unlimited)")
+	flag.IntVar(&opts.MaxRoomClients, "max-room-clients", opts.MaxRoomClients, "maximum subscribers per room across WebSocket and SSE (0 for unlimited)")
+	flag.IntVar(&opts.MaxRooms, "max-rooms", opts.MaxRooms, "maximum rooms, beyond which subscribes and publishes don't create new ones (0 for unlimited)")
+	flag.IntVar(&opts.MaxAnonymousConnections, "max-anonymous-connections", opts.MaxAnonymousConnections, "maximum concurrent subscribers without a valid JWT, within -max-connections (0 for no separate limit)")
+	flag.IntVar(&opts.MaxAnonymousRoomClients, "max-anonymous-room-clients", opts.MaxAnonymousRoomClients, "maximum subscribers per room without a valid JWT, within -max-room-clients (0 for no separate limit)")
+	flag.Float64Var(&opts.ShedThreshold, "shed-threshold", opts.ShedThreshold, "fraction of -max-connections at which slow clients start being shed")
+	flag.DurationVar(&opts.EvictIdleAfter, "evict-idle-after", opts.EvictIdleAfter, "at -max-connections, evict subscribers idle for this long to admit new ones (0 to disable)")
+	flag.BoolVar(&opts.Compression, "compression", opts.Compression, "negotiate permessage-deflate compression with subscribers by default")
+	flag.IntVar(&opts.CompressionMinSize, "compression-min-size", opts.CompressionMinSize, "send messages shorter than this many bytes uncompressed on compressed connections")
+	flag.BoolVar(&opts.CompressBinary, "compress-binary", opts.CompressBinary, "compress binary messages on compressed connections")
+	flag.BoolVar(&opts.AutoDetectFrameType, "auto-detect-frame-type", opts.AutoDetectFrameType, "send UTF-8 messages to WebSocket subscribers in text frames and others in binary frames, rather than all in binary frames")
+	flag.Int64Var(&opts.PublishQueueDepth, "publish-queue-depth", opts.PublishQueueDepth, "publishes that may wait for a busy room by default before further ones get 429 (0 for unlimited)")
+	flag.DurationVar(&opts.RoomCloseGrace, "room-close-grace", opts.RoomCloseGrace, "time between the closing notice and the disconnect of a deleted room's subscribers")
+	flag.Float64Var(&opts.MaxClientRate, "max-client-rate", opts.MaxClientRate, "maximum messages per second delivered to a subscriber (0 for unlimited)")
+	flag.StringVar(&opts.Subprotocol, "subprotocol", opts.Subprotocol, "WebSocket subprotocol subscribers must request (empty to not require one)")
+	flag.BoolVar(&opts.WSPing, "ws-ping", opts.WSPing, "send WebSocket pings to detect dead subscribers")
+	flag.DurationVar(&opts.WSReadTimeout, "ws-read-timeout", opts.WSReadTimeout, "with -ws-ping=false, close WebSocket connections that send nothing for this long")
+	flag.DurationVar(&opts.WSPongTimeout, "ws-pong-timeout", opts.WSPongTimeout, "with -ws-ping, close WebSocket connections that don't answer a ping within this long; pings are sent every 9/10 of it")
+	flag.DurationVar(&opts.SubscriberIdleTimeout, "subscriber-idle-timeout", opts.SubscriberIdleTimeout, "disconnect subscribers that haven't been sent a message for this long (0 to disable)")
+	flag.DurationVar(&opts.StreamIdleTimeout, "stream-idle-timeout", opts.StreamIdleTimeout, "end streaming publishes that send no line for this long (0 to disable)")
+	flag.Int64Var(&opts.MaxWSMessageSize, "max-ws-message-size", opts.MaxWSMessageSize, "maximum size in bytes of a message read from a WebSocket client")
+	flag.BoolVar(&opts.Welcome, "welcome", opts.Welcome, "send WebSocket subscribers a welcome message with their connection ID")
+	flag.IntVar(&opts.MaxContentSize, "max-content-size", opts.MaxContentSize, "maximum size in bytes of published content (0 for unlimited; 1 MiB for request bodies)")
+	flag.DurationVar(&opts.PublishBodyTimeout, "publish-body-timeout", opts.PublishBodyTimeout, "maximum duration for reading the body of a publish request")
+	flag.IntVar(&opts.MaxSessionBytes, "max-session-bytes", opts.MaxSessionBytes, "maximum bytes a publish session may assemble before it is aborted")
+	flag.DurationVar(&opts.PublishSessionTimeout, "publish-session-timeout", opts.PublishSessionTimeout, "discard publish sessions not committed within this long")
+	flag.IntVar(&opts.MaxSSEConnections, "max-sse-connections", opts.MaxSSEConnections, "maximum concurrent SSE subscriber connections (0 for unlimited)")
+	flag.DurationVar(&opts.SSEKeepalive, "sse-keepalive", opts.SSEKeepalive, "interval of keepalive comments on quiet SSE streams (0 to disable)")
+	flag.IntVar(&opts.HistorySize, "history-size", opts.HistorySize, "number of recent messages replayed to new subscribers (at most 256)")
+	flag.IntVar(&opts.HistoryBytes, "history-bytes", opts.HistoryBytes, "maximum total bytes of retained messages per room (0 for unlimited)")
+	flag.IntVar(&opts.MaxTotalHistoryBytes, "max-total-history-bytes", opts.MaxTotalHistoryBytes, "maximum total bytes of retained messages across all rooms, evicted from the least recently active rooms first (0 for unlimited)")
+	flag.IntVar(&opts.HistoryPerPublisher, "history-per-publisher", opts.HistoryPerPublisher, "maximum retained messages per publisher in a room's history (0 for unlimited)")
+	flag.StringVar(&opts.RequireRetention, "require-retention", opts.RequireRetention, "for publishes a room won't retain: off, warn (Warning header) or reject (409)")
+	flag.StringVar(&opts.MirrorHealthGate, "mirror-health-gate", opts.MirrorHealthGate, "for publishes to rooms with a failing remote mirror: off, warn (Warning header) or reject (503)")
+	flag.Float64Var(&opts.MirrorFailureThreshold, "mirror-failure-threshold", opts.MirrorFailureThreshold, "fraction of a remote mirror's recent deliveries that must fail for it to count as failing")
+	flag.DurationVar(&opts.RetainMaxAge, "retain-max-age", opts.RetainMaxAge, "clear retained content this long after a room's last publish (0 to keep it indefinitely)")
+	flag.DurationVar(&opts.ContentTTL, "content-ttl", opts.ContentTTL, "drop each retained message this long after it was published (0 to keep messages indefinitely)")
+	flag.IntVar(&opts.CompressRetained, "compress-retained", opts.CompressRetained, "keep retained messages of at least this many bytes gzip-compressed in memory (0 to disable)")
+	flag.DurationVar(&opts.DedupWindow, "dedup-window", opts.DedupWindow, "how long a room drops publishes repeating a recent dedup_key")
+	flag.IntVar(&opts.MaxScheduled, "max-scheduled", opts.MaxScheduled, "maximum number of scheduled messages pending across all rooms")
+	flag.IntVar(&opts.MaxRoomStreams, "max-room-streams", opts.MaxRoomStreams, "maximum concurrent streaming publishes per room (0 for unlimited)")
+	flag.StringVar(&opts.StreamPartialLine, "stream-partial-line", opts.StreamPartialLine, "what to do with a stream's final line if it lacks a newline: publish or discard")
+	flag.StringVar(&opts.AutoCreateRooms, "auto-create-rooms", opts.AutoCreateRooms, "regular expression room names must match in full to be created by subscribers and publishers; others must be created with the admin API (empty allows any)")
+	flag.DurationVar(&opts.RoomIdleTimeout, "room-idle-timeout", opts.RoomIdleTimeout, "remove rooms that have had no subscribers or activity for this long, along with their retained content (0 to keep rooms forever)")
+	flag.StringVar(&opts.PausedPublish, "paused-publish", opts.PausedPublish, "for publishes to paused rooms: reject (409) or buffer until the room resumes")
+	flag.IntVar(&opts.PauseBufferSize, "pause-buffer-size", opts.PauseBufferSize, "maximum publishes buffered per paused room with -paused-publish=buffer")
+	flag.StringVar(&opts.SlowClient, "slow-client", opts.SlowClient, "for subscribers whose send buffer is full: disconnect them, drop_oldest or drop_newest queued message, or coalesce the queue into the latest message")
+	flag.IntVar(&opts.FanOutThreshold, "fan-out-threshold", opts.FanOutThreshold, "number of subscribers from which rooms fan broadcasts out from parallel workers (0 to only do so in rooms with the parallel_fan_out meta setting)")
+	flag.IntVar(&opts.FanOutWorkers, "fan-out-workers", opts.FanOutWorkers, "workers each room fans broadcasts out from in parallel (0 for one per CPU)")
+	flag.StringVar(&opts.RoomPanic, "room-panic", opts.RoomPanic, "when a room's event loop panics: restart it, keeping the room, or close the room")
+	flag.IntVar(&opts.MaxPublisherIPs, "max-publisher-ips", opts.MaxPublisherIPs, "maximum distinct publisher IPs per room within -publisher-ip-window (0 for unlimited)")
+	flag.DurationVar(&opts.PublisherIPWindow, "publisher-ip-window", opts.PublisherIPWindow, "window over which distinct publisher IPs are counted")
+	flag.IntVar(&opts.MaxPublisherRooms, "max-publisher-rooms", opts.MaxPublisherRooms, "maximum distinct rooms a publisher may write to within -publisher-room-window (0 for unlimited)")
+	flag.DurationVar(&opts.PublisherRoomWindow, "publisher-room-window", opts.PublisherRoomWindow, "window over which the distinct rooms of a publisher are counted")
+	flag.Float64Var(&opts.PublishRate, "publish-rate", opts.PublishRate, "sustained publishes per second allowed per room, or per room and publisher IP with -publish-rate-per-ip (0 for unlimited)")
+	flag.IntVar(&opts.PublishBurst, "publish-burst", opts.PublishBurst, "publishes allowed at once before -publish-rate applies")
+	flag.StringVar(&opts.TrustedPublisherTokens, "trusted-publisher-tokens", opts.TrustedPublisherTokens, "comma-separated tokens that exempt publishes sending one as X-Trusted-Publisher from -publish-rate")
+	flag.BoolVar(&opts.PublishRatePerIP, "publish-rate-per-ip", opts.PublishRatePerIP, "apply -publish-rate to each publisher IP of a room separately")
+	flag.DurationVar(&opts.ReconnectInterval, "reconnect-interval", opts.ReconnectInterval, "minimum time between connections with the same client_id (0 for no limit)")
+	flag.DurationVar(&opts.ResumeWindow, "resume-window", opts.ResumeWindow, "how long a disconnected client_id's position is kept so a reconnect only replays what it missed (0 to disable)")
+	flag.StringVar(&opts.TagKeys, "tag-keys", opts.TagKeys, "comma-separated query parameters subscribers may tag connections with, e.g. platform,version")
+	flag.IntVar(&opts.MaxTagValues, "max-tag-values", opts.MaxTagValues, "distinct values tracked per tag key; further values are counted as \"other\"")
+	flag.DurationVar(&opts.CloseTimeout, "close-timeout", opts.CloseTimeout, "maximum time to wait for a WebSocket client to acknowledge a close frame")
+	flag.BoolVar(&opts.Envelope, "envelope", opts.Envelope, "wrap published messages in a JSON envelope with the room, publish time and sequence number")
+	flag.BoolVar(&opts.EnvelopeTypes, "envelope-types", opts.EnvelopeTypes, "tag enveloped messages as snapshot when replayed on joining or update when live")
+	flag.BoolVar(&opts.WSPublish, "ws-publish", opts.WSPublish, "broadcast messages WebSocket clients send to the rest of their room")
+	flag.BoolVar(&opts.WSPublishOptIn, "ws-publish-opt-in", opts.WSPublishOptIn, "with -ws-publish, only broadcast messages from clients that connect with ?mode=rw")
+	flag.Float64Var(&opts.WSPublishRate, "ws-publish-rate", opts.WSPublishRate, "sustained messages per second each WebSocket client may publish with -ws-publish (0 for unlimited)")
+	flag.IntVar(&opts.WSPublishBurst, "ws-publish-burst", opts.WSPublishBurst, "messages a WebSocket client may publish at once before -ws-publish-rate applies")
+	flag.StringVar(&opts.JWTKey, "jwt-key", opts.JWTKey, "HMAC key for subscriber JWTs (subscribing is open when empty)")
+	flag.BoolVar(&opts.AnonymousSubscribers, "anonymous-subscribers", opts.AnonymousSubscribers, "with -jwt-key, admit subscribers without a token as anonymous subscribers")
+	flag.StringVar(&opts.RoomTokenSecret, "room-token-secret", opts.RoomTokenSecret, "secret for signed room tokens; when set, URLs must carry a room token instead of the room name")
+	flag.StringVar(&opts.PublishHMACKey, "publish-hmac-key", opts.PublishHMACKey, "shared secret publish requests must be HMAC-signed with (publishing is open when empty)")
+	flag.DurationVar(&opts.PublishSignatureMaxAge, "publish-signature-max-age", opts.PublishSignatureMaxAge, "maximum age of a signed publish request's timestamp")
+	flag.StringVar(&opts.AdminToken, "admin-token", opts.AdminToken, "bearer token required for the admin API (disabled when empty)")
+	flag.StringVar(&opts.BridgeToken, "bridge-token", opts.BridgeToken, "shared secret of relays bridging rooms with each other, required from relays bridging into this one and sent by this one's bridges (bridges into this relay are refused when empty)")
+	flag.StringVar(&opts.StatsDAddr, "statsd-addr", opts.StatsDAddr, "StatsD/DogStatsD UDP address to send metrics to, e.g. 127.0.0.1:8125")
+	flag.StringVar(&opts.StatsDPrefix, "statsd-prefix", opts.StatsDPrefix, "prefix of StatsD metric names")
+	flag.DurationVar(&opts.StatsDInterval, "statsd-interval", opts.StatsDInterval, "interval between StatsD flushes")
+	flag.DurationVar(&opts.MetricsFlushInterval, "metrics-flush-interval", opts.MetricsFlushInterval, "interval at which rooms flush batched metric updates (0 to update on every message)")
+	flag.BoolVar(&opts.Maintenance, "maintenance", opts.Maintenance, "start in maintenance mode: public endpoints respond with 503 until it is turned off with the admin API")
+	flag.StringVar(&opts.MaintenanceMessage, "maintenance-message", opts.MaintenanceMessage, "message of 503 responses during maintenance")
+	flag.StringVar(&opts.MaintenancePage, "maintenance-page", opts.MaintenancePage, "file served as the body of 503 responses during maintenance, e.g. an HTML status page, instead of -maintenance-message")
+	flag.StringVar(&opts.MetricsPath, "metrics-path", opts.MetricsPath, "path of the Prometheus metrics endpoint (empty to disable)")
+	flag.BoolVar(&opts.DebugVars, "debug-vars", opts.DebugVars, "serve expvar variables, including relay.rooms, relay.clients and relay.messages, at /debug/vars")
+	flag.BoolVar(&opts.Pprof, "pprof", opts.Pprof, "serve runtime profiles at /debug/pprof/")
+	flag.StringVar(&opts.BasePath, "base-path", opts.BasePath, "path prefix the relay is served under, used when building room URLs")
+}
+
+// setFlagsFromEnv sets each flag that has a matching environment variable,
+// RELAY_ followed by the flag name in upper case with dashes as underscores,
+// e.g. RELAY_READ_BUFFER for -read-buffer. Flags given on the command line
+// take precedence.
+func setFlagsFromEnv() {
+	flag.VisitAll(func(f *flag.Flag) {
+		name := "RELAY_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(name); ok {
+			if err := f.Value.Set(v); err != nil {
+				log.Fatalf("%s: %v", name, err)
+			}
+		}
+	})
+}
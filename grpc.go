@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"relay/relay"
+)
+
+// grpcAddr is the address of the gRPC listener, serving relaypb.Relay from
+// the same rooms as the HTTP server. When empty, gRPC isn't served.
+var grpcAddr = flag.String("grpc-addr", "", "also serve the gRPC publish/subscribe service on this address, e.g. :9090, with the TLS certificates of -addr if any")
+
+// serveGRPC starts serving the relay's gRPC service on -grpc-addr, over TLS
+// when the HTTP server uses it, and returns the gRPC server, or nil without
+// -grpc-addr.
+func serveGRPC(relayServer *relay.Server, certManager *autocert.Manager) *grpc.Server {
+	if *grpcAddr == "" {
+		return nil
+	}
+	var opts []grpc.ServerOption
+	if certManager != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(certManager.TLSConfig())))
+	} else if tlsEnabled() {
+		creds, err := credentials.NewServerTLSFromFile(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	lis, err := net.Listen("tcp", *grpcAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gs := grpc.NewServer(opts...)
+	relayServer.RegisterGRPC(gs)
+	go func() {
+		log.Println("gRPC server started on " + *grpcAddr)
+		if err := gs.Serve(lis); err != nil {
+			log.Fatal("Serve (gRPC): ", err)
+		}
+	}()
+	return gs
+}
@@ -1,258 +1,236 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
-	"strings"
-	"sync"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/handlers"
-	"github.com/gorilla/websocket"
+
+	"relay/relay"
 )
 
-const (
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
+var (
+	// addr is the address the public listener binds to.
+	addr = flag.String("addr", ":8080", "address to listen on")
 
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
+	// adminAddr is the address of a separate listener for the management
+	// endpoints. When empty they are served alongside public traffic.
+	adminAddr = flag.String("admin-addr", "", "separate listen address for admin endpoints, e.g. 127.0.0.1:8081")
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-)
+	// HTTP server timeouts. They only cover the HTTP exchange: the upgrader clears
+	// the connection deadlines once a WebSocket is hijacked, and the pumps manage
+	// their own deadlines from then on.
+	readTimeout  = flag.Duration("read-timeout", 10*time.Second, "maximum duration for reading an HTTP request, including the body")
+	writeTimeout = flag.Duration("write-timeout", 10*time.Second, "maximum duration before timing out writes of an HTTP response")
+	idleTimeout  = flag.Duration("idle-timeout", 120*time.Second, "maximum time to wait for the next request on a keep-alive connection")
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
+	// shutdownTimeout bounds a graceful shutdown: connections still open after
+	// it are closed forcibly.
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "maximum time to wait for connections to close on SIGINT/SIGTERM before force-closing them")
 
-// Room maintains the set of active clients and broadcasts messages to the clients.
-type Room struct {
-	name        string
-	clients     map[*Client]bool
-	broadcast   chan []byte
-	register    chan *Client
-	unregister  chan *Client
-	lastContent []byte
-}
+	// logLevel and logFormat configure the structured log output.
+	logLevel  = flag.String("log-level", "info", "minimum level of the messages logged: debug (including every connection and broadcast), info, warn or error")
+	logFormat = flag.String("log-format", "text", "log output format: text or json")
 
-func newRoom(name string) *Room {
-	return &Room{
-		name:       name,
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
-	}
-}
+	// dataDir is where rooms' latest content and history are persisted, so
+	// that they survive a restart.
+	dataDir = flag.String("data-dir", "", "directory to persist each room's latest content and history in, restored on first use after a restart")
+)
 
-func (r *Room) run() {
-	for {
-		select {
-		case client := <-r.register:
-			r.clients[client] = true
-			if len(r.lastContent) > 0 {
-				client.send <- r.lastContent
-			}
-		case client := <-r.unregister:
-			if _, ok := r.clients[client]; ok {
-				delete(r.clients, client)
-				close(client.send)
-			}
-		case message := <-r.broadcast:
-			if bytes.Equal(r.lastContent, message) {
-				continue
+// recoverHandler turns a panicking handler into a 500 response instead of
+// aborting the connection, and logs the panic with its stack.
+func recoverHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
 			}
-			r.lastContent = message
-			for client := range r.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(r.clients, client)
-				}
+			if err == http.ErrAbortHandler {
+				panic(err)
 			}
-		}
-	}
+			log.Printf("%s %s: recovered from panic: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
 }
 
-// RoomManager manages all the rooms
-type RoomManager struct {
-	rooms map[string]*Room
-	mu    sync.RWMutex
-}
-
-func (rm *RoomManager) getRoom(name string) *Room {
-	rm.mu.Lock()
-	defer rm.mu.Unlock()
+func main() {
+	opts := relay.DefaultOptions()
+	opts.Static = frontend()
+	bindOptions(&opts)
+	setFlagsFromEnv()
+	flag.Parse()
 
-	if room, ok := rm.rooms[name]; ok {
-		return room
+	logger, err := newLogger(*logLevel, *logFormat)
+	if err != nil {
+		log.Fatal(err)
 	}
+	// The standard logger, used by the HTTP servers, writes through it too.
+	slog.SetDefault(logger)
+	opts.Logger = logger
 
-	room := newRoom(name)
-	rm.rooms[name] = room
-	go room.run()
-	return room
-}
-
-var roomManager = &RoomManager{
-	rooms: make(map[string]*Room),
-}
-
-// Client is a middleman between the websocket connection and the hub.
-type Client struct {
-	room *Room
-	conn *websocket.Conn
-	send chan []byte
-}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be set together")
+	}
+	if *tlsCert != "" && *autocertHosts != "" {
+		log.Fatal("-autocert-hosts can't be combined with -tls-cert")
+	}
+	if *tlsRedirectAddr != "" && !tlsEnabled() {
+		log.Fatal("-tls-redirect-addr requires -tls-cert and -tls-key")
+	}
 
-// readPump pumps messages from the websocket connection to the hub.
-// We don't expect clients to send messages, but we need to read to handle close and pong.
-func (c *Client) readPump() {
-	defer func() {
-		c.room.unregister <- c
-		c.conn.Close()
-	}()
-	c.conn.SetReadLimit(512)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-	for {
-		_, _, err := c.conn.ReadMessage()
+	if *templateDir != "" {
+		templates, err := loadTemplates(*templateDir)
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
-			}
-			break
+			log.Fatal(err)
 		}
+		opts.Templates = templates
 	}
-}
-
-// writePump pumps messages from the hub to the websocket connection.
-func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
-	defer func() {
-		ticker.Stop()
-		c.conn.Close()
-	}()
-	for {
-		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			if err := w.Close(); err != nil {
-				return
-			}
-		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				return
-			}
+	if *dataDir != "" {
+		store, err := relay.NewFileStore(*dataDir, opts.HistorySize)
+		if err != nil {
+			log.Fatal(err)
 		}
+		opts.Persister = store
 	}
-}
 
-func serveWs(w http.ResponseWriter, r *http.Request) {
-	// Extract room ID from URL. Assuming /ws/{roomID}
-	pathParts := strings.Split(r.URL.Path, "/")
-	if len(pathParts) < 3 {
-		http.Error(w, "Invalid room ID", http.StatusBadRequest)
-		return
+	if *backplaneURL != "" {
+		backplane, err := relay.NewRedisBackplane(*backplaneURL, *backplaneChannel)
+		if err != nil {
+			log.Fatal("-backplane-url: ", err)
+		}
+		defer backplane.Close()
+		opts.Backplane = backplane
 	}
-	roomID := pathParts[2]
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	relayServer, err := relay.NewServer(opts)
 	if err != nil {
-		log.Println(err)
-		return
+		log.Fatal(err)
 	}
 
-	room := roomManager.getRoom(roomID)
-	client := &Client{room: room, conn: conn, send: make(chan []byte, 256)}
-	client.room.register <- client
-
-	// Allow collection of memory referenced by the caller by doing all work in
-	// new goroutines.
-	go client.writePump()
-	go client.readPump()
-}
+	mux := http.NewServeMux()
 
-func handlePublish(w http.ResponseWriter, r *http.Request) {
-	// Serve static files for the frontend
-	if r.URL.Path == "/" || r.URL.Path == "/index.html" {
-		http.ServeFile(w, r, "./public/index.html")
-		return
-	}
-	if r.URL.Path == "/style.css" {
-		http.ServeFile(w, r, "./public/style.css")
-		return
+	// Management endpoints move to their own listener when -admin-addr is set,
+	// so they can be bound to a private interface.
+	adminMux := mux
+	if *adminAddr != "" {
+		adminMux = http.NewServeMux()
 	}
-	if r.URL.Path == "/app.js" {
-		http.ServeFile(w, r, "./public/app.js")
-		return
-	}
-	if r.URL.Path == "/qrcode.min.js" {
-		http.ServeFile(w, r, "./public/qrcode.min.js")
-		return
+	relayServer.Register(mux, adminMux)
+
+	var servers []*http.Server
+	if *adminAddr != "" {
+		adminServer := newServer(*adminAddr, adminMux)
+		servers = append(servers, adminServer)
+		go func() {
+			log.Println("Admin server started on " + *adminAddr)
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal("ListenAndServe (admin): ", err)
+			}
+		}()
 	}
 
-	// Extract room ID from URL. Assuming /{roomID}
-	pathParts := strings.Split(r.URL.Path, "/")
-	if len(pathParts) < 2 {
-		http.Error(w, "Invalid room ID", http.StatusBadRequest)
-		return
+	certManager := newCertManager()
+	server := newServer(*addr, mux)
+	if certManager != nil {
+		server.TLSConfig = certManager.TLSConfig()
 	}
-	roomID := pathParts[1]
+	servers = append(servers, server)
+	go func() {
+		var err error
+		if certManager != nil {
+			log.Println("Server started on " + *addr + " (TLS, certificates for " + *autocertHosts + ")")
+			err = server.ListenAndServeTLS("", "")
+		} else if tlsEnabled() {
+			log.Println("Server started on " + *addr + " (TLS)")
+			err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			log.Println("Server started on " + *addr)
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal("ListenAndServe: ", err)
+		}
+	}()
 
-	// If the path is just "/", ignore or handle root
-	if roomID == "" {
-		http.Error(w, "Missing room ID", http.StatusBadRequest)
-		return
-	}
+	grpcServer := serveGRPC(relayServer, certManager)
 
-	content := r.URL.Query().Get("content")
-	if content == "" {
-		http.Error(w, "Missing content parameter", http.StatusBadRequest)
-		return
+	if *tlsRedirectAddr != "" {
+		var redirect http.Handler = http.HandlerFunc(redirectToHTTPS)
+		if certManager != nil {
+			// Also answers Let's Encrypt's HTTP challenges.
+			redirect = certManager.HTTPHandler(redirect)
+		}
+		redirectServer := newServer(*tlsRedirectAddr, redirect)
+		servers = append(servers, redirectServer)
+		go func() {
+			log.Println("HTTPS redirect server started on " + *tlsRedirectAddr)
+			if err := redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal("ListenAndServe (redirect): ", err)
+			}
+		}()
 	}
 
-	room := roomManager.getRoom(roomID)
-	room.broadcast <- []byte(content)
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Published to " + roomID))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down")
+	// Connections still open after -shutdown-timeout are closed forcibly.
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	relayServer.Shutdown(ctx, servers...)
+	if grpcServer != nil {
+		// Subscribe streams ended with the shutdown; in-flight publishes get
+		// what is left of -shutdown-timeout to finish.
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcServer.Stop()
+		}
+	}
 }
 
-func main() {
-	// Subscriber endpoint: /ws/{roomID}
-	http.HandleFunc("/ws/", serveWs)
-
-	// Publisher endpoint: /{roomID}?content=...
-	// We use a catch-all pattern or specific handler.
-	// Since http.HandleFunc matches prefixes, "/" will match everything not matched by others.
-	// But we need to be careful not to capture /ws/ if we defined it.
-	// The specific pattern "/ws/" takes precedence over "/".
-	http.HandleFunc("/", handlePublish)
+// newLogger returns a logger writing to stderr in format, text or json, at
+// level and above.
+func newLogger(level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid -log-level %q", level)
+	}
+	handlerOpts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, handlerOpts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, handlerOpts)), nil
+	}
+	return nil, fmt.Errorf("invalid -log-format %q: must be text or json", format)
+}
 
-	log.Println("Server started on :8080")
-	err := http.ListenAndServe(":8080", handlers.CompressHandler(http.DefaultServeMux))
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+// newServer returns an HTTP server for handler on addr with the configured timeouts.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      recoverHandler(handlers.CompressHandler(handler)),
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
 	}
 }
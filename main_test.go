@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"relay/relay"
+)
+
+// setFlag sets the named flag for the duration of the test.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	old := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set(name, old) })
+}
+
+func TestServerTimeouts(t *testing.T) {
+	setFlag(t, "read-timeout", "50ms")
+	setFlag(t, "write-timeout", "2s")
+	setFlag(t, "idle-timeout", "3s")
+	server := newServer("127.0.0.1:0", http.NotFoundHandler())
+	if server.ReadTimeout != 50*time.Millisecond || server.WriteTimeout != 2*time.Second || server.IdleTimeout != 3*time.Second {
+		t.Fatalf("timeouts = %v, %v, %v", server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(lis)
+	t.Cleanup(func() { server.Close() })
+
+	// A client that never finishes its request is cut off after the read
+	// timeout.
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: relay\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	io.Copy(io.Discard, conn)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("the connection stayed open for %v", elapsed)
+	}
+}
+
+func TestRecoverHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(http.ResponseWriter, *http.Request) { panic("boom") })
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+	ts := httptest.NewServer(recoverHandler(mux))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("panicking handler: status %d, want 500", res.StatusCode)
+	}
+
+	// The server is still up.
+	res, err = http.Get(ts.URL + "/ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("after the panic: status %d, want 200", res.StatusCode)
+	}
+}
+
+func TestFlagsFromEnv(t *testing.T) {
+	// bindOptions defines flags on the command line flag set, so it can only
+	// run once per test binary.
+	opts := relay.DefaultOptions()
+	bindOptions(&opts)
+	if opts.ReadBufferSize != 1024 || opts.WriteBufferSize != 1024 || *addr != ":8080" {
+		t.Fatalf("defaults: -read-buffer %d, -write-buffer %d, -addr %q", opts.ReadBufferSize, opts.WriteBufferSize, *addr)
+	}
+	t.Cleanup(func() { *addr = ":8080" })
+
+	t.Setenv("RELAY_ADDR", ":9000")
+	t.Setenv("RELAY_READ_BUFFER", "4096")
+	t.Setenv("RELAY_STATIC_DIR", "/srv/public")
+	setFlagsFromEnv()
+	if *addr != ":9000" || opts.ReadBufferSize != 4096 || opts.StaticDir != "/srv/public" {
+		t.Errorf("from the environment: -addr %q, -read-buffer %d, -static-dir %q", *addr, opts.ReadBufferSize, opts.StaticDir)
+	}
+
+	// Flags on the command line take precedence.
+	if err := flag.CommandLine.Parse([]string{"-read-buffer", "8192", "-write-buffer", "2048"}); err != nil {
+		t.Fatal(err)
+	}
+	if opts.ReadBufferSize != 8192 || opts.WriteBufferSize != 2048 {
+		t.Errorf("from the command line: -read-buffer %d, -write-buffer %d", opts.ReadBufferSize, opts.WriteBufferSize)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	for _, tt := range []struct {
+		addr, want string
+	}{
+		{":443", "https://relay.example/room1?content=hi"},
+		{":8443", "https://relay.example:8443/room1?content=hi"},
+	} {
+		setFlag(t, "addr", tt.addr)
+		w := httptest.NewRecorder()
+		redirectToHTTPS(w, httptest.NewRequest(http.MethodGet, "http://relay.example:8080/room1?content=hi", nil))
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tt.want {
+			t.Errorf("-addr %s: %d to %q, want 301 to %q", tt.addr, w.Code, w.Header().Get("Location"), tt.want)
+		}
+	}
+}
+
+func TestWSS(t *testing.T) {
+	opts := relay.DefaultOptions()
+	opts.WSPongTimeout = 100 * time.Millisecond
+	s, err := relay.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewTLSServer(s.Handler())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx, ts.Config)
+		ts.Close()
+	})
+
+	dialer := websocket.Dialer{TLSClientConfig: ts.Client().Transport.(*http.Transport).TLSClientConfig}
+	conn, _, err := dialer.Dial("wss"+strings.TrimPrefix(ts.URL, "https")+"/ws/secure", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	messages := make(chan string)
+	go func() {
+		defer close(messages)
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			messages <- string(message)
+		}
+	}()
+
+	// Pings are answered over TLS as over plain connections, keeping the
+	// connection up well past the pong timeout.
+	time.Sleep(5 * opts.WSPongTimeout)
+	if err := s.Publish("secure", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message, ok := <-messages:
+		if !ok || message != "hello" {
+			t.Errorf("received %q (open %t), want hello", message, ok)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the message")
+	}
+}
+
+func TestCertManager(t *testing.T) {
+	if newCertManager() != nil || tlsEnabled() {
+		t.Fatal("a certificate manager without -autocert-hosts")
+	}
+
+	setFlag(t, "autocert-hosts", "relay.example.com, ws.example.com,")
+	setFlag(t, "autocert-cache", t.TempDir())
+	m := newCertManager()
+	if m == nil || !tlsEnabled() {
+		t.Fatal("no certificate manager with -autocert-hosts")
+	}
+	for host, want := range map[string]bool{
+		"relay.example.com": true,
+		"ws.example.com":    true,
+		"evil.example":      false,
+	} {
+		if err := m.HostPolicy(context.Background(), host); (err == nil) != want {
+			t.Errorf("host policy for %s: %v, want allowed %t", host, err, want)
+		}
+	}
+
+	// The redirect listener also answers Let's Encrypt's challenges, and
+	// redirects everything else.
+	setFlag(t, "addr", ":443")
+	redirect := m.HTTPHandler(http.HandlerFunc(redirectToHTTPS))
+	w := httptest.NewRecorder()
+	redirect.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://relay.example.com/room1", nil))
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("plain request to the redirect listener: %d, want 301", w.Code)
+	}
+	w = httptest.NewRecorder()
+	redirect.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://relay.example.com/.well-known/acme-challenge/unknown", nil))
+	if w.Code == http.StatusMovedPermanently {
+		t.Error("an ACME challenge was redirected")
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	for _, tt := range []struct {
+		level, format string
+		ok            bool
+	}{
+		{"info", "text", true},
+		{"debug", "json", true},
+		{"WARN", "text", true},
+		{"verbose", "text", false},
+		{"info", "yaml", false},
+	} {
+		logger, err := newLogger(tt.level, tt.format)
+		if (err == nil) != tt.ok {
+			t.Errorf("newLogger(%q, %q): %v, want success %t", tt.level, tt.format, err, tt.ok)
+		}
+		if err == nil && logger.Enabled(context.Background(), slog.LevelDebug) != (tt.level == "debug") {
+			t.Errorf("newLogger(%q, %q): debug enabled %t", tt.level, tt.format, !(tt.level == "debug"))
+		}
+	}
+}
+
+func TestFrontend(t *testing.T) {
+	// The relay serves these files, so they must all be embedded.
+	for _, name := range []string{"index.html", "style.css", "app.js", "qrcode.min.js"} {
+		if _, err := fs.Stat(frontend(), name); err != nil {
+			t.Errorf("embedded frontend: %v", err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package relay
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+var (
+	errMissingAccessToken = errors.New("room requires an access token")
+	errWrongAccessToken   = errors.New("wrong room access token")
+	errRoomTokenSettled   = errors.New("room's access token is already settled")
+)
+
+// claimAccessToken settles the room's access token on its first publish: the
+// publisher's token, or none, leaving the room open, if it presented none.
+// Later publishes must present the same token. Subscribers that joined
+// before the token was set and don't hold it are disconnected.
+func (r *Room) claimAccessToken(token string) error {
+	if !r.accessToken.CompareAndSwap(nil, &token) {
+		return r.checkAccessToken(token)
+	}
+	if token != "" {
+		r.evictUnadmitted()
+	}
+	return nil
+}
+
+// issueTokens locks a room whose access token isn't settled yet with two
+// random tokens: one to publish, which is also the room's access token, and
+// one that only lets subscribers in. It fails with errRoomTokenSettled if the
+// room's first publish, or an earlier call, already settled its token.
+func (r *Room) issueTokens() (publish, subscribe string, err error) {
+	publish, subscribe = newAccessToken(), newAccessToken()
+	if !r.accessToken.CompareAndSwap(nil, &publish) {
+		return "", "", errRoomTokenSettled
+	}
+	r.subscribeToken.Store(&subscribe)
+	r.evictUnadmitted()
+	return publish, subscribe, nil
+}
+
+// evictUnadmitted disconnects the subscribers that joined before the room's
+// access token was set and don't hold it.
+func (r *Room) evictUnadmitted() {
+	r.do(func() {
+		evicted := false
+		for client := range r.clients {
+			if r.admitsSubscriber(client.accessToken) != nil {
+				close(client.send)
+				r.deleteClient(client)
+				evicted = true
+			}
+		}
+		if evicted {
+			r.announceClients()
+		}
+	})
+}
+
+// newAccessToken returns a random token of 32 bytes, base64url-encoded.
+func newAccessToken() string {
+	var b [32]byte
+	rand.Read(b[:])
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// checkAccessToken checks token against the room's access token, if it has
+// one, in constant time.
+func (r *Room) checkAccessToken(token string) error {
+	want := r.accessToken.Load()
+	if want == nil || *want == "" {
+		return nil
+	}
+	if token == "" {
+		return errMissingAccessToken
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(*want)) != 1 {
+		return errWrongAccessToken
+	}
+	return nil
+}
+
+// admitsSubscriber checks a subscriber's token against the room's access
+// token or, if it has one, its subscribe token. With JWTKey, subscribers
+// present JWTs instead, which authorize them on their own.
+func (r *Room) admitsSubscriber(token string) error {
+	if r.srv.opts.JWTKey != "" {
+		return nil
+	}
+	if want := r.subscribeToken.Load(); want != nil && token != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(*want)) == 1 {
+		return nil
+	}
+	return r.checkAccessToken(token)
+}
+
+// accessTokenStatus maps an access token error to its HTTP status code.
+func accessTokenStatus(err error) int {
+	if errors.Is(err, errWrongAccessToken) {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// handleIssueRoomTokens creates a room locked with separate publish and
+// subscribe tokens: POST /api/rooms?room={roomID}
+// Without a room, one is created under a random name, along with its room
+// token when RoomTokenSecret is set. Rooms whose access token is already
+// settled get 409.
+func (s *Server) handleIssueRoomTokens(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("room")
+	generated := roomID == ""
+	if generated {
+		roomID = newConnectionID()
+	} else {
+		var err error
+		if roomID, err = s.resolveRoomID(roomID); err != nil {
+			http.Error(w, err.Error(), roomIDStatus(err))
+			return
+		}
+	}
+
+	room, err := s.rooms.openRoom(roomID)
+	if err != nil {
+		http.Error(w, err.Error(), openRoomStatus(err))
+		return
+	}
+	publish, subscribe, err := room.issueTokens()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	response := map[string]string{"room": roomID, "publish_token": publish, "subscribe_token": subscribe}
+	if generated && s.opts.RoomTokenSecret != "" {
+		response["room_token"] = s.signRoomToken(roomID)
+	}
+	writeJSON(w, http.StatusCreated, response)
+}
@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRoomAccessToken(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+
+	// A subscriber without the token, joined before the room was locked, is
+	// disconnected by the publish that sets it.
+	early := dialWS(t, ts, "/ws/locked", nil)
+	room := waitForRoom(t, s, "locked")
+	waitForClients(t, room, 1)
+	if code, body := publish(t, ts, "locked", "first", url.Values{"token": {"secret"}}); code != http.StatusOK {
+		t.Fatalf("claiming the room: %d %s", code, body)
+	}
+	for {
+		if _, _, err := early.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	bearer := http.Header{"Authorization": {"Bearer secret"}}
+	for _, tt := range []struct {
+		name   string
+		query  string
+		header http.Header
+		want   int
+	}{
+		{"missing", "", nil, http.StatusUnauthorized},
+		{"wrong", "&token=guess", nil, http.StatusForbidden},
+		{"query", "&token=secret", nil, http.StatusOK},
+		{"header", "", bearer, http.StatusOK},
+	} {
+		code, body := request(t, http.MethodPost, ts.URL+"/locked?content="+tt.name+tt.query, "", tt.header)
+		if code != tt.want {
+			t.Errorf("publish with %s token: %d %s, want %d", tt.name, code, strings.TrimSpace(body), tt.want)
+		}
+	}
+	if code, got := request(t, http.MethodGet, ts.URL+"/api/rooms/locked/latest", "", bearer); code != http.StatusOK || got != "header" {
+		t.Errorf("latest = %d %q, want only publishes with the token", code, got)
+	}
+	if code, _ := request(t, http.MethodGet, ts.URL+"/api/rooms/locked/latest", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("latest without the token: status %d, want 401", code)
+	}
+
+	target := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/locked"
+	for _, tt := range []struct {
+		query string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"?token=guess", http.StatusForbidden},
+	} {
+		_, res, err := websocket.DefaultDialer.Dial(target+tt.query, nil)
+		if err == nil || res == nil || res.StatusCode != tt.want {
+			t.Errorf("subscribing with %q: %v, want status %d", tt.query, err, tt.want)
+		}
+	}
+	dialWS(t, ts, "/ws/locked?token=secret", nil)
+
+	// A room first published to without a token stays open, even to
+	// publishers that present one.
+	if code, body := publish(t, ts, "open", "first", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if code, body := publish(t, ts, "open", "second", url.Values{"token": {"secret"}}); code != http.StatusOK {
+		t.Errorf("publish with a token to an open room: %d %s", code, body)
+	}
+	dialWS(t, ts, "/ws/open", nil)
+}
+
+func TestIssueRoomTokens(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	code, body := request(t, http.MethodPost, ts.URL+"/api/rooms?room=issued", "", nil)
+	if code != http.StatusCreated {
+		t.Fatalf("creating the room: %d %s", code, body)
+	}
+	var tokens struct {
+		Room      string `json:"room"`
+		Publish   string `json:"publish_token"`
+		Subscribe string `json:"subscribe_token"`
+	}
+	if err := json.Unmarshal([]byte(body), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if tokens.Room != "issued" || tokens.Publish == "" || tokens.Subscribe == "" || tokens.Publish == tokens.Subscribe {
+		t.Fatalf("issued %+v, want distinct publish and subscribe tokens", tokens)
+	}
+
+	// Either token lets subscribers in.
+	subscriber := dialWS(t, ts, "/ws/issued?token="+tokens.Subscribe, nil)
+	dialWS(t, ts, "/ws/issued?token="+tokens.Publish, nil)
+	waitForClients(t, waitForRoom(t, s, "issued"), 2)
+	if _, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/issued", nil); err == nil || res == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("subscribing without a token: %v, want status 401", err)
+	}
+
+	// Only the publish token lets publishers in.
+	if code, body := publish(t, ts, "issued", "from a subscriber", url.Values{"token": {tokens.Subscribe}}); code != http.StatusForbidden {
+		t.Errorf("publishing with the subscribe token: %d %s, want 403", code, body)
+	}
+	if code, body := publish(t, ts, "issued", "hello", url.Values{"token": {tokens.Publish}}); code != http.StatusOK {
+		t.Fatalf("publishing with the publish token: %d %s", code, body)
+	}
+	if _, message, err := subscriber.ReadMessage(); err != nil || string(message) != "hello" {
+		t.Errorf("subscriber received %q (%v), want hello", message, err)
+	}
+
+	// The tokens are settled once.
+	if code, body := request(t, http.MethodPost, ts.URL+"/api/rooms?room=issued", "", nil); code != http.StatusConflict {
+		t.Errorf("issuing tokens again: %d %s, want 409", code, body)
+	}
+	if code, body := publish(t, ts, "claimed", "first", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if code, body := request(t, http.MethodPost, ts.URL+"/api/rooms?room=claimed", "", nil); code != http.StatusConflict {
+		t.Errorf("issuing tokens for a room already published to: %d %s, want 409", code, body)
+	}
+
+	// Without a room, one is named at random.
+	code, body = request(t, http.MethodPost, ts.URL+"/api/rooms", "", nil)
+	if code != http.StatusCreated {
+		t.Fatalf("creating an unnamed room: %d %s", code, body)
+	}
+	if err := json.Unmarshal([]byte(body), &tokens); err != nil || tokens.Room == "" {
+		t.Fatalf("issued %s (%v), want a room name", body, err)
+	}
+	if _, ok := s.rooms.lookupRoom(tokens.Room); !ok {
+		t.Errorf("room %s wasn't opened", tokens.Room)
+	}
+}
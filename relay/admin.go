@@ -0,0 +1,377 @@
+package relay
+
+import (
+	"compress/flate"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxClientsPerLookup bounds the number of connections returned by /admin/clients.
+	maxClientsPerLookup = 100
+
+	// maxMetaBodySize bounds the JSON body accepted by the room meta and command
+	// endpoints.
+	maxMetaBodySize = 64 << 10
+)
+
+// requireAdmin rejects requests that don't present the admin token as a bearer token.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.opts.AdminToken == "" {
+			http.Error(w, "Admin API disabled", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.AdminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// writeJSON writes v as the JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleMirrorTo configures one-way mirroring:
+// POST /api/rooms/{roomID}/mirror-to?room={target}&retain={bool}
+// With retain=false the target delivers mirrored messages live without
+// retaining them. With url={target} instead of room, broadcasts are POSTed to
+// that URL, e.g. a room on another relay.
+func (s *Server) handleMirrorTo(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	if targetURL := r.URL.Query().Get("url"); targetURL != "" {
+		if err := parseMirrorURL(targetURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.rooms.getRoom(roomID)
+		s.remoteMirrors.add(roomID, targetURL)
+		writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "mirror_to_url": targetURL})
+		return
+	}
+	target := r.URL.Query().Get("room")
+	if target == "" {
+		http.Error(w, "Missing room or url parameter", http.StatusBadRequest)
+		return
+	}
+	retain := true
+	if v := r.URL.Query().Get("retain"); v != "" {
+		var err error
+		if retain, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Invalid retain parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := s.rooms.addMirror(roomID, target, retain); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "mirror_to": target, "retain": retain})
+}
+
+// roomMeta holds a room's configurable settings. Fields left out of a meta
+// request keep their current value.
+type roomMeta struct {
+	Priority          *int32   `json:"priority,omitempty"`
+	LatestOnly        *bool    `json:"latest_only,omitempty"`
+	MaxRetainBytes    *int64   `json:"max_retain_bytes,omitempty"`
+	MaxContentSize    *int64   `json:"max_content_size,omitempty"`
+	RetainContentType *string  `json:"retain_content_type,omitempty"`
+	Compression       *bool    `json:"compression,omitempty"`
+	CompressionLevel  *int32   `json:"compression_level,omitempty"`
+	ParallelFanOut    *bool    `json:"parallel_fan_out,omitempty"`
+	QueueDepth        *int64   `json:"queue_depth,omitempty"`
+	SendBuffer        *int64   `json:"send_buffer,omitempty"`
+	SlowClient        *string  `json:"slow_client,omitempty"`
+	Reliable          *bool    `json:"reliable,omitempty"`
+	PublishRate       *float64 `json:"publish_rate,omitempty"`
+	PublishBurst      *int     `json:"publish_burst,omitempty"`
+}
+
+// validate checks that the settings present in meta are in range.
+func (meta roomMeta) validate() error {
+	if meta.MaxRetainBytes != nil && *meta.MaxRetainBytes < 0 {
+		return errors.New("max_retain_bytes must not be negative")
+	}
+	if meta.MaxContentSize != nil && *meta.MaxContentSize < 0 {
+		return errors.New("max_content_size must not be negative")
+	}
+	if meta.RetainContentType != nil && *meta.RetainContentType != "" {
+		if _, _, err := mime.ParseMediaType(*meta.RetainContentType); err != nil {
+			return errors.New("retain_content_type must be a media type")
+		}
+	}
+	if meta.CompressionLevel != nil && (*meta.CompressionLevel < 0 || *meta.CompressionLevel > flate.BestCompression) {
+		return fmt.Errorf("compression_level must be between 0 and %d", flate.BestCompression)
+	}
+	if meta.QueueDepth != nil && *meta.QueueDepth < 0 {
+		return errors.New("queue_depth must not be negative")
+	}
+	if meta.SendBuffer != nil && (*meta.SendBuffer < 0 || *meta.SendBuffer > maxSendBufferSize) {
+		return fmt.Errorf("send_buffer must be between 0 and %d", maxSendBufferSize)
+	}
+	if meta.SlowClient != nil && !validSlowClientPolicy(*meta.SlowClient) {
+		return errors.New("slow_client must be disconnect, drop_oldest, drop_newest or coalesce")
+	}
+	if meta.PublishRate != nil && *meta.PublishRate < 0 {
+		return errors.New("publish_rate must not be negative")
+	}
+	if meta.PublishBurst != nil && *meta.PublishBurst < 1 {
+		return errors.New("publish_burst must be at least 1")
+	}
+	return nil
+}
+
+// handleRoomMeta updates a room's settings: POST /api/rooms/{roomID}/meta
+// It responds with the room's resulting settings.
+func (s *Server) handleRoomMeta(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+
+	var meta roomMeta
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMetaBodySize)).Decode(&meta); err != nil {
+		http.Error(w, "Invalid room meta: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := meta.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	room := s.rooms.getRoom(roomID)
+	room.applyMeta(meta)
+
+	writeJSON(w, http.StatusOK, room.meta())
+}
+
+// commandEvent is a control command broadcast to a room's subscribers,
+// distinguished from content by its type.
+type commandEvent struct {
+	Type    string          `json:"type"`
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+// handleRoomCommand broadcasts a control command to a room's current
+// subscribers: POST /api/rooms/{roomID}/command
+// The body is {"command": name, "args": any JSON}. Commands aren't retained,
+// replayed, mirrored or counted as published messages. It responds with the
+// number of subscribers the command was queued for.
+func (s *Server) handleRoomCommand(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+
+	var event commandEvent
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMetaBodySize)).Decode(&event); err != nil {
+		http.Error(w, "Invalid command: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if event.Command == "" {
+		http.Error(w, "Missing command", http.StatusBadRequest)
+		return
+	}
+	event.Type = "command"
+	message, _ := json.Marshal(event)
+
+	delivered := 0
+	if room, ok := s.rooms.lookupRoom(roomID); ok {
+		room.do(func() {
+			room.fanOut(message, nil)
+			// fanOut drops the clients it couldn't queue the message for.
+			delivered = len(room.clients)
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "delivered": delivered})
+}
+
+// handleCreateRoom creates a room, in particular one that AutoCreateRooms
+// doesn't let subscribers and publishers create: PUT /api/rooms/{roomID}
+// An optional body holds settings to apply, as for handleRoomMeta. It
+// responds with 201 if the room was created and 200 if it existed.
+func (s *Server) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	if roomID == directoryRoomName {
+		http.Error(w, errReservedRoom.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateRoomID(roomID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var meta roomMeta
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMetaBodySize)).Decode(&meta); err != nil && err != io.EOF {
+		http.Error(w, "Invalid room meta: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := meta.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	if _, ok := s.rooms.lookupRoom(roomID); !ok {
+		status = http.StatusCreated
+	}
+	s.rooms.getRoom(roomID).applyMeta(meta)
+
+	writeJSON(w, status, map[string]any{"room": roomID})
+}
+
+// handleDeleteRoom closes a room and disconnects its subscribers:
+// DELETE /api/rooms/{roomID}?grace={duration}
+// Subscribers get a closing notice and the grace period (RoomCloseGrace
+// by default) before they are disconnected.
+func (s *Server) handleDeleteRoom(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	grace := s.opts.RoomCloseGrace
+	if v := r.URL.Query().Get("grace"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid grace parameter", http.StatusBadRequest)
+			return
+		}
+		grace = d
+	}
+
+	if !s.rooms.deleteRoom(roomID, grace) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]any{"room": roomID, "grace_ms": grace.Milliseconds()})
+}
+
+// handleRoomToken issues the signed token that stands in for a room's name in
+// URLs when RoomTokenSecret is set: GET /api/rooms/{roomID}/token
+func (s *Server) handleRoomToken(w http.ResponseWriter, r *http.Request) {
+	if s.opts.RoomTokenSecret == "" {
+		http.Error(w, "Room tokens are disabled", http.StatusNotFound)
+		return
+	}
+
+	roomID := r.PathValue("roomID")
+	writeJSON(w, http.StatusOK, map[string]string{"room": roomID, "token": s.signRoomToken(roomID)})
+}
+
+// handleRoomPriority sets a room's load-shedding priority: POST /api/rooms/{roomID}/priority?level={n}
+// Slow clients of lower-priority rooms are shed first under connection pressure.
+func (s *Server) handleRoomPriority(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	level, err := strconv.ParseInt(r.URL.Query().Get("level"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid level parameter", http.StatusBadRequest)
+		return
+	}
+
+	s.rooms.getRoom(roomID).priority.Store(int32(level))
+
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "priority": level})
+}
+
+// handleRoomLatestOnly toggles preemptive fan-out: POST /api/rooms/{roomID}/latest-only?enabled={bool}
+// In latest-only rooms a new publish preempts the delivery of the previous one
+// to clients that haven't been served yet.
+func (s *Server) handleRoomLatestOnly(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "Invalid enabled parameter", http.StatusBadRequest)
+		return
+	}
+
+	s.rooms.getRoom(roomID).latestOnly.Store(enabled)
+
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "latest_only": enabled})
+}
+
+// roomInfo describes a room in admin responses.
+type roomInfo struct {
+	Name         string    `json:"name"`
+	Clients      int64     `json:"clients"`
+	LastActivity time.Time `json:"last_activity,omitzero"`
+	LastError    string    `json:"last_error,omitempty"`
+	ErrorCount   int64     `json:"error_count"`
+}
+
+// handleListRooms lists the rooms, optionally only those with a publish, join
+// or leave within a window: GET /api/rooms?active_since={duration}
+func (s *Server) handleListRooms(w http.ResponseWriter, r *http.Request) {
+	var cutoff time.Time
+	if v := r.URL.Query().Get("active_since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid active_since parameter", http.StatusBadRequest)
+			return
+		}
+		cutoff = time.Now().Add(-d)
+	}
+
+	infos := []roomInfo{}
+	for _, room := range s.rooms.all() {
+		var lastActivity time.Time
+		if ns := room.lastActivity.Load(); ns != 0 {
+			lastActivity = time.Unix(0, ns)
+		}
+		if lastActivity.Before(cutoff) {
+			continue
+		}
+		lastError, errorCount := room.errorStatus()
+		infos = append(infos, roomInfo{
+			Name:         room.name,
+			Clients:      room.members.Load(),
+			LastActivity: lastActivity,
+			LastError:    lastError,
+			ErrorCount:   errorCount,
+		})
+	}
+	slices.SortFunc(infos, func(a, b roomInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	writeJSON(w, http.StatusOK, map[string]any{"rooms": infos})
+}
+
+// clientInfo describes a single connection in admin responses.
+type clientInfo struct {
+	ID          string            `json:"connection_id"`
+	Room        string            `json:"room"`
+	Transport   string            `json:"transport"`
+	RemoteAddr  string            `json:"remote_addr"`
+	ConnectedAt time.Time         `json:"connected_at"`
+	BytesSent   int64             `json:"bytes_sent"`
+	Acked       uint64            `json:"acked,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// handleClientsByIP lists the connections of one client IP: GET /admin/clients?ip={ip}
+func (s *Server) handleClientsByIP(w http.ResponseWriter, r *http.Request) {
+	ip := r.URL.Query().Get("ip")
+	if ip == "" {
+		http.Error(w, "Missing ip parameter", http.StatusBadRequest)
+		return
+	}
+
+	clients := s.clientIndex.lookup(ip, maxClientsPerLookup)
+	infos := make([]clientInfo, 0, len(clients))
+	for _, c := range clients {
+		infos = append(infos, c.info())
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"ip": ip, "clients": infos})
+}
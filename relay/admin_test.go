@@ -0,0 +1,267 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientsByIP(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	dialWS(t, ts, "/ws/one", nil)
+	dialWS(t, ts, "/ws/two", nil)
+
+	var rooms []string
+	eventually(t, "both connections to be listed", func() bool {
+		code, body := admin(t, ts, http.MethodGet, "/admin/clients?ip=127.0.0.1", "")
+		if code != http.StatusOK {
+			t.Fatalf("GET /admin/clients: %d %s", code, body)
+		}
+		var res struct {
+			Clients []clientInfo `json:"clients"`
+		}
+		if err := json.Unmarshal([]byte(body), &res); err != nil {
+			t.Fatal(err)
+		}
+		rooms = rooms[:0]
+		for _, c := range res.Clients {
+			rooms = append(rooms, c.Room)
+		}
+		slices.Sort(rooms)
+		return len(rooms) == 2
+	})
+	if want := []string{"one", "two"}; !slices.Equal(rooms, want) {
+		t.Errorf("rooms = %q, want %q", rooms, want)
+	}
+
+	if code, body := admin(t, ts, http.MethodGet, "/admin/clients?ip=192.0.2.1", ""); code != http.StatusOK || body != `{"clients":[],"ip":"192.0.2.1"}`+"\n" {
+		t.Errorf("another IP's clients = %d %q", code, body)
+	}
+	if code, _ := admin(t, ts, http.MethodGet, "/admin/clients", ""); code != http.StatusBadRequest {
+		t.Errorf("without an IP = %d, want 400", code)
+	}
+	if code, _ := request(t, http.MethodGet, ts.URL+"/admin/clients?ip=127.0.0.1", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("without the admin token = %d, want 401", code)
+	}
+}
+
+func TestMaxRetainBytes(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/capped/meta", `{"max_retain_bytes":-1}`); code != http.StatusBadRequest {
+		t.Errorf("negative max_retain_bytes: %d %s, want 400", code, body)
+	}
+	code, body := admin(t, ts, http.MethodPost, "/api/rooms/capped/meta", `{"max_retain_bytes":5}`)
+	if code != http.StatusOK || !strings.Contains(body, `"max_retain_bytes":5`) {
+		t.Fatalf("setting max_retain_bytes: %d %s", code, body)
+	}
+
+	client := joinTestClient(t, waitForRoom(t, s, "capped"), 16)
+	for _, content := range []string{"small", "too large to retain"} {
+		if code, body := publish(t, ts, "capped", content, nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+	}
+	// Both are delivered live, but only the small one is retained.
+	eventually(t, "both messages", func() bool { return len(client.send) == 2 })
+	if got, want := received(client), []string{"small", "too large to retain"}; !slices.Equal(got, want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+	if got := latest(t, ts, "capped"); got != "small" {
+		t.Errorf("latest = %q, want small", got)
+	}
+}
+
+func TestDeleteRoomGrace(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	conn := dialWS(t, ts, "/ws/closing", nil)
+	room := waitForRoom(t, s, "closing")
+	waitForClients(t, room, 1)
+
+	const grace = 200 * time.Millisecond
+	start := time.Now()
+	if code, body := admin(t, ts, http.MethodDelete, "/api/rooms/closing?grace="+grace.String(), ""); code != http.StatusAccepted {
+		t.Fatalf("DELETE: %d %s", code, body)
+	}
+
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading the notice: %v", err)
+	}
+	var notice closingEvent
+	if err := json.Unmarshal(message, &notice); err != nil || notice.Type != "closing" || notice.ReconnectIn != grace.Milliseconds() {
+		t.Fatalf("notice %s, want a closing event with reconnect_in_ms %d", message, grace.Milliseconds())
+	}
+
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNoStatusReceived) {
+		t.Errorf("after the notice: %v, want a close", err)
+	}
+	if elapsed := time.Since(start); elapsed < grace {
+		t.Errorf("closed after %v, before the %v grace period", elapsed, grace)
+	}
+	if _, ok := s.rooms.lookupRoom("closing"); ok {
+		t.Error("the room still exists")
+	}
+}
+
+// listRooms returns the names of the rooms listed by GET /api/rooms with the
+// given query.
+func listRooms(t testing.TB, ts *httptest.Server, query string) []string {
+	t.Helper()
+	code, body := admin(t, ts, http.MethodGet, "/api/rooms"+query, "")
+	if code != http.StatusOK {
+		t.Fatalf("GET /api/rooms%s: %d %s", query, code, body)
+	}
+	var res struct {
+		Rooms []roomInfo `json:"rooms"`
+	}
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, room := range res.Rooms {
+		names = append(names, room.Name)
+	}
+	return names
+}
+
+func TestListActiveRooms(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	if code, body := publish(t, ts, "dormant", "hello", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if code, body := publish(t, ts, "active", "hello", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+
+	if got, want := listRooms(t, ts, ""), []string{"active", "dormant"}; !slices.Equal(got, want) {
+		t.Errorf("rooms = %q, want %q", got, want)
+	}
+	if got, want := listRooms(t, ts, "?active_since=100ms"), []string{"active"}; !slices.Equal(got, want) {
+		t.Errorf("rooms active within 100ms = %q, want %q", got, want)
+	}
+	// A subscriber joining counts as activity.
+	dialWS(t, ts, "/ws/dormant", nil)
+	eventually(t, "the subscriber's join to count", func() bool {
+		return slices.Equal(listRooms(t, ts, "?active_since=100ms"), []string{"active", "dormant"})
+	})
+	if code, _ := admin(t, ts, http.MethodGet, "/api/rooms?active_since=soon", ""); code != http.StatusBadRequest {
+		t.Errorf("invalid active_since: status %d, want 400", code)
+	}
+}
+
+func TestRoomCommand(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HistorySize = 10
+	_, ts := newTestServer(t, opts)
+	if code, body := publish(t, ts, "commanded", "content", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	conn := dialWS(t, ts, "/ws/commanded", nil)
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "content" {
+		t.Fatalf("retained %q (%v)", message, err)
+	}
+
+	code, body := admin(t, ts, http.MethodPost, "/api/rooms/commanded/command", `{"command":"show_banner","args":{"text":"Back soon"}}`)
+	if code != http.StatusOK || !strings.Contains(body, `"delivered":1`) {
+		t.Fatalf("command: %d %s, want it delivered to 1 subscriber", code, body)
+	}
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var command commandEvent
+	if err := json.Unmarshal(message, &command); err != nil || command.Type != "command" || command.Command != "show_banner" || string(command.Args) != `{"text":"Back soon"}` {
+		t.Errorf("received %s, want the command frame", message)
+	}
+
+	// The command is neither retained nor replayed.
+	if got := latest(t, ts, "commanded"); got != "content" {
+		t.Errorf("latest = %q after the command, want the content", got)
+	}
+	code, body = request(t, http.MethodGet, ts.URL+"/api/rooms/commanded/replay", "", nil)
+	if code != http.StatusOK || strings.Contains(body, "show_banner") {
+		t.Errorf("replay after the command: %d %s", code, body)
+	}
+
+	for _, tt := range []struct {
+		body string
+		want int
+	}{
+		{`{"args":{}}`, http.StatusBadRequest},
+		{`not JSON`, http.StatusBadRequest},
+	} {
+		if code, body := admin(t, ts, http.MethodPost, "/api/rooms/commanded/command", tt.body); code != tt.want {
+			t.Errorf("command %s: %d %s, want %d", tt.body, code, body, tt.want)
+		}
+	}
+	if code, _ := request(t, http.MethodPost, ts.URL+"/api/rooms/commanded/command", `{"command":"refresh"}`, nil); code != http.StatusUnauthorized {
+		t.Errorf("command without the admin token: status %d, want 401", code)
+	}
+}
+
+func TestRoomSendBuffer(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	for room, body := range map[string]string{
+		"chat":   `{"send_buffer":1024}`,
+		"status": `{"send_buffer":4}`,
+		"plain":  "",
+	} {
+		if code, body := admin(t, ts, http.MethodPut, "/api/rooms/"+room, body); code != http.StatusCreated {
+			t.Fatalf("creating %s: %d %s", room, code, body)
+		}
+	}
+	// sendBuffers waits for the named room to have n clients, and returns
+	// the capacities of their send buffers in increasing order.
+	sendBuffers := func(name string, n int) []int {
+		room := waitForRoom(t, s, name)
+		var sizes []int
+		eventually(t, "the subscribers to join "+name, func() bool {
+			sizes = nil
+			room.do(func() {
+				for client := range room.clients {
+					sizes = append(sizes, cap(client.send))
+				}
+			})
+			return len(sizes) == n
+		})
+		slices.Sort(sizes)
+		return sizes
+	}
+
+	dialWS(t, ts, "/ws/chat", nil)
+	openSSE(t, ts, "/sse/status")
+	dialWS(t, ts, "/ws/plain", nil)
+	for room, want := range map[string][]int{
+		"chat":   {1024},
+		"status": {4},
+		"plain":  {sendBufferSize},
+	} {
+		if got := sendBuffers(room, 1); !slices.Equal(got, want) {
+			t.Errorf("%s: send buffers %v, want %v", room, got, want)
+		}
+	}
+
+	// Changing the setting applies to clients that join afterwards.
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/plain/meta", `{"send_buffer":16}`); code != http.StatusOK {
+		t.Fatalf("updating plain: %d %s", code, body)
+	}
+	dialWS(t, ts, "/ws/plain", nil)
+	if got, want := sendBuffers("plain", 2), []int{16, sendBufferSize}; !slices.Equal(got, want) {
+		t.Errorf("plain: send buffers %v, want %v", got, want)
+	}
+
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/plain/meta", fmt.Sprintf(`{"send_buffer":%d}`, maxSendBufferSize+1)); code != http.StatusBadRequest {
+		t.Errorf("a send buffer over the maximum: %d %s, want 400", code, body)
+	}
+}
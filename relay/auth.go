@@ -0,0 +1,211 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	errMissingToken     = errors.New("missing token")
+	errInvalidToken     = errors.New("invalid token")
+	errRoomNotAllowed   = errors.New("token does not allow this room")
+	errInvalidRoomToken = errors.New("invalid room token")
+	errReservedRoom     = errors.New("room name is reserved")
+
+	errMissingSignature = errors.New("missing signature")
+	errInvalidSignature = errors.New("invalid signature")
+	errStaleSignature   = errors.New("signature timestamp out of range")
+)
+
+// subscriberClaims are the claims of a subscriber JWT. Rooms holds glob
+// patterns (as in path.Match) of the rooms the bearer may subscribe to, and
+// MaxConns, if positive, caps the bearer's concurrent subscriptions.
+type subscriberClaims struct {
+	Rooms    []string `json:"rooms"`
+	MaxConns int      `json:"max_conns,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// requestToken returns the bearer token of r, taken from the Authorization
+// header or, for browsers that can't set headers on WebSockets, the token
+// query parameter.
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authorizeSubscriber checks that r carries a valid JWT allowing a
+// subscription to roomID, unless it is anonymous and AnonymousSubscribers is
+// set, and that AuthorizeSubscriber accepts it, and returns the token's
+// subscription quota.
+func (s *Server) authorizeSubscriber(r *http.Request, roomID string) (subscriberQuota, error) {
+	quota, err := s.verifySubscriberToken(r, roomID)
+	if err == nil && s.opts.AuthorizeSubscriber != nil {
+		if err := s.opts.AuthorizeSubscriber(r, roomID); err != nil {
+			return subscriberQuota{}, hookError{err}
+		}
+	}
+	return quota, err
+}
+
+// verifySubscriberToken checks r's JWT for authorizeSubscriber.
+func (s *Server) verifySubscriberToken(r *http.Request, roomID string) (subscriberQuota, error) {
+	if s.opts.JWTKey == "" {
+		return subscriberQuota{}, nil
+	}
+
+	raw := requestToken(r)
+	if raw == "" {
+		if s.opts.AnonymousSubscribers {
+			return subscriberQuota{}, nil
+		}
+		return subscriberQuota{}, errMissingToken
+	}
+
+	var claims subscriberClaims
+	_, err := jwt.ParseWithClaims(raw, &claims, func(*jwt.Token) (any, error) {
+		return []byte(s.opts.JWTKey), nil
+	}, jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}))
+	if err != nil {
+		return subscriberQuota{}, errInvalidToken
+	}
+
+	for _, pattern := range claims.Rooms {
+		if ok, _ := path.Match(pattern, roomID); ok {
+			quota := claims.quota(raw)
+			quota.authenticated = true
+			return quota, nil
+		}
+	}
+	return subscriberQuota{}, errRoomNotAllowed
+}
+
+// signRoomToken returns the room token for room: the base64url-encoded room
+// name and its HMAC-SHA256 under RoomTokenSecret, joined by a dot.
+func (s *Server) signRoomToken(room string) string {
+	mac := hmac.New(sha256.New, []byte(s.opts.RoomTokenSecret))
+	mac.Write([]byte(room))
+	return base64.RawURLEncoding.EncodeToString([]byte(room)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// resolveRoomID returns the room a URL segment refers to. Without
+// RoomTokenSecret the segment is the room name itself; with it the segment
+// must be a room token, which is verified and decoded. Either way the name
+// must pass validateRoomID.
+func (s *Server) resolveRoomID(segment string) (string, error) {
+	if s.opts.RoomTokenSecret == "" {
+		if segment == directoryRoomName {
+			return "", errReservedRoom
+		}
+		if err := validateRoomID(segment); err != nil {
+			return "", err
+		}
+		return segment, nil
+	}
+
+	encodedRoom, encodedMAC, ok := strings.Cut(segment, ".")
+	if !ok {
+		return "", errInvalidRoomToken
+	}
+	room, err := base64.RawURLEncoding.DecodeString(encodedRoom)
+	if err != nil {
+		return "", errInvalidRoomToken
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil {
+		return "", errInvalidRoomToken
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.opts.RoomTokenSecret))
+	mac.Write(room)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return "", errInvalidRoomToken
+	}
+	if string(room) == directoryRoomName {
+		return "", errReservedRoom
+	}
+	if err := validateRoomID(string(room)); err != nil {
+		return "", err
+	}
+	return string(room), nil
+}
+
+// publishSignature returns the hex-encoded HMAC-SHA256 under
+// PublishHMACKey of a publish request: its method, request URI, timestamp
+// and body, each followed by a newline except the body.
+func (s *Server) publishSignature(method, requestURI, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(s.opts.PublishHMACKey))
+	mac.Write([]byte(method + "\n" + requestURI + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyPublishSignature checks, when PublishHMACKey is set, that r
+// carries a valid X-Signature of its body for an X-Timestamp (Unix seconds)
+// within PublishSignatureMaxAge of now.
+func (s *Server) verifyPublishSignature(r *http.Request, body []byte) error {
+	if s.opts.PublishHMACKey == "" {
+		return nil
+	}
+
+	signature := r.Header.Get("X-Signature")
+	timestamp := r.Header.Get("X-Timestamp")
+	if signature == "" || timestamp == "" {
+		return errMissingSignature
+	}
+	sum, err := hex.DecodeString(signature)
+	if err != nil {
+		return errInvalidSignature
+	}
+	expected, _ := hex.DecodeString(s.publishSignature(r.Method, r.URL.RequestURI(), timestamp, body))
+	if !hmac.Equal(sum, expected) {
+		return errInvalidSignature
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errInvalidSignature
+	}
+	if age := time.Since(time.Unix(seconds, 0)).Abs(); age > s.opts.PublishSignatureMaxAge {
+		return errStaleSignature
+	}
+	return nil
+}
+
+// hookError is an error returned by one of the authorization hooks of
+// Options, which rejects the request as forbidden.
+type hookError struct {
+	error
+}
+
+// authorizePublish applies AuthorizePublish to a publish to room.
+func (s *Server) authorizePublish(r *http.Request, room string) error {
+	if s.opts.AuthorizePublish == nil {
+		return nil
+	}
+	if err := s.opts.AuthorizePublish(r, room); err != nil {
+		return hookError{err}
+	}
+	return nil
+}
+
+// authStatus maps an authorization error to its HTTP status code.
+func authStatus(err error) int {
+	if errors.Is(err, errRoomNotAllowed) || errors.As(err, new(hookError)) {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
@@ -0,0 +1,279 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// testJWTKey is the JWTKey of the servers the tests in this file start.
+const testJWTKey = "test-jwt-key"
+
+// signToken returns claims signed with key using method.
+func signToken(t testing.TB, method jwt.SigningMethod, key string, claims subscriberClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestSubscriberToken(t *testing.T) {
+	opts := DefaultOptions()
+	opts.JWTKey = testJWTKey
+	_, ts := newTestServer(t, opts)
+
+	token := signToken(t, jwt.SigningMethodHS256, testJWTKey, subscriberClaims{Rooms: []string{"team-a-*"}})
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		room   string
+		header http.Header
+		query  string
+		want   int
+	}{
+		{"missing", "team-a-1", nil, "", http.StatusUnauthorized},
+		{"header", "team-a-1", bearer(token), "", http.StatusOK},
+		{"query", "team-a-1", nil, "?token=" + token, http.StatusOK},
+		{"other room", "team-b-1", bearer(token), "", http.StatusForbidden},
+		{"wrong key", "team-a-1", bearer(signToken(t, jwt.SigningMethodHS256, "other-key", subscriberClaims{Rooms: []string{"*"}})), "", http.StatusUnauthorized},
+		{"HS512", "team-a-1", bearer(signToken(t, jwt.SigningMethodHS512, testJWTKey, subscriberClaims{Rooms: []string{"team-a-1"}})), "", http.StatusOK},
+		{"garbage", "team-a-1", bearer("not-a-jwt"), "", http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := request(t, http.MethodGet, ts.URL+"/api/rooms/"+tt.room+"/presence"+tt.query, "", tt.header)
+			if code != tt.want {
+				t.Errorf("presence of %s: status %d (%s), want %d", tt.room, code, strings.TrimSpace(body), tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscriberTokenWebSocket(t *testing.T) {
+	opts := DefaultOptions()
+	opts.JWTKey = testJWTKey
+	_, ts := newTestServer(t, opts)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/"
+
+	_, res, err := websocket.DefaultDialer.Dial(url+"team-a-1", nil)
+	if err == nil || res == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("dialing without a token: %v, want status 401", err)
+	}
+
+	token := signToken(t, jwt.SigningMethodHS256, testJWTKey, subscriberClaims{Rooms: []string{"team-a-*"}})
+	_, res, err = websocket.DefaultDialer.Dial(url+"team-b-1?token="+token, nil)
+	if err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+		t.Fatalf("dialing a room the token doesn't allow: %v, want status 403", err)
+	}
+
+	dialWS(t, ts, "/ws/team-a-1?token="+token, nil)
+}
+
+func TestRoomTokens(t *testing.T) {
+	opts := DefaultOptions()
+	opts.RoomTokenSecret = "test-room-secret"
+	s, ts := newTestServer(t, opts)
+
+	code, body := admin(t, ts, http.MethodGet, "/api/rooms/secret-room/token", "")
+	if code != http.StatusOK {
+		t.Fatalf("issuing a token: %d %s", code, body)
+	}
+	var issued struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(body), &issued); err != nil {
+		t.Fatal(err)
+	}
+
+	// A valid token resolves to the room it was issued for.
+	if code, body := publish(t, ts, issued.Token, "hello", nil); code != http.StatusOK {
+		t.Fatalf("publishing with the token: %d %s", code, body)
+	}
+	if _, ok := s.rooms.lookupRoom("secret-room"); !ok {
+		t.Error("the token didn't resolve to secret-room")
+	}
+	if got := latest(t, ts, issued.Token); got != "hello" {
+		t.Errorf("latest = %q, want hello", got)
+	}
+	dialWS(t, ts, "/ws/"+issued.Token, nil)
+
+	// Tampering with either part of the token, or using the bare room name,
+	// is rejected.
+	_, mac, _ := strings.Cut(issued.Token, ".")
+	flipped := []byte(mac)
+	flipped[0] ^= 1
+	for _, segment := range []string{
+		base64.RawURLEncoding.EncodeToString([]byte("other-room")) + "." + mac,
+		strings.Replace(issued.Token, mac, string(flipped), 1),
+		"secret-room",
+	} {
+		if code, _ := publish(t, ts, segment, "hello", nil); code != http.StatusForbidden {
+			t.Errorf("publishing to %s: status %d, want 403", segment, code)
+		}
+		_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/"+segment, nil)
+		if err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+			t.Errorf("subscribing to %s: %v, want status 403", segment, err)
+		}
+	}
+	if _, ok := s.rooms.lookupRoom("other-room"); ok {
+		t.Error("a tampered token opened a room")
+	}
+}
+
+// signPublish returns the X-Signature and X-Timestamp headers signing a
+// publish with key at time at.
+func signPublish(key, method, requestURI, body string, at time.Time) http.Header {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(key))
+	io.WriteString(mac, method+"\n"+requestURI+"\n"+timestamp+"\n"+body)
+	return http.Header{
+		"X-Signature": {hex.EncodeToString(mac.Sum(nil))},
+		"X-Timestamp": {timestamp},
+	}
+}
+
+func TestPublishSignature(t *testing.T) {
+	const key = "test-hmac-key"
+	opts := DefaultOptions()
+	opts.PublishHMACKey = key
+	_, ts := newTestServer(t, opts)
+
+	now := time.Now()
+	valid := signPublish(key, http.MethodPost, "/signed", "hello", now)
+	for _, tt := range []struct {
+		name   string
+		body   string
+		header http.Header
+		want   int
+	}{
+		{"valid", "hello", valid, http.StatusOK},
+		{"missing", "hello", nil, http.StatusUnauthorized},
+		{"wrong key", "hello", signPublish("other-key", http.MethodPost, "/signed", "hello", now), http.StatusUnauthorized},
+		{"other body", "tampered", valid, http.StatusUnauthorized},
+		{"other room", "hello", signPublish(key, http.MethodPost, "/other", "hello", now), http.StatusUnauthorized},
+		{"not hex", "hello", http.Header{"X-Signature": {"zz"}, "X-Timestamp": valid["X-Timestamp"]}, http.StatusUnauthorized},
+		{"stale", "hello", signPublish(key, http.MethodPost, "/signed", "hello", now.Add(-opts.PublishSignatureMaxAge-time.Minute)), http.StatusUnauthorized},
+		{"future", "hello", signPublish(key, http.MethodPost, "/signed", "hello", now.Add(opts.PublishSignatureMaxAge+time.Minute)), http.StatusUnauthorized},
+	} {
+		if code, body := request(t, http.MethodPost, ts.URL+"/signed", tt.body, tt.header); code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, code, strings.TrimSpace(body), tt.want)
+		}
+	}
+	if got := latest(t, ts, "signed"); got != "hello" {
+		t.Errorf("latest = %q, want only the validly signed publish", got)
+	}
+}
+
+func TestSubscriberQuota(t *testing.T) {
+	opts := DefaultOptions()
+	opts.JWTKey = testJWTKey
+	s, ts := newTestServer(t, opts)
+	claims := func(id string) subscriberClaims {
+		return subscriberClaims{
+			Rooms:            []string{"*"},
+			MaxConns:         2,
+			RegisteredClaims: jwt.RegisteredClaims{Subject: "tenant", ID: id},
+		}
+	}
+	token := signToken(t, jwt.SigningMethodHS256, testJWTKey, claims("1"))
+	// Another of the tenant's tokens shares its quota.
+	other := signToken(t, jwt.SigningMethodHS256, testJWTKey, claims("2"))
+
+	first := dialWS(t, ts, "/ws/quota-1?token="+token, nil)
+	dialWS(t, ts, "/ws/quota-2?token="+other, nil)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/quota-3?token="
+	for _, token := range []string{token, other} {
+		_, res, err := websocket.DefaultDialer.Dial(url+token, nil)
+		if err == nil || res == nil || res.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("subscribing past the quota: %v, want status 429", err)
+		}
+	}
+	if res := openSSE(t, ts, "/sse/quota-3?token="+token); res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("subscribing over SSE past the quota: status %d, want 429", res.StatusCode)
+	}
+
+	// Closing a subscription frees its place.
+	first.Close()
+	room := waitForRoom(t, s, "quota-1")
+	eventually(t, "the subscriber to leave", func() bool { return room.members.Load() == 0 })
+	eventually(t, "the quota to be released", func() bool {
+		s.tokenConnections.mu.Lock()
+		defer s.tokenConnections.mu.Unlock()
+		return s.tokenConnections.counts["sub:tenant"] == 1
+	})
+	dialWS(t, ts, "/ws/quota-3?token="+token, nil)
+}
+
+func TestAnonymousSubscribers(t *testing.T) {
+	opts := DefaultOptions()
+	opts.JWTKey = testJWTKey
+	opts.AnonymousSubscribers = true
+	_, ts := newTestServer(t, opts)
+
+	if code, body := request(t, http.MethodGet, ts.URL+"/api/rooms/room1/presence", "", nil); code != http.StatusOK {
+		t.Errorf("anonymous presence: status %d (%s), want 200", code, body)
+	}
+	// A token that is presented must still be valid.
+	header := http.Header{"Authorization": {"Bearer not-a-jwt"}}
+	if code, _ := request(t, http.MethodGet, ts.URL+"/api/rooms/room1/presence", "", header); code != http.StatusUnauthorized {
+		t.Errorf("invalid token: status %d, want 401", code)
+	}
+}
+
+func TestAnonymousLimits(t *testing.T) {
+	opts := DefaultOptions()
+	opts.JWTKey = testJWTKey
+	opts.AnonymousSubscribers = true
+	opts.MaxRoomClients = 4
+	opts.MaxAnonymousRoomClients = 2
+	opts.MaxAnonymousConnections = 3
+	s, ts := newTestServer(t, opts)
+	token := signToken(t, jwt.SigningMethodHS256, testJWTKey, subscriberClaims{Rooms: []string{"*"}})
+	room := "tiered"
+
+	for range 2 {
+		dialWS(t, ts, "/ws/"+room, nil)
+	}
+	r := waitForRoom(t, s, room)
+	eventually(t, "the anonymous subscribers to join", func() bool { return r.members.Load() == 2 })
+	if res := openSSE(t, ts, "/sse/"+room); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("anonymous subscriber past the anonymous room limit: status %d, want 503", res.StatusCode)
+	}
+
+	// Authenticated subscribers may go on up to the room's own limit.
+	for range 2 {
+		if res := openSSE(t, ts, "/sse/"+room+"?token="+token); res.StatusCode != http.StatusOK {
+			t.Fatalf("authenticated subscriber: status %d", res.StatusCode)
+		}
+	}
+	if res := openSSE(t, ts, "/sse/"+room+"?token="+token); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("authenticated subscriber past the room limit: status %d, want 503", res.StatusCode)
+	}
+
+	// Across rooms, anonymous subscribers have a connection limit of their
+	// own.
+	if res := openSSE(t, ts, "/sse/other"); res.StatusCode != http.StatusOK {
+		t.Fatalf("anonymous subscriber to another room: status %d", res.StatusCode)
+	}
+	if res := openSSE(t, ts, "/sse/other"); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("anonymous subscriber past the anonymous connection limit: status %d, want 503", res.StatusCode)
+	}
+	if res := openSSE(t, ts, "/sse/other?token="+token); res.StatusCode != http.StatusOK {
+		t.Errorf("authenticated subscriber: status %d, want 200", res.StatusCode)
+	}
+}
@@ -0,0 +1,156 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const (
+	// backplaneQueue bounds the messages waiting to be sent to the
+	// backplane. Further messages aren't shared, and are recorded as errors
+	// of their rooms.
+	backplaneQueue = 1024
+
+	// backplaneRetry is how long to wait before subscribing to the backplane
+	// again after the subscription failed.
+	backplaneRetry = time.Second
+)
+
+// Backplane carries rooms' broadcasts between the relay instances sharing it,
+// such as replicas behind a load balancer, so that the subscribers of a room
+// on every instance get what is published to it on any of them. It is
+// typically a Redis or NATS channel: each message published is delivered to
+// every subscribed instance, including its sender, which ignores it.
+type Backplane interface {
+	// Publish sends message to the instances sharing the backplane.
+	Publish(message []byte) error
+	// Subscribe calls deliver with each message sent to the backplane until
+	// ctx is done or the subscription fails.
+	Subscribe(ctx context.Context, deliver func(message []byte)) error
+}
+
+// backplaneMessage is a publication as it is carried on the backplane.
+type backplaneMessage struct {
+	// Origin is the instance ID of the relay it was published on.
+	Origin      string `json:"origin"`
+	Room        string `json:"room"`
+	Content     []byte `json:"content"`
+	ContentType string `json:"content_type,omitempty"`
+	Publisher   string `json:"publisher,omitempty"`
+	Sender      string `json:"sender,omitempty"`
+	LiveOnly    bool   `json:"live_only,omitempty"`
+	Topic       string `json:"topic,omitempty"`
+	// TTL is the message's TTL in milliseconds, if it has one.
+	TTL int64 `json:"ttl_ms,omitempty"`
+}
+
+// backplane shares a server's broadcasts through Options.Backplane and
+// publishes those of other instances to its rooms.
+type backplane struct {
+	srv *Server
+	// id identifies this instance, so it can ignore its own messages.
+	id    string
+	queue chan backplaneMessage
+}
+
+func newBackplane(s *Server) *backplane {
+	return &backplane{srv: s, id: s.id, queue: make(chan backplaneMessage, backplaneQueue)}
+}
+
+// start sends queued messages to the backplane and receives those of other
+// instances until the server shuts down.
+func (b *backplane) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-b.srv.shutdownStarted
+		cancel()
+	}()
+	go b.send(ctx)
+	go b.receive(ctx)
+}
+
+// share queues p, published to room, for the other instances. It never
+// blocks the room.
+func (b *backplane) share(room *Room, p publication) {
+	m := backplaneMessage{
+		Origin:      b.id,
+		Room:        room.name,
+		Content:     p.message,
+		ContentType: p.contentType,
+		Publisher:   p.publisher,
+		Sender:      p.sender,
+		LiveOnly:    p.liveOnly,
+		Topic:       p.topic,
+		TTL:         p.ttl.Milliseconds(),
+	}
+	select {
+	case b.queue <- m:
+	default:
+		room.recordError("not shared with the backplane: queue full")
+	}
+}
+
+// send publishes the queued messages to the backplane in order.
+func (b *backplane) send(ctx context.Context) {
+	for {
+		select {
+		case m := <-b.queue:
+			message, _ := json.Marshal(m)
+			if err := b.srv.opts.Backplane.Publish(message); err != nil {
+				b.srv.log.Warn("backplane: publishing", "room", m.Room, "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// receive subscribes to the backplane, subscribing again whenever the
+// subscription fails.
+func (b *backplane) receive(ctx context.Context) {
+	for {
+		err := b.srv.opts.Backplane.Subscribe(ctx, b.deliver)
+		if ctx.Err() != nil {
+			return
+		}
+		b.srv.log.Warn("backplane: subscription ended", "err", err)
+		select {
+		case <-time.After(backplaneRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver publishes a message from another instance to its room on this one.
+// It is neither shared again nor mirrored: the instance it was published on
+// did that.
+func (b *backplane) deliver(message []byte) {
+	var m backplaneMessage
+	if err := json.Unmarshal(message, &m); err != nil {
+		b.srv.log.Warn("backplane: invalid message", "err", err)
+		return
+	}
+	if m.Origin == b.id {
+		return
+	}
+	if m.Room == directoryRoomName || validateRoomID(m.Room) != nil {
+		b.srv.log.Warn("backplane: invalid room", "room", m.Room)
+		return
+	}
+	room, err := b.srv.rooms.openRoom(m.Room)
+	if err != nil {
+		return
+	}
+	room.submitUnlessPaused(publication{
+		message:     m.Content,
+		publisher:   m.Publisher,
+		sender:      m.Sender,
+		contentType: m.ContentType,
+		liveOnly:    m.LiveOnly,
+		topic:       m.Topic,
+		ttl:         time.Duration(m.TTL) * time.Millisecond,
+		remote:      true,
+	})
+}
@@ -0,0 +1,614 @@
+package relay
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// bridgeSubprotocol is the WebSocket subprotocol a relay offers when it
+	// connects to a room on another relay as a bridge rather than as a
+	// subscriber. The version names the format of bridgeFrame.
+	bridgeSubprotocol = "relay.bridge.v1"
+
+	// bridgeTokenHeader carries BridgeToken on bridge connections.
+	bridgeTokenHeader = "X-Bridge-Token"
+
+	// bridgeQueue bounds the messages waiting to be sent over a bridge.
+	// Further messages are dropped, and counted.
+	bridgeQueue = 256
+
+	// maxBridgeHops bounds the relays a bridged message may have been
+	// broadcast on.
+	maxBridgeHops = 16
+
+	// bridgeRetry is how long a bridge waits before reconnecting to its
+	// upstream relay after its first failure. The wait doubles with every
+	// further failure, up to maxBridgeRetry.
+	bridgeRetry    = time.Second
+	maxBridgeRetry = 30 * time.Second
+
+	// maxBridgeRequestSize bounds the body of a bridge request.
+	maxBridgeRequestSize = 16 << 10
+)
+
+var errBridgeNotFound = errors.New("bridge not found")
+
+// bridgeFrame is a broadcast as it is carried between bridged relays.
+type bridgeFrame struct {
+	// Origins are the instance IDs of the relays the message was broadcast
+	// on, starting with the one it was published on. A relay drops messages
+	// that went through it already, so that bridges can't loop.
+	Origins     []string `json:"origins"`
+	Content     []byte   `json:"content"`
+	ContentType string   `json:"content_type,omitempty"`
+	Topic       string   `json:"topic,omitempty"`
+	// TTL is the message's TTL in milliseconds, if it has one.
+	TTL int64 `json:"ttl_ms,omitempty"`
+}
+
+// bridgeStats counts the messages of a bridge.
+type bridgeStats struct {
+	forwarded atomic.Int64
+	received  atomic.Int64
+	dropped   atomic.Int64
+}
+
+// bridgeConn is a WebSocket connection bridging a room with the same room on
+// another relay, whichever of them dialed it: it sends the room's broadcasts
+// to the other relay, publishes those it receives from it, or both.
+type bridgeConn struct {
+	srv  *Server
+	room string
+	conn *websocket.Conn
+	// peer identifies the other relay as the publisher of the messages
+	// received from it.
+	peer          string
+	send, receive bool
+	stats         *bridgeStats
+	queue         chan publication
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newBridgeConn(s *Server, room string, conn *websocket.Conn, peer string, send, receive bool, stats *bridgeStats) *bridgeConn {
+	return &bridgeConn{
+		srv:     s,
+		room:    room,
+		conn:    conn,
+		peer:    peer,
+		send:    send,
+		receive: receive,
+		stats:   stats,
+		queue:   make(chan publication, bridgeQueue),
+		stop:    make(chan struct{}),
+	}
+}
+
+// enqueue queues p for the other relay, unless the connection doesn't send
+// or p came from it. It never blocks the room.
+func (bc *bridgeConn) enqueue(p publication) {
+	if !bc.send || p.via == bc {
+		return
+	}
+	select {
+	case bc.queue <- p:
+	default:
+		bc.stats.dropped.Add(1)
+	}
+}
+
+// close makes the connection's pumps exit.
+func (bc *bridgeConn) close() {
+	bc.stopOnce.Do(func() { close(bc.stop) })
+}
+
+// run exchanges messages with the other relay until the connection fails,
+// it is closed or the server shuts down.
+func (bc *bridgeConn) run() error {
+	go bc.writePump()
+	defer bc.close()
+	return bc.readPump()
+}
+
+// readPump publishes the messages received from the other relay to the room.
+func (bc *bridgeConn) readPump() error {
+	// Content is base64 in frames.
+	bc.conn.SetReadLimit(int64(bc.srv.contentLimit())*4/3 + maxBridgeRequestSize)
+	bc.conn.SetReadDeadline(time.Now().Add(pongWait))
+	bc.conn.SetPongHandler(func(string) error {
+		bc.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	for {
+		_, message, err := bc.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if !bc.receive {
+			continue
+		}
+		var f bridgeFrame
+		if err := json.Unmarshal(message, &f); err != nil {
+			bc.srv.log.Warn("bridge: invalid message", "room", bc.room, "peer", bc.peer, "err", err)
+			continue
+		}
+		bc.deliver(f)
+	}
+}
+
+// deliver publishes a message from the other relay to the room, unless it
+// was broadcast on this relay already. It is mirrored and sent over the
+// room's other bridges like a message published here.
+func (bc *bridgeConn) deliver(f bridgeFrame) {
+	s := bc.srv
+	if slices.Contains(f.Origins, s.id) {
+		return
+	}
+	if len(f.Origins) == 0 || len(f.Origins) > maxBridgeHops || len(f.Content) == 0 {
+		s.log.Warn("bridge: invalid message", "room", bc.room, "peer", bc.peer)
+		return
+	}
+	room, err := s.rooms.openRoom(bc.room)
+	if err != nil {
+		return
+	}
+	if len(f.Content) > s.contentLimit() || !room.admitsContentSize(len(f.Content)) {
+		room.recordError("rejected message from bridge " + bc.peer + ": content too large")
+		return
+	}
+	bc.stats.received.Add(1)
+	room.submitUnlessPaused(publication{
+		message:     f.Content,
+		publisher:   bc.peer,
+		contentType: f.ContentType,
+		topic:       f.Topic,
+		ttl:         time.Duration(f.TTL) * time.Millisecond,
+		origins:     f.Origins,
+		via:         bc,
+	})
+}
+
+// writePump sends the queued messages to the other relay, pinging it during
+// quiet periods, until the connection fails, it is closed or the server
+// shuts down.
+func (bc *bridgeConn) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		bc.conn.Close()
+	}()
+	for {
+		select {
+		case p := <-bc.queue:
+			frame, _ := json.Marshal(bridgeFrame{
+				Origins:     append(slices.Clone(p.origins), bc.srv.id),
+				Content:     p.message,
+				ContentType: p.contentType,
+				Topic:       p.topic,
+				TTL:         p.ttl.Milliseconds(),
+			})
+			bc.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := bc.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				return
+			}
+			bc.stats.forwarded.Add(1)
+		case <-ticker.C:
+			bc.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := bc.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-bc.stop:
+			bc.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+			return
+		case <-bc.srv.shutdownStarted:
+			bc.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(writeWait))
+			return
+		}
+	}
+}
+
+// bridge is a room's bridge to the room of an upstream relay, which this
+// relay connects to as a WebSocket client, reconnecting whenever the
+// connection fails. Its direction is "out" to send the room's broadcasts
+// upstream, "in" to publish upstream's broadcasts to the room, or "both".
+type bridge struct {
+	id        string
+	url       string
+	direction string
+	stats     bridgeStats
+	stop      chan struct{}
+	// conn is the bridge's current connection, if it is connected. It is
+	// guarded by the mutex of Bridges.
+	conn *bridgeConn
+}
+
+// bridgeStatus describes a bridge in the bridge API.
+type bridgeStatus struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	Direction string `json:"direction"`
+	Connected bool   `json:"connected"`
+	Forwarded int64  `json:"forwarded"`
+	Received  int64  `json:"received"`
+	Dropped   int64  `json:"dropped"`
+}
+
+// bridgeConfig is a bridge as it is exported with a room's state.
+type bridgeConfig struct {
+	URL       string `json:"url"`
+	Direction string `json:"direction"`
+}
+
+// run keeps the bridge connected to its upstream relay until it is removed
+// or the server shuts down.
+func (b *bridge) run(s *Server, room string) {
+	retry := bridgeRetry
+	for {
+		connectedAt := time.Now()
+		err := b.connect(s, room)
+		if time.Since(connectedAt) > maxBridgeRetry {
+			retry = bridgeRetry
+		}
+		select {
+		case <-b.stop:
+			return
+		case <-s.shutdownStarted:
+			return
+		default:
+		}
+		s.log.Warn("bridge: disconnected", "room", room, "url", b.url, "err", err, "retry_in", retry)
+		select {
+		case <-time.After(retry):
+		case <-b.stop:
+			return
+		case <-s.shutdownStarted:
+			return
+		}
+		retry = min(retry*2, maxBridgeRetry)
+	}
+}
+
+// connect connects to the upstream relay and exchanges messages with it
+// until the connection fails or the bridge is removed.
+func (b *bridge) connect(s *Server, room string) error {
+	u, _ := url.Parse(b.url) // Validated by parseBridgeURL.
+	q := u.Query()
+	q.Set("direction", b.direction)
+	u.RawQuery = q.Encode()
+
+	header := make(http.Header)
+	if s.opts.BridgeToken != "" {
+		header.Set(bridgeTokenHeader, s.opts.BridgeToken)
+	}
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: writeWait,
+		Subprotocols:     []string{bridgeSubprotocol},
+	}
+	conn, resp, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("%w: %s", err, resp.Status)
+		}
+		return err
+	}
+	if conn.Subprotocol() != bridgeSubprotocol {
+		conn.Close()
+		return errors.New("upstream doesn't accept bridges")
+	}
+
+	bc := newBridgeConn(s, room, conn, u.Host, b.direction != "in", b.direction != "out", &b.stats)
+	if !s.bridges.attach(room, bc, b) {
+		// Removed while connecting.
+		conn.Close()
+		return nil
+	}
+	defer s.bridges.detach(room, bc, b)
+	s.log.Info("bridge: connected", "room", room, "url", b.url, "direction", b.direction)
+	return bc.run()
+}
+
+func (b *bridge) status() bridgeStatus {
+	return bridgeStatus{
+		ID:        b.id,
+		URL:       b.url,
+		Direction: b.direction,
+		Forwarded: b.stats.forwarded.Load(),
+		Received:  b.stats.received.Load(),
+		Dropped:   b.stats.dropped.Load(),
+	}
+}
+
+// Bridges holds the bridges of each room by room name: the connections
+// bridging it with other relays, whichever end dialed them, and the bridges
+// this relay dials, by ID.
+type Bridges struct {
+	srv    *Server
+	conns  map[string]map[*bridgeConn]bool
+	dialed map[string]map[string]*bridge
+	mu     sync.RWMutex
+}
+
+func newBridges(s *Server) *Bridges {
+	return &Bridges{
+		srv:    s,
+		conns:  make(map[string]map[*bridgeConn]bool),
+		dialed: make(map[string]map[string]*bridge),
+	}
+}
+
+// add bridges the named room with the room of the upstream relay at url, a
+// WebSocket URL such as ws://relay-b:8080/ws/room1, in direction, and
+// returns the new bridge.
+func (bs *Bridges) add(room, url, direction string) *bridge {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.dialed[room] == nil {
+		bs.dialed[room] = make(map[string]*bridge)
+	}
+	b := &bridge{
+		id:        newConnectionID(),
+		url:       url,
+		direction: direction,
+		stop:      make(chan struct{}),
+	}
+	bs.dialed[room][b.id] = b
+	go b.run(bs.srv, room)
+	return b
+}
+
+// delete removes the named room's bridge with the given ID, disconnecting
+// it. Messages still queued for it are dropped.
+func (bs *Bridges) delete(room, id string) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	b, ok := bs.dialed[room][id]
+	if !ok {
+		return errBridgeNotFound
+	}
+	bs.stop(b)
+	delete(bs.dialed[room], id)
+	if len(bs.dialed[room]) == 0 {
+		delete(bs.dialed, room)
+	}
+	return nil
+}
+
+// remove disconnects every bridge of the named room, which has been removed.
+func (bs *Bridges) remove(room string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	for _, b := range bs.dialed[room] {
+		bs.stop(b)
+	}
+	for bc := range bs.conns[room] {
+		bc.close()
+	}
+	delete(bs.dialed, room)
+	delete(bs.conns, room)
+}
+
+// stop stops b and disconnects it. bs.mu must be held.
+func (bs *Bridges) stop(b *bridge) {
+	close(b.stop)
+	if b.conn != nil {
+		b.conn.close()
+	}
+}
+
+// attach registers bc, a connection of the named room and of b if it was
+// dialed by this relay, reporting false if b has been removed since.
+func (bs *Bridges) attach(room string, bc *bridgeConn, b *bridge) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if b != nil {
+		select {
+		case <-b.stop:
+			return false
+		default:
+		}
+		b.conn = bc
+	}
+	if bs.conns[room] == nil {
+		bs.conns[room] = make(map[*bridgeConn]bool)
+	}
+	bs.conns[room][bc] = true
+	return true
+}
+
+// detach unregisters bc, a connection registered with attach.
+func (bs *Bridges) detach(room string, bc *bridgeConn, b *bridge) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if b != nil && b.conn == bc {
+		b.conn = nil
+	}
+	delete(bs.conns[room], bc)
+	if len(bs.conns[room]) == 0 {
+		delete(bs.conns, room)
+	}
+}
+
+// targets returns the connections bridging the named room.
+func (bs *Bridges) targets(room string) []*bridgeConn {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	targets := make([]*bridgeConn, 0, len(bs.conns[room]))
+	for bc := range bs.conns[room] {
+		targets = append(targets, bc)
+	}
+	return targets
+}
+
+// bridged reports whether the named room has bridges, connected or not.
+func (bs *Bridges) bridged(room string) bool {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	return len(bs.conns[room]) > 0 || len(bs.dialed[room]) > 0
+}
+
+// list returns the status of the bridges the named room dials.
+func (bs *Bridges) list(room string) []bridgeStatus {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	statuses := []bridgeStatus{}
+	for _, b := range bs.dialed[room] {
+		status := b.status()
+		status.Connected = b.conn != nil
+		statuses = append(statuses, status)
+	}
+	slices.SortFunc(statuses, func(a, b bridgeStatus) int {
+		return strings.Compare(a.URL+a.ID, b.URL+b.ID)
+	})
+	return statuses
+}
+
+// configs returns the bridges the named room dials, for exporting.
+func (bs *Bridges) configs(room string) []bridgeConfig {
+	var configs []bridgeConfig
+	for _, status := range bs.list(room) {
+		configs = append(configs, bridgeConfig{URL: status.URL, Direction: status.Direction})
+	}
+	return configs
+}
+
+// parseBridgeURL checks that a bridge's upstream URL is an absolute WebSocket
+// URL.
+func parseBridgeURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		return fmt.Errorf("invalid url %q", raw)
+	}
+	return nil
+}
+
+// validBridgeDirection reports whether direction is a bridge direction.
+func validBridgeDirection(direction string) bool {
+	return direction == "in" || direction == "out" || direction == "both"
+}
+
+// wantsBridge reports whether a WebSocket request comes from a relay
+// bridging a room, offering bridgeSubprotocol.
+func wantsBridge(r *http.Request) bool {
+	return slices.Contains(websocket.Subprotocols(r), bridgeSubprotocol)
+}
+
+// serveBridge accepts a connection from a relay bridging a room with this
+// relay's: a WebSocket request for /ws/{roomID} offering bridgeSubprotocol
+// and presenting BridgeToken. Its direction query parameter is the bridge's
+// direction as seen by the other relay.
+func (s *Server) serveBridge(w http.ResponseWriter, r *http.Request, roomID string) {
+	if s.opts.BridgeToken == "" {
+		http.Error(w, "Bridges disabled", http.StatusForbidden)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(bridgeTokenHeader)), []byte(s.opts.BridgeToken)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if roomID == directoryRoomName {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+	direction := cmp.Or(r.URL.Query().Get("direction"), "both")
+	if !validBridgeDirection(direction) {
+		http.Error(w, "Invalid direction parameter", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.rooms.openRoom(roomID); err != nil {
+		http.Error(w, err.Error(), openRoomStatus(err))
+		return
+	}
+
+	upgrader := s.upgrader
+	upgrader.Subprotocols = []string{bridgeSubprotocol}
+	// Relays send no Origin; the token authenticates them.
+	upgrader.CheckOrigin = func(*http.Request) bool { return true }
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has responded with an HTTP error.
+		return
+	}
+	bc := newBridgeConn(s, roomID, conn, remoteIP(r), direction != "out", direction != "in", &bridgeStats{})
+	s.bridges.attach(roomID, bc, nil)
+	defer s.bridges.detach(roomID, bc, nil)
+	s.log.Info("bridge: accepted", "room", roomID, "remote_addr", r.RemoteAddr, "direction", direction)
+	err = bc.run()
+	s.log.Info("bridge: closed", "room", roomID, "remote_addr", r.RemoteAddr, "err", err)
+}
+
+// handleAddBridge bridges a room with the room of an upstream relay:
+// POST /api/rooms/{roomID}/bridges with {"url":"ws://...","direction":"both"}
+// The relay connects to the url, the upstream room's WebSocket URL, and
+// forwards broadcasts "out" to it, "in" from it, or "both" (the default).
+func (s *Server) handleAddBridge(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	var req bridgeConfig
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBridgeRequestSize)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if roomID == directoryRoomName {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+	s.rooms.getRoom(roomID)
+	b := s.bridges.add(roomID, req.URL, cmp.Or(req.Direction, "both"))
+	writeJSON(w, http.StatusCreated, map[string]any{"room": roomID, "bridge": b.status()})
+}
+
+// validate checks a bridge's URL and direction, which may be left empty for
+// both.
+func (c bridgeConfig) validate() error {
+	if err := parseBridgeURL(c.URL); err != nil {
+		return err
+	}
+	if c.Direction != "" && !validBridgeDirection(c.Direction) {
+		return errors.New("direction must be in, out or both")
+	}
+	return nil
+}
+
+// handleListBridges lists the bridges a room dials with their message
+// counts: GET /api/rooms/{roomID}/bridges
+func (s *Server) handleListBridges(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "bridges": s.bridges.list(roomID)})
+}
+
+// handleDeleteBridge removes a room's bridge:
+// DELETE /api/rooms/{roomID}/bridges/{id}
+func (s *Server) handleDeleteBridge(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	if err := s.bridges.delete(roomID, r.PathValue("id")); err != nil {
+		http.Error(w, "Bridge not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "deleted": r.PathValue("id")})
+}
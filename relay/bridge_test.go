@@ -0,0 +1,177 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+const testBridgeToken = "bridge-secret"
+
+// listBridges returns the bridges room dials on ts.
+func listBridges(t testing.TB, ts *httptest.Server, room string) []bridgeStatus {
+	t.Helper()
+	code, body := admin(t, ts, http.MethodGet, "/api/rooms/"+room+"/bridges", "")
+	if code != http.StatusOK {
+		t.Fatalf("listing bridges: %d %s", code, body)
+	}
+	var list struct {
+		Bridges []bridgeStatus `json:"bridges"`
+	}
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		t.Fatal(err)
+	}
+	return list.Bridges
+}
+
+// dialBridge connects to room on ts as a relay bridging it would, with the
+// given token and query.
+func dialBridge(ts *httptest.Server, room, token, query string) (*websocket.Conn, *http.Response, error) {
+	dialer := websocket.Dialer{Subprotocols: []string{bridgeSubprotocol}}
+	return dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/"+room+query, http.Header{bridgeTokenHeader: {token}})
+}
+
+func TestBridgeConfig(t *testing.T) {
+	for _, tt := range []struct {
+		config bridgeConfig
+		ok     bool
+	}{
+		{bridgeConfig{URL: "ws://relay-b:8080/ws/room1"}, true},
+		{bridgeConfig{URL: "wss://relay-b.example.com/ws/room1", Direction: "in"}, true},
+		{bridgeConfig{URL: "http://relay-b:8080/ws/room1"}, false},
+		{bridgeConfig{URL: "ws:///ws/room1"}, false},
+		{bridgeConfig{URL: "ws://relay-b:8080/ws/room1", Direction: "sideways"}, false},
+	} {
+		if err := tt.config.validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: validate() = %v, want success %t", tt.config, err, tt.ok)
+		}
+	}
+}
+
+func TestBridge(t *testing.T) {
+	opts := DefaultOptions()
+	opts.BridgeToken = testBridgeToken
+	opts.PublishRate = 0
+	a, tsA := newTestServer(t, opts)
+	b, tsB := newTestServer(t, opts)
+
+	code, body := admin(t, tsA, http.MethodPost, "/api/rooms/shared/bridges", `{"url":"ws`+strings.TrimPrefix(tsB.URL, "http")+`/ws/shared"}`)
+	var added struct {
+		Bridge bridgeStatus `json:"bridge"`
+	}
+	if code != http.StatusCreated || json.Unmarshal([]byte(body), &added) != nil || added.Bridge.Direction != "both" {
+		t.Fatalf("adding a bridge: %d %s", code, body)
+	}
+	eventually(t, "the bridge to connect", func() bool {
+		bridges := listBridges(t, tsA, "shared")
+		return len(bridges) == 1 && bridges[0].Connected && len(b.bridges.targets("shared")) == 1
+	})
+
+	subA, subB := dialWS(t, tsA, "/ws/shared", nil), dialWS(t, tsB, "/ws/shared", nil)
+	waitForClients(t, waitForRoom(t, a, "shared"), 1)
+	waitForClients(t, waitForRoom(t, b, "shared"), 1)
+	for _, tt := range []struct {
+		ts      *httptest.Server
+		content string
+	}{
+		{tsA, "from a"},
+		{tsB, "from b"},
+	} {
+		if code, body := publish(t, tt.ts, "shared", tt.content, nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+		for _, sub := range []*websocket.Conn{subA, subB} {
+			if _, message, err := sub.ReadMessage(); err != nil || string(message) != tt.content {
+				t.Errorf("received %q (%v), want %q on both relays", message, err, tt.content)
+			}
+		}
+	}
+	eventually(t, "the bridge's counts", func() bool {
+		bridges := listBridges(t, tsA, "shared")
+		return bridges[0].Forwarded == 1 && bridges[0].Received == 1
+	})
+
+	path := "/api/rooms/shared/bridges/" + added.Bridge.ID
+	if code, body := admin(t, tsA, http.MethodDelete, path, ""); code != http.StatusOK {
+		t.Fatalf("deleting the bridge: %d %s", code, body)
+	}
+	if code, _ := admin(t, tsA, http.MethodDelete, path, ""); code != http.StatusNotFound {
+		t.Errorf("deleting the bridge again: %d, want 404", code)
+	}
+	eventually(t, "the bridge to disconnect", func() bool { return len(b.bridges.targets("shared")) == 0 })
+	if got := listBridges(t, tsA, "shared"); len(got) != 0 {
+		t.Errorf("bridges after deleting: %+v", got)
+	}
+}
+
+func TestBridgeLoopPrevention(t *testing.T) {
+	opts := DefaultOptions()
+	opts.BridgeToken = testBridgeToken
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	peer, _, err := dialBridge(ts, "looped", testBridgeToken, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	sub := dialWS(t, ts, "/ws/looped", nil)
+	waitForClients(t, waitForRoom(t, s, "looped"), 1)
+
+	// Messages that went through this relay already are dropped. The peer's
+	// messages are published in order, so the looped one was dropped if the
+	// next one comes first.
+	for _, f := range []bridgeFrame{
+		{Origins: []string{"relay-b"}, Content: []byte("bridged")},
+		{Origins: []string{"relay-b", s.id}, Content: []byte("looped")},
+		{Origins: []string{"relay-c", "relay-b"}, Content: []byte("bridged again")},
+	} {
+		if err := peer.WriteJSON(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readLines(t, sub, 2); !slices.Equal(got, []string{"bridged", "bridged again"}) {
+		t.Errorf("received %q, want the messages that hadn't been through the relay", got)
+	}
+	if code, body := publish(t, ts, "looped", "local", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+
+	// Messages aren't sent back over the bridge they came in on, and carry
+	// the relay's ID.
+	var f bridgeFrame
+	if err := peer.ReadJSON(&f); err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Content) != "local" || len(f.Origins) != 1 || f.Origins[0] != s.id {
+		t.Errorf("bridged %+v, want the local message from %s", f, s.id)
+	}
+}
+
+func TestBridgeRejected(t *testing.T) {
+	opts := DefaultOptions()
+	opts.BridgeToken = testBridgeToken
+	_, ts := newTestServer(t, opts)
+	_, disabled := newTestServer(t, DefaultOptions())
+	for _, tt := range []struct {
+		ts           *httptest.Server
+		token, query string
+		want         int
+	}{
+		{ts, "wrong", "", http.StatusUnauthorized},
+		{ts, testBridgeToken, "?direction=sideways", http.StatusBadRequest},
+		{disabled, testBridgeToken, "", http.StatusForbidden},
+	} {
+		_, res, err := dialBridge(tt.ts, "room", tt.token, tt.query)
+		if err == nil || res == nil || res.StatusCode != tt.want {
+			t.Errorf("bridging with token %q and %q: %v, want status %d", tt.token, tt.query, err, tt.want)
+		}
+	}
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/room/bridges", `{"url":"http://relay-b/ws/room"}`); code != http.StatusBadRequest {
+		t.Errorf("adding a bridge to an HTTP URL: %d %s, want 400", code, body)
+	}
+}
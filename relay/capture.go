@@ -0,0 +1,168 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxCapturedMessages bounds a room's capture; further messages aren't
+	// captured.
+	maxCapturedMessages = 10000
+
+	// maxPlaybackBodySize bounds the capture uploaded for playback.
+	maxPlaybackBodySize = 64 << 20
+)
+
+// capturedMessage is a message broadcast to a room while it was capturing,
+// one per line of a capture.
+type capturedMessage struct {
+	envelope
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// content returns the message's decoded content.
+func (m capturedMessage) content() ([]byte, error) {
+	switch m.Encoding {
+	case "":
+		return []byte(m.Content), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(m.Content)
+	}
+	return nil, fmt.Errorf("unknown encoding %q", m.Encoding)
+}
+
+// capture records the message of p, broadcast with sequence number seq at
+// publishedAt, if the room is capturing. It must be called on the room's
+// goroutine.
+func (r *Room) capture(p *publication, seq uint64, publishedAt time.Time) {
+	if !r.capturing || len(r.captured) == maxCapturedMessages {
+		return
+	}
+	m := capturedMessage{
+		envelope:    envelope{Room: r.name, TS: publishedAt.UnixMilli(), Seq: seq, Content: string(p.message)},
+		ContentType: p.contentType,
+	}
+	if !utf8.Valid(p.message) {
+		m.Content = base64.StdEncoding.EncodeToString(p.message)
+		m.Encoding = "base64"
+	}
+	r.captured = append(r.captured, m)
+}
+
+// handleStartCapture starts capturing the messages broadcast to a room,
+// discarding any capture in progress: POST /api/rooms/{roomID}/capture
+func (s *Server) handleStartCapture(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	room := s.rooms.getRoom(roomID)
+	if !room.do(func() { room.capturing, room.captured = true, nil }) {
+		http.Error(w, errRoomClosed.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "capturing": true})
+}
+
+// handleStopCapture stops a room's capture and responds with the captured
+// messages as JSON Lines: DELETE /api/rooms/{roomID}/capture
+func (s *Server) handleStopCapture(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	room, ok := s.rooms.lookupRoom(roomID)
+	capturing := false
+	var captured []capturedMessage
+	if ok {
+		room.do(func() {
+			capturing, captured = room.capturing, room.captured
+			room.capturing, room.captured = false, nil
+		})
+	}
+	if !capturing {
+		http.Error(w, "Room is not capturing", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+roomID+`.jsonl"`)
+	enc := json.NewEncoder(w)
+	for _, m := range captured {
+		enc.Encode(m)
+	}
+}
+
+// handlePlayback publishes the messages of a capture, as JSON Lines in the
+// request body, to a room, keeping the intervals between them:
+// POST /api/rooms/{roomID}/playback?speed={factor}
+// The messages are published in the background after the response, with the
+// intervals divided by speed.
+func (s *Server) handlePlayback(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	speed := 1.0
+	if v := r.URL.Query().Get("speed"); v != "" {
+		var err error
+		if speed, err = strconv.ParseFloat(v, 64); err != nil || speed <= 0 {
+			http.Error(w, "Invalid speed parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var messages []capturedMessage
+	var contents [][]byte
+	scanner := bufio.NewScanner(http.MaxBytesReader(w, r.Body, maxPlaybackBodySize))
+	scanner.Buffer(nil, maxPlaybackBodySize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var m capturedMessage
+		err := json.Unmarshal(scanner.Bytes(), &m)
+		var content []byte
+		if err == nil {
+			content, err = m.content()
+		}
+		if err == nil && len(content) == 0 {
+			err = errors.New("empty content")
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid capture: line %d: %v", line, err), http.StatusBadRequest)
+			return
+		}
+		messages = append(messages, m)
+		contents = append(contents, content)
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, "Error reading capture: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	go s.playBack(roomID, messages, contents, speed)
+	writeJSON(w, http.StatusAccepted, map[string]any{"room": roomID, "messages": len(messages)})
+}
+
+// playBack publishes the captured messages with the given contents to the
+// named room, spaced as they were captured divided by speed, until done or
+// the server shuts down.
+func (s *Server) playBack(roomID string, messages []capturedMessage, contents [][]byte, speed float64) {
+	start := time.Now()
+	for i, m := range messages {
+		offset := time.Duration(float64(time.Duration(m.TS-messages[0].TS)*time.Millisecond) / speed)
+		timer := time.NewTimer(time.Until(start.Add(offset)))
+		select {
+		case <-timer.C:
+		case <-s.shutdownStarted:
+			timer.Stop()
+			return
+		}
+		contentType := m.ContentType
+		if contentType == "" {
+			contentType = publishContentType(nil, contents[i], false)
+		}
+		s.rooms.getRoom(roomID).submitUnlessPaused(publication{message: contents[i], publisher: "playback", contentType: contentType})
+	}
+}
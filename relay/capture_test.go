@@ -0,0 +1,71 @@
+package relay
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureAndPlayback(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/recorded/capture", ""); code != http.StatusOK {
+		t.Fatalf("starting the capture: %d %s", code, body)
+	}
+	messages := [][]byte{[]byte("one"), {0xff, 0xfe, 't', 'w', 'o'}, []byte(`{"three":3}`)}
+	for i, message := range messages {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		if err := s.Publish("recorded", message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	room := waitForRoom(t, s, "recorded")
+	room.do(func() {})
+
+	code, capture := admin(t, ts, http.MethodDelete, "/api/rooms/recorded/capture", "")
+	if code != http.StatusOK || strings.Count(capture, "\n") != len(messages) || !strings.Contains(capture, `"encoding":"base64"`) {
+		t.Fatalf("stopping the capture: %d %s, want %d lines", code, capture, len(messages))
+	}
+	if code, _ := admin(t, ts, http.MethodDelete, "/api/rooms/recorded/capture", ""); code != http.StatusNotFound {
+		t.Errorf("stopping a stopped capture: status %d, want 404", code)
+	}
+
+	conn := dialWS(t, ts, "/ws/replayed", nil)
+	replayed := waitForRoom(t, s, "replayed")
+	waitForClients(t, replayed, 1)
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/replayed/playback", capture); code != http.StatusAccepted {
+		t.Fatalf("playback: %d %s", code, body)
+	}
+
+	// The messages arrive in order, about as far apart as they were
+	// published.
+	var arrivals []time.Time
+	for i, want := range messages {
+		_, got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		arrivals = append(arrivals, time.Now())
+		if !bytes.Equal(got, want) {
+			t.Errorf("message %d: %q, want %q", i, got, want)
+		}
+	}
+	for i := 1; i < len(arrivals); i++ {
+		if gap := arrivals[i].Sub(arrivals[i-1]); gap < interval-20*time.Millisecond || gap > 3*interval {
+			t.Errorf("message %d arrived %v after the one before, want about %v", i, gap, interval)
+		}
+	}
+
+	for _, body := range []string{"not JSON\n", `{"content":""}` + "\n", `{"content":"x","encoding":"rot13"}` + "\n"} {
+		if code, _ := admin(t, ts, http.MethodPost, "/api/rooms/replayed/playback", body); code != http.StatusBadRequest {
+			t.Errorf("playing back %q: status %d, want 400", body, code)
+		}
+	}
+}
@@ -0,0 +1,770 @@
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client is a middleman between the websocket connection and the hub.
+type Client struct {
+	room *Room
+	conn *websocket.Conn
+	send chan []byte
+
+	// id is the connection's server-assigned UUID, used in logs and admin
+	// responses.
+	id string
+
+	// ip is the remote IP the connection was accepted from.
+	ip          string
+	remoteAddr  string
+	connectedAt time.Time
+
+	// minInterval is the minimum time between two messages delivered to the
+	// client, or zero for no rate limit.
+	minInterval time.Duration
+	// batch asks for the messages queued for the client to be sent together,
+	// one per line, in a single frame.
+	batch bool
+
+	// readDone is closed once the read pump has exited, e.g. because the
+	// client answered a close frame.
+	readDone chan struct{}
+
+	// wantsStats asks for the room's statistics to be sent when the client joins.
+	wantsStats bool
+
+	// encoding is the application-level encoding of the messages sent to the
+	// client: empty for none or encodingGzip.
+	encoding string
+	// template is the name of the template the client's messages are
+	// rendered with, if any.
+	template string
+	// delta asks for JSON objects to be sent as merge patches against the
+	// previous message. deltaSeq is the sequence number of the latest
+	// message the client was sent, which its patches apply to; it is only
+	// used by the room's fan-out.
+	delta    bool
+	deltaSeq uint64
+	// shard is the room's fan-out shard the client is in, if any, at
+	// shardIndex among its clients. Both are only used on the room's
+	// goroutine.
+	shard      *fanOutShard
+	shardIndex int
+	// group is the subscriber group the client shares the room's messages
+	// with, if any.
+	group string
+	// topics are the topics the subscriber receives messages tagged with,
+	// from ?topics=, or nil for all of them.
+	topics map[string]bool
+	// name is the name the subscriber gave itself with ?name=, reported by
+	// the room's presence endpoint.
+	name string
+	// maxStale is how old the retained messages replayed to the client may
+	// be, or zero for any age.
+	maxStale time.Duration
+
+	// tags are the connection's analytics tags, from the TagKeys query
+	// parameters.
+	tags map[string]string
+
+	// accessToken is the token the subscriber presented, checked against its
+	// room's access token.
+	accessToken string
+
+	// quota is the subscription quota of the client's JWT.
+	quota subscriberQuota
+
+	// maxMessages, if positive, is the number of messages after which the
+	// client is disconnected, from the max_messages query parameter.
+	// uncounted is the number of messages queued on joining that don't count
+	// towards it, set by the room before queuing them.
+	maxMessages int
+	countReplay bool
+	uncounted   atomic.Int64
+
+	// clientID identifies the client across reconnects, from the client_id
+	// query parameter. undelivered is set once a message queued for the
+	// client may not have reached it, so its position can't be resumed from.
+	clientID    string
+	undelivered atomic.Bool
+
+	// noEcho excludes the client from the broadcast of messages it publishes
+	// with WSPublish, from the echo=0 query parameter.
+	noEcho bool
+	// envelope is set for clients that asked for messages in envelopes
+	// without Envelope.
+	envelope bool
+
+	// sse is set for SSE subscribers, whose messages are framed as events.
+	// lastEventID is the sequence number of the last message the subscriber
+	// received before reconnecting, from Last-Event-ID or ?last_event_id=,
+	// or 0.
+	sse         bool
+	lastEventID uint64
+	// grpc is set for gRPC subscribers, whose messages are sent as
+	// relaypb.Message.
+	grpc bool
+
+	// readOnly keeps the client from publishing with WSPublish: it connected
+	// with mode=r, or without mode=rw under WSPublishOptIn.
+	readOnly bool
+	// publishBucket rate-limits the client's publishes for WSPublishRate. It
+	// is only used by the client's read pump.
+	publishBucket tokenBucket
+
+	// lastMessage is when the room last queued a message for the client, or
+	// when the client joined. It is only accessed by the room's goroutine.
+	lastMessage time.Time
+	// kicked is set once an administrator has disconnected the client.
+	kicked atomic.Bool
+	// bytesSent counts the bytes of the messages written to the client.
+	bytesSent atomic.Int64
+	// acked is the sequence number of the latest message the client
+	// acknowledged, in reliable rooms.
+	acked atomic.Uint64
+	// dropped counts the messages dropped under the room's slow client
+	// policy since the client was last warned. Like lastMessage, it is only
+	// accessed by whoever is fanning out to the client.
+	dropped int
+}
+
+// enqueue queues message for the client at time now without blocking. If
+// the client's send buffer is full, the room's slow client policy applies,
+// and enqueue reports false if the client must be disconnected.
+func (c *Client) enqueue(message []byte, now time.Time) bool {
+	c.warnDropped()
+	select {
+	case c.send <- message:
+	default:
+		if !c.overflow(message) {
+			return false
+		}
+	}
+	c.lastMessage = now
+	return true
+}
+
+// newConnectionID returns a random (version 4) UUID.
+func newConnectionID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// ClientIndex tracks the live connections of each remote IP.
+type ClientIndex struct {
+	byIP map[string]map[*Client]bool
+	mu   sync.RWMutex
+}
+
+func (ci *ClientIndex) add(c *Client) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	if ci.byIP[c.ip] == nil {
+		ci.byIP[c.ip] = make(map[*Client]bool)
+	}
+	ci.byIP[c.ip][c] = true
+}
+
+func (ci *ClientIndex) remove(c *Client) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	delete(ci.byIP[c.ip], c)
+	if len(ci.byIP[c.ip]) == 0 {
+		delete(ci.byIP, c.ip)
+	}
+}
+
+// lookup returns up to limit connections accepted from ip.
+func (ci *ClientIndex) lookup(ip string, limit int) []*Client {
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+
+	clients := make([]*Client, 0, min(len(ci.byIP[ip]), limit))
+	for c := range ci.byIP[ip] {
+		if len(clients) == limit {
+			break
+		}
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// readPump pumps messages from the websocket connection to the hub.
+// We don't expect clients to send messages, but we need to read to handle close and pong.
+func (c *Client) readPump() {
+	defer func() {
+		if err := recover(); err != nil {
+			c.log().Error("readPump recovered from panic", "panic", err, "stack", string(debug.Stack()))
+		}
+		close(c.readDone)
+		c.room.leave(c)
+		c.room.srv.clientIndex.remove(c)
+		c.room.srv.tagGauges.remove(c.tags)
+		c.room.srv.release(c.room, c.quota)
+		c.room.srv.tokenConnections.release(c.quota)
+		c.conn.Close()
+	}()
+	readWait := c.room.srv.opts.WSPongTimeout
+	if !c.room.srv.opts.WSPing {
+		readWait = c.room.srv.opts.WSReadTimeout
+	}
+	c.conn.SetReadLimit(c.room.srv.opts.MaxWSMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(readWait))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(readWait)); return nil })
+	if !c.room.srv.opts.WSPing {
+		// Without pings of our own, anything the client sends shows it's alive.
+		c.conn.SetPingHandler(func(data string) error {
+			c.conn.SetReadDeadline(time.Now().Add(readWait))
+			err := c.conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+			if err == websocket.ErrCloseSent {
+				return nil
+			}
+			return err
+		})
+	}
+	for {
+		messageType, message, err := c.conn.ReadMessage()
+		if err != nil {
+			// Clients going away, frames rejected with a close of our own and
+			// kicked clients echoing their close are routine; only log close
+			// codes that hint at a problem.
+			if !c.kicked.Load() && websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure, websocket.CloseTryAgainLater) {
+				c.log().Warn("unexpected close", "err", err)
+			}
+			break
+		}
+		if !c.room.srv.opts.WSPing {
+			c.conn.SetReadDeadline(time.Now().Add(readWait))
+		}
+		if c.room.reliable.Load() {
+			if seq, ok := parseAck(messageType, message); ok {
+				c.ack(seq)
+				continue
+			}
+		}
+		if c.room.srv.opts.WSPublish && !c.readOnly && len(message) > 0 {
+			c.publish(messageType, message)
+		}
+	}
+}
+
+// writePump pumps messages from the hub to the websocket connection.
+func (c *Client) writePump() {
+	// Pings leave the client a tenth of the pong timeout to answer.
+	ticker := time.NewTicker(c.room.srv.opts.WSPongTimeout * 9 / 10)
+	pings := ticker.C
+	if !c.room.srv.opts.WSPing {
+		pings = nil
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			c.log().Error("writePump recovered from panic", "panic", err, "stack", string(debug.Stack()))
+		}
+		ticker.Stop()
+		c.conn.Close()
+		c.room.srv.wsConnections.Add(-1)
+	}()
+	idle := newIdleTimer(c.room.srv.opts.SubscriberIdleTimeout)
+	defer idle.stop()
+	// With a delivery rate, send is nil while the pace timer runs, so that
+	// further messages queue up in c.send and are subject to the room's
+	// usual slow-client handling. Pacing ends with a shutdown, to send what
+	// is queued before the close frame.
+	send := c.send
+	pace := time.NewTimer(0)
+	pace.Stop()
+	defer pace.Stop()
+	interval := c.minInterval
+	shutdown := c.room.srv.shutdownStarted
+	if interval == 0 {
+		shutdown = nil
+	}
+	delivered := 0
+	for {
+		select {
+		case <-pace.C:
+			send = c.send
+		case <-shutdown:
+			shutdown = nil
+			pace.Stop()
+			send = c.send
+			interval = 0
+		case <-c.readDone:
+			// The client is gone; what is still queued can't reach it.
+			return
+		case message, ok := <-send:
+			if ok && interval > 0 {
+				send = nil
+				pace.Reset(interval)
+			}
+
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub closed the channel.
+				c.closeHandshake()
+				return
+			}
+
+			messages := [][]byte{message}
+			if c.batch && c.minInterval == 0 {
+				messages = c.gather(message, delivered)
+			}
+			size := len(messages) - 1
+			for _, message := range messages {
+				size += len(message)
+			}
+
+			// Text frames must be valid UTF-8, so anything else is
+			// delivered as binary.
+			messageType := websocket.BinaryMessage
+			if c.room.srv.opts.AutoDetectFrameType && validUTF8(messages) {
+				messageType = websocket.TextMessage
+			}
+			c.conn.EnableWriteCompression(c.compresses(messageType, size))
+			w, err := c.conn.NextWriter(messageType)
+			if err != nil {
+				c.writeFailed(err)
+				return
+			}
+			for i, message := range messages {
+				if i > 0 {
+					if _, err := w.Write(newline); err != nil {
+						c.writeFailed(err)
+						return
+					}
+				}
+				if _, err := w.Write(message); err != nil {
+					c.writeFailed(err)
+					return
+				}
+			}
+			if err := w.Close(); err != nil {
+				c.writeFailed(err)
+				return
+			}
+			c.bytesSent.Add(int64(size))
+
+			if delivered += len(messages); c.maxMessages > 0 && delivered >= c.messageLimit() {
+				c.sendClose(websocket.FormatCloseMessage(websocket.CloseNormalClosure, "max_messages delivered"))
+				return
+			}
+			idle.reset()
+		case <-idle.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.sendClose(websocket.FormatCloseMessage(websocket.CloseNormalClosure, "idle timeout"))
+			return
+		case <-pings:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.writeFailed(err)
+				return
+			}
+		}
+	}
+}
+
+// newline separates the messages of a batched frame.
+var newline = []byte{'\n'}
+
+// gather returns message followed by the messages already queued for a
+// batching client, up to maxBatchSize bytes in all and without going past
+// its max_messages once delivered messages have been. A closed send buffer
+// is left for the write pump to find on its next receive.
+func (c *Client) gather(message []byte, delivered int) [][]byte {
+	messages := [][]byte{message}
+	size := len(message)
+	n := len(c.send)
+	if c.maxMessages > 0 {
+		n = min(n, c.messageLimit()-delivered-1)
+	}
+	for range n {
+		if size >= maxBatchSize {
+			break
+		}
+		// The room may take messages back from a slow client's buffer.
+		select {
+		case next, ok := <-c.send:
+			if !ok {
+				return messages
+			}
+			messages = append(messages, next)
+			size += len(next) + 1
+		default:
+			return messages
+		}
+	}
+	return messages
+}
+
+// validUTF8 reports whether all of messages are valid UTF-8.
+func validUTF8(messages [][]byte) bool {
+	for _, message := range messages {
+		if !utf8.Valid(message) {
+			return false
+		}
+	}
+	return true
+}
+
+// compresses reports whether a message of messageType and size bytes is worth
+// compressing, if the connection negotiated permessage-deflate: small
+// messages barely shrink, and binary ones are often compressed already.
+func (c *Client) compresses(messageType, size int) bool {
+	opts := &c.room.srv.opts
+	if messageType == websocket.BinaryMessage && !opts.CompressBinary {
+		return false
+	}
+	return size >= opts.CompressionMinSize
+}
+
+// writeFailed handles an error writing to the client, after which writePump
+// closes the connection. A write that timed out may have left a frame half
+// sent, so no close frame can follow it: the connection is closed outright,
+// which the client sees as an abnormal closure (1006), and the read pump
+// unregisters the client as its read fails.
+func (c *Client) writeFailed(err error) {
+	c.undelivered.Store(true)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		c.room.srv.metrics.writeTimeouts.Add(1)
+		c.log().Info("write timed out, disconnecting")
+	}
+}
+
+// ServeWS upgrades a subscriber's request to a WebSocket and joins it to the
+// room named by the request path: /ws/{roomID}
+func (s *Server) ServeWS(w http.ResponseWriter, r *http.Request) {
+	// Extract room ID from URL. Assuming /ws/{roomID}
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 3 {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+	roomID := directoryRoomName
+	if pathParts[2] != directoryRoomName {
+		var err error
+		if roomID, err = s.resolveRoomID(pathParts[2]); err != nil {
+			http.Error(w, err.Error(), roomIDStatus(err))
+			return
+		}
+	}
+
+	if wantsBridge(r) {
+		s.serveBridge(w, r, roomID)
+		return
+	}
+
+	quota, err := s.authorizeSubscriber(r, roomID)
+	if err != nil {
+		http.Error(w, err.Error(), authStatus(err))
+		return
+	}
+
+	rate, ok := s.clientRate(r)
+	if !ok {
+		http.Error(w, "Invalid rate parameter", http.StatusBadRequest)
+		return
+	}
+
+	var maxMessages int
+	if v := r.URL.Query().Get("max_messages"); v != "" {
+		if maxMessages, err = strconv.Atoi(v); err != nil || maxMessages < 1 {
+			http.Error(w, "Invalid max_messages parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode != "" && mode != "r" && mode != "rw" {
+		http.Error(w, "Invalid mode parameter", http.StatusBadRequest)
+		return
+	}
+
+	encoding := r.URL.Query().Get("encoding")
+	if encoding != "" && encoding != encodingGzip {
+		http.Error(w, "Invalid encoding parameter", http.StatusBadRequest)
+		return
+	}
+
+	template, err := s.subscriberTemplate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	group, err := requestGroup(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name, err := requestPresenceName(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	topics, err := requestTopics(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	maxStale, err := requestMaxStale(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lastEventID, err := requestLastEventID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tags, err := s.connectionTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s.opts.Subprotocol != "" && !slices.Contains(websocket.Subprotocols(r), s.opts.Subprotocol) {
+		http.Error(w, "Subprotocol "+s.opts.Subprotocol+" required", http.StatusBadRequest)
+		return
+	}
+
+	if !s.allowReconnect(w, r) {
+		return
+	}
+
+	if s.shuttingDown.Load() {
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	room, err := s.subscriptionRoom(roomID)
+	if errors.Is(err, errTooManyRooms) {
+		s.rejectWS(w, r, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := room.admitsSubscriber(requestToken(r)); err != nil {
+		http.Error(w, err.Error(), accessTokenStatus(err))
+		return
+	}
+	if !s.tokenConnections.acquire(quota) {
+		http.Error(w, errQuotaExceeded.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err := s.admit(room, quota); err != nil {
+		s.tokenConnections.release(quota)
+		s.rejectWS(w, r, err)
+		return
+	}
+
+	// Offer permessage-deflate according to the room's setting, and select
+	// the subprotocols the server knows of that the client offered.
+	roomUpgrader := s.upgrader
+	roomUpgrader.EnableCompression = room.compression.Load()
+	if s.opts.Subprotocol != "" {
+		roomUpgrader.Subprotocols = append(roomUpgrader.Subprotocols, s.opts.Subprotocol)
+	}
+	if slices.Contains(websocket.Subprotocols(r), envelopeSubprotocol) {
+		roomUpgrader.Subprotocols = append(roomUpgrader.Subprotocols, envelopeSubprotocol)
+	}
+
+	conn, err := roomUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.log.Info("WebSocket upgrade failed", "room", room.name, "remote_addr", r.RemoteAddr, "err", err)
+		s.metrics.upgradeFailures.Add(1)
+		s.release(room, quota)
+		s.tokenConnections.release(quota)
+		return
+	}
+	if level := room.compressionLevel.Load(); level != 0 {
+		// Validated, so it can't fail.
+		conn.SetCompressionLevel(int(level))
+	}
+
+	client := &Client{
+		room:        room,
+		conn:        conn,
+		send:        make(chan []byte, room.sendBufferSize()),
+		readDone:    make(chan struct{}),
+		id:          newConnectionID(),
+		ip:          remoteIP(r),
+		remoteAddr:  r.RemoteAddr,
+		connectedAt: time.Now(),
+		wantsStats:  r.URL.Query().Get("stats") == "1",
+		encoding:    encoding,
+		template:    template,
+		delta:       r.URL.Query().Get("delta") == "1",
+		group:       group,
+		name:        name,
+		topics:      topics,
+		maxStale:    maxStale,
+		tags:        tags,
+		accessToken: requestToken(r),
+		clientID:    r.URL.Query().Get("client_id"),
+		quota:       quota,
+		noEcho:      r.URL.Query().Get("echo") == "0",
+		envelope:    wantsEnvelope(r) || room.reliable.Load(),
+		lastEventID: lastEventID,
+		readOnly:    mode == "r" || (s.opts.WSPublishOptIn && mode != "rw"),
+		maxMessages: maxMessages,
+		countReplay: r.URL.Query().Get("count_replay") != "0",
+		batch:       r.URL.Query().Get("batch") == "1",
+	}
+	if rate > 0 {
+		client.minInterval = time.Duration(float64(time.Second) / rate)
+	}
+	if s.opts.Welcome {
+		// Queued before joining the room, so it is the first message sent.
+		welcome, _ := json.Marshal(welcomeEvent{Type: "welcome", ConnectionID: client.id})
+		client.send <- client.encode(welcome)
+	}
+	if !client.room.join(client) {
+		// The room was closed while the client was connecting.
+		conn.Close()
+		s.release(room, quota)
+		s.tokenConnections.release(quota)
+		return
+	}
+	s.clientIndex.add(client)
+	s.tagGauges.add(client.tags)
+
+	// Allow collection of memory referenced by the caller by doing all work in
+	// new goroutines.
+	s.wsConnections.Add(1)
+	go client.writePump()
+	go client.readPump()
+}
+
+// admit reserves a slot for a new subscriber of room, whichever transport it
+// uses, shedding slow clients when the server is under connection pressure.
+// Every successful admit must be paired with a release.
+func (s *Server) admit(room *Room, quota subscriberQuota) error {
+	if n := room.members.Add(1); s.opts.MaxRoomClients > 0 && n > int64(s.opts.MaxRoomClients) {
+		room.members.Add(-1)
+		s.metrics.roomFullRejections.Add(1)
+		return errRoomFull
+	}
+	if !quota.authenticated {
+		if n := room.anonymousMembers.Add(1); s.opts.MaxAnonymousRoomClients > 0 && n > int64(s.opts.MaxAnonymousRoomClients) {
+			room.anonymousMembers.Add(-1)
+			room.members.Add(-1)
+			s.metrics.roomFullRejections.Add(1)
+			return errRoomFull
+		}
+	}
+
+	n := s.connections.Add(1)
+	if !quota.authenticated {
+		// Anonymous subscribers over their limit don't shed or evict others.
+		if n := s.anonymousConnections.Add(1); s.opts.MaxAnonymousConnections > 0 && n > int64(s.opts.MaxAnonymousConnections) {
+			s.release(room, quota)
+			s.metrics.connectionRejections.Add(1)
+			return errTooManyConnections
+		}
+	}
+	if s.opts.MaxConnections <= 0 {
+		return nil
+	}
+
+	threshold := int64(float64(s.opts.MaxConnections) * s.opts.ShedThreshold)
+	if n > threshold {
+		// Dropped clients release their slots once their pumps exit, so count
+		// them against n straight away to admit this connection.
+		n -= int64(s.rooms.shedSlowClients(int(n - threshold)))
+	}
+	if n > int64(s.opts.MaxConnections) && s.opts.EvictIdleAfter > 0 {
+		n -= int64(s.rooms.evictIdleClients(int(n - int64(s.opts.MaxConnections))))
+	}
+	if n > int64(s.opts.MaxConnections) {
+		s.release(room, quota)
+		s.metrics.connectionRejections.Add(1)
+		return errTooManyConnections
+	}
+	return nil
+}
+
+// contentLimit returns the maximum size of content read from a request body.
+func (s *Server) contentLimit() int {
+	if s.opts.MaxContentSize > 0 {
+		return s.opts.MaxContentSize
+	}
+	return defaultMaxContentSize
+}
+
+// release frees the slot of a subscriber of room reserved by admit.
+func (s *Server) release(room *Room, quota subscriberQuota) {
+	room.members.Add(-1)
+	s.connections.Add(-1)
+	if !quota.authenticated {
+		room.anonymousMembers.Add(-1)
+		s.anonymousConnections.Add(-1)
+	}
+}
+
+// rejectWS turns away a WebSocket subscriber over a connection limit by
+// completing the handshake and closing with 1013 (try again later) and err
+// as the reason: unlike an HTTP error, which browsers hide from scripts, the
+// close code and reason reach the client.
+func (s *Server) rejectWS(w http.ResponseWriter, r *http.Request, err error) {
+	upgrader := s.upgrader
+	// Browsers fail handshakes that select none of their subprotocols.
+	upgrader.Subprotocols = websocket.Subprotocols(r)
+	conn, upgradeErr := upgrader.Upgrade(w, r, nil)
+	if upgradeErr != nil {
+		// The upgrader has responded with an HTTP error.
+		return
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()), time.Now().Add(writeWait))
+	conn.Close()
+}
+
+var (
+	errRoomFull           = errors.New("room is full")
+	errTooManyConnections = errors.New("too many connections")
+)
+
+// clientRate returns the delivery rate in messages per second for a subscriber:
+// the rate query parameter bounded by MaxClientRate, or zero for unlimited.
+// It reports false if the rate parameter is malformed or below
+// minClientRate.
+func (s *Server) clientRate(r *http.Request) (float64, bool) {
+	rate := s.opts.MaxClientRate
+	if v := r.URL.Query().Get("rate"); v != "" {
+		requested, err := strconv.ParseFloat(v, 64)
+		if err != nil || requested < minClientRate {
+			return 0, false
+		}
+		if rate <= 0 || requested < rate {
+			rate = requested
+		}
+	}
+	return rate, true
+}
@@ -0,0 +1,912 @@
+package relay
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// countingConn counts the bytes read from a connection.
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// benchmarkDocument returns a JSON document of about size bytes, like the
+// API responses relayed to mobile subscribers, numbered n so that successive
+// documents differ.
+func benchmarkDocument(size, n int) []byte {
+	type item struct {
+		ID       int      `json:"id"`
+		Name     string   `json:"name"`
+		Price    float64  `json:"price"`
+		InStock  bool     `json:"in_stock"`
+		Tags     []string `json:"tags"`
+		Supplier string   `json:"supplier"`
+	}
+	doc := struct {
+		Revision int    `json:"revision"`
+		Items    []item `json:"items"`
+	}{Revision: n}
+	for i := 0; ; i++ {
+		b, _ := json.Marshal(doc)
+		if len(b) >= size {
+			return b
+		}
+		doc.Items = append(doc.Items, item{
+			ID:       i,
+			Name:     fmt.Sprintf("Item %d", i),
+			Price:    float64(i%1000) + 0.99,
+			InStock:  i%3 != 0,
+			Tags:     []string{"catalog", fmt.Sprintf("category-%d", i%12)},
+			Supplier: fmt.Sprintf("supplier-%d.example.com", i%40),
+		})
+	}
+}
+
+// BenchmarkCompression relays JSON documents to a WebSocket subscriber without
+// compression, with permessage-deflate, and with it above a 4 KiB threshold.
+// ns/op is the CPU cost of relaying a document, including compressing and
+// decompressing it, and wire-B/msg the bytes it took on the wire.
+func BenchmarkCompression(b *testing.B) {
+	for _, size := range []int{1 << 10, 32 << 10} {
+		for _, mode := range []struct {
+			name        string
+			compression bool
+			minSize     int
+		}{
+			{"off", false, 0},
+			{"on", true, 0},
+			{"above-4KiB", true, 4 << 10},
+		} {
+			b.Run(fmt.Sprintf("size=%dKiB/compression=%s", size>>10, mode.name), func(b *testing.B) {
+				benchmarkCompression(b, size, mode.compression, mode.minSize)
+			})
+		}
+	}
+}
+
+func benchmarkCompression(b *testing.B, size int, compression bool, minSize int) {
+	opts := DefaultOptions()
+	opts.Compression = compression
+	opts.CompressionMinSize = minSize
+	s, ts := newTestServer(b, opts)
+
+	var read atomic.Int64
+	dialer := &websocket.Dialer{
+		EnableCompression: true,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			return countingConn{Conn: conn, read: &read}, err
+		},
+	}
+	conn := dialWS(b, ts, "/ws/compression", dialer)
+	room := waitForRoom(b, s, "compression")
+	waitForClients(b, room, 1)
+
+	docs := make([][]byte, 16)
+	for i := range docs {
+		docs[i] = benchmarkDocument(size, i)
+	}
+	b.SetBytes(int64(len(docs[0])))
+	b.ResetTimer()
+	read.Store(0)
+	for i := range b.N {
+		if err := s.Publish("compression", docs[i%len(docs)]); err != nil {
+			b.Fatal(err)
+		}
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(message) >= len(docs[0])/2 {
+				break
+			}
+		}
+	}
+	b.ReportMetric(float64(read.Load())/float64(b.N), "wire-B/msg")
+}
+
+// readLines reads WebSocket messages from conn until it has n lines, splitting
+// batched messages into their lines.
+func readLines(t testing.TB, conn *websocket.Conn, n int) []string {
+	t.Helper()
+	var lines []string
+	for len(lines) < n {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("after %d lines: %v", len(lines), err)
+		}
+		lines = append(lines, strings.Split(string(message), "\n")...)
+	}
+	return lines
+}
+
+func TestBatchedWrites(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	conn := dialWS(t, ts, "/ws/batched?batch=1", nil)
+	room := waitForRoom(t, s, "batched")
+	waitForClients(t, room, 1)
+
+	var want []string
+	for i := range 200 {
+		message := fmt.Sprint("message ", i)
+		want = append(want, message)
+		if err := s.Publish("batched", []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readLines(t, conn, len(want)); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// BenchmarkBatchedWrites relays bursts of 64 messages to a WebSocket
+// subscriber, one frame per message and, with batch=1, in frames joining the
+// messages queued for it.
+func BenchmarkBatchedWrites(b *testing.B) {
+	for _, batch := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batch=%t", batch), func(b *testing.B) {
+			opts := DefaultOptions()
+			opts.PublishRate = 0
+			s, ts := newTestServer(b, opts)
+			path := "/ws/batched"
+			if batch {
+				path += "?batch=1"
+			}
+			conn := dialWS(b, ts, path, nil)
+			room := waitForRoom(b, s, "batched")
+			waitForClients(b, room, 1)
+
+			const burst = 64
+			messages := make([][]byte, burst)
+			for i := range messages {
+				messages[i] = fmt.Appendf(nil, `{"seq":%d,"value":"update"}`, i)
+			}
+			b.ResetTimer()
+			for range b.N {
+				for _, message := range messages {
+					if err := s.Publish("batched", message); err != nil {
+						b.Fatal(err)
+					}
+				}
+				readLines(b, conn, burst)
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*burst), "ns/msg")
+		})
+	}
+}
+
+// BenchmarkWriteBufferPool connects 200 subscribers that are each sent the
+// retained message and then stay idle, with and without a shared write
+// buffer pool, and reports the heap they hold per connection.
+func BenchmarkWriteBufferPool(b *testing.B) {
+	const conns = 200
+	for _, pool := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pool=%t", pool), func(b *testing.B) {
+			opts := DefaultOptions()
+			opts.WriteBufferSize = 32 << 10
+			opts.WriteBufferPool = pool
+			s, ts := newTestServer(b, opts)
+			if err := s.Publish("idle", []byte("retained")); err != nil {
+				b.Fatal(err)
+			}
+			room := waitForRoom(b, s, "idle")
+
+			var held uint64
+			var before, after runtime.MemStats
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				open := make([]*websocket.Conn, conns)
+				for i := range open {
+					conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/idle", nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, _, err := conn.ReadMessage(); err != nil {
+						b.Fatal(err)
+					}
+					open[i] = conn
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				held += after.HeapInuse - before.HeapInuse
+
+				for _, conn := range open {
+					conn.Close()
+				}
+				eventually(b, "the subscribers to leave", func() bool { return room.members.Load() == 0 })
+			}
+			b.ReportMetric(float64(held)/float64(b.N*conns), "heap-B/conn")
+		})
+	}
+}
+
+func TestClientRate(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	opts.MaxClientRate = 20
+	s, ts := newTestServer(t, opts)
+
+	// The requested rate is bounded by MaxClientRate.
+	conn := dialWS(t, ts, "/ws/paced?rate=100", nil)
+	waitForClients(t, waitForRoom(t, s, "paced"), 1)
+
+	const n = 5
+	start := time.Now()
+	for i := range n {
+		if err := s.Publish("paced", []byte(fmt.Sprint("message ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readLines(t, conn, n)
+	// The first message goes out at once, the others 50ms apart.
+	if elapsed, want := time.Since(start), (n-1)*50*time.Millisecond; elapsed < want {
+		t.Errorf("received %d messages in %v, want at least %v", n, elapsed, want)
+	}
+}
+
+func TestClientRateInvalid(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	for _, rate := range []string{"fast", "0", "-1", "0.001"} {
+		if code, _ := request(t, http.MethodGet, ts.URL+"/ws/paced?rate="+rate, "", nil); code != http.StatusBadRequest {
+			t.Errorf("rate=%s: status %d, want 400", rate, code)
+		}
+	}
+	for _, rate := range []float64{-1, 0.01} {
+		opts := DefaultOptions()
+		opts.MaxClientRate = rate
+		if err := opts.validate(); err == nil {
+			t.Errorf("validate accepted a max client rate of %g", rate)
+		}
+	}
+}
+
+func TestClientRateDisconnect(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	conn := dialWS(t, ts, fmt.Sprint("/ws/paced?rate=", minClientRate), nil)
+	room := waitForRoom(t, s, "paced")
+	waitForClients(t, room, 1)
+	for _, content := range []string{"first", "second"} {
+		if err := s.Publish("paced", []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "first" {
+		t.Fatalf("received %q (%v), want the first message at once", message, err)
+	}
+
+	// The write pump waiting to send the second message notices the client
+	// leaving well before its 10s are up.
+	conn.Close()
+	eventually(t, "the write pump to exit", func() bool { return s.wsConnections.Load() == 0 })
+}
+
+func TestClientRateShutdown(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	conn := dialWS(t, ts, fmt.Sprint("/ws/paced?rate=", minClientRate), nil)
+	waitForClients(t, waitForRoom(t, s, "paced"), 1)
+	for _, content := range []string{"first", "second", "third"} {
+		if err := s.Publish("paced", []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A shutdown sends what is queued at once, then the close frame.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown := make(chan struct{})
+	go func() {
+		s.Shutdown(ctx, ts.Config)
+		close(shutdown)
+	}()
+	if got := readLines(t, conn, 2); !slices.Equal(got, []string{"second", "third"}) {
+		t.Errorf("received %q during the shutdown, want the queued messages", got)
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("after the queued messages: %v, want a going-away close", err)
+	}
+	<-shutdown
+}
+
+func TestRoomCompression(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/compressed/meta", `{"compression":true}`); code != http.StatusOK {
+		t.Fatalf("enabling compression: %d %s", code, body)
+	}
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	for room, want := range map[string]bool{"compressed": true, "plain": false} {
+		conn, res, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/"+room, nil)
+		if err != nil {
+			t.Fatalf("dialing %s: %v", room, err)
+		}
+		conn.Close()
+		if got := strings.Contains(res.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate"); got != want {
+			t.Errorf("%s negotiated permessage-deflate: %t, want %t", room, got, want)
+		}
+	}
+}
+
+func TestRequiredSubprotocol(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Subprotocol = "relay.v1"
+	_, ts := newTestServer(t, opts)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/room1"
+
+	for _, offered := range [][]string{nil, {"other"}} {
+		dialer := &websocket.Dialer{Subprotocols: offered}
+		_, res, err := dialer.Dial(url, nil)
+		if err == nil || res == nil || res.StatusCode != http.StatusBadRequest {
+			t.Errorf("offering %q: %v, want status 400", offered, err)
+		}
+	}
+
+	dialer := &websocket.Dialer{Subprotocols: []string{"other", "relay.v1"}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("offering relay.v1: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.Subprotocol(); got != "relay.v1" {
+		t.Errorf("selected subprotocol %q, want relay.v1", got)
+	}
+}
+
+// logBuffer collects a server's logs for inspection.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWelcome(t *testing.T) {
+	var logs logBuffer
+	opts := DefaultOptions()
+	opts.Welcome = true
+	opts.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	_, ts := newTestServer(t, opts)
+	conn := dialWS(t, ts, "/ws/welcome", nil)
+
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var welcome welcomeEvent
+	if err := json.Unmarshal(message, &welcome); err != nil || welcome.Type != "welcome" || welcome.ConnectionID == "" {
+		t.Fatalf("first message %s, want a welcome with a connection ID", message)
+	}
+
+	eventually(t, "the connection to be logged", func() bool {
+		return strings.Contains(logs.String(), "client="+welcome.ConnectionID)
+	})
+	code, body := admin(t, ts, http.MethodGet, "/admin/clients?ip=127.0.0.1", "")
+	if code != http.StatusOK || !strings.Contains(body, `"connection_id":"`+welcome.ConnectionID+`"`) {
+		t.Errorf("GET /admin/clients: %d %s, want connection %s", code, body, welcome.ConnectionID)
+	}
+}
+
+func TestDisabledPings(t *testing.T) {
+	for _, ping := range []bool{true, false} {
+		t.Run(fmt.Sprint("ping=", ping), func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.WSPing = ping
+			opts.WSPongTimeout = 50 * time.Millisecond
+			opts.WSReadTimeout = 200 * time.Millisecond
+			_, ts := newTestServer(t, opts)
+			conn := dialWS(t, ts, "/ws/quiet", nil)
+
+			var pings atomic.Int32
+			conn.SetPingHandler(func(data string) error {
+				pings.Add(1)
+				return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+			})
+			start := time.Now()
+			if ping {
+				// Answered pings keep the connection up.
+				conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			}
+			_, _, err := conn.ReadMessage()
+			if err == nil {
+				t.Fatal("received a message")
+			}
+
+			if ping {
+				if pings.Load() == 0 {
+					t.Error("no pings were sent")
+				}
+				return
+			}
+			if pings.Load() != 0 {
+				t.Errorf("%d pings were sent", pings.Load())
+			}
+			// The silent client is disconnected after the read timeout.
+			if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 3*time.Second {
+				t.Errorf("disconnected after %v, want about 200ms", elapsed)
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Errorf("the connection wasn't closed: %v", err)
+			}
+		})
+	}
+}
+
+func TestStatsOnJoin(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	for _, content := range []string{"one", "two"} {
+		if code, body := publish(t, ts, "stats", content, nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+	}
+	room := waitForRoom(t, s, "stats")
+	joinTestClient(t, room, 16)
+
+	before := time.Now()
+	conn := dialWS(t, ts, "/ws/stats?stats=1", nil)
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats statsEvent
+	if err := json.Unmarshal(message, &stats); err != nil || stats.Type != "stats" {
+		t.Fatalf("first message %s, want stats", message)
+	}
+	if stats.Clients != 2 || stats.Sequence != 2 || stats.LastPublish.IsZero() || stats.LastPublish.After(before) {
+		t.Errorf("stats %s, want 2 clients, sequence 2 and the time of the last publish", message)
+	}
+
+	// The retained content follows.
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "two" {
+		t.Errorf("second message %q (%v), want two", message, err)
+	}
+}
+
+// writeFrame writes a masked WebSocket frame with the given opcode and
+// payload to conn, bypassing the checks of the websocket package.
+func writeFrame(t testing.TB, conn *websocket.Conn, opcode byte, payload []byte) {
+	t.Helper()
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	default:
+		frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	// A zero mask leaves the payload as is.
+	frame = append(frame, 0, 0, 0, 0)
+	frame = append(frame, payload...)
+	if _, err := conn.NetConn().Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOversizedFramesClose(t *testing.T) {
+	var logs logBuffer
+	opts := DefaultOptions()
+	opts.MaxWSMessageSize = 512
+	opts.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	s, ts := newTestServer(t, opts)
+
+	for _, tt := range []struct {
+		name string
+		send func(*websocket.Conn)
+		code int
+	}{
+		{"message", func(conn *websocket.Conn) {
+			conn.WriteMessage(websocket.TextMessage, bytes.Repeat([]byte("x"), 1024))
+		}, websocket.CloseMessageTooBig},
+		{"ping", func(conn *websocket.Conn) {
+			writeFrame(t, conn, websocket.PingMessage, bytes.Repeat([]byte("x"), 200))
+		}, websocket.CloseProtocolError},
+		{"pong", func(conn *websocket.Conn) {
+			writeFrame(t, conn, websocket.PongMessage, bytes.Repeat([]byte("x"), 200))
+		}, websocket.CloseProtocolError},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialWS(t, ts, "/ws/frames", nil)
+			tt.send(conn)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, tt.code) {
+				t.Errorf("got %v, want a close with code %d", err, tt.code)
+			}
+		})
+	}
+
+	// The closes are routine, not logged as errors.
+	eventually(t, "the connections to close", func() bool { return s.connections.Load() == 0 })
+	if strings.Contains(logs.String(), "unexpected close") {
+		t.Errorf("logged:\n%s", logs.String())
+	}
+}
+
+func TestGzipEncoding(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	raw := dialWS(t, ts, "/ws/encoded", nil)
+	gzipped := dialWS(t, ts, "/ws/encoded?encoding=gzip", nil)
+	room := waitForRoom(t, s, "encoded")
+	waitForClients(t, room, 2)
+
+	content := strings.Repeat("compressible ", 20)
+	if code, body := publish(t, ts, "encoded", content, nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+
+	kind, message, err := raw.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != websocket.TextMessage || string(message) != content {
+		t.Errorf("raw subscriber got a frame of type %d with %q", kind, message)
+	}
+
+	kind, message, err = gzipped.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != websocket.BinaryMessage {
+		t.Errorf("gzip subscriber got a frame of type %d, want binary", kind)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(message))
+	if err != nil {
+		t.Fatalf("gzip subscriber got %q: %v", message, err)
+	}
+	decoded, err := io.ReadAll(zr)
+	if err != nil || string(decoded) != content {
+		t.Errorf("gzip subscriber's message decodes to %q (%v), want %q", decoded, err, content)
+	}
+}
+
+// stallingListener accepts connections with small send buffers, whose write
+// deadlines are brought forward to at most timeout away, so that a write to a
+// peer that stops reading times out quickly.
+type stallingListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (l stallingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	conn.(*net.TCPConn).SetWriteBuffer(4096)
+	return stallingConn{conn, l.timeout}, nil
+}
+
+type stallingConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c stallingConn) SetWriteDeadline(t time.Time) error {
+	if limit := time.Now().Add(c.timeout); !t.IsZero() && t.After(limit) {
+		t = limit
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func TestWriteTimeoutMidMessage(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxContentSize = 4 << 20
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(s.Handler())
+	ts.Listener = stallingListener{ts.Listener, 100 * time.Millisecond}
+	ts.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx, ts.Config)
+		ts.Close()
+	})
+
+	// A subscriber that doesn't read, with a small receive buffer.
+	dialer := &websocket.Dialer{NetDial: func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err == nil {
+			conn.(*net.TCPConn).SetReadBuffer(4096)
+		}
+		return conn, err
+	}}
+	conn := dialWS(t, ts, "/ws/stalled", dialer)
+	room := waitForRoom(t, s, "stalled")
+	waitForClients(t, room, 1)
+
+	if err := s.Publish("stalled", bytes.Repeat([]byte("x"), 4<<20)); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the write to time out", func() bool { return s.metrics.writeTimeouts.Load() == 1 })
+	eventually(t, "the subscriber to be unregistered", func() bool { return room.members.Load() == 0 })
+
+	// The half sent message is abandoned and the connection closed without
+	// a close frame.
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseAbnormalClosure) {
+				t.Errorf("reading the stalled message: %v, want an abnormal closure", err)
+			}
+			break
+		}
+		t.Fatal("received the whole message")
+	}
+}
+
+// recordingConn keeps a copy of the bytes read from a connection.
+type recordingConn struct {
+	net.Conn
+	mu   *sync.Mutex
+	read *bytes.Buffer
+}
+
+func (c recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.read.Write(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+// compressedMessages reports, for each data message in stream, the unmasked
+// frames a server sent after its handshake response, whether it was
+// compressed.
+func compressedMessages(t testing.TB, stream []byte) []bool {
+	t.Helper()
+	_, frames, ok := bytes.Cut(stream, []byte("\r\n\r\n"))
+	if !ok {
+		t.Fatal("no handshake response")
+	}
+	var compressed []bool
+	for len(frames) >= 2 {
+		// RSV1 on a message's first frame marks it compressed; continuation
+		// (0) and control (8 and up) frames don't start messages.
+		if opcode := frames[0] & 0x0f; opcode != 0 && opcode < 8 {
+			compressed = append(compressed, frames[0]&0x40 != 0)
+		}
+		size, header := int(frames[1]&0x7f), 2
+		switch size {
+		case 126:
+			size, header = int(binary.BigEndian.Uint16(frames[2:])), 4
+		case 127:
+			size, header = int(binary.BigEndian.Uint64(frames[2:])), 10
+		}
+		frames = frames[header+size:]
+	}
+	return compressed
+}
+
+func TestCompressionPerMessage(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Compression = true
+	opts.CompressionMinSize = 1024
+	opts.CompressBinary = false
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+
+	var mu sync.Mutex
+	var read bytes.Buffer
+	dialer := &websocket.Dialer{
+		EnableCompression: true,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			return recordingConn{Conn: conn, mu: &mu, read: &read}, err
+		},
+	}
+	conn := dialWS(t, ts, "/ws/mixed", dialer)
+	room := waitForRoom(t, s, "mixed")
+	waitForClients(t, room, 1)
+
+	messages := []struct {
+		name    string
+		message []byte
+		want    bool
+	}{
+		{"small binary", []byte{0xff, 0xfe, 0x00, 0x01}, false},
+		{"large text", benchmarkDocument(4096, 0), true},
+		{"small text", []byte(`{"status":"ok"}`), false},
+		{"large binary", append([]byte{0xff}, benchmarkDocument(4096, 1)...), false},
+	}
+	for _, m := range messages {
+		if err := s.Publish("mixed", m.message); err != nil {
+			t.Fatal(err)
+		}
+		if _, got, err := conn.ReadMessage(); err != nil || !bytes.Equal(got, m.message) {
+			t.Fatalf("%s: received %.20q (%v)", m.name, got, err)
+		}
+	}
+
+	mu.Lock()
+	compressed := compressedMessages(t, read.Bytes())
+	mu.Unlock()
+	if len(compressed) != len(messages) {
+		t.Fatalf("%d messages on the wire, want %d", len(compressed), len(messages))
+	}
+	for i, m := range messages {
+		if compressed[i] != m.want {
+			t.Errorf("%s compressed: %t, want %t", m.name, compressed[i], m.want)
+		}
+	}
+}
+
+func TestRoomCompressionLevel(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	for room, level := range map[string]int{"fast": flate.BestSpeed, "small": flate.BestCompression} {
+		meta := fmt.Sprintf(`{"compression":true,"compression_level":%d}`, level)
+		if code, body := admin(t, ts, http.MethodPut, "/api/rooms/"+room, meta); code != http.StatusCreated {
+			t.Fatalf("creating %s: %d %s", room, code, body)
+		}
+	}
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/fast/meta", `{"compression_level":10}`); code != http.StatusBadRequest {
+		t.Errorf("an invalid level: %d %s, want 400", code, body)
+	}
+
+	document := benchmarkDocument(64<<10, 0)
+	wire := make(map[string]int64)
+	for _, room := range []string{"fast", "small"} {
+		var read atomic.Int64
+		dialer := &websocket.Dialer{
+			EnableCompression: true,
+			NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+				return countingConn{Conn: conn, read: &read}, err
+			},
+		}
+		conn, res, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/"+room, nil)
+		if err != nil {
+			t.Fatalf("dialing %s: %v", room, err)
+		}
+		defer conn.Close()
+		if !strings.Contains(res.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+			t.Errorf("%s didn't negotiate compression", room)
+		}
+		r := waitForRoom(t, s, room)
+		waitForClients(t, r, 1)
+
+		handshake := read.Load()
+		if err := s.Publish(room, document); err != nil {
+			t.Fatal(err)
+		}
+		if _, message, err := conn.ReadMessage(); err != nil || !bytes.Equal(message, document) {
+			t.Fatalf("%s: received %d bytes (%v), want the document", room, len(message), err)
+		}
+		wire[room] = read.Load() - handshake
+	}
+	if wire["small"] >= wire["fast"] || wire["fast"] >= int64(len(document)) {
+		t.Errorf("%d bytes on the wire at the best compression and %d at the best speed, for %d bytes", wire["small"], wire["fast"], len(document))
+	}
+}
+
+func TestAutoDetectFrameType(t *testing.T) {
+	text, binary := []byte("héllo, text"), []byte{0xff, 0xfe, 0x00, 0x01}
+	for _, autoDetect := range []bool{true, false} {
+		opts := DefaultOptions()
+		opts.AutoDetectFrameType = autoDetect
+		opts.PublishRate = 0
+		s, ts := newTestServer(t, opts)
+		conn := dialWS(t, ts, "/ws/frames", nil)
+		room := waitForRoom(t, s, "frames")
+		waitForClients(t, room, 1)
+
+		wantText := websocket.BinaryMessage
+		if autoDetect {
+			wantText = websocket.TextMessage
+		}
+		for _, tt := range []struct {
+			message []byte
+			want    int
+		}{
+			{text, wantText},
+			{binary, websocket.BinaryMessage},
+		} {
+			if err := s.Publish("frames", tt.message); err != nil {
+				t.Fatal(err)
+			}
+			messageType, got, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if messageType != tt.want || !bytes.Equal(got, tt.message) {
+				t.Errorf("auto-detect %t: %q delivered as %q in frame type %d, want type %d", autoDetect, tt.message, got, messageType, tt.want)
+			}
+		}
+	}
+}
+
+func TestWSPongTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	opts := DefaultOptions()
+	opts.WSPongTimeout = timeout
+	s, ts := newTestServer(t, opts)
+
+	// Reading answers pings, so a subscriber that reads stays connected.
+	responsive := dialWS(t, ts, "/ws/pinged", nil)
+	go func() {
+		for {
+			if _, _, err := responsive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	// This one swallows the pings without answering them.
+	silent := dialWS(t, ts, "/ws/pinged", nil)
+	var pings atomic.Int64
+	silent.SetPingHandler(func(string) error {
+		pings.Add(1)
+		return nil
+	})
+	room := waitForRoom(t, s, "pinged")
+	waitForClients(t, room, 2)
+
+	start := time.Now()
+	silent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := silent.ReadMessage(); err == nil {
+		t.Fatal("the silent subscriber received a message")
+	}
+	if elapsed := time.Since(start); elapsed > timeout+time.Second {
+		t.Errorf("the silent subscriber was disconnected after %v, want about %v", elapsed, timeout)
+	}
+	if pings.Load() == 0 {
+		t.Error("the silent subscriber got no pings")
+	}
+	waitForClients(t, room, 1)
+
+	opts.WSPongTimeout = 0
+	if err := opts.validate(); err == nil {
+		t.Error("validate accepted a pong timeout of 0")
+	}
+}
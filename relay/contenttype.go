@@ -0,0 +1,51 @@
+package relay
+
+import (
+	"mime"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	contentTypeText   = "text/plain; charset=utf-8"
+	contentTypeBinary = "application/octet-stream"
+)
+
+// publishContentType returns the content type of a publish's content: the
+// request's Content-Type for a body, which defaults to binary, and text or
+// binary according to the content otherwise.
+func publishContentType(r *http.Request, content []byte, fromBody bool) string {
+	if fromBody {
+		if contentType := r.Header.Get("Content-Type"); contentType != "" {
+			return contentType
+		}
+		return contentTypeBinary
+	}
+	if utf8.Valid(content) {
+		return contentTypeText
+	}
+	return contentTypeBinary
+}
+
+// frameContentType returns the content type of a message a WebSocket client
+// sent in a frame of the given type.
+func frameContentType(messageType int) string {
+	if messageType == websocket.TextMessage {
+		return contentTypeText
+	}
+	return contentTypeBinary
+}
+
+// retainsContentType reports whether the room retains content of the given
+// type: any if it has no retain_content_type, and otherwise content of that
+// media type, whatever its parameters.
+func (r *Room) retainsContentType(contentType string) bool {
+	allowed := r.retainContentType.Load()
+	if allowed == nil || *allowed == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == *allowed
+}
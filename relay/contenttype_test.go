@@ -0,0 +1,43 @@
+package relay
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRetainContentType(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	if code, body := publish(t, ts, "status", "open", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/status/meta", `{"retain_content_type":"not a type/"}`); code != http.StatusBadRequest {
+		t.Errorf("setting an invalid type: %d %s, want 400", code, body)
+	}
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/status/meta", `{"retain_content_type":"application/json"}`); code != http.StatusOK {
+		t.Fatalf("setting retain_content_type: %d %s", code, body)
+	}
+	conn := dialWS(t, ts, "/ws/status", nil)
+	conn.ReadMessage()
+
+	status := `{"status":"ok"}`
+	for _, tt := range []struct {
+		content, contentType string
+	}{
+		// Parameters of the media type don't matter.
+		{status, "application/json; charset=utf-8"},
+		{"\x00\x01", "application/octet-stream"},
+		{"plain", "text/plain"},
+	} {
+		code, body := request(t, http.MethodPost, ts.URL+"/status", tt.content, http.Header{"Content-Type": {tt.contentType}})
+		if code != http.StatusOK {
+			t.Fatalf("publish %s: %d %s", tt.contentType, code, body)
+		}
+		// Content that isn't retained is still broadcast.
+		if _, message, err := conn.ReadMessage(); err != nil || string(message) != tt.content {
+			t.Errorf("received %q (%v), want the %s content", message, err, tt.contentType)
+		}
+	}
+	if got := latest(t, ts, "status"); got != status {
+		t.Errorf("latest = %q, want only the JSON retained", got)
+	}
+}
@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maxDedupKeyLength bounds the length of a publish's dedup key.
+	maxDedupKeyLength = 256
+
+	// maxDedupKeys bounds the dedup keys a room remembers; the oldest are
+	// forgotten early beyond it.
+	maxDedupKeys = 10000
+)
+
+// DedupKeys holds the dedup keys recently published to a room.
+type DedupKeys struct {
+	seen map[string]time.Time
+	// order holds the keys in seen, oldest first. Keys are all remembered for
+	// the same window, so they also expire in this order.
+	order []dedupEntry
+	// window is how long keys are remembered.
+	window time.Duration
+	mu     sync.Mutex
+}
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+func newDedupKeys(window time.Duration) *DedupKeys {
+	return &DedupKeys{
+		seen:   make(map[string]time.Time),
+		window: window,
+	}
+}
+
+// add records a publish with key and reports whether it is new, false if the
+// key was already published within the window.
+func (d *DedupKeys) add(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for len(d.order) > 0 && (now.Sub(d.order[0].seen) > d.window || len(d.order) >= maxDedupKeys) {
+		d.forget(d.order[0])
+		d.order = d.order[1:]
+	}
+
+	if _, ok := d.seen[key]; ok {
+		return false
+	}
+	d.seen[key] = now
+	d.order = append(d.order, dedupEntry{key: key, seen: now})
+	return true
+}
+
+// remove forgets key, for a publish that failed after it was added. Publishes
+// without a dedup key may call it with the empty key, which is never added.
+func (d *DedupKeys) remove(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.seen, key)
+}
+
+// forget removes e's key from seen unless the key was removed and added again
+// since, in which case a later entry in order belongs to it.
+func (d *DedupKeys) forget(e dedupEntry) {
+	if t, ok := d.seen[e.key]; ok && t.Equal(e.seen) {
+		delete(d.seen, e.key)
+	}
+}
@@ -0,0 +1,68 @@
+package relay
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupKeys(t *testing.T) {
+	d := newDedupKeys(50 * time.Millisecond)
+	if !d.add("a") || !d.add("b") {
+		t.Fatal("new keys were reported as duplicates")
+	}
+	if d.add("a") {
+		t.Error("a repeated key was reported as new")
+	}
+
+	// A removed key can be added again, and its old entry expiring doesn't
+	// forget the new one.
+	d.remove("b")
+	time.Sleep(30 * time.Millisecond)
+	if !d.add("b") {
+		t.Error("a removed key was reported as a duplicate")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !d.add("a") {
+		t.Error("a key was remembered past the window")
+	}
+	if d.add("b") {
+		t.Error("a re-added key was forgotten with its old entry")
+	}
+}
+
+func TestPublishDedupKey(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxContentSize = 16
+	s, ts := newTestServer(t, opts)
+	if code, body := publish(t, ts, "idempotent", "open", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	room := waitForRoom(t, s, "idempotent")
+	client := joinTestClient(t, room, 16)
+	received(client)
+
+	for _, tt := range []struct {
+		content, key string
+		want         int
+	}{
+		{"first", "k1", http.StatusOK},
+		{"first retried", "k1", http.StatusOK},
+		{"second", "k2", http.StatusOK},
+		// A failed publish doesn't use up its key.
+		{strings.Repeat("x", 17), "k3", http.StatusRequestEntityTooLarge},
+		{"third", "k3", http.StatusOK},
+	} {
+		code, body := publish(t, ts, "idempotent", tt.content, url.Values{"dedup_key": {tt.key}})
+		if code != tt.want {
+			t.Errorf("publish %q with key %s: %d %s, want %d", tt.content, tt.key, code, body, tt.want)
+		}
+	}
+	room.do(func() {})
+	if got, want := received(client), []string{"first", "second", "third"}; !slices.Equal(got, want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+}
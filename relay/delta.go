@@ -0,0 +1,112 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+)
+
+// deltaEvent is what delta subscribers receive in place of a JSON object
+// that differs from the previous message in a few members.
+type deltaEvent struct {
+	Type string `json:"type"`
+	// Patch is the JSON merge patch (RFC 7386) that turns the previous
+	// message into this one.
+	Patch map[string]any `json:"patch"`
+}
+
+// deltaMessage returns p's message for fan-out, along with what delta
+// subscribers need to be sent the difference from the room's previous message
+// instead. It must be called on the room's goroutine for every message
+// fanned out in publish order, after p has been recorded.
+func (r *Room) deltaMessage(p publication) *encodedMessage {
+	m := &encodedMessage{raw: p.out, envelope: p.envelope, eventID: p.seq, topic: p.topic, content: p.message, seq: r.sequence}
+	if r.deltaSeq != 0 {
+		m.base, m.baseSeq = r.deltaBase, r.deltaSeq
+	}
+	r.deltaBase, r.deltaSeq = p.message, r.sequence
+	return m
+}
+
+// resetDelta makes the next message go to delta subscribers in full, after
+// messages that not every subscriber received in publish order. It must be
+// called on the room's goroutine.
+func (r *Room) resetDelta() {
+	r.deltaBase, r.deltaSeq = nil, 0
+}
+
+// encodeDelta returns the delta event that turns base into message, or nil
+// if they aren't both JSON objects, message can't be expressed as a merge
+// patch (merge patches can't set members to null) or the event wouldn't be
+// smaller than message.
+func encodeDelta(base, message []byte) []byte {
+	from, ok := decodeObject(base)
+	if !ok {
+		return nil
+	}
+	to, ok := decodeObject(message)
+	if !ok || hasNullMember(to) {
+		return nil
+	}
+	event, _ := json.Marshal(deltaEvent{Type: "delta", Patch: mergePatch(from, to)})
+	if len(event) >= len(message) {
+		return nil
+	}
+	return event
+}
+
+// decodeObject decodes b if it is a JSON object, keeping numbers as written.
+func decodeObject(b []byte) (map[string]any, bool) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var object map[string]any
+	if err := d.Decode(&object); err != nil || object == nil || d.More() {
+		return nil, false
+	}
+	return object, true
+}
+
+// hasNullMember reports whether object or any object nested in its members
+// has a null member.
+func hasNullMember(object map[string]any) bool {
+	for _, v := range object {
+		switch v := v.(type) {
+		case nil:
+			return true
+		case map[string]any:
+			if hasNullMember(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mergePatch returns the JSON merge patch that turns from into to: removed
+// members are set to null, nested objects are patched recursively and other
+// changed members, including arrays, are replaced.
+func mergePatch(from, to map[string]any) map[string]any {
+	patch := make(map[string]any)
+	for k := range from {
+		if _, ok := to[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	for k, v := range to {
+		old, ok := from[k]
+		switch {
+		case !ok:
+			patch[k] = v
+		case reflect.DeepEqual(old, v):
+		default:
+			oldObject, oldIsObject := old.(map[string]any)
+			object, isObject := v.(map[string]any)
+			if oldIsObject && isObject {
+				patch[k] = mergePatch(oldObject, object)
+			} else {
+				patch[k] = v
+			}
+		}
+	}
+	return patch
+}
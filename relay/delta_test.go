@@ -0,0 +1,118 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// applyMergePatch applies the JSON merge patch patch to target.
+func applyMergePatch(target, patch map[string]any) {
+	for k, v := range patch {
+		switch v := v.(type) {
+		case nil:
+			delete(target, k)
+		case map[string]any:
+			object, ok := target[k].(map[string]any)
+			if !ok {
+				object = make(map[string]any)
+				target[k] = object
+			}
+			applyMergePatch(object, v)
+		default:
+			target[k] = v
+		}
+	}
+}
+
+func TestDeltaSubscriber(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	const base = `{"name":"sensor-1","location":{"building":"north","floor":3},"reading":20,"unit":"celsius","status":"ok"}`
+	if code, body := publish(t, ts, "state", base, nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	deltas, full := dialWS(t, ts, "/ws/state?delta=1", nil), dialWS(t, ts, "/ws/state", nil)
+	room := waitForRoom(t, s, "state")
+	waitForClients(t, room, 2)
+
+	// Both start from the retained message.
+	var state map[string]any
+	if err := deltas.ReadJSON(&state); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := full.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	sentDeltas := 0
+	for _, update := range []string{
+		`{"name":"sensor-1","location":{"building":"north","floor":3},"reading":21,"unit":"celsius","status":"ok"}`,
+		`{"name":"sensor-1","location":{"building":"north","floor":4},"reading":21,"unit":"celsius"}`,
+		`{"name":"sensor-1","location":{"building":"north","floor":4},"reading":22,"unit":"celsius","status":"alarm"}`,
+		// Not an object, so sent in full; the next delta is against it.
+		`[1,2,3]`,
+		`{"name":"sensor-1","reading":23}`,
+	} {
+		if code, body := publish(t, ts, "state", update, nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+		_, message, err := full.ReadMessage()
+		if err != nil || string(message) != update {
+			t.Fatalf("full subscriber received %s (%v), want %s", message, err, update)
+		}
+
+		_, message, err = deltas.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var delta deltaEvent
+		if json.Unmarshal(message, &delta) == nil && delta.Type == "delta" {
+			sentDeltas++
+			applyMergePatch(state, delta.Patch)
+		} else {
+			state = nil
+			json.Unmarshal(message, &state)
+		}
+		var want map[string]any
+		json.Unmarshal([]byte(update), &want)
+		if !reflect.DeepEqual(state, want) {
+			t.Errorf("delta subscriber reconstructed %v from %s, want %s", state, message, update)
+		}
+	}
+	if sentDeltas != 3 {
+		t.Errorf("%d deltas sent, want 3", sentDeltas)
+	}
+}
+
+func TestEncodeDelta(t *testing.T) {
+	const base = `{"a":"a long enough value","b":{"c":1,"d":2},"e":[1,2,3]}`
+	for _, tt := range []struct {
+		message string
+		want    string
+	}{
+		{`{"a":"a long enough value","b":{"c":1,"d":3},"e":[1,2,3]}`, `{"patch":{"b":{"d":3}},"type":"delta"}`},
+		{`{"a":"a long enough value","b":{"c":1},"e":[1,2,3],"f":true}`, `{"patch":{"b":{"d":null},"f":true},"type":"delta"}`},
+		// Merge patches can't set members to null.
+		{`{"a":"a long enough value","b":{"c":1,"d":null},"e":[1,2,3]}`, ""},
+		// A patch that isn't smaller than the message.
+		{`{"x":1}`, ""},
+		{`"not an object"`, ""},
+	} {
+		got := encodeDelta([]byte(base), []byte(tt.message))
+		if tt.want == "" {
+			if got != nil {
+				t.Errorf("delta to %s = %s, want none", tt.message, got)
+			}
+			continue
+		}
+		var gotJSON, wantJSON any
+		json.Unmarshal(got, &gotJSON)
+		json.Unmarshal([]byte(tt.want), &wantJSON)
+		if !reflect.DeepEqual(gotJSON, wantJSON) {
+			t.Errorf("delta to %s = %s, want %s", tt.message, got, tt.want)
+		}
+	}
+}
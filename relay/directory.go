@@ -0,0 +1,51 @@
+package relay
+
+import (
+	"encoding/json"
+)
+
+// directoryRoomName is the reserved name under which subscribers get a live
+// feed of room lifecycle events instead of a room's messages: /ws/__rooms__
+const directoryRoomName = "__rooms__"
+
+// directoryEvent describes a change to the set of rooms or their subscribers.
+type directoryEvent struct {
+	// Type is room_created, room_clients or room_deleted.
+	Type    string `json:"type"`
+	Room    string `json:"room"`
+	Clients int    `json:"clients"`
+}
+
+// directoryRoom returns the room that directory events are broadcast to. It
+// is not managed by the room manager, so it can't be deleted or looked up by
+// name.
+func (s *Server) directoryRoom() *Room {
+	s.directory.once.Do(func() {
+		s.directory.room = newRoom(s, directoryRoomName)
+		go s.directory.room.run()
+	})
+	return s.directory.room
+}
+
+// subscriptionRoom returns the room a subscriber of roomID joins.
+func (s *Server) subscriptionRoom(roomID string) (*Room, error) {
+	if roomID == directoryRoomName {
+		return s.directoryRoom(), nil
+	}
+	return s.rooms.openRoom(roomID)
+}
+
+// announce broadcasts event to the directory's current subscribers.
+func (s *Server) announce(event directoryEvent) {
+	message, _ := json.Marshal(event)
+	s.directoryRoom().publishToCurrent(message, "")
+}
+
+// announceClients announces the room's subscriber count. It must be called
+// on the room's goroutine.
+func (r *Room) announceClients() {
+	if r.name == directoryRoomName {
+		return
+	}
+	r.srv.announce(directoryEvent{Type: "room_clients", Room: r.name, Clients: len(r.clients)})
+}
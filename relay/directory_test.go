@@ -0,0 +1,64 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// nextDirectoryEvent reads directory events from conn until one about room.
+func nextDirectoryEvent(t testing.TB, conn *websocket.Conn, room string) directoryEvent {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for an event about %s: %v", room, err)
+		}
+		var event directoryEvent
+		if err := json.Unmarshal(message, &event); err != nil {
+			t.Fatalf("malformed directory event %s: %v", message, err)
+		}
+		if event.Room == room {
+			return event
+		}
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	directory := dialWS(t, ts, "/ws/"+directoryRoomName, nil)
+	waitForClients(t, s.directoryRoom(), 1)
+
+	if code, body := publish(t, ts, "lobby", "hello", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if event := nextDirectoryEvent(t, directory, "lobby"); event.Type != "room_created" {
+		t.Errorf("first event %+v, want room_created", event)
+	}
+
+	dialWS(t, ts, "/ws/lobby", nil)
+	if event := nextDirectoryEvent(t, directory, "lobby"); event.Type != "room_clients" || event.Clients != 1 {
+		t.Errorf("event %+v, want room_clients with 1 client", event)
+	}
+
+	if code, body := admin(t, ts, http.MethodDelete, "/api/rooms/lobby?grace=0s", ""); code != http.StatusAccepted {
+		t.Fatalf("DELETE: %d %s", code, body)
+	}
+	// The subscriber leaving may be announced first.
+	for nextDirectoryEvent(t, directory, "lobby").Type != "room_deleted" {
+	}
+}
+
+func TestDirectoryReserved(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	if code, _ := publish(t, ts, directoryRoomName, "spoofed", nil); code != http.StatusForbidden {
+		t.Errorf("publishing to the directory: status %d, want 403", code)
+	}
+	if code, _ := admin(t, ts, http.MethodDelete, "/api/rooms/"+directoryRoomName, ""); code == http.StatusAccepted {
+		t.Error("the directory was deleted")
+	}
+}
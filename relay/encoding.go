@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"sync"
+)
+
+// encodingGzip is the application-level encoding subscribers can ask for with
+// ?encoding=gzip. Unlike permessage-deflate it is visible to the application,
+// which receives every message as a gzip stream in a binary frame.
+const encodingGzip = "gzip"
+
+// encodedMessage caches the variants of a message during its fan-out, so
+// each is computed at most once however many subscribers ask for it.
+type encodedMessage struct {
+	raw []byte
+	// envelope is the envelope of a published message, for subscribers that
+	// asked for one when raw isn't already wrapped in it.
+	envelope *envelope
+	// eventID is the sequence number of a published message, which SSE
+	// subscribers get as the event's ID, or zero for events and unnumbered
+	// messages.
+	eventID uint64
+	// topic is the topic a published message was tagged with, if any.
+	topic string
+
+	// content is the published message raw is made from, seq its sequence
+	// number, and base the message delta subscribers were sent before it,
+	// with its sequence number baseSeq. seq is zero for messages that don't
+	// change delta subscribers' state, and baseSeq zero if there is no base.
+	content []byte
+	seq     uint64
+	base    []byte
+	baseSeq uint64
+
+	mu       sync.Mutex
+	variants map[variant][]byte
+}
+
+// variant is the form in which a client receives messages: the template they
+// are rendered with, their encoding, whether it is a delta or enveloped, and
+// whether it is framed as an SSE event.
+type variant struct {
+	template string
+	encoding string
+	delta    bool
+	envelope bool
+	sse      bool
+}
+
+// forClient returns the message in the form the client asked for. Delta
+// clients get a delta if they hold the message's base, and the full message
+// otherwise.
+func (m *encodedMessage) forClient(c *Client) []byte {
+	key := variant{template: c.template, encoding: c.encoding, sse: c.sse}
+	key.envelope = c.envelope && m.envelope != nil && !c.room.srv.opts.Envelope
+	if c.delta && m.seq != 0 {
+		key.delta = m.baseSeq != 0 && c.deltaSeq == m.baseSeq
+		c.deltaSeq = m.seq
+	}
+	if key == (variant{}) {
+		return m.raw
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.variants[key]
+	if !ok {
+		message := m.raw
+		if key.envelope {
+			message = m.envelope.marshal()
+		}
+		if key.delta {
+			if delta := encodeDelta(m.base, m.content); delta != nil {
+				message = delta
+			}
+		}
+		b = c.encodeEvent(message, m.eventID)
+		if m.variants == nil {
+			m.variants = make(map[variant][]byte)
+		}
+		m.variants[key] = b
+	}
+	return b
+}
+
+// encode returns message in the form the client asked for, for messages sent
+// to this client alone.
+func (c *Client) encode(message []byte) []byte {
+	return c.encodeEvent(message, 0)
+}
+
+// encodeEvent is encode for a message with the given event ID, for SSE
+// subscribers, or zero if it has none.
+func (c *Client) encodeEvent(message []byte, id uint64) []byte {
+	if c.template != "" {
+		message = c.room.srv.render(c.template, message)
+	}
+	if c.encoding == encodingGzip {
+		message = gzipBytes(message)
+	}
+	if c.sse {
+		message = sseEvent(message, id)
+	}
+	return message
+}
+
+// gzipBytes returns the gzip compression of b.
+func gzipBytes(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,24 @@
+package relay
+
+import "testing"
+
+func TestEncodedMessageVariantsAreShared(t *testing.T) {
+	s, _ := newTestServer(t, DefaultOptions())
+	room, err := s.rooms.openRoom("variants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := &Client{room: room}
+	gzip1 := &Client{room: room, encoding: encodingGzip}
+	gzip2 := &Client{room: room, encoding: encodingGzip}
+
+	m := &encodedMessage{raw: []byte("hello")}
+	if got := m.forClient(plain); &got[0] != &m.raw[0] {
+		t.Error("a plain subscriber didn't get the raw message")
+	}
+	// The gzip encoding is computed once for every subscriber asking for it.
+	a, b := m.forClient(gzip1), m.forClient(gzip2)
+	if &a[0] != &b[0] {
+		t.Error("the message was compressed for each gzip subscriber")
+	}
+}
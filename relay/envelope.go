@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// envelopeSubprotocol is the WebSocket subprotocol a subscriber can offer to
+// have messages wrapped in envelopes without Envelope. The version names
+// the envelope's format.
+const envelopeSubprotocol = "relay.envelope.v1"
+
+// envelope is the JSON object published messages are wrapped in for
+// subscribers with Envelope, or that asked for one.
+type envelope struct {
+	Room string `json:"room"`
+	// TS is when the message was published, in Unix milliseconds.
+	TS int64 `json:"ts"`
+	// Seq is the message's number among those published to the room,
+	// omitted for messages that aren't numbered, such as publishes to the
+	// current audience.
+	Seq uint64 `json:"seq,omitempty"`
+	// Sender is the connection ID of the WebSocket subscriber that published
+	// the message with WSPublish, omitted for messages published over HTTP.
+	Sender  string `json:"sender,omitempty"`
+	Content string `json:"content"`
+	// Encoding is "base64" when Content is binary content in base64.
+	Encoding string `json:"encoding,omitempty"`
+	// Type is, with EnvelopeTypes, "snapshot" for the retained messages
+	// replayed to a joining subscriber and "update" for live ones.
+	Type string `json:"type,omitempty"`
+}
+
+// envelop returns the envelope message is wrapped in, given its sequence
+// number, publish time and sender. replayed is whether it is being replayed
+// to a joining subscriber rather than broadcast live.
+func (r *Room) envelop(message []byte, seq uint64, publishedAt time.Time, sender string, replayed bool) *envelope {
+	e := &envelope{Room: r.name, TS: publishedAt.UnixMilli(), Seq: seq, Sender: sender, Content: string(message)}
+	if !utf8.Valid(message) {
+		e.Content = base64.StdEncoding.EncodeToString(message)
+		e.Encoding = "base64"
+	}
+	if r.srv.opts.EnvelopeTypes {
+		e.Type = "update"
+		if replayed {
+			e.Type = "snapshot"
+		}
+	}
+	return e
+}
+
+// marshal returns the envelope as sent to subscribers.
+func (e *envelope) marshal() []byte {
+	wrapped, _ := json.Marshal(e)
+	return wrapped
+}
+
+// wrap returns the message of e as sent to the room's subscribers: with
+// Envelope, wrapped in e, and otherwise unchanged.
+func (r *Room) wrap(message []byte, e *envelope) []byte {
+	if !r.srv.opts.Envelope {
+		return message
+	}
+	return e.marshal()
+}
+
+// wantsEnvelope reports whether a subscriber asked for messages in envelopes,
+// with ?envelope=1 or, over WebSocket, by offering envelopeSubprotocol.
+func wantsEnvelope(r *http.Request) bool {
+	return r.URL.Query().Get("envelope") == "1" || slices.Contains(websocket.Subprotocols(r), envelopeSubprotocol)
+}
@@ -0,0 +1,150 @@
+package relay
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readEnvelope reads a message from conn and decodes it as an envelope.
+func readEnvelope(t testing.TB, conn *websocket.Conn) envelope {
+	t.Helper()
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e envelope
+	if err := json.Unmarshal(message, &e); err != nil {
+		t.Fatalf("received %q, want an envelope: %v", message, err)
+	}
+	return e
+}
+
+func TestEnvelope(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Envelope = true
+	s, ts := newTestServer(t, opts)
+	conn := dialWS(t, ts, "/ws/wrapped", nil)
+	room := waitForRoom(t, s, "wrapped")
+	waitForClients(t, room, 1)
+
+	before := time.Now()
+	if code, body := publish(t, ts, "wrapped", "hello", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	binary := []byte{0xff, 0x00, 0xfe}
+	query := url.Values{"content_b64": {base64.StdEncoding.EncodeToString(binary)}, "binary": {"1"}}
+	if code, body := request(t, http.MethodPost, ts.URL+"/wrapped?"+query.Encode(), "", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+
+	text := readEnvelope(t, conn)
+	if text.Room != "wrapped" || text.Content != "hello" || text.Encoding != "" || text.Seq == 0 {
+		t.Errorf("text envelope %+v", text)
+	}
+	if ts := time.UnixMilli(text.TS); ts.Before(before.Truncate(time.Millisecond)) || ts.After(time.Now()) {
+		t.Errorf("envelope timestamp %v, want the time of the publish", ts)
+	}
+	// Binary content is base64-encoded so that the envelope is valid JSON.
+	bin := readEnvelope(t, conn)
+	if bin.Encoding != "base64" || bin.Content != base64.StdEncoding.EncodeToString(binary) {
+		t.Errorf("binary envelope %+v", bin)
+	}
+	if bin.Seq != text.Seq+1 {
+		t.Errorf("sequence numbers %d then %d, want consecutive ones", text.Seq, bin.Seq)
+	}
+
+	// Joining subscribers get the retained content in its envelope.
+	if e := readEnvelope(t, dialWS(t, ts, "/ws/wrapped", nil)); e.Seq != bin.Seq || e.Encoding != "base64" {
+		t.Errorf("replayed envelope %+v, want the last one", e)
+	}
+}
+
+func TestEnvelopeOff(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	raw := dialWS(t, ts, "/ws/plain", nil)
+	wrapped := dialWS(t, ts, "/ws/plain?envelope=1", nil)
+	room := waitForRoom(t, s, "plain")
+	waitForClients(t, room, 2)
+	if code, body := publish(t, ts, "plain", `{"a":1}`, nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if _, message, err := raw.ReadMessage(); err != nil || string(message) != `{"a":1}` {
+		t.Errorf("received %q (%v), want the content unchanged", message, err)
+	}
+	// Subscribers may still ask for envelopes.
+	if e := readEnvelope(t, wrapped); e.Content != `{"a":1}` || e.Room != "plain" {
+		t.Errorf("envelope %+v", e)
+	}
+}
+
+func TestEnvelopeTypes(t *testing.T) {
+	opts := DefaultOptions()
+	opts.EnvelopeTypes = true
+	s, ts := newTestServer(t, opts)
+	if code, body := publish(t, ts, "typed", "initial", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	conn := dialWS(t, ts, "/ws/typed?envelope=1", nil)
+	if e := readEnvelope(t, conn); e.Type != "snapshot" || e.Content != "initial" {
+		t.Errorf("first message %+v, want the retained content as a snapshot", e)
+	}
+	room := waitForRoom(t, s, "typed")
+	waitForClients(t, room, 1)
+
+	for _, content := range []string{"live 1", "live 2"} {
+		if code, body := publish(t, ts, "typed", content, nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+		if e := readEnvelope(t, conn); e.Type != "update" || e.Content != content {
+			t.Errorf("live message %+v, want %q as an update", e, content)
+		}
+	}
+
+	// Subscribers that didn't ask for envelopes get the content as is.
+	if _, message, err := dialWS(t, ts, "/ws/typed", nil).ReadMessage(); err != nil || string(message) != "live 2" {
+		t.Errorf("plain subscriber received %q (%v), want the bare content", message, err)
+	}
+}
+
+func TestEnvelopeSubprotocol(t *testing.T) {
+	opts := DefaultOptions()
+	opts.WSPublish = true
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	wrapped := dialWS(t, ts, "/ws/chat", &websocket.Dialer{Subprotocols: []string{"other.v1", envelopeSubprotocol}})
+	if got := wrapped.Subprotocol(); got != envelopeSubprotocol {
+		t.Errorf("negotiated subprotocol %q, want %q", got, envelopeSubprotocol)
+	}
+	sender := dialWS(t, ts, "/ws/chat?echo=0", nil)
+	room := waitForRoom(t, s, "chat")
+	waitForClients(t, room, 2)
+	var senderID string
+	room.do(func() {
+		for client := range room.clients {
+			if !client.envelope {
+				senderID = client.id
+			}
+		}
+	})
+
+	// Envelopes name the subscriber that published the message, and carry
+	// no sender for publishes over HTTP.
+	if err := sender.WriteMessage(websocket.TextMessage, []byte("from a subscriber")); err != nil {
+		t.Fatal(err)
+	}
+	if e := readEnvelope(t, wrapped); e.Content != "from a subscriber" || e.Sender != senderID || senderID == "" {
+		t.Errorf("envelope %+v, want sender %q", e, senderID)
+	}
+	if code, body := publish(t, ts, "chat", "from HTTP", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if e := readEnvelope(t, wrapped); e.Content != "from HTTP" || e.Sender != "" {
+		t.Errorf("envelope %+v, want no sender", e)
+	}
+}
@@ -0,0 +1,157 @@
+package relay
+
+import (
+	"runtime"
+	"time"
+)
+
+// fanOutShard is a share of a room's clients that a worker goroutine of its
+// own enqueues messages for in parallel fan-outs. Its clients are only
+// modified on the room's goroutine, between fan-outs.
+type fanOutShard struct {
+	clients []*Client
+	jobs    chan fanOutJob
+}
+
+// fanOutJob is a message for a shard's worker to enqueue for the shard's
+// clients. The worker sends the clients whose send buffer was full on done.
+type fanOutJob struct {
+	m     *encodedMessage
+	skip  *Client
+	picks map[*Client]bool
+	now   time.Time
+	done  chan<- []*Client
+}
+
+// run enqueues the messages of the shard's jobs until the shard is stopped.
+func (sh *fanOutShard) run() {
+	for job := range sh.jobs {
+		var slow []*Client
+		for _, client := range sh.clients {
+			if client == job.skip || !receives(client, job.m.topic, job.picks) {
+				continue
+			}
+			if !client.enqueue(job.m.forClient(client), job.now) {
+				slow = append(slow, client)
+			}
+		}
+		job.done <- slow
+	}
+}
+
+// parallel reports whether the room's broadcasts are fanned out in parallel,
+// as the room asks for it or has at least FanOutThreshold clients. A single
+// worker would only take over the room goroutine's work while it waits, so
+// with one, as with one CPU and no FanOutWorkers, rooms fan out themselves.
+// It must be called on the room's goroutine.
+func (r *Room) parallel() bool {
+	if r.srv.fanOutWorkers() < 2 {
+		return false
+	}
+	threshold := r.srv.opts.FanOutThreshold
+	return r.parallelFanOut.Load() || (threshold > 0 && len(r.clients) >= threshold)
+}
+
+// fanOutWorkers returns the number of workers rooms fan out with in
+// parallel: FanOutWorkers, or one per CPU.
+func (s *Server) fanOutWorkers() int {
+	if s.opts.FanOutWorkers > 0 {
+		return s.opts.FanOutWorkers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// fanOutShards returns the room's fan-out shards, splitting its clients
+// across FanOutWorkers new shards and starting their workers on first use.
+// The shards then last as long as the room. It must be called on the room's
+// goroutine.
+func (r *Room) fanOutShards() []*fanOutShard {
+	if r.shards != nil {
+		return r.shards
+	}
+	workers := r.srv.fanOutWorkers()
+	r.shards = make([]*fanOutShard, workers)
+	for i := range r.shards {
+		r.shards[i] = &fanOutShard{jobs: make(chan fanOutJob)}
+		go r.shards[i].run()
+	}
+	r.fanOutDone = make(chan []*Client, workers)
+	for client := range r.clients {
+		r.shard(client)
+	}
+	return r.shards
+}
+
+// stopFanOutShards stops the workers of the room's fan-out shards, if it has
+// any. It must be called on the room's goroutine.
+func (r *Room) stopFanOutShards() {
+	for _, shard := range r.shards {
+		close(shard.jobs)
+	}
+	r.shards = nil
+}
+
+// shard adds client to the room's smallest fan-out shard.
+func (r *Room) shard(client *Client) {
+	smallest := r.shards[0]
+	for _, shard := range r.shards[1:] {
+		if len(shard.clients) < len(smallest.clients) {
+			smallest = shard
+		}
+	}
+	client.shard = smallest
+	client.shardIndex = len(smallest.clients)
+	smallest.clients = append(smallest.clients, client)
+}
+
+// unshard removes client from its fan-out shard, if it is in one.
+func (r *Room) unshard(client *Client) {
+	shard := client.shard
+	if shard == nil {
+		return
+	}
+	last := len(shard.clients) - 1
+	moved := shard.clients[last]
+	shard.clients[client.shardIndex] = moved
+	moved.shardIndex = client.shardIndex
+	shard.clients[last] = nil
+	shard.clients = shard.clients[:last]
+	client.shard = nil
+}
+
+// addClient adds client to the room's clients, and to a fan-out shard if the
+// room has them. It must be called on the room's goroutine.
+func (r *Room) addClient(client *Client) {
+	r.clients[client] = true
+	if r.shards != nil {
+		r.shard(client)
+	}
+}
+
+// deleteClient removes client from the room's clients and its fan-out
+// shard. It must be called on the room's goroutine.
+func (r *Room) deleteClient(client *Client) {
+	delete(r.clients, client)
+	r.unshard(client)
+}
+
+// fanOutParallel behaves like fanOut but has the workers of the room's
+// fan-out shards enqueue message for their clients. Each client is served by
+// a single worker and the fan-out completes before the next one starts, so
+// every client still gets the room's messages in order. Slow clients are
+// dropped once the workers are done, as only the room's goroutine may modify
+// r.clients.
+func (r *Room) fanOutParallel(m *encodedMessage, skip *Client, picks map[*Client]bool) {
+	shards := r.fanOutShards()
+	now := time.Now()
+	for _, shard := range shards {
+		shard.jobs <- fanOutJob{m: m, skip: skip, picks: picks, now: now, done: r.fanOutDone}
+	}
+	var slow []*Client
+	for range shards {
+		slow = append(slow, <-r.fanOutDone...)
+	}
+	for _, client := range slow {
+		r.drop(client)
+	}
+}
@@ -0,0 +1,155 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParallelFanOutKeepsOrder(t *testing.T) {
+	opts := DefaultOptions()
+	opts.FanOutThreshold = 10
+	opts.FanOutWorkers = 4
+	opts.PublishRate = 0
+	s, _ := newTestServer(t, opts)
+	room, err := s.rooms.openRoom("fanout")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clients []*Client
+	for range 25 {
+		clients = append(clients, joinTestClient(t, room, 64))
+	}
+	// Leaving moves another client into the departed one's place in its
+	// shard.
+	room.leave(clients[3])
+	clients = slices.Delete(clients, 3, 4)
+	for _, client := range clients {
+		received(client)
+	}
+
+	var want []string
+	for i := range 20 {
+		message := fmt.Sprint("message ", i)
+		want = append(want, message)
+		if err := s.Publish("fanout", []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	room.do(func() {
+		if !room.parallel() || room.shards == nil {
+			t.Error("a room above the threshold doesn't fan out in parallel")
+		}
+	})
+	for i, client := range clients {
+		var got []string
+		eventually(t, "the messages", func() bool {
+			got = append(got, received(client)...)
+			return len(got) >= len(want)
+		})
+		if !slices.Equal(got, want) {
+			t.Errorf("client %d got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestParallelFanOutSetting(t *testing.T) {
+	opts := DefaultOptions()
+	opts.FanOutThreshold = 0
+	opts.FanOutWorkers = 4
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	if code, body := admin(t, ts, http.MethodPut, "/api/rooms/fast", `{"parallel_fan_out":true}`); code != http.StatusCreated {
+		t.Fatalf("creating the room: %d %s", code, body)
+	}
+	room := waitForRoom(t, s, "fast")
+	var conns []*websocket.Conn
+	for range 10 {
+		conns = append(conns, dialWS(t, ts, "/ws/fast", nil))
+	}
+	waitForClients(t, room, len(conns))
+
+	// Every subscriber gets the room's messages in the order published, over
+	// its own connection, while the workers fan them out.
+	var want []string
+	for i := range 50 {
+		message := fmt.Sprint("message ", i)
+		want = append(want, message)
+		if err := s.Publish("fast", []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, conn := range conns {
+		if got := readLines(t, conn, len(want)); !slices.Equal(got, want) {
+			t.Errorf("subscriber %d received %q, want %q", i, got, want)
+		}
+	}
+	room.do(func() {
+		if room.shards == nil {
+			t.Error("the room didn't fan out in parallel")
+		}
+	})
+
+	// A single worker can't run alongside the room, so the room fans out
+	// itself.
+	opts.FanOutWorkers = 1
+	s, _ = newTestServer(t, opts)
+	room, err := s.rooms.openRoom("fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.parallelFanOut.Store(true)
+	room.do(func() {
+		if room.parallel() {
+			t.Error("a room fans out in parallel with a single worker")
+		}
+	})
+}
+
+// BenchmarkFanOut fans a message out to a room's subscribers on the room's
+// goroutine, and in parallel with one worker per CPU. Parallel fan-out needs
+// more than one CPU, so compare them with e.g. -cpu 1,4,8.
+func BenchmarkFanOut(b *testing.B) {
+	for _, clients := range []int{1000, 5000, 20000} {
+		for _, parallel := range []bool{false, true} {
+			b.Run(fmt.Sprintf("clients=%d/parallel=%t", clients, parallel), func(b *testing.B) {
+				workers := runtime.GOMAXPROCS(0)
+				if parallel && workers < 2 {
+					b.Skip("parallel fan-out needs more than one CPU")
+				}
+				opts := DefaultOptions()
+				opts.FanOutThreshold = 0
+				opts.FanOutWorkers = workers
+				s, _ := newTestServer(b, opts)
+				room, err := s.rooms.openRoom("fanout")
+				if err != nil {
+					b.Fatal(err)
+				}
+				room.parallelFanOut.Store(parallel)
+				joined := make([]*Client, clients)
+				for i := range joined {
+					joined[i] = joinTestClient(b, room, 16)
+				}
+				message := []byte("message")
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for range b.N {
+					room.do(func() {
+						room.fanOut(message, nil)
+					})
+					b.StopTimer()
+					for _, client := range joined {
+						received(client)
+					}
+					b.StartTimer()
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// FileStore is a RoomStore keeping each room's latest messages in a JSON file
+// of its own in a directory. Files are replaced atomically, and synced to disk
+// before Persist returns. It is a BatchPersister, so that a busy room's file is
+// rewritten once for all the messages retained during the previous write.
+type FileStore struct {
+	dir string
+	// keep is the number of messages kept per room.
+	keep int
+
+	// rooms caches the messages stored for each room written to.
+	rooms map[string][][]byte
+	mu    sync.Mutex
+}
+
+// storedRoom is the content of a room's file.
+type storedRoom struct {
+	// Messages are oldest first.
+	Messages [][]byte `json:"messages"`
+}
+
+// NewFileStore returns a FileStore keeping the latest keep messages of each
+// room in dir, which is created if it doesn't exist.
+func NewFileStore(dir string, keep int) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, keep: max(keep, 1), rooms: make(map[string][][]byte)}, nil
+}
+
+// path returns the file holding the named room. Room names may contain any
+// character, so they are encoded.
+func (st *FileStore) path(room string) string {
+	return filepath.Join(st.dir, base64.RawURLEncoding.EncodeToString([]byte(room))+".json")
+}
+
+// Persist adds content to the room's stored messages, dropping the oldest
+// beyond the number kept.
+func (st *FileStore) Persist(room string, content []byte) error {
+	return st.PersistBatch(room, [][]byte{content})
+}
+
+// PersistBatch adds contents, oldest first, to the room's stored messages in
+// a single write, dropping the oldest beyond the number kept.
+func (st *FileStore) PersistBatch(room string, contents [][]byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	messages, ok := st.rooms[room]
+	if !ok {
+		var err error
+		if messages, err = st.read(room); err != nil {
+			return err
+		}
+	}
+	messages = append(slices.Clip(messages), contents...)
+	if len(messages) > st.keep {
+		messages = messages[len(messages)-st.keep:]
+	}
+	if err := st.write(room, messages); err != nil {
+		return err
+	}
+	st.rooms[room] = messages
+	return nil
+}
+
+// Load returns the room's stored messages, oldest first.
+func (st *FileStore) Load(room string) ([][]byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if messages, ok := st.rooms[room]; ok {
+		return messages, nil
+	}
+	return st.read(room)
+}
+
+// Delete removes the room's stored messages.
+func (st *FileStore) Delete(room string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	delete(st.rooms, room)
+	if err := os.Remove(st.path(room)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// read returns the messages in the room's file, or none if it has no file.
+func (st *FileStore) read(room string) ([][]byte, error) {
+	data, err := os.ReadFile(st.path(room))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored storedRoom
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	return stored.Messages, nil
+}
+
+// write replaces the room's file with messages: they are written to a
+// temporary file that is synced and then renamed over it, so a crash leaves
+// either the old messages or the new ones.
+func (st *FileStore) write(room string, messages [][]byte) error {
+	data, _ := json.Marshal(storedRoom{Messages: messages})
+	f, err := os.CreateTemp(st.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), st.path(room))
+}
@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+)
+
+var errInvalidFilter = errors.New("invalid filter")
+
+// messageFilter selects JSON messages by the values of their fields. It
+// matches a message if all of its conditions do.
+type messageFilter []filterCondition
+
+// filterCondition compares the field at path with value.
+type filterCondition struct {
+	path   []string
+	value  any
+	negate bool
+}
+
+// parseFilter parses a filter expression: conditions of the form field==value
+// or field!=value joined by &&, e.g. type==error&&source.host!=db1. Fields
+// are dotted paths into JSON objects. Values are JSON literals (numbers,
+// true, false, null or quoted strings) or else bare strings.
+func parseFilter(expr string) (messageFilter, error) {
+	var filter messageFilter
+	for term := range strings.SplitSeq(expr, "&&") {
+		var cond filterCondition
+		field, value, ok := strings.Cut(term, "!=")
+		if ok {
+			cond.negate = true
+		} else if field, value, ok = strings.Cut(term, "=="); !ok {
+			return nil, errInvalidFilter
+		}
+
+		field = strings.TrimSpace(field)
+		if field == "" {
+			return nil, errInvalidFilter
+		}
+		cond.path = strings.Split(field, ".")
+
+		value = strings.TrimSpace(value)
+		if err := json.Unmarshal([]byte(value), &cond.value); err != nil {
+			cond.value = value
+		}
+		filter = append(filter, cond)
+	}
+	return filter, nil
+}
+
+// matches reports whether message satisfies every condition of the filter.
+// Messages that aren't JSON objects only satisfy an empty filter.
+func (f messageFilter) matches(message []byte) bool {
+	if len(f) == 0 {
+		return true
+	}
+
+	var doc map[string]any
+	if err := json.Unmarshal(message, &doc); err != nil {
+		return false
+	}
+	for _, cond := range f {
+		v, ok := lookupField(doc, cond.path)
+		if (ok && reflect.DeepEqual(v, cond.value)) == cond.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupField returns the value at path in doc.
+func lookupField(doc map[string]any, path []string) (any, bool) {
+	var v any = doc
+	for _, key := range path {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
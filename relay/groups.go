@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"errors"
+	"net/http"
+)
+
+// maxGroupNameLength bounds the length of a subscriber group's name.
+const maxGroupNameLength = 64
+
+var errInvalidGroup = errors.New("invalid group parameter")
+
+// requestGroup returns the subscriber group a subscribe request joins with
+// ?group=NAME, or "" for none.
+func requestGroup(r *http.Request) (string, error) {
+	group := r.URL.Query().Get("group")
+	if len(group) > maxGroupNameLength {
+		return "", errInvalidGroup
+	}
+	return group, nil
+}
+
+// subscriberGroup is a set of a room's subscribers, joined with ?group=NAME,
+// that share the room's messages like a work queue: each message goes to one
+// member, taking turns, instead of to all of them.
+type subscriberGroup struct {
+	members []*Client
+	// next is the index of the member due the next message.
+	next int
+}
+
+// joinGroup adds client to its subscriber group, if it named one. It must be
+// called on the room's goroutine.
+func (r *Room) joinGroup(client *Client) {
+	if client.group == "" {
+		return
+	}
+	group := r.groups[client.group]
+	if group == nil {
+		group = &subscriberGroup{}
+		r.groups[client.group] = group
+	}
+	group.members = append(group.members, client)
+}
+
+// groupPicks chooses the member of each subscriber group that the next
+// message, tagged with topic, goes to, other than skip and those that filter
+// the topic out, pruning members that have left the room. It returns nil if
+// the room has no groups, in which case the message goes to every client. It
+// must be called on the room's goroutine.
+func (r *Room) groupPicks(skip *Client, topic string) map[*Client]bool {
+	if len(r.groups) == 0 {
+		return nil
+	}
+	picks := make(map[*Client]bool, len(r.groups))
+	for name, group := range r.groups {
+		for tries := len(group.members); tries > 0 && len(group.members) > 0; tries-- {
+			group.next %= len(group.members)
+			member := group.members[group.next]
+			if !r.clients[member] {
+				group.members = append(group.members[:group.next], group.members[group.next+1:]...)
+				continue
+			}
+			group.next++
+			if member != skip && member.wantsTopic(topic) {
+				picks[member] = true
+				break
+			}
+		}
+		if len(group.members) == 0 {
+			delete(r.groups, name)
+		}
+	}
+	return picks
+}
+
+// receives reports whether client gets a message tagged with topic whose
+// group members are picks, as returned by groupPicks.
+func receives(client *Client, topic string, picks map[*Client]bool) bool {
+	return client.wantsTopic(topic) && (picks == nil || client.group == "" || picks[client])
+}
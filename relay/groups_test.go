@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSubscriberGroup(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	first := dialWS(t, ts, "/ws/jobs?group=workers", nil)
+	second := dialWS(t, ts, "/ws/jobs?group=workers", nil)
+	watcher := dialWS(t, ts, "/ws/jobs", nil)
+	room := waitForRoom(t, s, "jobs")
+	waitForClients(t, room, 3)
+
+	var want []string
+	for i := range 6 {
+		job := fmt.Sprint("job ", i)
+		want = append(want, job)
+		if code, body := publish(t, ts, "jobs", job, nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+	}
+
+	// The ungrouped subscriber gets every message.
+	if got := readLines(t, watcher, len(want)); !slices.Equal(got, want) {
+		t.Errorf("ungrouped subscriber received %q, want %q", got, want)
+	}
+	// The group's members take turns, so each gets half of them.
+	firstJobs, secondJobs := readLines(t, first, len(want)/2), readLines(t, second, len(want)/2)
+	got := slices.Concat(firstJobs, secondJobs)
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("group members received %q and %q, want each job once", firstJobs, secondJobs)
+	}
+
+	// A member that leaves stops getting turns.
+	second.Close()
+	waitForClients(t, room, 2)
+	for _, job := range []string{"job 6", "job 7"} {
+		if code, body := publish(t, ts, "jobs", job, nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+	}
+	if got := readLines(t, first, 2); !slices.Equal(got, []string{"job 6", "job 7"}) {
+		t.Errorf("remaining member received %q, want both jobs", got)
+	}
+}
+
+func TestSubscriberGroupInvalid(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	if res := openSSE(t, ts, "/sse/jobs?group="+strings.Repeat("g", maxGroupNameLength+1)); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("a group name that is too long: status %d, want 400", res.StatusCode)
+	}
+}
@@ -0,0 +1,312 @@
+package relay
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"relay/relay/relaypb"
+)
+
+// grpcService serves the relaypb.Relay service from the server's rooms, so
+// gRPC clients share them with WebSocket, SSE and HTTP clients.
+type grpcService struct {
+	relaypb.UnimplementedRelayServer
+	srv *Server
+}
+
+// RegisterGRPC registers the relay's gRPC service, relaypb.Relay, with gs.
+// Its publishes and subscriptions go to the same rooms as the HTTP
+// endpoints'.
+func (s *Server) RegisterGRPC(gs grpc.ServiceRegistrar) {
+	relaypb.RegisterRelayServer(gs, &grpcService{srv: s})
+}
+
+// grpcRequest returns an HTTP request standing for a gRPC call, with the
+// call's metadata as its headers, its peer as its remote address and query
+// as its URL's query, so that the call goes through the checks of the
+// equivalent HTTP request. gRPC metadata are HTTP/2 headers on the wire.
+func grpcRequest(ctx context.Context, query url.Values) *http.Request {
+	r := (&http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{RawQuery: query.Encode()},
+		Header: make(http.Header),
+	}).WithContext(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		for _, v := range values {
+			r.Header.Add(key, v)
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	return r
+}
+
+// grpcError returns err as the gRPC status matching the HTTP status the
+// equivalent HTTP request would have failed with.
+func grpcError(httpStatus int, err error) error {
+	code := codes.Unknown
+	switch httpStatus {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.FailedPrecondition
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, err.Error())
+}
+
+// grpcResponse records the error response of the checks HTTP publishes share
+// with gRPC ones, to return it as the call's status.
+type grpcResponse struct {
+	header http.Header
+	status int
+	body   strings.Builder
+}
+
+func (w *grpcResponse) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *grpcResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *grpcResponse) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// err returns the recorded response as a gRPC status.
+func (w *grpcResponse) err() error {
+	return grpcError(w.status, errors.New(strings.TrimSpace(w.body.String())))
+}
+
+// checkMaintenance returns an UNAVAILABLE status while the server is in
+// maintenance mode, which gRPC calls honor like the public HTTP endpoints.
+func (s *Server) checkMaintenance() error {
+	if !s.maintenance.Load() {
+		return nil
+	}
+	return status.Error(codes.Unavailable, *s.maintenanceMessage.Load())
+}
+
+// Publish broadcasts a message to a room and retains it, with the checks and
+// options of an HTTP publish. Signed publishes need the HTTP request line, so
+// with PublishHMACKey set, publishes over gRPC are refused.
+func (g *grpcService) Publish(ctx context.Context, req *relaypb.PublishRequest) (*relaypb.PublishResponse, error) {
+	s := g.srv
+	if err := s.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	if s.opts.PublishHMACKey != "" {
+		return nil, status.Error(codes.Unauthenticated, "signed publishes aren't supported over gRPC")
+	}
+	query := url.Values{"topic": {req.Topic}, "key": {req.Key}, "ttl": {req.Ttl}, "dedup_key": {req.DedupKey}}
+	if req.Durable {
+		query.Set("durable", "1")
+	}
+	r := grpcRequest(ctx, query)
+
+	roomID, err := s.resolveRoomID(req.Room)
+	if err != nil {
+		return nil, grpcError(roomIDStatus(err), err)
+	}
+	if err := s.authorizePublish(r, roomID); err != nil {
+		return nil, grpcError(http.StatusForbidden, err)
+	}
+	content := req.Content
+	if len(content) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "missing content")
+	}
+	params, err := s.parsePublishParams(r)
+	if err != nil {
+		return nil, grpcError(http.StatusBadRequest, err)
+	}
+	contentType := cmp.Or(req.ContentType, publishContentType(r, content, false))
+
+	w := &grpcResponse{}
+	room := s.checkPublish(w, r, roomID, content, contentType, params)
+	if room == nil {
+		return nil, w.err()
+	}
+	if params.dedupKey != "" && !room.dedupKeys.add(params.dedupKey) {
+		return &relaypb.PublishResponse{Room: roomID, Duplicate: true}, nil
+	}
+
+	p := params.publication(content, remoteIP(r), contentType)
+	if params.durable {
+		p.persisted = make(chan error, 1)
+	}
+	// As over HTTP, only plain publishes are buffered while the room is
+	// paused.
+	held, err := room.hold(p, !params.durable)
+	if err != nil {
+		room.dedupKeys.remove(params.dedupKey)
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if !held && !room.trySubmit(p) {
+		room.dedupKeys.remove(params.dedupKey)
+		return nil, status.Error(codes.ResourceExhausted, errPublishQueueFull.Error())
+	}
+	if params.durable && !awaitPersisted(w, r, room, p.persisted) {
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		return nil, w.err()
+	}
+	return &relaypb.PublishResponse{Room: roomID}, nil
+}
+
+// Subscribe streams a room's messages to a subscriber registered with the
+// room like a WebSocket or SSE one, counting against the same limits.
+func (g *grpcService) Subscribe(req *relaypb.SubscribeRequest, stream grpc.ServerStreamingServer[relaypb.Message]) error {
+	s := g.srv
+	if err := s.checkMaintenance(); err != nil {
+		return err
+	}
+	query := url.Values{"group": {req.Group}, "name": {req.Name}, "client_id": {req.ClientId}}
+	if len(req.Topics) > 0 {
+		for _, topic := range req.Topics {
+			if strings.Contains(topic, ",") {
+				return status.Error(codes.InvalidArgument, errInvalidTopic.Error())
+			}
+		}
+		query.Set("topics", strings.Join(req.Topics, ","))
+	}
+	ctx := stream.Context()
+	r := grpcRequest(ctx, query)
+
+	roomID, err := s.resolveRoomID(req.Room)
+	if err != nil {
+		return grpcError(roomIDStatus(err), err)
+	}
+	quota, err := s.authorizeSubscriber(r, roomID)
+	if err != nil {
+		return grpcError(authStatus(err), err)
+	}
+	group, err := requestGroup(r)
+	if err != nil {
+		return grpcError(http.StatusBadRequest, err)
+	}
+	name, err := requestPresenceName(r)
+	if err != nil {
+		return grpcError(http.StatusBadRequest, err)
+	}
+	topics, err := requestTopics(r)
+	if err != nil {
+		return grpcError(http.StatusBadRequest, err)
+	}
+	if s.shuttingDown.Load() {
+		return status.Error(codes.Unavailable, errShuttingDown.Error())
+	}
+
+	room, err := s.rooms.openRoom(roomID)
+	if err != nil {
+		return grpcError(openRoomStatus(err), err)
+	}
+	if err := room.admitsSubscriber(requestToken(r)); err != nil {
+		return grpcError(accessTokenStatus(err), err)
+	}
+	if !s.tokenConnections.acquire(quota) {
+		return status.Error(codes.ResourceExhausted, errQuotaExceeded.Error())
+	}
+	defer s.tokenConnections.release(quota)
+	if err := s.admit(room, quota); err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer s.release(room, quota)
+
+	client := &Client{
+		room:        room,
+		send:        make(chan []byte, room.sendBufferSize()),
+		id:          newConnectionID(),
+		ip:          remoteIP(r),
+		remoteAddr:  r.RemoteAddr,
+		connectedAt: time.Now(),
+		group:       group,
+		name:        name,
+		topics:      topics,
+		accessToken: requestToken(r),
+		clientID:    req.ClientId,
+		grpc:        true,
+	}
+	if !room.join(client) {
+		// The room was closed while the client was connecting.
+		return status.Error(codes.Unavailable, "room closed")
+	}
+	s.clientIndex.add(client)
+	defer func() {
+		room.leave(client)
+		s.clientIndex.remove(client)
+	}()
+
+	return client.streamMessages(ctx, stream)
+}
+
+// streamMessages sends the client's messages on a gRPC stream until the room
+// drops the client, the call is canceled or a send fails.
+func (c *Client) streamMessages(ctx context.Context, stream grpc.ServerStreamingServer[relaypb.Message]) error {
+	idle := newIdleTimer(c.room.srv.opts.SubscriberIdleTimeout)
+	defer idle.stop()
+	for {
+		select {
+		case message, ok := <-c.send:
+			if !ok {
+				return c.closeStatus()
+			}
+			if err := stream.Send(&relaypb.Message{Content: message}); err != nil {
+				c.undelivered.Store(true)
+				return err
+			}
+			c.bytesSent.Add(int64(len(message)))
+			idle.reset()
+		case <-idle.C:
+			return status.Error(codes.DeadlineExceeded, "idle for too long")
+		case <-ctx.Done():
+			return nil
+		case <-c.room.srv.shutdownStarted:
+			return status.Error(codes.Unavailable, errShuttingDown.Error())
+		}
+	}
+}
+
+// closeStatus returns the status a gRPC subscriber's stream ends with once
+// the room has dropped it, like the close code a WebSocket subscriber gets.
+func (c *Client) closeStatus() error {
+	switch {
+	case c.kicked.Load():
+		return status.Error(codes.PermissionDenied, "kicked by an administrator")
+	case c.room.srv.shuttingDown.Load():
+		return status.Error(codes.Unavailable, errShuttingDown.Error())
+	case c.room.srv.maintenance.Load():
+		return status.Error(codes.Unavailable, "maintenance")
+	}
+	return status.Error(codes.Aborted, "disconnected by the room")
+}
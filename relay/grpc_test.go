@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"relay/relay/relaypb"
+)
+
+// newGRPCClient serves s's gRPC service over an in-memory connection and
+// returns a client for it.
+func newGRPCClient(t *testing.T, s *Server) relaypb.RelayClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	s.RegisterGRPC(gs)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return relaypb.NewRelayClient(conn)
+}
+
+func TestGRPCPublishSubscribe(t *testing.T) {
+	s, _ := newTestServer(t, DefaultOptions())
+	client := newGRPCClient(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Subscribe(ctx, &relaypb.SubscribeRequest{Room: "grpc"})
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	room := waitForRoom(t, s, "grpc")
+	waitForClients(t, room, 1)
+
+	if _, err := client.Publish(ctx, &relaypb.PublishRequest{Room: "grpc", Content: []byte("hello")}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	for {
+		message, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		if string(message.Content) == "hello" {
+			break
+		}
+	}
+}
+
+func TestGRPCMaintenance(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Maintenance = true
+	s, _ := newTestServer(t, opts)
+	client := newGRPCClient(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.Publish(ctx, &relaypb.PublishRequest{Room: "grpc", Content: []byte("hello")})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Publish in maintenance = %v, want Unavailable", err)
+	}
+	stream, err := client.Subscribe(ctx, &relaypb.SubscribeRequest{Room: "grpc"})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Subscribe in maintenance = %v, want Unavailable", err)
+	}
+	if _, ok := s.rooms.lookupRoom("grpc"); ok {
+		t.Error("a call in maintenance created the room")
+	}
+}
+
+func TestGRPCPublishOptions(t *testing.T) {
+	s, _ := newTestServer(t, DefaultOptions())
+	client := newGRPCClient(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &relaypb.PublishRequest{Room: "grpc", Content: []byte("hello"), DedupKey: "once"}
+	res, err := client.Publish(ctx, req)
+	if err != nil || res.Duplicate {
+		t.Fatalf("first Publish = %v, %v", res, err)
+	}
+	res, err = client.Publish(ctx, req)
+	if err != nil || !res.Duplicate {
+		t.Fatalf("repeated Publish = %v, %v, want a duplicate", res, err)
+	}
+
+	for _, req := range []*relaypb.PublishRequest{
+		{Room: "grpc", Content: []byte("hello"), Ttl: "soon"},
+		{Room: "grpc", Content: []byte("hello"), DedupKey: string(make([]byte, maxDedupKeyLength+1))},
+		// Without a Persister, durable publishes are refused.
+		{Room: "grpc", Content: []byte("hello"), Durable: true},
+	} {
+		if _, err := client.Publish(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Publish(%v) = %v, want InvalidArgument", req, err)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package relay
+
+import (
+	"cmp"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// minSweepInterval bounds how often sweepRetainedContent runs, however short
+// RetainMaxAge and ContentTTL are.
+const minSweepInterval = 10 * time.Millisecond
+
+// History is a room's buffer of recent messages. It evicts the oldest messages
+// once either the message count or their total size exceeds its limits, and a
+// publisher's own oldest message once it exceeds its quota.
+type History struct {
+	messages []retainedMessage
+	// publishers holds the publisher of each message in messages.
+	publishers []string
+	// counts is the number of messages retained per publisher.
+	counts          map[string]int
+	size            int
+	maxCount        int
+	maxBytes        int
+	maxPerPublisher int
+	// total is the size of the messages retained across all rooms'
+	// histories, for MaxTotalHistoryBytes.
+	total *atomic.Int64
+}
+
+func newHistory(maxCount, maxBytes, maxPerPublisher int, total *atomic.Int64) *History {
+	return &History{
+		counts:          make(map[string]int),
+		maxCount:        maxCount,
+		maxBytes:        maxBytes,
+		maxPerPublisher: maxPerPublisher,
+		total:           total,
+	}
+}
+
+// add appends message from publisher, evicting messages as needed. A message
+// larger than maxBytes on its own is not retained. Messages from an unknown
+// (empty) publisher aren't subject to the per-publisher quota.
+func (h *History) add(message retainedMessage, publisher string) {
+	h.messages = append(h.messages, message)
+	h.publishers = append(h.publishers, publisher)
+	h.size += message.size
+	h.total.Add(int64(message.size))
+	h.counts[publisher]++
+	if h.maxPerPublisher > 0 && publisher != "" && h.counts[publisher] > h.maxPerPublisher {
+		h.remove(slices.Index(h.publishers, publisher))
+	}
+	for len(h.messages) > 0 && (len(h.messages) > h.maxCount || (h.maxBytes > 0 && h.size > h.maxBytes)) {
+		h.remove(0)
+	}
+}
+
+// remove evicts the i-th oldest message.
+func (h *History) remove(i int) {
+	h.size -= h.messages[i].size
+	h.total.Add(-int64(h.messages[i].size))
+	publisher := h.publishers[i]
+	if h.counts[publisher]--; h.counts[publisher] == 0 {
+		delete(h.counts, publisher)
+	}
+	h.messages = slices.Delete(h.messages, i, i+1)
+	h.publishers = slices.Delete(h.publishers, i, i+1)
+}
+
+// clear evicts every message.
+func (h *History) clear() {
+	h.total.Add(-int64(h.size))
+	h.messages, h.publishers, h.size = nil, nil, 0
+	clear(h.counts)
+}
+
+// retains reports whether a message of the given size and content type would
+// be kept in the room's history for replay.
+func (r *Room) retains(size int, contentType string) bool {
+	if r.srv.opts.HistorySize <= 0 || (r.srv.opts.HistoryBytes > 0 && size > r.srv.opts.HistoryBytes) {
+		return false
+	}
+	if !r.retainsContentType(contentType) {
+		return false
+	}
+	limit := r.maxRetainBytes.Load()
+	return limit == 0 || int64(size) <= limit
+}
+
+// checkRetention applies RequireRetention to a publish of size bytes of the
+// given content type to room. It responds with 409 and reports false if the
+// publish is rejected.
+func (s *Server) checkRetention(w http.ResponseWriter, room *Room, size int, contentType string) bool {
+	if s.opts.RequireRetention == "off" || room.retains(size, contentType) {
+		return true
+	}
+	if s.opts.RequireRetention == "reject" {
+		http.Error(w, "Room does not retain this message", http.StatusConflict)
+		return false
+	}
+	w.Header().Set("Warning", `299 - "room does not retain this message"`)
+	return true
+}
+
+// sweepRetainedContent periodically clears the retained content of rooms
+// that haven't retained a message for longer than RetainMaxAge, and drops
+// messages older than ContentTTL, until the server shuts down.
+func (s *Server) sweepRetainedContent() {
+	interval := time.Minute
+	for _, d := range []time.Duration{s.opts.RetainMaxAge, s.opts.ContentTTL} {
+		if d > 0 {
+			interval = min(interval, d/2)
+		}
+	}
+	interval = max(interval, minSweepInterval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.shutdownStarted:
+			return
+		}
+		now := time.Now()
+		for _, room := range s.rooms.all() {
+			if s.opts.RetainMaxAge > 0 {
+				room.clearRetainedBefore(now.Add(-s.opts.RetainMaxAge))
+			}
+			if s.opts.ContentTTL > 0 {
+				room.do(func() {
+					room.expireContent(now)
+				})
+			}
+		}
+	}
+}
+
+// clearRetainedBefore clears the room's retained content, including its
+// history, if it was last updated before cutoff. All of the history is at
+// least as old as the latest content.
+func (r *Room) clearRetainedBefore(cutoff time.Time) {
+	r.do(func() {
+		if r.lastContent.data == nil || !r.lastContentTime.Before(cutoff) {
+			return
+		}
+		r.lastContent = retainedMessage{}
+		r.lastContentHash = ""
+		r.history.clear()
+	})
+}
+
+// evictHistory evicts history messages, oldest first, from the rooms that
+// have gone the longest without activity until the histories of all rooms
+// fit in MaxTotalHistoryBytes again. Only one eviction runs at a time.
+func (s *Server) evictHistory() {
+	if !s.evictingHistory.CompareAndSwap(false, true) {
+		return
+	}
+	defer s.evictingHistory.Store(false)
+
+	limit := int64(s.opts.MaxTotalHistoryBytes)
+	rooms := s.rooms.all()
+	slices.SortFunc(rooms, func(a, b *Room) int {
+		return cmp.Compare(a.lastActivity.Load(), b.lastActivity.Load())
+	})
+	for _, room := range rooms {
+		if s.historyBytes.Load() <= limit {
+			return
+		}
+		room.do(func() {
+			for len(room.history.messages) > 0 && s.historyBytes.Load() > limit {
+				room.history.remove(0)
+				s.metrics.historyEvictions.Add(1)
+			}
+		})
+	}
+}
+
+// expireContent drops the retained messages, including the latest content,
+// that are older than ContentTTL or whose own TTL has run out at now. Besides
+// the periodic sweep and the room's expiry timer, it runs before retained
+// content is read, so expired messages are never served in between. It must
+// be called on the room's goroutine.
+func (r *Room) expireContent(now time.Time) {
+	if r.srv.opts.ContentTTL > 0 {
+		cutoff := now.Add(-r.srv.opts.ContentTTL)
+		// The history is kept in the order the messages were retained.
+		for len(r.history.messages) > 0 && r.history.messages[0].retainedAt.Before(cutoff) {
+			r.history.remove(0)
+		}
+		if r.lastContent.data != nil && r.lastContent.retainedAt.Before(cutoff) {
+			r.lastContent = retainedMessage{}
+			r.lastContentHash = ""
+		}
+	}
+	if r.nextExpiry.IsZero() || now.Before(r.nextExpiry) {
+		// No message's TTL has run out yet.
+		return
+	}
+	// Messages with a TTL may expire in any order.
+	for i := len(r.history.messages) - 1; i >= 0; i-- {
+		if r.history.messages[i].expired(now) {
+			r.history.remove(i)
+		}
+	}
+	if r.lastContent.expired(now) {
+		r.lastContent = retainedMessage{}
+		r.lastContentHash = ""
+	}
+}
+
+// handleReplay returns the room's history, oldest first, optionally only the
+// messages matching a filter expression and at most the newest limit of them,
+// with the Cache-Control directive the newest message was published with:
+// GET /api/rooms/{roomID}/replay?filter={expr}&limit={n}
+func (s *Server) handleReplay(w http.ResponseWriter, r *http.Request) {
+	roomID, err := s.resolveRoomID(r.PathValue("roomID"))
+	if err != nil {
+		http.Error(w, err.Error(), roomIDStatus(err))
+		return
+	}
+
+	if _, err := s.authorizeSubscriber(r, roomID); err != nil {
+		http.Error(w, err.Error(), authStatus(err))
+		return
+	}
+
+	var filter messageFilter
+	if expr := r.URL.Query().Get("filter"); expr != "" {
+		if filter, err = parseFilter(expr); err != nil {
+			http.Error(w, "Invalid filter parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var history []retainedMessage
+	if room, ok := s.rooms.lookupRoom(roomID); ok {
+		if err := room.admitsSubscriber(requestToken(r)); err != nil {
+			http.Error(w, err.Error(), accessTokenStatus(err))
+			return
+		}
+		room.do(func() {
+			room.expireContent(time.Now())
+			history = slices.Clone(room.history.messages)
+		})
+	}
+
+	messages := []string{}
+	for _, retained := range history {
+		if message := retained.content(); filter.matches(message) {
+			messages = append(messages, string(message))
+		}
+	}
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	// The replay changes with the next message, so the newest one's
+	// directive governs.
+	if len(history) > 0 && history[len(history)-1].cacheControl != "" {
+		w.Header().Set("Cache-Control", history[len(history)-1].cacheControl)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "messages": messages})
+}
+
+// requestMaxStale returns how old the retained messages replayed to a
+// subscriber may be, from ?max_stale=DURATION, or 0 for any age.
+func requestMaxStale(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("max_stale")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, errors.New("invalid max_stale parameter")
+	}
+	return d, nil
+}
+
+// replay returns the history messages to replay to a joining client: the
+// most recent ones that fit in its send buffer alongside the other messages
+// it is queued on joining, as they are all queued before its write pump
+// starts, and that are no older than the client's max_stale nor already
+// delivered to it before a reconnect or, for SSE subscribers, before their
+// Last-Event-ID. Subscriber group members get none, as
+// each message is meant for a single member. It must be called on the room's
+// goroutine.
+func (r *Room) replay(client *Client) []retainedMessage {
+	if client.group != "" {
+		return nil
+	}
+	messages := r.resume(client, r.history.messages)
+	// A Last-Event-ID beyond the room's sequence is from before a restart.
+	if client.lastEventID > 0 && client.lastEventID <= r.sequence {
+		// The history is oldest first.
+		for len(messages) > 0 && messages[0].seq <= client.lastEventID {
+			messages = messages[1:]
+		}
+	}
+	if client.maxStale > 0 {
+		// The history is oldest first.
+		cutoff := time.Now().Add(-client.maxStale)
+		for len(messages) > 0 && messages[0].retainedAt.Before(cutoff) {
+			messages = messages[1:]
+		}
+	}
+	if client.topics != nil {
+		messages = slices.DeleteFunc(slices.Clone(messages), func(m retainedMessage) bool {
+			return !client.wantsTopic(m.topic)
+		})
+	}
+	free := cap(client.send) - len(client.send)
+	if r.srv.opts.Presence && r.srv.opts.PresenceBaseline {
+		free--
+	}
+	if client.wantsStats {
+		free--
+	}
+	if r.srv.opts.Presence && r.srv.opts.PresenceSelfJoin {
+		free--
+	}
+	if len(messages) > free {
+		messages = messages[len(messages)-max(free, 0):]
+	}
+	return messages
+}
@@ -0,0 +1,400 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSweepWithSubMillisecondAges(t *testing.T) {
+	opts := DefaultOptions()
+	opts.RetainMaxAge = time.Nanosecond
+	opts.ContentTTL = time.Nanosecond
+	_, ts := newTestServer(t, opts)
+
+	if code, body := publish(t, ts, "sweep", "hello", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	eventually(t, "the retained content to be swept", func() bool {
+		code, _ := request(t, http.MethodGet, ts.URL+"/api/rooms/sweep/latest", "", nil)
+		return code == http.StatusNotFound
+	})
+}
+
+func TestHistoryLimit(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HistorySize = 10
+	_, ts := newTestServer(t, opts)
+
+	for _, content := range []string{"one", "two", "three"} {
+		if code, body := publish(t, ts, "history", content, nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+	}
+	for _, path := range []string{"/api/rooms/history/replay", "/history/history"} {
+		code, body := request(t, http.MethodGet, ts.URL+path+"?limit=2", "", nil)
+		if code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", path, code, body)
+		}
+		var replay struct {
+			Room     string   `json:"room"`
+			Messages []string `json:"messages"`
+		}
+		if err := json.Unmarshal([]byte(body), &replay); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		if want := []string{"two", "three"}; !slices.Equal(replay.Messages, want) {
+			t.Errorf("GET %s = %q, want %q", path, replay.Messages, want)
+		}
+	}
+}
+
+func TestHistoryByteLimit(t *testing.T) {
+	var total atomic.Int64
+	h := newHistory(100, 1000, 0, &total)
+	for i := range 10 {
+		h.add(retainedMessage{data: []byte{byte(i)}, size: 300}, "")
+	}
+	// The byte limit is hit long before the count limit.
+	if len(h.messages) != 3 || h.size != 900 || total.Load() != 900 {
+		t.Errorf("retained %d messages of %d bytes (%d in total), want 3 of 900", len(h.messages), h.size, total.Load())
+	}
+	if first := h.messages[0].data[0]; first != 7 {
+		t.Errorf("oldest retained message is %d, want 7", first)
+	}
+
+	// A message larger than the limit on its own evicts everything.
+	h.add(retainedMessage{size: 2000}, "")
+	if len(h.messages) != 0 || total.Load() != 0 {
+		t.Errorf("retained %d messages (%d bytes in total), want none", len(h.messages), total.Load())
+	}
+}
+
+func TestHistoryByteLimitReplay(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HistorySize = 10
+	opts.HistoryBytes = 10
+	_, ts := newTestServer(t, opts)
+
+	for _, content := range []string{"aaaa", "bbbb", "cccc"} {
+		if code, body := publish(t, ts, "bytes", content, nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+	}
+	code, body := request(t, http.MethodGet, ts.URL+"/api/rooms/bytes/replay", "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("replay: %d %s", code, body)
+	}
+	var replay struct {
+		Messages []string `json:"messages"`
+	}
+	if err := json.Unmarshal([]byte(body), &replay); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"bbbb", "cccc"}; !slices.Equal(replay.Messages, want) {
+		t.Errorf("replay = %q, want %q", replay.Messages, want)
+	}
+}
+
+func TestHistoryPerPublisher(t *testing.T) {
+	var total atomic.Int64
+	h := newHistory(10, 0, 3, &total)
+	// A chatty publisher and a quiet one.
+	for i := range 8 {
+		h.add(retainedMessage{data: []byte{byte(i)}, size: 1}, "chatty")
+		if i%4 == 0 {
+			h.add(retainedMessage{data: []byte{byte(100 + i)}, size: 1}, "quiet")
+		}
+	}
+	h.add(retainedMessage{data: []byte{200}, size: 1}, "")
+	h.add(retainedMessage{data: []byte{201}, size: 1}, "")
+
+	var got []byte
+	for _, message := range h.messages {
+		got = append(got, message.data[0])
+	}
+	// The chatty publisher keeps its 3 most recent messages, without
+	// evicting the quiet one's, and unknown publishers aren't limited.
+	if want := []byte{100, 104, 5, 6, 7, 200, 201}; !slices.Equal(got, want) {
+		t.Errorf("retained %v, want %v", got, want)
+	}
+	if h.counts["chatty"] != 3 || h.counts["quiet"] != 2 {
+		t.Errorf("counts %v, want 3 for chatty and 2 for quiet", h.counts)
+	}
+}
+
+func TestHistoryPerPublisherReplay(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HistorySize = 6
+	opts.HistoryPerPublisher = 3
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+
+	publishFrom := func(ip, content string) {
+		r := httptest.NewRequest(http.MethodPost, "/fair?content="+content, nil)
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("publish from %s: %d %s", ip, w.Code, w.Body)
+		}
+	}
+	for _, content := range []string{"a1", "a2", "a3", "a4", "a5", "a6"} {
+		publishFrom("192.0.2.1", content)
+	}
+	publishFrom("192.0.2.2", "b1")
+	publishFrom("192.0.2.2", "b2")
+
+	code, body := request(t, http.MethodGet, ts.URL+"/api/rooms/fair/replay", "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("replay: %d %s", code, body)
+	}
+	var replay struct {
+		Messages []string `json:"messages"`
+	}
+	if err := json.Unmarshal([]byte(body), &replay); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a4", "a5", "a6", "b1", "b2"}; !slices.Equal(replay.Messages, want) {
+		t.Errorf("replay = %q, want %q", replay.Messages, want)
+	}
+}
+
+func TestRequireRetention(t *testing.T) {
+	for _, tt := range []struct {
+		mode    string
+		code    int
+		warning bool
+	}{
+		{"off", http.StatusOK, false},
+		{"warn", http.StatusOK, true},
+		{"reject", http.StatusConflict, false},
+	} {
+		opts := DefaultOptions()
+		opts.HistorySize = 0
+		opts.RequireRetention = tt.mode
+		_, ts := newTestServer(t, opts)
+
+		res, err := http.Post(ts.URL+"/unretained?content=hello", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.mode, res.StatusCode, tt.code)
+		}
+		if warning := res.Header.Get("Warning") != ""; warning != tt.warning {
+			t.Errorf("%s: Warning %q", tt.mode, res.Header.Get("Warning"))
+		}
+	}
+}
+
+func TestHistoryReplayOnJoin(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		size, bytes  int
+		publish      []string
+		wantReplayed []string
+	}{
+		{"size", 3, 0, []string{"one", "two", "three", "four"}, []string{"two", "three", "four"}},
+		{"bytes", 10, 8, []string{"aaaa", "bbbb", "cccc"}, []string{"bbbb", "cccc"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.HistorySize = tt.size
+			opts.HistoryBytes = tt.bytes
+			_, ts := newTestServer(t, opts)
+			for _, content := range tt.publish {
+				if code, body := publish(t, ts, "replayed", content, nil); code != http.StatusOK {
+					t.Fatalf("publish: %d %s", code, body)
+				}
+			}
+
+			// The history is replayed oldest first, followed by live
+			// messages.
+			conn := dialWS(t, ts, "/ws/replayed", nil)
+			read := func(want string) {
+				t.Helper()
+				if _, message, err := conn.ReadMessage(); err != nil || string(message) != want {
+					t.Fatalf("received %q (%v), want %q", message, err, want)
+				}
+			}
+			for _, content := range tt.wantReplayed {
+				read(content)
+			}
+			if code, body := publish(t, ts, "replayed", "live", nil); code != http.StatusOK {
+				t.Fatalf("publish: %d %s", code, body)
+			}
+			read("live")
+		})
+	}
+}
+
+func TestFilteredReplay(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HistorySize = 10
+	_, ts := newTestServer(t, opts)
+
+	for _, content := range []string{
+		`{"type":"error","n":1}`,
+		`{"type":"info","n":2}`,
+		"not JSON",
+		`{"type":"error","n":3}`,
+		`{"type":"error","n":4}`,
+	} {
+		if code, body := publish(t, ts, "mixed", content, nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+	}
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"filter=type==error", []string{`{"type":"error","n":1}`, `{"type":"error","n":3}`, `{"type":"error","n":4}`}},
+		{"filter=type==error%26%26n!=3", []string{`{"type":"error","n":1}`, `{"type":"error","n":4}`}},
+		{"filter=type==error&limit=1", []string{`{"type":"error","n":4}`}},
+		{"filter=type==debug", []string{}},
+	} {
+		code, body := request(t, http.MethodGet, ts.URL+"/api/rooms/mixed/replay?"+tt.query, "", nil)
+		if code != http.StatusOK {
+			t.Fatalf("replay?%s: %d %s", tt.query, code, body)
+		}
+		var replay struct {
+			Messages []string `json:"messages"`
+		}
+		if err := json.Unmarshal([]byte(body), &replay); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(replay.Messages, tt.want) {
+			t.Errorf("replay?%s = %q, want %q", tt.query, replay.Messages, tt.want)
+		}
+	}
+
+	if code, body := request(t, http.MethodGet, ts.URL+"/api/rooms/mixed/replay?filter=type", "", nil); code != http.StatusBadRequest {
+		t.Errorf("replay with an invalid filter: %d %s, want 400", code, body)
+	}
+}
+
+func TestContentTTL(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+	opts := DefaultOptions()
+	opts.HistorySize = 10
+	opts.ContentTTL = ttl
+	s, ts := newTestServer(t, opts)
+
+	if code, body := publish(t, ts, "ephemeral", "old", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	time.Sleep(ttl * 3 / 4)
+	if code, body := publish(t, ts, "ephemeral", "new", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	time.Sleep(ttl / 2)
+
+	// Subscribers joining now only get the message that hasn't expired.
+	conn := dialWS(t, ts, "/ws/ephemeral", nil)
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "new" {
+		t.Fatalf("replayed %q (%v), want only new", message, err)
+	}
+	conn.Close()
+
+	// Expired content is dropped from memory without anyone asking for it.
+	room := waitForRoom(t, s, "ephemeral")
+	eventually(t, "the content to be dropped", func() bool {
+		var retained int
+		room.do(func() {
+			retained = len(room.history.messages)
+			if room.lastContent.data != nil {
+				retained++
+			}
+		})
+		return retained == 0
+	})
+	if got := latest(t, ts, "ephemeral"); got != "" {
+		t.Errorf("latest = %q after the TTL", got)
+	}
+}
+
+func TestMaxStaleReplay(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	if code, body := publish(t, ts, "aging", "aged", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	strict := dialWS(t, ts, "/ws/aging?max_stale=100ms", nil)
+	tolerant := dialWS(t, ts, "/ws/aging?max_stale=1m", nil)
+	room := waitForRoom(t, s, "aging")
+	waitForClients(t, room, 2)
+	if code, body := publish(t, ts, "aging", "fresh", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+
+	// Only the tolerant subscriber is sent the aged content first.
+	if got := readLines(t, tolerant, 2); !slices.Equal(got, []string{"aged", "fresh"}) {
+		t.Errorf("tolerant subscriber received %q, want the replay and the new message", got)
+	}
+	if got := readLines(t, strict, 1); !slices.Equal(got, []string{"fresh"}) {
+		t.Errorf("strict subscriber received %q, want only the new message", got)
+	}
+
+	if res := openSSE(t, ts, "/sse/aging?max_stale=soon"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("an invalid max_stale: status %d, want 400", res.StatusCode)
+	}
+}
+
+func TestMaxTotalHistoryBytes(t *testing.T) {
+	const size = 100
+	opts := DefaultOptions()
+	opts.HistorySize = 10
+	opts.MaxTotalHistoryBytes = 5 * size
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	n := 0
+	publishTo := func(room string) {
+		t.Helper()
+		n++
+		content := fmt.Sprintf("%0*d", size, n)
+		if code, body := publish(t, ts, room, content, nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	histories := func() map[string]int {
+		counts := make(map[string]int)
+		for _, name := range []string{"oldest", "middle", "newest"} {
+			room := waitForRoom(t, s, name)
+			room.do(func() { counts[name] = len(room.history.messages) })
+		}
+		return counts
+	}
+
+	for _, room := range []string{"oldest", "oldest", "middle", "middle", "newest", "newest"} {
+		publishTo(room)
+	}
+	// Going past the ceiling evicts the least recently active room's oldest
+	// message.
+	eventually(t, "the oldest message to be evicted", func() bool {
+		return maps.Equal(histories(), map[string]int{"oldest": 1, "middle": 2, "newest": 2})
+	})
+
+	// Further on, that room is emptied before the next one loses any.
+	publishTo("newest")
+	publishTo("newest")
+	eventually(t, "two more messages to be evicted", func() bool {
+		return maps.Equal(histories(), map[string]int{"oldest": 0, "middle": 1, "newest": 4})
+	})
+	if got := s.historyBytes.Load(); got != 5*size {
+		t.Errorf("%d bytes of history, want %d", got, 5*size)
+	}
+	if got := s.metrics.historyEvictions.Load(); got != 3 {
+		t.Errorf("%d history evictions, want 3", got)
+	}
+}
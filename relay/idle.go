@@ -0,0 +1,34 @@
+package relay
+
+import "time"
+
+// idleTimer fires once a subscriber has been sent nothing for
+// SubscriberIdleTimeout. Its channel is nil, and never fires, when subscribers
+// may stay idle indefinitely.
+type idleTimer struct {
+	C       <-chan time.Time
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func newIdleTimer(timeout time.Duration) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	if timeout > 0 {
+		t.timer = time.NewTimer(timeout)
+		t.C = t.timer.C
+	}
+	return t
+}
+
+// reset restarts the timer after the subscriber was sent something.
+func (t *idleTimer) reset() {
+	if t.timer != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *idleTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
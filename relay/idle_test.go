@@ -0,0 +1,100 @@
+package relay
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// openStream starts a streaming publish to room on ts, and returns the
+// writer feeding its body and a channel receiving its response's status and
+// body once it ends.
+func openStream(t testing.TB, ts *httptest.Server, room string) (*io.PipeWriter, <-chan string) {
+	t.Helper()
+	body, producer := io.Pipe()
+	t.Cleanup(func() { producer.Close() })
+	done := make(chan string, 1)
+	go func() {
+		res, err := http.Post(ts.URL+"/api/rooms/"+room+"/stream", "text/plain", body)
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		done <- res.Status + ": " + string(b)
+	}()
+	return producer, done
+}
+
+func TestSubscriberIdleTimeout(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	opts := DefaultOptions()
+	opts.SubscriberIdleTimeout = idle
+	opts.StreamIdleTimeout = 0
+	s, ts := newTestServer(t, opts)
+	producer, done := openStream(t, ts, "quiet")
+
+	start := time.Now()
+	conn := dialWS(t, ts, "/ws/quiet", nil)
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("idle WebSocket subscriber: %v, want a normal closure", err)
+	}
+	if elapsed := time.Since(start); elapsed < idle {
+		t.Errorf("disconnected after %v, want at least %v", elapsed, idle)
+	}
+	sse := openSSE(t, ts, "/sse/quiet")
+	if _, err := io.ReadAll(sse.Body); err != nil {
+		t.Errorf("idle SSE subscriber: %v, want the stream ended", err)
+	}
+	room := waitForRoom(t, s, "quiet")
+	eventually(t, "the subscribers to leave", func() bool { return room.members.Load() == 0 })
+
+	// The streaming publisher, as quiet for as long, is unaffected.
+	select {
+	case status := <-done:
+		t.Fatalf("quiet stream ended: %s", status)
+	default:
+	}
+	io.WriteString(producer, "still here\n")
+	producer.Close()
+	if status := <-done; !strings.HasPrefix(status, "200 OK") {
+		t.Errorf("stream: %s", status)
+	}
+	if got := latest(t, ts, "quiet"); got != "still here" {
+		t.Errorf("latest = %q", got)
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	opts := DefaultOptions()
+	opts.StreamIdleTimeout = idle
+	opts.SubscriberIdleTimeout = 0
+	s, ts := newTestServer(t, opts)
+	dialWS(t, ts, "/ws/quiet", nil)
+	room := waitForRoom(t, s, "quiet")
+	eventually(t, "the subscriber to join", func() bool { return room.members.Load() == 1 })
+
+	start := time.Now()
+	producer, done := openStream(t, ts, "quiet")
+	io.WriteString(producer, "one\n")
+	if status := <-done; !strings.HasPrefix(status, "408 Request Timeout: Stream idle for too long, 1 lines published") {
+		t.Errorf("idle stream: %s", status)
+	}
+	if elapsed := time.Since(start); elapsed < idle {
+		t.Errorf("stream ended after %v, want at least %v", elapsed, idle)
+	}
+
+	// The subscriber, sent nothing since, stays.
+	time.Sleep(2 * idle)
+	if n := room.members.Load(); n != 1 {
+		t.Errorf("%d subscribers after the stream's timeout, want 1", n)
+	}
+}
@@ -0,0 +1,28 @@
+package relay
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// maxRequestIDLength bounds the length of a request ID supplied by a
+// publisher.
+const maxRequestIDLength = 128
+
+// requestID returns the ID a publish is logged with: the one the publisher
+// supplied in the X-Request-ID header, or else a new one. It is echoed in the
+// response's X-Request-ID header.
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" || len(id) > maxRequestIDLength {
+		id = newConnectionID()
+	}
+	w.Header().Set("X-Request-ID", id)
+	return id
+}
+
+// log returns the logger for the client's events, carrying its room and
+// connection ID.
+func (c *Client) log() *slog.Logger {
+	return c.room.srv.log.With("room", c.room.name, "client", c.id)
+}
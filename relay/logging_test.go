@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// logRecords returns the JSON log records in logs with the given message.
+func logRecords(t testing.TB, logs *logBuffer, msg string) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	for line := range strings.Lines(logs.String()) {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		if record["msg"] == msg {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestStructuredLogs(t *testing.T) {
+	var logs logBuffer
+	opts := DefaultOptions()
+	opts.Logger = slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	s, ts := newTestServer(t, opts)
+	conn := dialWS(t, ts, "/ws/logged", nil)
+	room := waitForRoom(t, s, "logged")
+	waitForClients(t, room, 1)
+
+	// Publishes are logged with the request ID the publisher sent, or a
+	// generated one, which is returned either way.
+	for _, tt := range []struct {
+		sent    string
+		echoed  bool
+		content string
+	}{
+		{"trace-123", true, "first"},
+		{"", false, "second"},
+		{strings.Repeat("r", maxRequestIDLength+1), false, "third"},
+	} {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/logged?content="+tt.content, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.sent != "" {
+			req.Header.Set("X-Request-ID", tt.sent)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		id := res.Header.Get("X-Request-ID")
+		if res.StatusCode != http.StatusOK || id == "" || (id == tt.sent) != tt.echoed {
+			t.Errorf("publish with X-Request-ID %.20q: status %d, X-Request-ID %.20q", tt.sent, res.StatusCode, id)
+		}
+		conn.ReadMessage()
+
+		var logged map[string]any
+		for _, record := range logRecords(t, &logs, "broadcast") {
+			if record["request_id"] == id {
+				logged = record
+			}
+		}
+		if logged == nil || logged["room"] != "logged" || logged["size"] != float64(len(tt.content)) || logged["clients"] != float64(1) {
+			t.Errorf("broadcast of %s logged as %v", tt.content, logged)
+		}
+	}
+
+	// Subscribers are logged joining and leaving, with their connection ID.
+	conn.Close()
+	waitForClients(t, room, 0)
+	registered, unregistered := logRecords(t, &logs, "client registered"), logRecords(t, &logs, "client unregistered")
+	if len(registered) != 1 || len(unregistered) != 1 {
+		t.Fatalf("logged %d registrations and %d unregistrations, want one each", len(registered), len(unregistered))
+	}
+	if r, u := registered[0], unregistered[0]; r["room"] != "logged" || r["transport"] != "ws" || r["client"] == nil || u["client"] != r["client"] || u["bytes_sent"] != float64(len("first")+len("second")+len("third")) {
+		t.Errorf("logged registration %v and unregistration %v", r, u)
+	}
+}
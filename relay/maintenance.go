@@ -0,0 +1,132 @@
+package relay
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maintenanceEvent is the notice sent to subscribers disconnected when
+// maintenance starts.
+type maintenanceEvent struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	// ReconnectIn is the number of milliseconds after which the relay is
+	// expected back, if known.
+	ReconnectIn int64 `json:"reconnect_in_ms,omitempty"`
+}
+
+// unlessMaintenance wraps a public endpoint so that it responds with 503
+// while the server is in maintenance.
+func (s *Server) unlessMaintenance(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.maintenance.Load() {
+			s.serveMaintenance(w)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// serveMaintenance responds with 503 and MaintenancePage, or the maintenance
+// message if there is no page.
+func (s *Server) serveMaintenance(w http.ResponseWriter) {
+	if s.opts.MaintenancePage != "" {
+		if page, err := os.ReadFile(s.opts.MaintenancePage); err == nil {
+			contentType := mime.TypeByExtension(filepath.Ext(s.opts.MaintenancePage))
+			if contentType == "" {
+				contentType = "text/html; charset=utf-8"
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(page)
+			return
+		}
+	}
+	http.Error(w, *s.maintenanceMessage.Load(), http.StatusServiceUnavailable)
+}
+
+// handleHealth reports whether the relay is serving: GET /healthz
+// It responds with 503 during maintenance and shutdown.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case s.shuttingDown.Load():
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting_down"})
+	case s.maintenance.Load():
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "maintenance", "message": *s.maintenanceMessage.Load()})
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+// handleMaintenance turns maintenance mode on or off:
+// POST /admin/maintenance?enabled={bool}&message={text}&disconnect={bool}&reconnect_in={duration}
+// With disconnect, current subscribers are sent a maintenance notice, with
+// reconnect_in as a hint of when to come back, and disconnected.
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "Invalid enabled parameter", http.StatusBadRequest)
+		return
+	}
+	disconnect := false
+	if v := r.URL.Query().Get("disconnect"); v != "" {
+		if disconnect, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Invalid disconnect parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	var reconnectIn time.Duration
+	if v := r.URL.Query().Get("reconnect_in"); v != "" {
+		if reconnectIn, err = time.ParseDuration(v); err != nil || reconnectIn < 0 {
+			http.Error(w, "Invalid reconnect_in parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if message := r.URL.Query().Get("message"); message != "" {
+		s.maintenanceMessage.Store(&message)
+	}
+	s.maintenance.Store(enabled)
+
+	disconnected := 0
+	if enabled && disconnect {
+		notice, _ := json.Marshal(maintenanceEvent{Type: "maintenance", Message: *s.maintenanceMessage.Load(), ReconnectIn: reconnectIn.Milliseconds()})
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, room := range append(s.rooms.all(), s.directoryRoom()) {
+			wg.Go(func() {
+				n := room.disconnectAll(notice)
+				mu.Lock()
+				disconnected += n
+				mu.Unlock()
+			})
+		}
+		wg.Wait()
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"maintenance": enabled, "message": *s.maintenanceMessage.Load(), "disconnected": disconnected})
+}
+
+// disconnectAll sends the room's subscribers notice and disconnects them,
+// leaving the room open. It returns the number of subscribers disconnected.
+func (r *Room) disconnectAll(notice []byte) int {
+	n := 0
+	r.do(func() {
+		r.fanOut(notice, nil)
+		for client := range r.clients {
+			close(client.send)
+			r.deleteClient(client)
+			n++
+		}
+		if n > 0 {
+			r.announceClients()
+		}
+	})
+	return n
+}
@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMaintenance(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	if code, body := publish(t, ts, "live", "before", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	conn := dialWS(t, ts, "/ws/live", nil)
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "before" {
+		t.Fatalf("replay %q (%v)", message, err)
+	}
+
+	code, body := admin(t, ts, http.MethodPost, "/admin/maintenance?enabled=true&message=Back+soon&disconnect=true&reconnect_in=1m", "")
+	if code != http.StatusOK {
+		t.Fatalf("starting maintenance: %d %s", code, body)
+	}
+	var started struct {
+		Disconnected int `json:"disconnected"`
+	}
+	if err := json.Unmarshal([]byte(body), &started); err != nil || started.Disconnected != 1 {
+		t.Errorf("starting maintenance: %s, want 1 subscriber disconnected", body)
+	}
+
+	// The subscriber is told why, and when to come back.
+	var notice maintenanceEvent
+	if err := conn.ReadJSON(&notice); err != nil {
+		t.Fatal(err)
+	}
+	if want := (maintenanceEvent{Type: "maintenance", Message: "Back soon", ReconnectIn: 60000}); notice != want {
+		t.Errorf("notice %+v, want %+v", notice, want)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Errorf("after the notice: %v, want a try again later close", err)
+	}
+
+	// Publishing and subscribing are unavailable, and health says why.
+	if code, body := publish(t, ts, "live", "during", nil); code != http.StatusServiceUnavailable || strings.TrimSpace(body) != "Back soon" {
+		t.Errorf("publish: %d %s, want 503 with the message", code, body)
+	}
+	_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/live", nil)
+	if err == nil || res == nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("subscribing: %v, want status 503", err)
+	}
+	if res := openSSE(t, ts, "/sse/live"); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("subscribing over SSE: status %d, want 503", res.StatusCode)
+	}
+	code, body = request(t, http.MethodGet, ts.URL+"/healthz", "", nil)
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, `"maintenance"`) {
+		t.Errorf("health: %d %s, want 503 reporting maintenance", code, body)
+	}
+	if got := string(s.rooms.getRoom("live").lastContent.content()); got != "before" {
+		t.Errorf("retained %q, want the publish during maintenance ignored", got)
+	}
+
+	// Ending maintenance restores service.
+	if code, body := admin(t, ts, http.MethodPost, "/admin/maintenance?enabled=false", ""); code != http.StatusOK {
+		t.Fatalf("ending maintenance: %d %s", code, body)
+	}
+	if code, body := request(t, http.MethodGet, ts.URL+"/healthz", "", nil); code != http.StatusOK {
+		t.Errorf("health: %d %s", code, body)
+	}
+	if code, body := publish(t, ts, "live", "after", nil); code != http.StatusOK {
+		t.Errorf("publish: %d %s", code, body)
+	}
+	dialWS(t, ts, "/ws/live", nil)
+}
+
+func TestMaintenancePage(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "maintenance.html")
+	if err := os.WriteFile(page, []byte("<h1>Down for maintenance</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.Maintenance = true
+	opts.MaintenancePage = page
+	_, ts := newTestServer(t, opts)
+
+	res, err := http.Post(ts.URL+"/room1?content=hello", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable || res.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("publish: status %d, Content-Type %q, want 503 with the page", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+}
@@ -0,0 +1,30 @@
+package relay
+
+// joinMessages returns the number of messages the room queues for client on
+// joining that don't count towards its max_messages: its presence baseline
+// and stats and, unless it asked to count them, the replayed history messages.
+// It must be called on the room's goroutine.
+func (r *Room) joinMessages(client *Client, replayed int) int {
+	n := 0
+	if r.srv.opts.Presence && r.srv.opts.PresenceBaseline {
+		n++
+	}
+	if client.wantsStats {
+		n++
+	}
+	if !client.countReplay {
+		n += replayed
+	}
+	return n
+}
+
+// messageLimit returns the number of messages to send the client before
+// disconnecting it: its max_messages plus the welcome message and the
+// uncounted messages it was sent on joining.
+func (c *Client) messageLimit() int {
+	limit := c.maxMessages + int(c.uncounted.Load())
+	if c.room.srv.opts.Welcome {
+		limit++
+	}
+	return limit
+}
@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMaxMessages(t *testing.T) {
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"max_messages=3", []string{"retained", "message 1", "message 2"}},
+		{"max_messages=3&count_replay=0", []string{"retained", "message 1", "message 2", "message 3"}},
+	} {
+		s, ts := newTestServer(t, DefaultOptions())
+		if code, body := publish(t, ts, "limited", "retained", nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+		conn := dialWS(t, ts, "/ws/limited?"+tt.query, nil)
+		room := waitForRoom(t, s, "limited")
+		waitForClients(t, room, 1)
+		for i := 1; i <= 5; i++ {
+			if code, body := publish(t, ts, "limited", fmt.Sprint("message ", i), nil); code != http.StatusOK {
+				t.Fatalf("publish: %d %s", code, body)
+			}
+		}
+
+		var got []string
+		var err error
+		for {
+			var message []byte
+			if _, message, err = conn.ReadMessage(); err != nil {
+				break
+			}
+			got = append(got, string(message))
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: received %q, want %q", tt.query, got, tt.want)
+		}
+		if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Errorf("%s: closed with %v, want a normal closure", tt.query, err)
+		}
+	}
+}
+
+func TestMaxMessagesInvalid(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	for _, v := range []string{"0", "-1", "many"} {
+		_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/limited?max_messages="+v, nil)
+		if err == nil || res == nil || res.StatusCode != http.StatusBadRequest {
+			t.Errorf("max_messages=%s: %v, want status 400", v, err)
+		}
+	}
+}
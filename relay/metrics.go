@@ -0,0 +1,198 @@
+package relay
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// metricCounters are a server's instrumentation points, updated as it runs.
+type metricCounters struct {
+	// messagesPublished counts messages published to rooms.
+	messagesPublished atomic.Int64
+
+	// bytesPublished counts the bytes of messages published to rooms.
+	bytesPublished atomic.Int64
+
+	// clientDrops counts clients disconnected for not keeping up with their room.
+	clientDrops atomic.Int64
+
+	// writeTimeouts counts WebSocket clients disconnected because a write to
+	// them timed out.
+	writeTimeouts atomic.Int64
+
+	// upgradeFailures counts WebSocket handshakes that failed after the
+	// subscriber was admitted.
+	upgradeFailures atomic.Int64
+
+	// historyEvictions counts history messages evicted to keep the histories
+	// of all rooms within MaxTotalHistoryBytes.
+	historyEvictions atomic.Int64
+
+	// roomFullRejections, connectionRejections and roomsRejected count the
+	// subscribers turned away by MaxRoomClients, by MaxConnections or
+	// another server-wide connection limit, and the rooms not created for
+	// MaxRooms.
+	roomFullRejections   atomic.Int64
+	connectionRejections atomic.Int64
+	roomsRejected        atomic.Int64
+}
+
+// metricsBatch holds a room's metric updates that haven't been added to the
+// shared counters yet. It is only used from the room's goroutine.
+type metricsBatch struct {
+	messages int64
+	bytes    int64
+	drops    int64
+
+	// counters are the shared counters the updates are added to, and batched
+	// is set if they are only added when the room flushes the batch.
+	counters *metricCounters
+	batched  bool
+}
+
+// published counts a message of size bytes published to the room.
+func (b *metricsBatch) published(size int) {
+	b.messages++
+	b.bytes += int64(size)
+	if !b.batched {
+		b.flush()
+	}
+}
+
+// dropped counts a client disconnected for not keeping up.
+func (b *metricsBatch) dropped() {
+	b.drops++
+	if !b.batched {
+		b.flush()
+	}
+}
+
+// flush adds the accumulated updates to the shared counters.
+func (b *metricsBatch) flush() {
+	if b.messages != 0 {
+		b.counters.messagesPublished.Add(b.messages)
+		b.counters.bytesPublished.Add(b.bytes)
+	}
+	if b.drops != 0 {
+		b.counters.clientDrops.Add(b.drops)
+	}
+	b.messages, b.bytes, b.drops = 0, 0, 0
+}
+
+// handleMetrics serves the relay's metrics in the Prometheus text format:
+// GET /metrics
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics := []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"relay_rooms_total", "gauge", "Rooms.", int64(s.rooms.count())},
+		{"relay_clients_total", "gauge", "Connected subscribers across WebSocket and SSE.", s.connections.Load()},
+		{"relay_messages_published_total", "counter", "Messages published to rooms.", s.metrics.messagesPublished.Load()},
+		{"relay_bytes_published_total", "counter", "Bytes of messages published to rooms.", s.metrics.bytesPublished.Load()},
+		{"relay_client_send_drops_total", "counter", "Subscribers disconnected for not keeping up with their room.", s.metrics.clientDrops.Load()},
+		{"relay_client_write_timeouts_total", "counter", "WebSocket subscribers disconnected because a write to them timed out.", s.metrics.writeTimeouts.Load()},
+		{"relay_history_bytes", "gauge", "Bytes of messages retained in room histories.", s.historyBytes.Load()},
+		{"relay_history_evictions_total", "counter", "History messages evicted to stay within -max-total-history-bytes.", s.metrics.historyEvictions.Load()},
+		{"relay_ws_upgrade_failures_total", "counter", "WebSocket handshakes that failed.", s.metrics.upgradeFailures.Load()},
+		{"relay_room_full_rejections_total", "counter", "Subscribers rejected for -max-room-clients or -max-anonymous-room-clients.", s.metrics.roomFullRejections.Load()},
+		{"relay_connection_rejections_total", "counter", "Subscribers rejected for -max-connections, -max-anonymous-connections or -max-sse-connections.", s.metrics.connectionRejections.Load()},
+		{"relay_rooms_rejected_total", "counter", "Rooms not created for -max-rooms.", s.metrics.roomsRejected.Load()},
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+
+	// Room names are limited to characters that need no escaping in labels.
+	rooms := s.rooms.all()
+	slices.SortFunc(rooms, func(a, b *Room) int { return strings.Compare(a.name, b.name) })
+	fmt.Fprint(w, "# HELP relay_room_clients Connected subscribers per room.\n# TYPE relay_room_clients gauge\n")
+	for _, room := range rooms {
+		fmt.Fprintf(w, "relay_room_clients{room=\"%s\"} %d\n", room.name, room.members.Load())
+	}
+}
+
+// publishDebugVars publishes the server's room, client and published message
+// counts as expvar variables.
+func (s *Server) publishDebugVars() error {
+	vars := []struct {
+		name  string
+		value func() any
+	}{
+		{"relay.rooms", func() any { return s.rooms.count() }},
+		{"relay.clients", func() any { return s.connections.Load() }},
+		{"relay.messages", func() any { return s.metrics.messagesPublished.Load() }},
+	}
+	for _, v := range vars {
+		if expvar.Get(v.name) != nil {
+			return fmt.Errorf("%s is already published", v.name)
+		}
+	}
+	for _, v := range vars {
+		expvar.Publish(v.name, expvar.Func(v.value))
+	}
+	return nil
+}
+
+// startStatsD starts sending the server's metrics to a StatsD server at addr
+// every StatsDInterval, until the server shuts down: counters as deltas since
+// the previous flush, and gauges as their current value.
+func (s *Server) startStatsD(addr string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	counters := []struct {
+		name  string
+		value *atomic.Int64
+		last  int64
+	}{
+		{name: "messages_published", value: &s.metrics.messagesPublished},
+		{name: "bytes_published", value: &s.metrics.bytesPublished},
+		{name: "client_drops", value: &s.metrics.clientDrops},
+		{name: "client_write_timeouts", value: &s.metrics.writeTimeouts},
+		{name: "ws_upgrade_failures", value: &s.metrics.upgradeFailures},
+		{name: "history_evictions", value: &s.metrics.historyEvictions},
+	}
+
+	go func() {
+		defer conn.Close()
+		ticker := time.NewTicker(s.opts.StatsDInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.shutdownStarted:
+				return
+			}
+			var lines []string
+			for i := range counters {
+				c := &counters[i]
+				v := c.value.Load()
+				if delta := v - c.last; delta != 0 {
+					lines = append(lines, fmt.Sprintf("%s%s:%d|c", s.opts.StatsDPrefix, c.name, delta))
+				}
+				c.last = v
+			}
+			lines = append(lines,
+				fmt.Sprintf("%sclients:%d|g", s.opts.StatsDPrefix, s.connections.Load()),
+				fmt.Sprintf("%srooms:%d|g", s.opts.StatsDPrefix, s.rooms.count()),
+				fmt.Sprintf("%shistory_bytes:%d|g", s.opts.StatsDPrefix, s.historyBytes.Load()),
+			)
+			lines = append(lines, s.tagGauges.statsdLines(s.opts.StatsDPrefix)...)
+			if _, err := conn.Write([]byte(strings.Join(lines, "\n"))); err != nil {
+				s.log.Warn("sending metrics to StatsD", "err", err)
+			}
+		}
+	}()
+	return nil
+}
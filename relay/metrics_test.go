@@ -0,0 +1,246 @@
+package relay
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metricValue returns the value of the unlabeled metric name in the metrics
+// served by ts, or -1 if there is none.
+func metricValue(t testing.TB, ts string, name string) int64 {
+	t.Helper()
+	code, body := request(t, http.MethodGet, ts+"/metrics", "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("GET /metrics: %d %s", code, body)
+	}
+	for line := range strings.SplitSeq(body, "\n") {
+		var value int64
+		if _, err := fmt.Sscanf(line, name+" %d", &value); err == nil {
+			return value
+		}
+	}
+	return -1
+}
+
+func TestBatchedMetricsMatchTotals(t *testing.T) {
+	for _, interval := range []time.Duration{0, 20 * time.Millisecond} {
+		t.Run(fmt.Sprint("interval=", interval), func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.MetricsFlushInterval = interval
+			opts.PublishRate = 0
+			_, ts := newTestServer(t, opts)
+
+			var messages, bytes int64
+			for i := range 30 {
+				room := fmt.Sprint("room", i%3)
+				if i < 3 {
+					// Creating the room is announced in the directory
+					// room.
+					event, _ := json.Marshal(directoryEvent{Type: "room_created", Room: room})
+					messages++
+					bytes += int64(len(event))
+				}
+				content := strings.Repeat("x", i+1)
+				if code, body := publish(t, ts, room, content, nil); code != http.StatusOK {
+					t.Fatalf("publish: %d %s", code, body)
+				}
+				messages++
+				bytes += int64(len(content))
+			}
+			eventually(t, "the metrics to be flushed", func() bool {
+				return metricValue(t, ts.URL, "relay_messages_published_total") == messages &&
+					metricValue(t, ts.URL, "relay_bytes_published_total") == bytes
+			})
+		})
+	}
+}
+
+func TestStatsD(t *testing.T) {
+	lis, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	opts := DefaultOptions()
+	opts.StatsDAddr = lis.LocalAddr().String()
+	opts.StatsDInterval = 10 * time.Millisecond
+	_, ts := newTestServer(t, opts)
+	if code, body := publish(t, ts, "room1", "hello", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	// Creating the room is announced in the directory room.
+	event, _ := json.Marshal(directoryEvent{Type: "room_created", Room: "room1"})
+
+	// Counters are sent as deltas, so they add up to the totals.
+	counters := make(map[string]int64)
+	gauges := make(map[string]bool)
+	lis.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64<<10)
+	for counters["relay.messages_published"] < 2 || counters["relay.bytes_published"] < int64(len(event)+len("hello")) {
+		n, _, err := lis.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("reading StatsD packets: %v (counters %v)", err, counters)
+		}
+		for line := range strings.SplitSeq(string(buf[:n]), "\n") {
+			var name string
+			var value int64
+			var kind string
+			if _, err := fmt.Sscanf(strings.Replace(line, ":", " ", 1), "%s %d|%s", &name, &value, &kind); err != nil {
+				t.Fatalf("malformed StatsD line %q: %v", line, err)
+			}
+			switch kind {
+			case "c":
+				counters[name] += value
+			case "g":
+				gauges[name] = true
+			default:
+				t.Errorf("unexpected metric type in %q", line)
+			}
+		}
+	}
+	if got, want := counters["relay.messages_published"], int64(2); got != want {
+		t.Errorf("messages_published = %d, want %d", got, want)
+	}
+	for _, name := range []string{"relay.clients", "relay.rooms"} {
+		if !gauges[name] {
+			t.Errorf("no %s gauge", name)
+		}
+	}
+}
+
+// BenchmarkMetricsUpdate counts published messages from rooms running in
+// parallel, each adding to the shared counters on every message or
+// accumulating them in a batch flushed every 1000 messages.
+func BenchmarkMetricsUpdate(b *testing.B) {
+	for _, batched := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batched=%t", batched), func(b *testing.B) {
+			var counters metricCounters
+			b.RunParallel(func(pb *testing.PB) {
+				batch := metricsBatch{counters: &counters, batched: batched}
+				for n := 0; pb.Next(); n++ {
+					batch.published(64)
+					if n%1000 == 0 {
+						batch.flush()
+					}
+				}
+				batch.flush()
+			})
+			if got := counters.messagesPublished.Load(); got != int64(b.N) {
+				b.Fatalf("counted %d messages, want %d", got, b.N)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+
+	// Scrape while rooms are created and subscribers come and go, for the
+	// race detector.
+	done := make(chan struct{})
+	scraped := make(chan struct{})
+	go func() {
+		defer close(scraped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				http.Get(ts.URL + "/metrics")
+			}
+		}
+	}()
+	for i := range 5 {
+		dialWS(t, ts, fmt.Sprint("/ws/room", i%2), nil).Close()
+	}
+	close(done)
+	<-scraped
+
+	conn1 := dialWS(t, ts, "/ws/metered", nil)
+	dialWS(t, ts, "/ws/metered", nil)
+	room := waitForRoom(t, s, "metered")
+	waitForClients(t, room, 2)
+	eventually(t, "the other subscribers to leave", func() bool { return metricValue(t, ts.URL, "relay_clients_total") == 2 })
+	if got, want := metricValue(t, ts.URL, "relay_rooms_total"), int64(s.rooms.count()); got != want || want < 3 {
+		t.Errorf("relay_rooms_total = %d, want %d", got, want)
+	}
+
+	published := metricValue(t, ts.URL, "relay_messages_published_total")
+	joinTestClient(t, room, 0)
+	if code, body := publish(t, ts, "metered", "hello", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	conn1.ReadMessage()
+	eventually(t, "the metrics to be updated", func() bool {
+		return metricValue(t, ts.URL, "relay_messages_published_total") > published &&
+			metricValue(t, ts.URL, "relay_client_send_drops_total") == 1
+	})
+}
+
+func TestDebugVars(t *testing.T) {
+	opts := DefaultOptions()
+	opts.DebugVars = true
+	// expvar variables can only be published once per process, so only the
+	// first run of the test can serve them.
+	if expvar.Get("relay.rooms") == nil {
+		_, ts := newTestServer(t, opts)
+		dialWS(t, ts, "/ws/vars", nil)
+		if code, body := publish(t, ts, "vars", "hello", nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+
+		var vars map[string]json.RawMessage
+		eventually(t, "the variables to be updated", func() bool {
+			code, body := request(t, http.MethodGet, ts.URL+"/debug/vars", "", nil)
+			if code != http.StatusOK {
+				t.Fatalf("GET /debug/vars: %d %s", code, body)
+			}
+			if err := json.Unmarshal([]byte(body), &vars); err != nil {
+				t.Fatal(err)
+			}
+			return string(vars["relay.rooms"]) == "1" && string(vars["relay.clients"]) == "1" && string(vars["relay.messages"]) != "0"
+		})
+	}
+
+	// Another server can't publish them too.
+	if _, err := NewServer(opts); err == nil {
+		t.Error("a second server published the expvar variables")
+	}
+}
+
+func TestRoomClientsMetric(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	for _, path := range []string{"/ws/busy", "/ws/busy", "/ws/quiet"} {
+		dialWS(t, ts, path, nil)
+	}
+	waitForClients(t, waitForRoom(t, s, "busy"), 2)
+	waitForClients(t, waitForRoom(t, s, "quiet"), 1)
+
+	code, body := request(t, http.MethodGet, ts.URL+"/metrics", "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("GET /metrics: %d %s", code, body)
+	}
+	for _, want := range []string{`relay_room_clients{room="busy"} 2`, `relay_room_clients{room="quiet"} 1`} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics are missing %s", want)
+		}
+	}
+
+	// A request to the WebSocket endpoint that isn't a handshake fails to
+	// upgrade.
+	if code, _ := request(t, http.MethodGet, ts.URL+"/ws/busy", "", nil); code != http.StatusBadRequest {
+		t.Errorf("plain GET of a WebSocket endpoint: status %d, want 400", code)
+	}
+	if got := metricValue(t, ts.URL, "relay_ws_upgrade_failures_total"); got != 1 {
+		t.Errorf("relay_ws_upgrade_failures_total = %d, want 1", got)
+	}
+}
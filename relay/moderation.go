@@ -0,0 +1,129 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+)
+
+// noticeEvent is an administrative notice broadcast to every room's
+// subscribers.
+type noticeEvent struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// clientInfos returns the details of the room's subscribers, oldest connection
+// first.
+func (r *Room) clientInfos() []clientInfo {
+	infos := []clientInfo{}
+	r.do(func() {
+		for client := range r.clients {
+			infos = append(infos, client.info())
+		}
+	})
+	slices.SortFunc(infos, func(a, b clientInfo) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+	return infos
+}
+
+// kick disconnects the subscriber with the given connection ID, reporting
+// whether the room had one.
+func (r *Room) kick(id string) bool {
+	kicked := false
+	r.do(func() {
+		for client := range r.clients {
+			if client.id == id {
+				client.kicked.Store(true)
+				r.remove(client)
+				kicked = true
+				return
+			}
+		}
+	})
+	return kicked
+}
+
+// handleRoomClients lists a room's subscribers: GET /api/rooms/{roomID}/clients
+func (s *Server) handleRoomClients(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	room, ok := s.rooms.lookupRoom(roomID)
+	if !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "clients": room.clientInfos()})
+}
+
+// handleKickClient disconnects one of a room's subscribers:
+// DELETE /api/rooms/{roomID}/clients/{id}
+// WebSocket subscribers are closed with 1008 (policy violation).
+func (s *Server) handleKickClient(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	room, ok := s.rooms.lookupRoom(roomID)
+	if !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	id := r.PathValue("id")
+	if !room.kick(id) {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "kicked": id})
+}
+
+// handleNotice broadcasts an administrative notice to the current
+// subscribers of every room: POST /admin/notice with {"message":"..."}
+// Like commands, notices aren't retained, replayed or mirrored. It responds
+// with the number of rooms and subscribers the notice was queued for.
+func (s *Server) handleNotice(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMetaBodySize)).Decode(&req); err != nil {
+		http.Error(w, "Invalid notice: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Message == "" {
+		http.Error(w, "Missing message", http.StatusBadRequest)
+		return
+	}
+
+	notice, _ := json.Marshal(noticeEvent{Type: "notice", Message: req.Message})
+	rooms, delivered := 0, 0
+	for _, room := range s.rooms.all() {
+		room.do(func() {
+			room.fanOut(notice, nil)
+			delivered += len(room.clients)
+		})
+		rooms++
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"rooms": rooms, "delivered": delivered})
+}
+
+// transport names the protocol the client is connected over.
+func (c *Client) transport() string {
+	switch {
+	case c.sse:
+		return "sse"
+	case c.grpc:
+		return "grpc"
+	}
+	return "ws"
+}
+
+// info describes the client in admin responses.
+func (c *Client) info() clientInfo {
+	return clientInfo{
+		ID:          c.id,
+		Room:        c.room.name,
+		Transport:   c.transport(),
+		RemoteAddr:  c.remoteAddr,
+		ConnectedAt: c.connectedAt,
+		BytesSent:   c.bytesSent.Load(),
+		Acked:       c.acked.Load(),
+		Tags:        c.tags,
+	}
+}
@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestKickClient(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	ws := dialWS(t, ts, "/ws/moderated", nil)
+	room := waitForRoom(t, s, "moderated")
+	waitForClients(t, room, 1)
+	openSSE(t, ts, "/sse/moderated")
+	waitForClients(t, room, 2)
+	if code, body := publish(t, ts, "moderated", "hello", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if _, _, err := ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	var list struct {
+		Clients []clientInfo `json:"clients"`
+	}
+	eventually(t, "the bytes sent to be counted", func() bool {
+		code, body := admin(t, ts, http.MethodGet, "/api/rooms/moderated/clients", "")
+		if code != http.StatusOK {
+			t.Fatalf("listing clients: %d %s", code, body)
+		}
+		if err := json.Unmarshal([]byte(body), &list); err != nil {
+			t.Fatal(err)
+		}
+		return len(list.Clients) == 2 && list.Clients[0].BytesSent == int64(len("hello"))
+	})
+	// The oldest connection comes first.
+	if ws, sse := list.Clients[0], list.Clients[1]; ws.Transport != "ws" || sse.Transport != "sse" || ws.ID == "" || ws.RemoteAddr == "" || ws.ConnectedAt.After(sse.ConnectedAt) {
+		t.Errorf("clients %+v, want the WebSocket subscriber then the SSE one", list.Clients)
+	}
+
+	kicked := list.Clients[0].ID
+	if code, body := admin(t, ts, http.MethodDelete, "/api/rooms/moderated/clients/"+kicked, ""); code != http.StatusOK {
+		t.Fatalf("kicking: %d %s", code, body)
+	}
+	_, _, err := ws.ReadMessage()
+	if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "kicked by an administrator" {
+		t.Errorf("kicked subscriber: %v, want a policy violation close", err)
+	}
+	waitForClients(t, room, 1)
+	for _, path := range []string{"/api/rooms/moderated/clients/" + kicked, "/api/rooms/unknown/clients/" + kicked} {
+		if code, _ := admin(t, ts, http.MethodDelete, path, ""); code != http.StatusNotFound {
+			t.Errorf("DELETE %s: status %d, want 404", path, code)
+		}
+	}
+}
+
+func TestNotice(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	if code, body := publish(t, ts, "first", "retained", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	ws := dialWS(t, ts, "/ws/first", nil)
+	if _, message, err := ws.ReadMessage(); err != nil || string(message) != "retained" {
+		t.Fatalf("received %q (%v), want the retained content", message, err)
+	}
+	sse := bufio.NewReader(openSSE(t, ts, "/sse/second").Body)
+	waitForClients(t, waitForRoom(t, s, "first"), 1)
+	waitForClients(t, waitForRoom(t, s, "second"), 1)
+
+	code, body := admin(t, ts, http.MethodPost, "/admin/notice", `{"message":"Maintenance at 22:00 UTC"}`)
+	var result struct {
+		Delivered int `json:"delivered"`
+	}
+	if code != http.StatusOK || json.Unmarshal([]byte(body), &result) != nil || result.Delivered != 2 {
+		t.Fatalf("notice: %d %s, want it delivered to both subscribers", code, body)
+	}
+	const want = `{"type":"notice","message":"Maintenance at 22:00 UTC"}`
+	if _, message, err := ws.ReadMessage(); err != nil || string(message) != want {
+		t.Errorf("WebSocket subscriber received %q (%v), want the notice", message, err)
+	}
+	if got := readEvent(t, sse); got != want {
+		t.Errorf("SSE subscriber received %q, want the notice", got)
+	}
+	// Notices aren't retained.
+	if got := latest(t, ts, "first"); got != "retained" {
+		t.Errorf("latest = %q, want the published content", got)
+	}
+
+	if code, body := admin(t, ts, http.MethodPost, "/admin/notice", `{"message":""}`); code != http.StatusBadRequest {
+		t.Errorf("an empty notice: %d %s, want 400", code, body)
+	}
+}
@@ -0,0 +1,514 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Options configures a Server. Start from DefaultOptions: the zero value
+// disables features whose defaults are on, such as WebSocket pings. Fields
+// mirror the relay binary's flags, which document them further.
+type Options struct {
+	// Static holds the frontend files served at the root of the public
+	// endpoints, such as the relay binary's embedded copy, or is nil to serve
+	// no frontend.
+	Static fs.FS
+	// StaticDir, if set, is a directory the frontend files are served from
+	// instead of Static, e.g. to work on them without rebuilding.
+	StaticDir string
+	// BasePath is the path prefix the relay is served under, e.g. when it
+	// sits behind a reverse proxy at https://example.com/relay/. It is used
+	// when building room URLs.
+	BasePath string
+
+	// ReadBufferSize and WriteBufferSize size the I/O buffers of WebSocket
+	// connections. Larger buffers save syscalls for large messages at the
+	// cost of memory per connection.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// WriteBufferPool shares write buffers between WebSocket connections,
+	// which then hold one only while writing a message. This saves memory
+	// when most connections are idle, at the cost of getting a buffer from
+	// the pool for every message.
+	WriteBufferPool bool
+
+	// AllowMissingOrigin admits WebSocket upgrades without an Origin header,
+	// which native clients typically omit. Disable it to only accept
+	// browsers.
+	AllowMissingOrigin bool
+	// AllowedOrigins restricts which websites may open WebSockets to the
+	// relay or publish to it, so that arbitrary pages can't use rooms whose
+	// names they guess: a comma-separated list of origins, e.g.
+	// https://app.example.com, where * matches any part of a host, as in
+	// https://*.example.com. Publishes from these origins get CORS headers.
+	// Empty allows only the relay's own origin, and * any origin.
+	AllowedOrigins string
+	// AllowAnyOrigin allows every origin regardless of AllowedOrigins, for
+	// development.
+	AllowAnyOrigin bool
+	// Subprotocol, if set, rejects WebSocket upgrades that don't offer it in
+	// Sec-WebSocket-Protocol. It is selected when offered.
+	Subprotocol string
+	// Compression is the default permessage-deflate setting of new rooms.
+	Compression bool
+	// On connections that negotiated permessage-deflate, messages shorter
+	// than CompressionMinSize bytes are sent uncompressed, and so are binary
+	// messages unless CompressBinary is set.
+	CompressionMinSize int
+	CompressBinary     bool
+	// AutoDetectFrameType sends messages that are valid UTF-8 to WebSocket
+	// subscribers in text frames and others in binary frames. Without it,
+	// every message is sent in a binary frame, as text frames must be valid
+	// UTF-8.
+	AutoDetectFrameType bool
+
+	// WSPing enables WebSocket pings. Without them, a subscriber is
+	// considered gone once nothing has been read from it for WSReadTimeout,
+	// and dead peers are otherwise left to TCP keepalive.
+	WSPing        bool
+	WSReadTimeout time.Duration
+	// WSPongTimeout is how long, with WSPing, a subscriber may take to answer
+	// a ping before it is considered gone. Pings are sent every nine tenths
+	// of it.
+	WSPongTimeout time.Duration
+	// SubscriberIdleTimeout disconnects subscribers that haven't been sent
+	// anything, pings and keepalives aside, for this long. 0 disables it.
+	SubscriberIdleTimeout time.Duration
+	// StreamIdleTimeout ends streaming publishes that send no line for this
+	// long. 0 lets them stay quiet indefinitely.
+	StreamIdleTimeout time.Duration
+	// MaxWSMessageSize is the largest message a WebSocket client may send.
+	// Larger messages are answered with a 1009 (message too big) close, and
+	// oversized or otherwise malformed control frames with a 1002 (protocol
+	// error) close.
+	MaxWSMessageSize int64
+	// WSPublish lets WebSocket subscribers publish to their room by sending
+	// it messages, e.g. for collaborative editing where every peer pushes
+	// updates. Otherwise messages from clients are read and discarded.
+	WSPublish bool
+	// WSPublishOptIn limits WSPublish to the clients that connect with
+	// ?mode=rw. Clients can always opt out with ?mode=r.
+	WSPublishOptIn bool
+	// WSPublishRate and WSPublishBurst bound how fast each WebSocket client
+	// may publish with WSPublish, on top of the room's PublishRate, so one
+	// chatty client can't use up the room's rate for everyone else. A
+	// WSPublishRate of 0 means no per-client limit.
+	WSPublishRate  float64
+	WSPublishBurst int
+	// Welcome sends each WebSocket subscriber its connection ID before any
+	// other message.
+	Welcome bool
+	// CloseTimeout bounds how long a WebSocket client is given to answer a
+	// close frame, so unresponsive clients can't hold up a shutdown.
+	CloseTimeout time.Duration
+
+	// MaxSSEConnections caps SSE subscribers on their own, on top of the
+	// limits they share with WebSocket subscribers. 0 means unlimited.
+	MaxSSEConnections int
+	// SSEKeepalive is how long an SSE stream may stay quiet before a comment
+	// is sent to keep proxies from closing it. 0 disables keepalives.
+	SSEKeepalive time.Duration
+
+	// Envelope wraps each published message in a JSON envelope for
+	// subscribers, carrying the room, publish time and the room's sequence
+	// number for it, so clients can detect messages missed while they were
+	// disconnected.
+	Envelope bool
+	// EnvelopeTypes tags enveloped messages with a type, "snapshot" for the
+	// retained messages replayed to a joining subscriber and "update" for
+	// live ones, so clients can tell the initial state from what follows.
+	// It applies to envelopes from Envelope and to those subscribers ask for.
+	EnvelopeTypes bool
+
+	// Templates are the templates subscribers can have each JSON message
+	// rendered with before delivery, by selecting one by name with
+	// ?template=NAME.
+	Templates map[string]Template
+
+	// Persister, if set, durably stores the content rooms retain, and lets
+	// publishers wait for it with ?durable=1. If it is a RoomStore, such as a
+	// FileStore, rooms load their latest content and history from it when
+	// they are created, e.g. on first use after a restart.
+	Persister Persister
+
+	// Logger receives the server's logs, or slog.Default() if it is nil.
+	// Clients' lifecycles and broadcasts are logged at the debug level.
+	Logger *slog.Logger
+
+	// Backplane, if set, shares rooms' broadcasts with the other relay
+	// instances using it, so that rooms span all of them.
+	Backplane Backplane
+
+	// Maintenance starts the server in maintenance mode, which the admin API
+	// can turn off: the public endpoints respond with 503 and
+	// MaintenancePage, or MaintenanceMessage if it is empty, while the
+	// management endpoints keep working.
+	Maintenance        bool
+	MaintenanceMessage string
+	MaintenancePage    string
+
+	// Presence makes rooms broadcast their subscriber count whenever it
+	// changes.
+	Presence bool
+	// PresenceBaseline sends a joining subscriber the count as it was before
+	// its own join, so the first subscriber of a new room sees 0 before it
+	// sees 1.
+	PresenceBaseline bool
+	// PresenceSelfJoin controls whether a joining subscriber receives the
+	// presence update caused by its own join.
+	PresenceSelfJoin bool
+	// PresenceEvents makes rooms broadcast a join or leave event, with the
+	// subscriber's connection ID and the name it gave itself, whenever a
+	// subscriber joins or leaves. PresenceSelfJoin applies to them as well.
+	PresenceEvents bool
+
+	// MaxConnections caps the number of concurrent subscriber connections
+	// across WebSocket and SSE. 0 means unlimited.
+	MaxConnections int
+	// MaxRoomClients caps the subscribers of a single room, counting every
+	// transport. 0 means unlimited.
+	MaxRoomClients int
+	// MaxRooms caps the rooms subscribers and publishers may create on
+	// first use; rooms created through the admin API don't count against
+	// it. 0 means unlimited.
+	MaxRooms int
+	// MaxAnonymousConnections and MaxAnonymousRoomClients are stricter
+	// limits for subscribers that didn't present a valid JWT, within
+	// MaxConnections and MaxRoomClients. 0 leaves them to those limits
+	// alone.
+	MaxAnonymousConnections int
+	MaxAnonymousRoomClients int
+	// ShedThreshold is the fraction of MaxConnections above which slow
+	// clients are shed, lowest-priority rooms first, to make room for new
+	// connections.
+	ShedThreshold float64
+	// EvictIdleAfter lets a new connection that would exceed MaxConnections
+	// take the slot of a subscriber that hasn't been sent anything for this
+	// long, once no slow clients are left to shed. 0 disables eviction.
+	EvictIdleAfter time.Duration
+	// MaxClientRate caps the messages per second delivered to each
+	// subscriber. Subscribers may ask for a lower rate with ?rate=N.
+	MaxClientRate float64
+	// ReconnectInterval throttles subscribers that identify themselves with
+	// ?client_id=, so a client stuck in a crash loop can't reconnect in a
+	// tight loop.
+	ReconnectInterval time.Duration
+	// ResumeWindow is how long the position of a subscriber that identified
+	// itself with ?client_id= is kept after it disconnects, so that if it
+	// reconnects within the window it is only replayed the history it
+	// missed. 0 disables resuming.
+	ResumeWindow time.Duration
+
+	// TagKeys lists the query parameters subscribers may tag their
+	// connection with for analytics, comma-separated, e.g. platform,version.
+	// Tags show up in the admin client listing and as per-tag connection
+	// gauges; they don't affect routing.
+	TagKeys string
+	// MaxTagValues bounds the distinct values counted per tag key, so that
+	// arbitrary client input can't blow up the number of metrics.
+	MaxTagValues int
+
+	// HistorySize is the number of recent messages a room replays to new
+	// subscribers, at most 256.
+	HistorySize int
+	// HistoryBytes bounds the total size of the messages a room retains. 0
+	// means unlimited.
+	HistoryBytes int
+	// MaxTotalHistoryBytes bounds the total size of the messages retained in
+	// the histories of all rooms. Beyond it, history is evicted from the
+	// rooms that have gone the longest without activity. 0 means unlimited.
+	MaxTotalHistoryBytes int
+	// HistoryPerPublisher caps the messages of any one publisher in a room's
+	// history, so a chatty publisher can't crowd out the others.
+	HistoryPerPublisher int
+	// RequireRetention guards against rooms that silently drop content late
+	// subscribers expect to be replayed: publishes a room won't retain are
+	// accepted ("off"), get a warning header ("warn") or are rejected
+	// ("reject").
+	RequireRetention string
+	// MirrorHealthGate guards against silently losing messages to a failing
+	// remote mirror: publishes to a room whose remote mirror failed more
+	// than MirrorFailureThreshold of its recent deliveries are accepted
+	// ("off"), get a warning header ("warn") or are rejected ("reject").
+	MirrorHealthGate       string
+	MirrorFailureThreshold float64
+	// RetainMaxAge is how long a room keeps its retained content after the
+	// last publish. The rooms themselves stay open for live traffic. 0 keeps
+	// content indefinitely.
+	RetainMaxAge time.Duration
+	// ContentTTL is how long each retained message, and the latest content,
+	// is kept after it was published, so that stale content doesn't
+	// resurface for late subscribers. 0 keeps messages indefinitely.
+	ContentTTL time.Duration
+	// CompressRetained is the size from which rooms keep retained messages
+	// gzip-compressed in memory. Large, compressible payloads such as JSON
+	// snapshots then take a fraction of the memory, at the cost of
+	// decompressing them whenever they are replayed. 0 disables compression.
+	CompressRetained int
+
+	// MaxContentSize caps the size of published content, after decoding. 0
+	// means unlimited, or 1 MiB for request bodies.
+	MaxContentSize int
+	// PublishBodyTimeout bounds the upload of a publish request body, on its
+	// own deadline so the HTTP server's read timeout can stay generous.
+	PublishBodyTimeout time.Duration
+	// MaxSessionBytes caps the content a publish session may assemble; a
+	// part taking it further aborts the session. Sessions not committed
+	// within PublishSessionTimeout of being opened are discarded.
+	MaxSessionBytes       int
+	PublishSessionTimeout time.Duration
+	// PublishQueueDepth is the default number of publishes that may wait
+	// for a busy room before further ones are rejected. 0 means unlimited.
+	PublishQueueDepth int64
+	// PublishRate and PublishBurst bound how fast a room can be published
+	// to, so that a tight loop of publishes can't monopolize the server and
+	// flood every subscriber of the room. A PublishRate of 0 means
+	// unlimited.
+	PublishRate  float64
+	PublishBurst int
+	// TrustedPublisherTokens is a comma-separated list of tokens that exempt
+	// HTTP publishes carrying one in X-Trusted-Publisher from rate limits.
+	TrustedPublisherTokens string
+	// PublishRatePerIP gives each publisher of a room a rate limit of its
+	// own, so that one publisher flooding a room doesn't lock out the others.
+	PublishRatePerIP bool
+	// MaxPublisherIPs caps the distinct IPs that may publish to a room
+	// within PublisherIPWindow. A room written to by many sources is a sign
+	// of abuse. 0 means unlimited.
+	MaxPublisherIPs   int
+	PublisherIPWindow time.Duration
+	// MaxPublisherRooms caps the distinct rooms a publisher, identified by
+	// its token or else its IP, may write to within PublisherRoomWindow. A
+	// publisher spraying thousands of rooms is a sign of a leaked credential
+	// or a runaway script. 0 means unlimited.
+	MaxPublisherRooms   int
+	PublisherRoomWindow time.Duration
+	// DedupWindow is how long a room remembers the dedup keys of publishes,
+	// so that a publisher retrying a publish doesn't broadcast it twice.
+	DedupWindow time.Duration
+	// MaxScheduled bounds the number of scheduled messages pending across
+	// all rooms.
+	MaxScheduled int
+	// StreamPartialLine decides what happens to a final line without a
+	// trailing newline when a publish stream ends, either because the
+	// producer finished or because it disconnected: "publish" or "discard".
+	StreamPartialLine string
+	// MaxRoomStreams caps the concurrent streaming publishes to each room.
+	// Streams are long-lived, so this bounds what a room's ingestion can
+	// tie up. 0 means unlimited.
+	MaxRoomStreams int
+
+	// AutoCreateRooms, if set, is a regular expression room names must
+	// match in full for subscribers and publishers to create the room on
+	// first use. Other rooms must be created through the admin API first.
+	AutoCreateRooms string
+	// RoomIdleTimeout is how long a room may go without subscribers or
+	// activity before it is removed, freeing its memory and goroutine.
+	// Servers that see many short-lived rooms would otherwise keep every one
+	// of them forever. 0 keeps rooms forever.
+	RoomIdleTimeout time.Duration
+	// PausedPublish is what happens to publishes to a paused room: they are
+	// rejected ("reject") or, except for those that report on their
+	// delivery, buffered until the room resumes ("buffer"), up to
+	// PauseBufferSize per room.
+	PausedPublish   string
+	PauseBufferSize int
+	// RoomPanic is what happens to a room whose event loop panics: its loop
+	// is restarted, keeping its clients and state ("restart"), or the room
+	// is removed and its clients disconnected, as its state may be
+	// inconsistent ("close").
+	RoomPanic string
+	// SlowClient is what rooms do by default with a subscriber whose send
+	// buffer is full: disconnect it, drop its oldest queued message
+	// (drop_oldest) or the new one (drop_newest), or replace everything
+	// queued with the new message (coalesce). Subscribers that lose messages
+	// are told how many once their buffer has room.
+	SlowClient string
+	// FanOutThreshold is the number of clients from which rooms fan their
+	// broadcasts out in parallel, as with the parallel_fan_out meta setting,
+	// or zero to leave it to that setting alone. FanOutWorkers is the number
+	// of workers each room fans out with in parallel, or zero for one per
+	// CPU. With a single worker, rooms always fan out sequentially.
+	FanOutThreshold int
+	FanOutWorkers   int
+	// RoomCloseGrace is how long subscribers of a deleted room are given,
+	// after a closing notice, before they are disconnected.
+	RoomCloseGrace time.Duration
+
+	// JWTKey is the HMAC key subscriber tokens are signed with.
+	// Subscriptions are unauthenticated when it is empty.
+	JWTKey string
+	// AnonymousSubscribers lets subscribers without a token in when JWTKey
+	// is set, as anonymous subscribers. Tokens that are presented must
+	// still be valid.
+	AnonymousSubscribers bool
+	// RoomTokenSecret enables capability URLs: when set, the room segment of
+	// subscribe and publish URLs must be a room token signed with it rather
+	// than the room name, so room names can't be guessed.
+	RoomTokenSecret string
+	// PublishHMACKey lets servers publish without tokens in URLs: when set,
+	// publish requests must carry an HMAC signature made with it.
+	PublishHMACKey string
+	// PublishSignatureMaxAge bounds how far a signed publish's timestamp may
+	// be from the server's clock, limiting the window for replays.
+	PublishSignatureMaxAge time.Duration
+	// AuthorizeSubscriber, if set, decides on each subscribe, over WebSocket
+	// or SSE, and each read of a room's history or presence that passed the
+	// checks above, for programs with their own authentication. A non-nil
+	// error rejects the request with 403 and the error as its message.
+	AuthorizeSubscriber func(r *http.Request, room string) error
+	// AuthorizePublish, if set, likewise decides on each HTTP publish,
+	// including streaming and multi-part ones.
+	AuthorizePublish func(r *http.Request, room string) error
+	// AdminToken guards the admin API. The API is disabled when it is empty.
+	AdminToken string
+	// BridgeToken is the shared secret of relays bridging rooms with each
+	// other: relays bridging a room into this one must present it, and this
+	// one presents it to the relays its bridges connect to. Bridges into
+	// this relay are refused when it is empty.
+	BridgeToken string
+
+	// MetricsPath is where metrics are served in the Prometheus text format.
+	// It shadows GET publishes to a room of the same name. Empty disables
+	// the endpoint.
+	MetricsPath string
+	// DebugVars publishes the relay.rooms, relay.clients and relay.messages
+	// expvar variables and serves them, along with the runtime's, at
+	// /debug/vars on the management endpoints. expvar variables are global,
+	// so only one Server per process may enable it.
+	DebugVars bool
+	// Pprof serves the runtime profiles of net/http/pprof at /debug/pprof/
+	// on the management endpoints.
+	Pprof bool
+	// MetricsFlushInterval batches the metric updates of each room: they are
+	// accumulated on the room's goroutine and added to the shared counters
+	// at this interval, rather than on every message.
+	MetricsFlushInterval time.Duration
+	// StatsDAddr is the UDP address metrics are sent to in StatsD format,
+	// every StatsDInterval, with StatsDPrefix before their names.
+	StatsDAddr     string
+	StatsDPrefix   string
+	StatsDInterval time.Duration
+}
+
+// DefaultOptions returns the relay's default settings.
+func DefaultOptions() Options {
+	return Options{
+		MaintenanceMessage:     "Down for maintenance",
+		ReadBufferSize:         1024,
+		WriteBufferSize:        1024,
+		AllowMissingOrigin:     true,
+		CompressBinary:         true,
+		AutoDetectFrameType:    true,
+		WSPing:                 true,
+		WSReadTimeout:          10 * time.Minute,
+		WSPongTimeout:          pongWait,
+		MaxWSMessageSize:       512,
+		CloseTimeout:           time.Second,
+		StreamIdleTimeout:      pongWait,
+		SSEKeepalive:           pingPeriod,
+		PresenceSelfJoin:       true,
+		ShedThreshold:          0.9,
+		MaxTagValues:           20,
+		HistorySize:            1,
+		RequireRetention:       "off",
+		RoomPanic:              "restart",
+		SlowClient:             "disconnect",
+		FanOutThreshold:        1000,
+		PausedPublish:          "reject",
+		PauseBufferSize:        1000,
+		MirrorHealthGate:       "off",
+		MirrorFailureThreshold: 0.5,
+		PublishBodyTimeout:     10 * time.Second,
+		MaxSessionBytes:        defaultMaxContentSize,
+		PublishSessionTimeout:  time.Minute,
+		PublishRate:            100,
+		PublishBurst:           200,
+		WSPublishBurst:         10,
+		PublisherIPWindow:      time.Hour,
+		PublisherRoomWindow:    time.Hour,
+		DedupWindow:            5 * time.Minute,
+		MaxScheduled:           1000,
+		StreamPartialLine:      "publish",
+		PublishSignatureMaxAge: 5 * time.Minute,
+		MetricsPath:            "/metrics",
+		StatsDPrefix:           "relay.",
+		StatsDInterval:         10 * time.Second,
+	}
+}
+
+// validate checks that the options are consistent and in range.
+func (o *Options) validate() error {
+	switch {
+	case o.MetricsPath != "" && !strings.HasPrefix(o.MetricsPath, "/"):
+		return errors.New("metrics path must start with /")
+	case o.StatsDAddr != "" && o.StatsDInterval <= 0:
+		return errors.New("StatsD interval must be positive")
+	case o.ReadBufferSize <= 0 || o.WriteBufferSize <= 0:
+		return errors.New("read and write buffer sizes must be positive")
+	case o.CompressionMinSize < 0:
+		return errors.New("compression min size must not be negative")
+	case o.MaxSessionBytes <= 0 || o.PublishSessionTimeout <= 0:
+		return errors.New("max session bytes and publish session timeout must be positive")
+	case o.MaxRoomStreams < 0:
+		return errors.New("max room streams must not be negative")
+	case o.StreamPartialLine != "publish" && o.StreamPartialLine != "discard":
+		return errors.New("stream partial line must be publish or discard")
+	case o.RequireRetention != "off" && o.RequireRetention != "warn" && o.RequireRetention != "reject":
+		return errors.New("require retention must be off, warn or reject")
+	case o.MirrorHealthGate != "off" && o.MirrorHealthGate != "warn" && o.MirrorHealthGate != "reject":
+		return errors.New("mirror health gate must be off, warn or reject")
+	case o.MirrorFailureThreshold <= 0 || o.MirrorFailureThreshold > 1:
+		return errors.New("mirror failure threshold must be above 0 and at most 1")
+	case o.ContentTTL < 0:
+		return errors.New("content TTL must not be negative")
+	case o.SSEKeepalive < 0:
+		return errors.New("SSE keepalive must not be negative")
+	case o.PublishRate < 0 || (o.PublishRate > 0 && o.PublishBurst < 1):
+		return errors.New("publish rate must not be negative, and publish burst must be at least 1 when it is set")
+	case o.WSPublishRate < 0 || (o.WSPublishRate > 0 && o.WSPublishBurst < 1):
+		return errors.New("WebSocket publish rate must not be negative, and its burst must be at least 1 when it is set")
+	case o.MaxClientRate < 0 || (o.MaxClientRate > 0 && o.MaxClientRate < minClientRate):
+		return fmt.Errorf("max client rate must be 0 for unlimited or at least %g", minClientRate)
+	case o.WSPongTimeout <= 0:
+		return errors.New("WebSocket pong timeout must be positive")
+	case o.MaxWSMessageSize <= 0:
+		return errors.New("max WebSocket message size must be positive")
+	case o.MaxTagValues < 1:
+		return errors.New("max tag values must be at least 1")
+	case o.SubscriberIdleTimeout < 0 || o.StreamIdleTimeout < 0:
+		return errors.New("idle timeouts must not be negative")
+	case o.MaxAnonymousConnections < 0 || o.MaxAnonymousRoomClients < 0:
+		return errors.New("anonymous connection limits must not be negative")
+	case o.MaxTotalHistoryBytes < 0:
+		return errors.New("max total history bytes must not be negative")
+	case o.RoomIdleTimeout < 0:
+		return errors.New("room idle timeout must not be negative")
+	case o.PausedPublish != "reject" && o.PausedPublish != "buffer":
+		return errors.New("paused publish must be reject or buffer")
+	case o.PauseBufferSize < 1:
+		return errors.New("pause buffer size must be at least 1")
+	case !validSlowClientPolicy(o.SlowClient):
+		return errors.New("slow client must be disconnect, drop_oldest, drop_newest or coalesce")
+	case o.RoomPanic != "restart" && o.RoomPanic != "close":
+		return errors.New("room panic must be restart or close")
+	case o.FanOutThreshold < 0:
+		return errors.New("parallel fan-out threshold must not be negative")
+	case o.FanOutWorkers < 0:
+		return errors.New("fan-out workers must not be negative")
+	case o.PublishQueueDepth < 0:
+		return errors.New("publish queue depth must not be negative")
+	}
+	if o.AutoCreateRooms != "" {
+		if _, err := regexp.Compile(o.AutoCreateRooms); err != nil {
+			return fmt.Errorf("auto create rooms: %w", err)
+		}
+	}
+	return nil
+}
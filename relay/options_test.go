@@ -0,0 +1,27 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateStatsDInterval(t *testing.T) {
+	opts := DefaultOptions()
+	opts.StatsDAddr = "127.0.0.1:8125"
+	opts.StatsDInterval = 0
+	if err := opts.validate(); err == nil {
+		t.Fatal("validate accepted a StatsD address without an interval")
+	}
+
+	opts.StatsDInterval = time.Second
+	if err := opts.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	// Without an address the interval is unused.
+	opts.StatsDAddr = ""
+	opts.StatsDInterval = 0
+	if err := opts.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+}
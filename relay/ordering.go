@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maxOrderingKeyLength bounds the length of a publish's ordering key.
+	maxOrderingKeyLength = 256
+
+	// maxPartitionedBatch bounds the broadcasts published together by
+	// publishPartitioned.
+	maxPartitionedBatch = 64
+)
+
+// publishPartitioned publishes p together with the broadcasts already waiting
+// for the room. They are retained in the order they arrived, but their
+// fan-outs are partitioned by ordering key: the messages of each key are
+// delivered in order by a worker of their own, in parallel with the other
+// keys.
+func (r *Room) publishPartitioned(p publication) {
+	batch := []publication{p}
+drain:
+	for len(batch) < maxPartitionedBatch {
+		select {
+		case next := <-r.broadcast:
+			batch = append(batch, next)
+		default:
+			break drain
+		}
+	}
+
+	var published []publication
+	partitions := make(map[string][]publication)
+	for _, p := range batch {
+		if r.record(&p) {
+			published = append(published, p)
+			partitions[p.key] = append(partitions[p.key], p)
+		}
+	}
+	// Subscribers get the partitions interleaved in no particular order, so
+	// deltas can't be relied on.
+	r.resetDelta()
+	r.fanOutPartitions(partitions)
+	for _, p := range published {
+		r.mirror(p)
+	}
+}
+
+// fanOutPartitions sends each partition's messages, in order, to every
+// client in the room, serving the partitions in parallel. A client that
+// misses a message is skipped for the rest of that partition, so it never
+// sees a gap in a key's order, and dropped once all the workers are done, as
+// only the room's goroutine may modify r.clients. Under slow client policies
+// other than disconnect, it is kept and told how many messages it missed
+// instead.
+func (r *Room) fanOutPartitions(partitions map[string][]publication) {
+	clients := make([]*Client, 0, len(r.clients))
+	for client := range r.clients {
+		clients = append(clients, client)
+	}
+
+	var mu sync.Mutex
+	slow := make(map[*Client]int)
+	var wg sync.WaitGroup
+	for _, partition := range partitions {
+		wg.Go(func() {
+			missed := make(map[*Client]int)
+			for _, p := range partition {
+				m := &encodedMessage{raw: p.out, envelope: p.envelope, eventID: p.seq, topic: p.topic}
+				for _, client := range clients {
+					if client == p.skip || !receives(client, p.topic, p.picks) {
+						continue
+					}
+					if missed[client] > 0 {
+						missed[client]++
+						continue
+					}
+					// Clients are shared between the workers, so unlike
+					// enqueue this leaves lastMessage to the room's goroutine.
+					select {
+					case client.send <- m.forClient(client):
+					default:
+						missed[client] = 1
+					}
+				}
+			}
+			mu.Lock()
+			for client, n := range missed {
+				slow[client] += n
+			}
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	now := time.Now()
+	disconnect := r.slowClientPolicy() == "disconnect"
+	for _, client := range clients {
+		if slow[client] > 0 && disconnect {
+			r.drop(client)
+			continue
+		}
+		if slow[client] > 0 {
+			client.dropped += slow[client]
+			client.undelivered.Store(true)
+		}
+		client.lastMessage = now
+	}
+}
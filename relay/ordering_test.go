@@ -0,0 +1,70 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOrderingKeys(t *testing.T) {
+	const perKey = 20
+	keys := []string{"a", "b", "c"}
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	room, err := s.rooms.openRoom("partitioned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clients []*Client
+	for range 3 {
+		clients = append(clients, joinTestClient(t, room, len(keys)*perKey))
+	}
+
+	// Hold up the room's loop so that the keys' publishes arrive interleaved
+	// and are fanned out together.
+	release := make(chan struct{})
+	go room.do(func() { <-release })
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Go(func() {
+			for i := range perKey {
+				code, body := publish(t, ts, "partitioned", fmt.Sprint(key, " ", i), url.Values{"key": {key}})
+				if code != http.StatusOK {
+					t.Errorf("publish: %d %s", code, body)
+					return
+				}
+			}
+		})
+	}
+	close(release)
+	wg.Wait()
+	room.do(func() {})
+
+	for i, client := range clients {
+		got := received(client)
+		if len(got) != len(keys)*perKey {
+			t.Errorf("client %d got %d messages, want %d", i, len(got), len(keys)*perKey)
+		}
+		// Each key's messages arrive in the order they were published,
+		// whatever the interleaving of keys.
+		for _, key := range keys {
+			var want, gotKey []string
+			for j := range perKey {
+				want = append(want, fmt.Sprint(key, " ", j))
+			}
+			for _, message := range got {
+				if strings.HasPrefix(message, key+" ") {
+					gotKey = append(gotKey, message)
+				}
+			}
+			if !slices.Equal(gotKey, want) {
+				t.Errorf("client %d got key %s's messages as %q", i, key, gotKey)
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package relay
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+var (
+	errRoomPaused      = errors.New("room is paused")
+	errPauseBufferFull = errors.New("room is paused and its publish buffer is full")
+)
+
+// pauseState is whether a room is paused and, with PausedPublish set to
+// buffer, the publications held back until it resumes.
+type pauseState struct {
+	mu       sync.Mutex
+	paused   bool
+	buffered []publication
+}
+
+// hold holds p back if the room is paused, reporting whether it did. While
+// paused, publishes are rejected with errRoomPaused, unless PausedPublish is
+// buffer and p is deferrable, in which case it is buffered until the room
+// resumes, up to PauseBufferSize publications.
+func (r *Room) hold(p publication, deferrable bool) (bool, error) {
+	r.pause.mu.Lock()
+	defer r.pause.mu.Unlock()
+
+	if !r.pause.paused {
+		return false, nil
+	}
+	if r.srv.opts.PausedPublish != "buffer" || !deferrable {
+		return false, errRoomPaused
+	}
+	if len(r.pause.buffered) >= r.srv.opts.PauseBufferSize {
+		return false, errPauseBufferFull
+	}
+	r.pause.buffered = append(r.pause.buffered, p)
+	return true, nil
+}
+
+// submitUnlessPaused queues p for broadcast like submit, or holds it back if
+// the room is paused, for publications that have no publisher to report to,
+// such as mirrored copies and scheduled messages. Those the room rejects
+// while paused are dropped.
+func (r *Room) submitUnlessPaused(p publication) {
+	if held, err := r.hold(p, true); err != nil {
+		r.recordError("dropped publish while paused: " + err.Error())
+	} else if !held {
+		r.submit(p)
+	}
+}
+
+// setPaused pauses or resumes the room. On resuming, the buffered
+// publications are broadcast in order, ahead of any publish made after the
+// resume, and their number is returned.
+func (r *Room) setPaused(paused bool) int {
+	r.pause.mu.Lock()
+	defer r.pause.mu.Unlock()
+
+	r.pause.paused = paused
+	if paused {
+		return 0
+	}
+	buffered := r.pause.buffered
+	r.pause.buffered = nil
+	for _, p := range buffered {
+		r.submit(p)
+	}
+	return len(buffered)
+}
+
+// paused reports whether the room is paused.
+func (r *Room) paused() bool {
+	r.pause.mu.Lock()
+	defer r.pause.mu.Unlock()
+
+	return r.pause.paused
+}
+
+// checkPaused holds p back if room is paused, as hold does. It responds with
+// 202 if p was buffered, or with 409 if it was rejected, and reports whether
+// the caller should go on to publish p.
+func checkPaused(w http.ResponseWriter, room *Room, p publication, deferrable bool) bool {
+	held, err := room.hold(p, deferrable)
+	if err != nil {
+		pausedError(w, err)
+		return false
+	}
+	if held {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("Buffered for " + room.name + " until it resumes"))
+		return false
+	}
+	return true
+}
+
+// pausedError responds with 409 to a publish rejected by hold.
+func pausedError(w http.ResponseWriter, err error) {
+	message := "Room is paused"
+	if errors.Is(err, errPauseBufferFull) {
+		message = "Room is paused and its publish buffer is full"
+	}
+	http.Error(w, message, http.StatusConflict)
+}
+
+// handlePauseRoom pauses a room: POST /api/rooms/{roomID}/pause
+// Until it resumes, publishes to it are rejected or, with PausedPublish set
+// to buffer, held back.
+func (s *Server) handlePauseRoom(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	room, ok := s.rooms.lookupRoom(roomID)
+	if !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	room.setPaused(true)
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "paused": true})
+}
+
+// handleResumeRoom resumes a paused room, broadcasting the publishes held
+// back while it was paused: POST /api/rooms/{roomID}/resume
+func (s *Server) handleResumeRoom(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	room, ok := s.rooms.lookupRoom(roomID)
+	if !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	released := room.setPaused(false)
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "paused": false, "released": released})
+}
@@ -0,0 +1,76 @@
+package relay
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestPausedPublishReject(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	conn := dialWS(t, ts, "/ws/paused", nil)
+	room := waitForRoom(t, s, "paused")
+	waitForClients(t, room, 1)
+
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/paused/pause", ""); code != http.StatusOK {
+		t.Fatalf("pausing: %d %s", code, body)
+	}
+	if code, body := publish(t, ts, "paused", "rejected", nil); code != http.StatusConflict {
+		t.Errorf("publish while paused: %d %s, want 409", code, body)
+	}
+	code, body := admin(t, ts, http.MethodPost, "/api/rooms/paused/resume", "")
+	if code != http.StatusOK {
+		t.Fatalf("resuming: %d %s", code, body)
+	}
+
+	// The rejected publish is gone for good.
+	if code, body := publish(t, ts, "paused", "after", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if got := readLines(t, conn, 1); !slices.Equal(got, []string{"after"}) {
+		t.Errorf("received %q, want only the publish after resuming", got)
+	}
+}
+
+func TestPausedPublishBuffer(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PausedPublish = "buffer"
+	opts.PauseBufferSize = 2
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	conn := dialWS(t, ts, "/ws/paused", nil)
+	room := waitForRoom(t, s, "paused")
+	waitForClients(t, room, 1)
+
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/paused/pause", ""); code != http.StatusOK {
+		t.Fatalf("pausing: %d %s", code, body)
+	}
+	for _, content := range []string{"one", "two"} {
+		if code, body := publish(t, ts, "paused", content, nil); code != http.StatusAccepted {
+			t.Errorf("publish while paused: %d %s, want 202", code, body)
+		}
+	}
+	// The buffer is bounded, and publishes that report on their delivery
+	// can't wait for the room to resume.
+	if code, body := publish(t, ts, "paused", "three", nil); code != http.StatusConflict {
+		t.Errorf("publish past the buffer: %d %s, want 409", code, body)
+	}
+	if code, body := publish(t, ts, "paused", "verbose", url.Values{"verbose": {"1"}}); code != http.StatusConflict {
+		t.Errorf("verbose publish while paused: %d %s, want 409", code, body)
+	}
+	if got := latest(t, ts, "paused"); got != "" {
+		t.Errorf("latest = %q while paused", got)
+	}
+
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/paused/resume", ""); code != http.StatusOK {
+		t.Fatalf("resuming: %d %s", code, body)
+	}
+	// The buffered publishes are delivered in order, ahead of later ones.
+	if code, body := publish(t, ts, "paused", "after", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if got, want := readLines(t, conn, 3), []string{"one", "two", "after"}; !slices.Equal(got, want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+}
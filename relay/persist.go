@@ -0,0 +1,224 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Persister durably stores rooms' retained content so that it can outlive the
+// process. Persist is called for each message a room retains, in the order the
+// room retains them and never for two messages of a room at once, and returns
+// once the content is durable, e.g. fsynced to disk or acknowledged by a
+// database.
+type Persister interface {
+	Persist(room string, content []byte) error
+}
+
+// BatchPersister is a Persister that can persist several of a room's messages
+// at once, e.g. in a single write. Messages a room retains while it is
+// persisting earlier ones are passed to PersistBatch together, oldest first.
+// FileStore is one.
+type BatchPersister interface {
+	Persister
+	PersistBatch(room string, contents [][]byte) error
+}
+
+// RoomStore is a Persister that can load back what it persisted, so that
+// rooms get their latest content and history back after a restart. FileStore
+// is one.
+type RoomStore interface {
+	Persister
+	// Load returns the latest messages persisted for room, oldest first, or
+	// none.
+	Load(room string) ([][]byte, error)
+	// Delete removes the messages persisted for room.
+	Delete(room string) error
+}
+
+var (
+	errPersistenceDisabled = errors.New("durable publishes require persistence")
+	errNotRetained         = errors.New("room does not retain this message")
+	errRoomClosed          = errors.New("room closed")
+)
+
+// persistence queues a room's retained messages for the Persister, which a
+// single writer goroutine at a time hands them to in sequence order.
+type persistence struct {
+	mu sync.Mutex
+	// queue holds the messages not persisted yet, oldest first, including
+	// those being written.
+	queue []*persistJob
+	// writing is set while a writer goroutine is running.
+	writing bool
+	// seq is the sequence number of the newest message persisted.
+	seq uint64
+}
+
+// persistJob is a message queued to be persisted.
+type persistJob struct {
+	content []byte
+	seq     uint64
+	// done receive the outcome of persisting the message.
+	done []chan<- error
+}
+
+// persist queues content, the room's retained message with sequence number
+// seq, to be persisted after the messages queued before it, and sends the
+// outcome on done, if it isn't nil, once the message itself is written. A
+// message already queued isn't queued again, and one persisted already counts
+// as persisted. It must be called on the room's goroutine, so that messages
+// are queued in sequence order.
+func (r *Room) persist(content []byte, seq uint64, done chan<- error) {
+	pp := &r.persistence
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if seq <= pp.seq {
+		if done != nil {
+			done <- nil
+		}
+		return
+	}
+	for _, job := range pp.queue {
+		if job.seq == seq {
+			if done != nil {
+				job.done = append(job.done, done)
+			}
+			return
+		}
+	}
+	job := &persistJob{content: content, seq: seq}
+	if done != nil {
+		job.done = append(job.done, done)
+	}
+	pp.queue = append(pp.queue, job)
+	if !pp.writing {
+		pp.writing = true
+		r.srv.persisting.Add(1)
+		go r.writePersisted()
+	}
+}
+
+// writePersisted hands the room's queued messages to the Persister until the
+// queue is empty: all of them at once if it is a BatchPersister, one by one
+// otherwise.
+func (r *Room) writePersisted() {
+	defer r.srv.persisting.Done()
+	pp := &r.persistence
+	batcher, batches := r.srv.opts.Persister.(BatchPersister)
+	for {
+		pp.mu.Lock()
+		jobs := pp.queue
+		if len(jobs) == 0 {
+			pp.writing = false
+			pp.mu.Unlock()
+			return
+		}
+		if !batches || len(jobs) == 1 {
+			jobs = jobs[:1]
+		}
+		pp.mu.Unlock()
+
+		var err error
+		if len(jobs) == 1 {
+			err = r.srv.opts.Persister.Persist(r.name, jobs[0].content)
+		} else {
+			contents := make([][]byte, len(jobs))
+			for i, job := range jobs {
+				contents[i] = job.content
+			}
+			err = batcher.PersistBatch(r.name, contents)
+		}
+		last := jobs[len(jobs)-1].seq
+		if err != nil {
+			r.srv.log.Error("persisting messages", "room", r.name, "seq", last, "count", len(jobs), "err", err)
+			r.recordError(fmt.Sprintf("persisting message %d: %v", last, err))
+		}
+
+		pp.mu.Lock()
+		if err == nil {
+			pp.seq = last
+		}
+		// Jobs are only appended to the queue while this goroutine runs.
+		pp.queue = pp.queue[len(jobs):]
+		for _, job := range jobs {
+			for _, done := range job.done {
+				done <- err
+			}
+		}
+		pp.mu.Unlock()
+	}
+}
+
+// load restores the room's latest content and history from the Persister, if
+// it is a RoomStore. It must be called before the room starts running.
+func (r *Room) load() {
+	store, ok := r.srv.opts.Persister.(RoomStore)
+	if !ok {
+		return
+	}
+	messages, err := store.Load(r.name)
+	if err != nil {
+		r.srv.log.Error("loading persisted messages", "room", r.name, "err", err)
+		r.recordError("loading persisted messages: " + err.Error())
+		return
+	}
+	if len(messages) == 0 {
+		return
+	}
+	now := time.Now()
+	// Publishers aren't persisted, so loaded messages count against no
+	// publisher's quota.
+	for _, message := range messages {
+		r.sequence++
+		retained := r.retain(message)
+		retained.retainedAt = now
+		retained.seq = r.sequence
+		r.history.add(retained, "")
+		r.lastContent = retained
+	}
+	r.lastContentTime = now
+	sum := sha256.Sum256(r.lastContent.content())
+	r.lastContentHash = hex.EncodeToString(sum[:])
+	// Already persisted.
+	r.persistence.seq = r.sequence
+}
+
+// unpersist removes the room's persisted messages when it is deleted, so that
+// they aren't loaded back if a room of the same name is created again.
+func (s *Server) unpersist(name string) {
+	store, ok := s.opts.Persister.(RoomStore)
+	if !ok {
+		return
+	}
+	if err := store.Delete(name); err != nil {
+		s.log.Error("deleting persisted messages", "room", name, "err", err)
+	}
+}
+
+// awaitPersisted waits for a durable publish to room to be persisted and
+// writes an error response if it wasn't, reporting whether it was.
+func awaitPersisted(w http.ResponseWriter, r *http.Request, room *Room, persisted <-chan error) bool {
+	var err error
+	select {
+	case err = <-persisted:
+	case <-room.done:
+		// The room may have shut down before retaining the message.
+		select {
+		case err = <-persisted:
+		default:
+			err = errRoomClosed
+		}
+	case <-r.Context().Done():
+		return false
+	}
+	if err != nil {
+		http.Error(w, "Message not persisted: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
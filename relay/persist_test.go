@@ -0,0 +1,187 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingPersister records the messages it persists, and blocks in Persist
+// until release is closed.
+type blockingPersister struct {
+	release chan struct{}
+
+	mu      sync.Mutex
+	written []string
+	batches int
+}
+
+func (p *blockingPersister) Persist(room string, content []byte) error {
+	return p.PersistBatch(room, [][]byte{content})
+}
+
+func (p *blockingPersister) PersistBatch(room string, contents [][]byte) error {
+	<-p.release
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, content := range contents {
+		p.written = append(p.written, string(content))
+	}
+	p.batches++
+	return nil
+}
+
+func (p *blockingPersister) messages() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.written)
+}
+
+func TestFileStoreKeepsEveryMessageInOrder(t *testing.T) {
+	const n = 50
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.HistorySize = n
+	opts.PublishRate = 0
+	opts.Persister = store
+	_, ts := newTestServer(t, opts)
+
+	var want []string
+	for i := range n {
+		content := fmt.Sprint("message ", i)
+		want = append(want, content)
+		query := url.Values{}
+		if i == n-1 {
+			// Acknowledged once it, and so everything before it, is
+			// written.
+			query.Set("durable", "1")
+		}
+		if code, body := publish(t, ts, "persisted", content, query); code != http.StatusOK {
+			t.Fatalf("publish %d: %d %s", i, code, body)
+		}
+	}
+
+	reopened, err := NewFileStore(dir, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := reopened.Load("persisted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, message := range messages {
+		got = append(got, string(message))
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Load = %q, want %q", got, want)
+	}
+}
+
+func TestDurablePublishWaitsForItsWrite(t *testing.T) {
+	persister := &blockingPersister{release: make(chan struct{})}
+	opts := DefaultOptions()
+	opts.Persister = persister
+	_, ts := newTestServer(t, opts)
+
+	results := make(chan int, 1)
+	go func() {
+		code, _ := publish(t, ts, "durable", "hello", url.Values{"durable": {"1"}})
+		results <- code
+	}()
+	select {
+	case code := <-results:
+		t.Fatalf("durable publish returned %d before its write", code)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(persister.release)
+	if code := <-results; code != http.StatusOK {
+		t.Fatalf("durable publish = %d, want 200", code)
+	}
+	if got := persister.messages(); !slices.Equal(got, []string{"hello"}) {
+		t.Errorf("persisted %q", got)
+	}
+
+	// Republishing the retained content is acknowledged without a write.
+	if code, body := publish(t, ts, "durable", "hello", url.Values{"durable": {"1"}}); code != http.StatusOK {
+		t.Fatalf("repeated durable publish: %d %s", code, body)
+	}
+	if got := persister.messages(); len(got) != 1 {
+		t.Errorf("persisted %q", got)
+	}
+}
+
+// failingPersister fails every write.
+type failingPersister struct{}
+
+func (failingPersister) Persist(room string, content []byte) error {
+	return errors.New("disk full")
+}
+
+func TestDurablePublishFailure(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Persister = failingPersister{}
+	_, ts := newTestServer(t, opts)
+
+	code, body := publish(t, ts, "durable", "hello", url.Values{"durable": {"1"}})
+	if code != http.StatusInternalServerError || !strings.Contains(body, "disk full") {
+		t.Errorf("durable publish: %d %s, want 500 with the persistence error", code, body)
+	}
+	// A publish that doesn't wait succeeds regardless.
+	if code, body := publish(t, ts, "durable", "again", nil); code != http.StatusOK {
+		t.Errorf("publish: %d %s", code, body)
+	}
+
+	// Without persistence, durable publishes are refused up front.
+	_, ts = newTestServer(t, DefaultOptions())
+	if code, body := publish(t, ts, "durable", "hello", url.Values{"durable": {"1"}}); code != http.StatusBadRequest {
+		t.Errorf("durable publish without persistence: %d %s, want 400", code, body)
+	}
+}
+
+func TestPersistBatchesQueuedMessages(t *testing.T) {
+	persister := &blockingPersister{release: make(chan struct{})}
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	opts.Persister = persister
+	s, ts := newTestServer(t, opts)
+
+	var want []string
+	for i := range 10 {
+		content := fmt.Sprint("message ", i)
+		want = append(want, content)
+		if code, body := publish(t, ts, "batched", content, nil); code != http.StatusOK {
+			t.Fatalf("publish %d: %d %s", i, code, body)
+		}
+	}
+	room := waitForRoom(t, s, "batched")
+	// The first message is being written, and the others are queued behind
+	// it.
+	eventually(t, "the messages to be queued", func() bool {
+		room.persistence.mu.Lock()
+		defer room.persistence.mu.Unlock()
+		return len(room.persistence.queue) == len(want)
+	})
+	close(persister.release)
+	eventually(t, "the messages to be persisted", func() bool {
+		return len(persister.messages()) == len(want)
+	})
+	if got := persister.messages(); !slices.Equal(got, want) {
+		t.Errorf("persisted %q, want %q", got, want)
+	}
+	persister.mu.Lock()
+	defer persister.mu.Unlock()
+	if persister.batches != 2 {
+		t.Errorf("persisted in %d writes, want 2", persister.batches)
+	}
+}
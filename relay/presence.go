@@ -0,0 +1,85 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+)
+
+// maxPresenceNameLength bounds the length of the name a subscriber gives
+// itself.
+const maxPresenceNameLength = 64
+
+var errInvalidPresenceName = errors.New("invalid name parameter")
+
+// membershipEvent announces a subscriber joining or leaving a room, with
+// PresenceEvents.
+type membershipEvent struct {
+	// Type is "join" or "leave".
+	Type string `json:"type"`
+	// Client is the subscriber's connection ID.
+	Client  string `json:"client"`
+	Name    string `json:"name,omitempty"`
+	Clients int    `json:"clients"`
+}
+
+// requestPresenceName returns the name a subscriber gives itself with
+// ?name=NAME, or "" for none.
+func requestPresenceName(r *http.Request) (string, error) {
+	name := r.URL.Query().Get("name")
+	if len(name) > maxPresenceNameLength {
+		return "", errInvalidPresenceName
+	}
+	return name, nil
+}
+
+// announceMembership broadcasts a join or leave event for client, with
+// PresenceEvents. A joining subscriber gets its own join event only with
+// PresenceSelfJoin. It must be called on the room's goroutine, after client
+// has been added to or removed from the room.
+func (r *Room) announceMembership(eventType string, client *Client) {
+	if !r.srv.opts.PresenceEvents {
+		return
+	}
+	message, _ := json.Marshal(membershipEvent{Type: eventType, Client: client.id, Name: client.name, Clients: len(r.clients)})
+	var skip *Client
+	if eventType == "join" && !r.srv.opts.PresenceSelfJoin {
+		skip = client
+	}
+	r.fanOut(message, skip)
+}
+
+// handlePresence serves a room's subscriber count and the names its
+// subscribers gave themselves: GET /api/rooms/{roomID}/presence
+func (s *Server) handlePresence(w http.ResponseWriter, r *http.Request) {
+	roomID, err := s.resolveRoomID(r.PathValue("roomID"))
+	if err != nil {
+		http.Error(w, err.Error(), roomIDStatus(err))
+		return
+	}
+
+	if _, err := s.authorizeSubscriber(r, roomID); err != nil {
+		http.Error(w, err.Error(), authStatus(err))
+		return
+	}
+
+	clients := 0
+	names := []string{}
+	if room, ok := s.rooms.lookupRoom(roomID); ok {
+		if err := room.admitsSubscriber(requestToken(r)); err != nil {
+			http.Error(w, err.Error(), accessTokenStatus(err))
+			return
+		}
+		room.do(func() {
+			clients = len(room.clients)
+			for client := range room.clients {
+				if client.name != "" {
+					names = append(names, client.name)
+				}
+			}
+		})
+	}
+	slices.Sort(names)
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "clients": clients, "names": names})
+}
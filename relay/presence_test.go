@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestInitialPresence(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		baseline, selfJoin bool
+		want               []string
+	}{
+		{"self join", false, true, []string{`{"type":"presence","clients":1}`}},
+		{"baseline", true, false, []string{`{"type":"presence","clients":0}`}},
+		{"baseline and self join", true, true, []string{`{"type":"presence","clients":0}`, `{"type":"presence","clients":1}`}},
+		{"neither", false, false, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Presence = true
+			opts.PresenceBaseline = tc.baseline
+			opts.PresenceSelfJoin = tc.selfJoin
+			s, _ := newTestServer(t, opts)
+			room, err := s.rooms.openRoom("presence")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			first := joinTestClient(t, room, 16)
+			if got := received(first); !slices.Equal(got, tc.want) {
+				t.Errorf("first subscriber got %q, want %q", got, tc.want)
+			}
+
+			// Later joins and leaves are broadcast to the others either way.
+			second := joinTestClient(t, room, 16)
+			if got, want := received(first), []string{`{"type":"presence","clients":2}`}; !slices.Equal(got, want) {
+				t.Errorf("after a second join, the first subscriber got %q, want %q", got, want)
+			}
+			room.leave(second)
+			room.do(func() {})
+			if got, want := received(first), []string{`{"type":"presence","clients":1}`}; !slices.Equal(got, want) {
+				t.Errorf("after a leave, the first subscriber got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPresenceNames(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PresenceEvents = true
+	opts.PresenceSelfJoin = false
+	s, ts := newTestServer(t, opts)
+	watcher := dialWS(t, ts, "/ws/lobby?name=watcher", nil)
+	room := waitForRoom(t, s, "lobby")
+	waitForClients(t, room, 1)
+	readMembership := func() membershipEvent {
+		t.Helper()
+		_, message, err := watcher.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e membershipEvent
+		if err := json.Unmarshal(message, &e); err != nil {
+			t.Fatalf("received %q, want a membership event: %v", message, err)
+		}
+		return e
+	}
+
+	// Joins and leaves are announced to the others, with the subscriber's
+	// name if it gave one.
+	alice := dialWS(t, ts, "/ws/lobby?name=alice", nil)
+	if e := readMembership(); e.Type != "join" || e.Name != "alice" || e.Client == "" || e.Clients != 2 {
+		t.Errorf("event %+v, want alice joining", e)
+	}
+	dialWS(t, ts, "/ws/lobby", nil)
+	if e := readMembership(); e.Type != "join" || e.Name != "" || e.Clients != 3 {
+		t.Errorf("event %+v, want an unnamed subscriber joining", e)
+	}
+
+	// Unnamed subscribers are counted but not listed, under the room's own
+	// URL as under the API's.
+	for _, path := range []string{"/lobby/presence", "/api/rooms/lobby/presence"} {
+		code, body := request(t, http.MethodGet, ts.URL+path, "", nil)
+		if want := `{"clients":3,"names":["alice","watcher"],"room":"lobby"}`; code != http.StatusOK || strings.TrimSpace(body) != want {
+			t.Errorf("GET %s: %d %s, want %s", path, code, body, want)
+		}
+	}
+
+	alice.Close()
+	if e := readMembership(); e.Type != "leave" || e.Name != "alice" || e.Clients != 2 {
+		t.Errorf("event %+v, want alice leaving", e)
+	}
+	code, body := request(t, http.MethodGet, ts.URL+"/lobby/presence", "", nil)
+	if want := `{"clients":2,"names":["watcher"],"room":"lobby"}`; code != http.StatusOK || strings.TrimSpace(body) != want {
+		t.Errorf("presence after alice left: %d %s, want %s", code, body, want)
+	}
+
+	code, body = request(t, http.MethodGet, ts.URL+"/empty/presence", "", nil)
+	if want := `{"clients":0,"names":[],"room":"empty"}`; code != http.StatusOK || strings.TrimSpace(body) != want {
+		t.Errorf("presence of a room without subscribers: %d %s, want %s", code, body, want)
+	}
+	if res := openSSE(t, ts, "/sse/lobby?name="+strings.Repeat("n", maxPresenceNameLength+1)); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("a name that is too long: status %d, want 400", res.StatusCode)
+	}
+}
@@ -0,0 +1,463 @@
+package relay
+
+import (
+	"cmp"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// handleLatest serves a room's retained content: GET /api/rooms/{roomID}/latest
+// It supports conditional requests through an ETag derived from the content hash.
+func (s *Server) handleLatest(w http.ResponseWriter, r *http.Request) {
+	roomID, err := s.resolveRoomID(r.PathValue("roomID"))
+	if err != nil {
+		http.Error(w, err.Error(), roomIDStatus(err))
+		return
+	}
+
+	room, ok := s.rooms.lookupRoom(roomID)
+	if !ok {
+		http.Error(w, "No content", http.StatusNotFound)
+		return
+	}
+	if err := room.admitsSubscriber(requestToken(r)); err != nil {
+		http.Error(w, err.Error(), accessTokenStatus(err))
+		return
+	}
+
+	var retained retainedMessage
+	var hash string
+	room.do(func() {
+		room.expireContent(time.Now())
+		retained = room.lastContent
+		hash = room.lastContentHash
+	})
+	content := retained.content()
+	if len(content) == 0 {
+		http.Error(w, "No content", http.StatusNotFound)
+		return
+	}
+
+	etag := `"` + hash + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cmp.Or(retained.cacheControl, "no-cache"))
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if utf8.Valid(content) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Write(content)
+}
+
+// handleRoomCount serves the number of a room's subscribers, for pages that
+// show a live count without holding a connection open:
+// GET /api/rooms/{roomID}/count
+// It reads a counter rather than going through the room's goroutine, and
+// lets caches hold the response for a second.
+func (s *Server) handleRoomCount(w http.ResponseWriter, r *http.Request) {
+	roomID, err := s.resolveRoomID(r.PathValue("roomID"))
+	if err != nil {
+		http.Error(w, err.Error(), roomIDStatus(err))
+		return
+	}
+
+	var clients int64
+	if room, ok := s.rooms.lookupRoom(roomID); ok {
+		if err := room.admitsSubscriber(requestToken(r)); err != nil {
+			http.Error(w, err.Error(), accessTokenStatus(err))
+			return
+		}
+		clients = room.members.Load()
+	}
+	w.Header().Set("Cache-Control", "public, max-age=1")
+	writeJSON(w, http.StatusOK, map[string]any{"clients": clients})
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP part of the request's remote address.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// HandlePublish publishes to the room named by the request path:
+// /{roomID}?content=... or a POST with the content as its body. It also serves
+// the frontend's static files, and each room's history and presence at
+// /{roomID}/history and /{roomID}/presence.
+func (s *Server) HandlePublish(w http.ResponseWriter, r *http.Request) {
+	// Serve static files for the frontend
+	if s.servesStatic(r) {
+		s.static.ServeHTTP(w, r)
+		return
+	}
+	// GET /{roomID}/history and /{roomID}/presence are the replay and
+	// presence endpoints under the room's own URL. They can't be patterns of
+	// their own, which would conflict with /ws/.
+	if r.Method == http.MethodGet {
+		if roomID, endpoint, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/"); ok && roomID != "" {
+			switch endpoint {
+			case "history":
+				r.SetPathValue("roomID", roomID)
+				s.handleReplay(w, r)
+				return
+			case "presence":
+				r.SetPathValue("roomID", roomID)
+				s.handlePresence(w, r)
+				return
+			}
+		}
+	}
+
+	// HTTP/1.0 clients, typically simple scripts, get the connection closed
+	// after each publish, and are told so explicitly.
+	if !r.ProtoAtLeast(1, 1) {
+		w.Header().Set("Connection", "close")
+	}
+	reqID := requestID(w, r)
+
+	// Extract room ID from URL. Assuming /{roomID}
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 2 {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+	roomID := pathParts[1]
+
+	// If the path is just "/", ignore or handle root
+	if roomID == "" {
+		http.Error(w, "Missing room ID", http.StatusBadRequest)
+		return
+	}
+
+	roomID, err := s.resolveRoomID(roomID)
+	if err != nil {
+		http.Error(w, err.Error(), roomIDStatus(err))
+		return
+	}
+
+	content := []byte(r.URL.Query().Get("content"))
+	if v := r.URL.Query().Get("content_b64"); v != "" {
+		// Accept both alphabets, with or without padding.
+		v = strings.TrimRight(v, "=")
+		enc := base64.RawStdEncoding
+		if strings.ContainsAny(v, "-_") {
+			enc = base64.RawURLEncoding
+		}
+		decoded, err := enc.DecodeString(v)
+		if err != nil {
+			http.Error(w, "Invalid content_b64 parameter", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("binary") != "1" && !utf8.Valid(decoded) {
+			http.Error(w, "content_b64 is not UTF-8 text, set binary=1 to publish binary content", http.StatusBadRequest)
+			return
+		}
+		content = decoded
+	}
+	var body []byte
+	if len(content) == 0 && r.Method == http.MethodPost {
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Now().Add(s.opts.PublishBodyTimeout))
+		body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, int64(s.contentLimit())))
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			http.Error(w, "Content too large", http.StatusRequestEntityTooLarge)
+			return
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			http.Error(w, "Timed out reading the request body", http.StatusRequestTimeout)
+			return
+		case err != nil:
+			http.Error(w, "Error reading the request body", http.StatusBadRequest)
+			return
+		}
+		content = body
+	}
+	if len(content) == 0 {
+		http.Error(w, "Missing content parameter", http.StatusBadRequest)
+		return
+	}
+	contentType := publishContentType(r, content, body != nil)
+	if err := s.verifyPublishSignature(r, body); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := s.authorizePublish(r, roomID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	params, err := s.parsePublishParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	room := s.checkPublish(w, r, roomID, content, contentType, params)
+	if room == nil {
+		return
+	}
+	publisher := remoteIP(r)
+
+	// A publish that repeats a recent dedup key, e.g. a retry, succeeds
+	// without being published again. The key is forgotten if the publish
+	// fails, so that it can be retried.
+	if params.dedupKey != "" {
+		if !room.dedupKeys.add(params.dedupKey) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Duplicate, not published to " + roomID))
+			return
+		}
+	}
+
+	if time.Now().Before(params.deliverAt) {
+		id, err := room.schedule.add(content, publisher, contentType, params.cacheControl, params.topic, params.ttl, params.deliverAt)
+		if err != nil {
+			room.dedupKeys.remove(params.dedupKey)
+			http.Error(w, "Too many scheduled messages", http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Scheduled %d for %s at %s", id, roomID, params.deliverAt.Format(time.RFC3339))
+		return
+	}
+
+	p := params.publication(content, publisher, contentType)
+	p.requestID = reqID
+	// Only plain publishes can be buffered while the room is paused; the
+	// others report on their outcome.
+	if !checkPaused(w, room, p, !params.verbose && !params.durable && !params.currentOnly && !params.ifMatch) {
+		room.dedupKeys.remove(params.dedupKey)
+		return
+	}
+	if params.durable {
+		p.persisted = make(chan error, 1)
+	}
+	if params.verbose {
+		delivered, ids, _ := room.publishVerbose(p, maxDeliveredIDs)
+		if params.durable && !awaitPersisted(w, r, room, p.persisted) {
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "delivered": delivered, "delivered_to": ids})
+		return
+	}
+
+	if params.currentOnly {
+		room.publishToCurrent(content, params.topic)
+	} else if params.ifMatch {
+		current, ok := room.compareAndPublish(p, r.URL.Query().Get("if_match"))
+		if !ok {
+			room.dedupKeys.remove(params.dedupKey)
+			w.Header().Set("ETag", `"`+current+`"`)
+			http.Error(w, "Content changed, current hash is "+current, http.StatusConflict)
+			return
+		}
+	} else if !room.trySubmit(p) {
+		room.dedupKeys.remove(params.dedupKey)
+		http.Error(w, "Publish queue full", http.StatusTooManyRequests)
+		return
+	}
+	if params.durable && !awaitPersisted(w, r, room, p.persisted) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Published to " + roomID))
+}
+
+// publishParams are the options of a publish, from its request's query.
+type publishParams struct {
+	deliverAt    time.Time
+	currentOnly  bool
+	verbose      bool
+	durable      bool
+	ifMatch      bool
+	key          string
+	topic        string
+	ttl          time.Duration
+	cacheControl string
+	dedupKey     string
+}
+
+// parsePublishParams parses the options of publish request r and checks that
+// they can be combined. Its errors are the message of a 400 response.
+func (s *Server) parsePublishParams(r *http.Request) (publishParams, error) {
+	var params publishParams
+	query := r.URL.Query()
+	if v := query.Get("deliver_at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return params, errors.New("invalid deliver_at parameter")
+		}
+		params.deliverAt = t
+	}
+	params.ifMatch = query.Has("if_match")
+	if !params.deliverAt.IsZero() && params.ifMatch {
+		return params, errors.New("deliver_at and if_match can't be combined")
+	}
+
+	switch v := query.Get("audience"); v {
+	case "", "all":
+	case "current":
+		params.currentOnly = true
+	default:
+		return params, errors.New("invalid audience parameter")
+	}
+	if params.currentOnly && (!params.deliverAt.IsZero() || params.ifMatch) {
+		return params, errors.New("audience=current can't be combined with deliver_at or if_match")
+	}
+
+	params.verbose = query.Get("verbose") == "1"
+	if params.verbose && (!params.deliverAt.IsZero() || params.ifMatch || params.currentOnly) {
+		return params, errors.New("verbose can't be combined with deliver_at, if_match or audience=current")
+	}
+
+	params.durable = query.Get("durable") == "1"
+	if params.durable && (!params.deliverAt.IsZero() || params.currentOnly) {
+		return params, errors.New("durable can't be combined with deliver_at or audience=current")
+	}
+	if params.durable && s.opts.Persister == nil {
+		return params, errPersistenceDisabled
+	}
+
+	params.key = query.Get("key")
+	if len(params.key) > maxOrderingKeyLength {
+		return params, errors.New("invalid key parameter")
+	}
+
+	var err error
+	if params.topic, err = requestTopic(r); err != nil {
+		return params, err
+	}
+
+	if params.ttl, err = requestTTL(r); err != nil {
+		return params, err
+	}
+	if params.ttl > 0 && params.currentOnly {
+		return params, errors.New("ttl can't be combined with audience=current")
+	}
+
+	params.cacheControl = query.Get("cache_control")
+	if !validCacheControl(params.cacheControl) {
+		return params, errors.New("invalid cache_control parameter")
+	}
+
+	params.dedupKey = query.Get("dedup_key")
+	if len(params.dedupKey) > maxDedupKeyLength {
+		return params, errors.New("invalid dedup_key parameter")
+	}
+	return params, nil
+}
+
+// publication returns the publication of content from publisher with the
+// options in params.
+func (params publishParams) publication(content []byte, publisher, contentType string) publication {
+	return publication{message: content, publisher: publisher, key: params.key, contentType: contentType, cacheControl: params.cacheControl, topic: params.topic, ttl: params.ttl}
+}
+
+// checkPublish runs the checks a publish of content to roomID with params must
+// pass, from the publisher's limits to the room's schema and retention, and
+// returns the room, opening it if need be. If a check fails, it responds with
+// the error and returns nil. HandlePublish and gRPC publishes share it.
+func (s *Server) checkPublish(w http.ResponseWriter, r *http.Request, roomID string, content []byte, contentType string, params publishParams) *Room {
+	if s.opts.MaxContentSize > 0 && len(content) > s.opts.MaxContentSize {
+		http.Error(w, "Content too large", http.StatusRequestEntityTooLarge)
+		return nil
+	}
+
+	publisher := remoteIP(r)
+	// Checked before the room is looked up, so that rejected publishes can't
+	// create rooms, and recorded once the publish passed every check.
+	if !s.publisherRooms.admits(publisherKey(r), roomID) {
+		http.Error(w, "Too many distinct rooms for this publisher", http.StatusForbidden)
+		return nil
+	}
+
+	room, err := s.rooms.openRoom(roomID)
+	if err != nil {
+		http.Error(w, err.Error(), openRoomStatus(err))
+		return nil
+	}
+	if err := room.claimAccessToken(requestToken(r)); err != nil {
+		http.Error(w, err.Error(), accessTokenStatus(err))
+		return nil
+	}
+	if !room.publisherIPs.allow(publisher) {
+		http.Error(w, "Too many distinct publishers for this room", http.StatusForbidden)
+		return nil
+	}
+	if !s.checkPublishRate(w, r, room, publisher) || !checkContentSize(w, room, len(content)) {
+		return nil
+	}
+
+	if !checkSchema(w, room, content) {
+		return nil
+	}
+
+	// Publishes to the current audience are never retained.
+	if !params.currentOnly && (!s.checkRetention(w, room, len(content), contentType) || !s.checkMirrorHealth(w, room)) {
+		return nil
+	}
+	if params.durable && !room.retains(len(content), contentType) {
+		http.Error(w, errNotRetained.Error()+", so it can't be persisted", http.StatusConflict)
+		return nil
+	}
+	if !s.publisherRooms.allow(publisherKey(r), roomID) {
+		http.Error(w, "Too many distinct rooms for this publisher", http.StatusForbidden)
+		return nil
+	}
+	return room
+}
+
+// checkContentSize applies the room's content size limit to a publish of size
+// bytes. It responds with 413 and reports false if the content is too large.
+func checkContentSize(w http.ResponseWriter, room *Room, size int) bool {
+	if room.admitsContentSize(size) {
+		return true
+	}
+	http.Error(w, "Content too large for this room", http.StatusRequestEntityTooLarge)
+	return false
+}
+
+// maxCacheControlLength bounds the length of a publish's Cache-Control
+// directive.
+const maxCacheControlLength = 256
+
+// validCacheControl reports whether v, from the cache_control parameter, can
+// be sent as a Cache-Control header: at most maxCacheControlLength printable
+// ASCII characters.
+func validCacheControl(v string) bool {
+	if len(v) > maxCacheControlLength {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if v[i] < ' ' || v[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,514 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// getLatest requests room's retained content on ts with the given
+// If-None-Match header, if any.
+func getLatest(t testing.TB, ts *httptest.Server, room, ifNoneMatch string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/rooms/"+room+"/latest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func TestLatestETag(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	if code, body := publish(t, ts, "etag", "one", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+
+	res := getLatest(t, ts, "etag", "")
+	etag := res.Header.Get("ETag")
+	if res.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("GET latest: status %d, ETag %q", res.StatusCode, etag)
+	}
+	if got := res.Header.Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Cache-Control %q, want no-cache", got)
+	}
+
+	if res := getLatest(t, ts, "etag", etag); res.StatusCode != http.StatusNotModified {
+		t.Errorf("GET latest with a matching ETag: status %d, want 304", res.StatusCode)
+	}
+	if res := getLatest(t, ts, "etag", `"other", W/`+etag); res.StatusCode != http.StatusNotModified {
+		t.Errorf("GET latest with a matching weak ETag in a list: status %d, want 304", res.StatusCode)
+	}
+
+	if code, body := publish(t, ts, "etag", "two", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	res = getLatest(t, ts, "etag", etag)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("GET latest with a stale ETag: status %d, want 200", res.StatusCode)
+	}
+	if res.Header.Get("ETag") == etag {
+		t.Error("the ETag didn't change with the content")
+	}
+}
+
+// publishIfMatch publishes content to room on ts if its retained content has
+// the given hash, and returns the response's status and ETag.
+func publishIfMatch(t testing.TB, ts *httptest.Server, room, content, hash string) (int, string) {
+	t.Helper()
+	query := url.Values{"content": {content}, "if_match": {hash}}
+	res, err := http.Post(ts.URL+"/"+room+"?"+query.Encode(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode, res.Header.Get("ETag")
+}
+
+func TestCompareAndPublish(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+
+	// An empty hash matches a room without content.
+	if code, _ := publishIfMatch(t, ts, "cas", "one", ""); code != http.StatusOK {
+		t.Fatalf("publishing to an empty room: status %d, want 200", code)
+	}
+	etag := getLatest(t, ts, "cas", "").Header.Get("ETag")
+
+	code, current := publishIfMatch(t, ts, "cas", "two", "")
+	if code != http.StatusConflict {
+		t.Fatalf("publishing with a stale hash: status %d, want 409", code)
+	}
+	if current != etag {
+		t.Errorf("conflict ETag %s, want the current one %s", current, etag)
+	}
+	if got := latest(t, ts, "cas"); got != "one" {
+		t.Errorf("after the conflict, latest = %q, want one", got)
+	}
+
+	if code, _ := publishIfMatch(t, ts, "cas", "two", strings.Trim(etag, `"`)); code != http.StatusOK {
+		t.Fatalf("publishing with the current hash: status %d, want 200", code)
+	}
+	if got := latest(t, ts, "cas"); got != "two" {
+		t.Errorf("latest = %q, want two", got)
+	}
+}
+
+func TestPublishToCurrentAudience(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HistorySize = 5
+	s, ts := newTestServer(t, opts)
+	if code, body := publish(t, ts, "audience", "retained", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	room := waitForRoom(t, s, "audience")
+	current := joinTestClient(t, room, 16)
+	received(current)
+
+	if code, body := publish(t, ts, "audience", "now", url.Values{"audience": {"current"}}); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if got := received(current); !slices.Equal(got, []string{"now"}) {
+		t.Errorf("the current subscriber received %q, want [now]", got)
+	}
+
+	// The message isn't retained, so later subscribers are only replayed
+	// what came before it.
+	late := joinTestClient(t, room, 16)
+	if got := received(late); !slices.Equal(got, []string{"retained"}) {
+		t.Errorf("a later subscriber received %q, want [retained]", got)
+	}
+	if got := latest(t, ts, "audience"); got != "retained" {
+		t.Errorf("latest = %q, want retained", got)
+	}
+
+	if code, _ := publish(t, ts, "audience", "now", url.Values{"audience": {"current"}, "if_match": {""}}); code != http.StatusBadRequest {
+		t.Errorf("audience=current with if_match: status %d, want 400", code)
+	}
+}
+
+func TestPublishBase64(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxContentSize = 8
+	s, ts := newTestServer(t, opts)
+	conn := dialWS(t, ts, "/ws/b64", nil)
+	room := waitForRoom(t, s, "b64")
+	waitForClients(t, room, 1)
+
+	binary := []byte{0x00, 0x01, 0xfe, 0xff}
+	query := url.Values{"content_b64": {base64.StdEncoding.EncodeToString(binary)}, "binary": {"1"}}
+	if code, body := request(t, http.MethodGet, ts.URL+"/b64?"+query.Encode(), "", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	kind, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != websocket.BinaryMessage || !bytes.Equal(message, binary) {
+		t.Errorf("received a frame of type %d with %x, want a binary frame with %x", kind, message, binary)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		query url.Values
+		want  int
+	}{
+		{"invalid", url.Values{"content_b64": {"not base64!"}}, http.StatusBadRequest},
+		{"binary without binary=1", url.Values{"content_b64": {base64.StdEncoding.EncodeToString(binary)}}, http.StatusBadRequest},
+		{"too large once decoded", url.Values{"content_b64": {base64.URLEncoding.EncodeToString([]byte("123456789"))}}, http.StatusRequestEntityTooLarge},
+		{"URL alphabet", url.Values{"content_b64": {base64.RawURLEncoding.EncodeToString([]byte{0xfb, 0xff})}, "binary": {"1"}}, http.StatusOK},
+	} {
+		if code, body := request(t, http.MethodGet, ts.URL+"/b64?"+tt.query.Encode(), "", nil); code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, code, body, tt.want)
+		}
+	}
+}
+
+func TestVerbosePublish(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	if code, body := publish(t, ts, "verbose", "first", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	room := waitForRoom(t, s, "verbose")
+	var want []string
+	for range 3 {
+		want = append(want, joinTestClient(t, room, 16).id)
+	}
+
+	code, body := publish(t, ts, "verbose", "second", url.Values{"verbose": {"1"}})
+	if code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	var res struct {
+		Delivered   int      `json:"delivered"`
+		DeliveredTo []string `json:"delivered_to"`
+	}
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(want)
+	slices.Sort(res.DeliveredTo)
+	if res.Delivered != 3 || !slices.Equal(res.DeliveredTo, want) {
+		t.Errorf("delivered to %d: %q, want 3: %q", res.Delivered, res.DeliveredTo, want)
+	}
+
+	// The list is bounded in large rooms, unlike the count.
+	for range maxDeliveredIDs {
+		joinTestClient(t, room, 16)
+	}
+	code, body = publish(t, ts, "verbose", "third", url.Values{"verbose": {"1"}})
+	if code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Delivered != maxDeliveredIDs+3 || len(res.DeliveredTo) != maxDeliveredIDs {
+		t.Errorf("delivered to %d, listing %d, want %d listing %d", res.Delivered, len(res.DeliveredTo), maxDeliveredIDs+3, maxDeliveredIDs)
+	}
+}
+
+func TestPublishBodyTimeout(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishBodyTimeout = 100 * time.Millisecond
+	_, ts := newTestServer(t, opts)
+
+	// A body that starts but never finishes.
+	body, w := io.Pipe()
+	defer w.Close()
+	go w.Write([]byte("partial"))
+
+	start := time.Now()
+	res, err := http.Post(ts.URL+"/slow", "text/plain", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("status %d, want 408", res.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("aborted after %v, want about 100ms", elapsed)
+	}
+	if got := latest(t, ts, "slow"); got != "" {
+		t.Errorf("published %q", got)
+	}
+}
+
+// rawRequest sends the raw HTTP request req to ts over a new connection and
+// returns the response and its body.
+func rawRequest(t testing.TB, ts *httptest.Server, req string) (*http.Response, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return res, string(body)
+}
+
+func TestPublishHTTPVersions(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+
+	for _, tt := range []struct {
+		name, req, want string
+		close           bool
+	}{
+		{"HTTP/1.0 query", "POST /versions?content=query HTTP/1.0\r\nHost: relay\r\n\r\n", "query", true},
+		{"HTTP/1.0 body", "POST /versions HTTP/1.0\r\nHost: relay\r\nContent-Length: 4\r\n\r\nbody", "body", true},
+		{"HTTP/1.1 chunked", "POST /versions HTTP/1.1\r\nHost: relay\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n3\r\nchu\r\n4\r\nnked\r\n0\r\n\r\n", "chunked", true},
+		{"HTTP/1.1 query", "POST /versions?content=kept HTTP/1.1\r\nHost: relay\r\n\r\n", "kept", false},
+	} {
+		res, body := rawRequest(t, ts, tt.req)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: %d %s", tt.name, res.StatusCode, body)
+			continue
+		}
+		if res.Close != tt.close {
+			t.Errorf("%s: Connection: close is %t, want %t", tt.name, res.Close, tt.close)
+		}
+		if got := latest(t, ts, "versions"); got != tt.want {
+			t.Errorf("%s: latest = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRoomQueueDepth(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+
+	for _, tt := range []struct {
+		room  string
+		depth int
+	}{
+		{"shallow", 1},
+		{"deep", 3},
+	} {
+		if code, body := publish(t, ts, tt.room, "open", nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+		meta := fmt.Sprintf(`{"queue_depth":%d}`, tt.depth)
+		if code, body := admin(t, ts, http.MethodPost, "/api/rooms/"+tt.room+"/meta", meta); code != http.StatusOK {
+			t.Fatalf("setting %s: %d %s", meta, code, body)
+		}
+		room := waitForRoom(t, s, tt.room)
+
+		// Hold up the room's loop so that publishes queue.
+		release := make(chan struct{})
+		go room.do(func() { <-release })
+		var wg sync.WaitGroup
+		codes := make(chan int, tt.depth)
+		for i := range tt.depth {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				code, _ := publish(t, ts, tt.room, fmt.Sprint("queued ", i), nil)
+				codes <- code
+			}()
+		}
+		eventually(t, "publishes to queue", func() bool { return room.queued.Load() == int64(tt.depth) })
+
+		if code, body := publish(t, ts, tt.room, "rejected", nil); code != http.StatusTooManyRequests {
+			t.Errorf("%s: publish past a depth of %d: %d %s, want 429", tt.room, tt.depth, code, body)
+		}
+		close(release)
+		wg.Wait()
+		close(codes)
+		for code := range codes {
+			if code != http.StatusOK {
+				t.Errorf("%s: queued publish: status %d", tt.room, code)
+			}
+		}
+	}
+}
+
+func TestPublishBody(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxContentSize = 16
+	s, ts := newTestServer(t, opts)
+	conn := dialWS(t, ts, "/ws/piped", nil)
+	room := waitForRoom(t, s, "piped")
+	waitForClients(t, room, 1)
+
+	// Command output, newlines, NUL bytes and all, goes through untouched.
+	content := "out\r\nerr\n\x00\xff"
+	if code, body := request(t, http.MethodPost, ts.URL+"/piped", content, nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != content {
+		t.Errorf("received %q (%v), want %q", message, err, content)
+	}
+	if got := latest(t, ts, "piped"); got != content {
+		t.Errorf("latest = %q, want %q", got, content)
+	}
+
+	if code, body := request(t, http.MethodPost, ts.URL+"/piped", strings.Repeat("x", 17), nil); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("publishing a body past MaxContentSize: %d %s, want 413", code, body)
+	}
+	if code, body := request(t, http.MethodPost, ts.URL+"/piped", "", nil); code != http.StatusBadRequest {
+		t.Errorf("publishing an empty body: %d %s, want 400", code, body)
+	}
+}
+
+func TestPublishLargeBody(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	conn := dialWS(t, ts, "/ws/uploads", nil)
+	waitForClients(t, waitForRoom(t, s, "uploads"), 1)
+
+	binary := make([]byte, 64<<10)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+	text := strings.Repeat("well past a query string ", 1000)
+	for _, tt := range []struct {
+		content, contentType string
+		frame                int
+	}{
+		{string(binary), "application/octet-stream", websocket.BinaryMessage},
+		{text, "text/plain", websocket.TextMessage},
+	} {
+		code, body := request(t, http.MethodPost, ts.URL+"/uploads", tt.content, http.Header{"Content-Type": {tt.contentType}})
+		if code != http.StatusOK {
+			t.Fatalf("publishing %d bytes of %s: %d %s", len(tt.content), tt.contentType, code, body)
+		}
+		frame, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame != tt.frame || string(message) != tt.content {
+			t.Errorf("%s: received %d bytes in a frame of type %d, want the %d bytes published in one of type %d", tt.contentType, len(message), frame, len(tt.content), tt.frame)
+		}
+	}
+
+	// Without MaxContentSize, bodies are capped at the default.
+	if code, body := request(t, http.MethodPost, ts.URL+"/uploads", strings.Repeat("x", defaultMaxContentSize+1), nil); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("publishing a body past the default limit: %d %.40s, want 413", code, body)
+	}
+}
+
+func TestRoomMaxContentSize(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxContentSize = 8192
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	for room, limit := range map[string]int{"chat": 16, "telemetry": 1 << 20} {
+		if code, body := admin(t, ts, http.MethodPut, "/api/rooms/"+room, fmt.Sprintf(`{"max_content_size":%d}`, limit)); code != http.StatusCreated {
+			t.Fatalf("creating %s: %d %s", room, code, body)
+		}
+	}
+
+	for _, tt := range []struct {
+		room string
+		size int
+		want int
+	}{
+		{"chat", 16, http.StatusOK},
+		{"chat", 17, http.StatusRequestEntityTooLarge},
+		{"telemetry", 4096, http.StatusOK},
+		// The server's limit still applies.
+		{"telemetry", 8193, http.StatusRequestEntityTooLarge},
+		{"other", 4096, http.StatusOK},
+	} {
+		if code, body := request(t, http.MethodPost, ts.URL+"/"+tt.room, strings.Repeat("x", tt.size), nil); code != tt.want {
+			t.Errorf("publishing %d bytes to %s: %d %s, want %d", tt.size, tt.room, code, strings.TrimSpace(body), tt.want)
+		}
+	}
+	if err := s.Publish("chat", bytes.Repeat([]byte("c"), 17)); err != errContentTooLarge {
+		t.Errorf("Publish past the room's limit = %v, want %v", err, errContentTooLarge)
+	}
+}
+
+func TestPublishCacheControl(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	if code, body := publish(t, ts, "cached", "snapshot", url.Values{"cache_control": {"public, max-age=60"}}); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if got := getLatest(t, ts, "cached", "").Header.Get("Cache-Control"); got != "public, max-age=60" {
+		t.Errorf("latest Cache-Control %q, want the published directive", got)
+	}
+	res, err := http.Get(ts.URL + "/api/rooms/cached/replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got := res.Header.Get("Cache-Control"); got != "public, max-age=60" {
+		t.Errorf("replay Cache-Control %q, want the published directive", got)
+	}
+
+	// Content published without a directive isn't cached.
+	if code, body := publish(t, ts, "cached", "uncached", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if got := getLatest(t, ts, "cached", "").Header.Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("latest Cache-Control %q, want no-cache", got)
+	}
+
+	for _, directive := range []string{"max-age=60\r\nX-Injected: 1", strings.Repeat("a", maxCacheControlLength+1)} {
+		if code, _ := publish(t, ts, "cached", "invalid", url.Values{"cache_control": {directive}}); code != http.StatusBadRequest {
+			t.Errorf("cache_control %.20q: status %d, want 400", directive, code)
+		}
+	}
+}
+
+func TestRoomCount(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	count := func() string {
+		t.Helper()
+		res, err := http.Get(ts.URL + "/api/rooms/counted/count")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK || res.Header.Get("Cache-Control") != "public, max-age=1" {
+			t.Errorf("count: status %d, Cache-Control %q", res.StatusCode, res.Header.Get("Cache-Control"))
+		}
+		return strings.TrimSpace(string(body))
+	}
+
+	// A room that doesn't exist has no subscribers, and isn't created.
+	if got := count(); got != `{"clients":0}` {
+		t.Errorf("count of a missing room = %s", got)
+	}
+	if _, ok := s.rooms.lookupRoom("counted"); ok {
+		t.Error("counting created the room")
+	}
+	ws := dialWS(t, ts, "/ws/counted", nil)
+	openSSE(t, ts, "/sse/counted")
+	eventually(t, "the count to include both subscribers", func() bool { return count() == `{"clients":2}` })
+	ws.Close()
+	eventually(t, "the count to drop", func() bool { return count() == `{"clients":1}` })
+}
@@ -0,0 +1,52 @@
+package relay
+
+import (
+	"errors"
+)
+
+var (
+	errEmptyMessage     = errors.New("empty message")
+	errContentTooLarge  = errors.New("content too large for this room")
+	errPublishQueueFull = errors.New("publish queue full")
+)
+
+// Publish broadcasts message to the named room and retains it, like an HTTP
+// publish, for programs embedding the relay. The room is created if need be.
+// The room's content size limit, schema and pause apply, but not the limits
+// on remote publishers such as publish rates. A message held back while the
+// room is paused is broadcast once it resumes. Publishes fail once Shutdown
+// has started.
+func (s *Server) Publish(room string, message []byte) error {
+	if room == directoryRoomName {
+		return errReservedRoom
+	}
+	if err := validateRoomID(room); err != nil {
+		return err
+	}
+	if len(message) == 0 {
+		return errEmptyMessage
+	}
+	if s.shuttingDown.Load() {
+		return errShuttingDown
+	}
+	r, err := s.rooms.openRoom(room)
+	if err != nil {
+		return err
+	}
+	if !r.admitsContentSize(len(message)) {
+		return errContentTooLarge
+	}
+	if schema := r.schema.Load(); schema != nil {
+		if err := schema.validate(message); err != nil {
+			return err
+		}
+	}
+	p := publication{message: message, contentType: publishContentType(nil, message, false)}
+	if held, err := r.hold(p, true); err != nil || held {
+		return err
+	}
+	if !r.trySubmit(p) {
+		return errPublishQueueFull
+	}
+	return nil
+}
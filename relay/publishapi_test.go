@@ -0,0 +1,94 @@
+package relay
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestServerPublish(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	conn := dialWS(t, ts, "/ws/embedded", nil)
+	waitForClients(t, waitForRoom(t, s, "embedded"), 1)
+	if err := s.Publish("embedded", []byte("from the program")); err != nil {
+		t.Fatal(err)
+	}
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "from the program" {
+		t.Errorf("received %q (%v), want the published message", message, err)
+	}
+	if got := latest(t, ts, "embedded"); got != "from the program" {
+		t.Errorf("latest = %q, want the published message retained", got)
+	}
+
+	// Rooms are created as needed.
+	if err := s.Publish("created", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the message to be retained", func() bool { return latest(t, ts, "created") == "first" })
+
+	if code, body := admin(t, ts, http.MethodPut, "/api/rooms/small", `{"max_content_size":4}`); code != http.StatusCreated {
+		t.Fatalf("creating the room: %d %s", code, body)
+	}
+	for _, tt := range []struct {
+		room, message string
+		err           error
+	}{
+		{"small", "too large", errContentTooLarge},
+		{"embedded", "", errEmptyMessage},
+		{directoryRoomName, "listing", errReservedRoom},
+	} {
+		if err := s.Publish(tt.room, []byte(tt.message)); !errors.Is(err, tt.err) {
+			t.Errorf("Publish(%q, %q) = %v, want %v", tt.room, tt.message, err, tt.err)
+		}
+	}
+	if err := s.Publish(strings.Repeat("r", 1000), []byte("lost")); err == nil {
+		t.Error("Publish accepted an invalid room name")
+	}
+}
+
+func TestAuthorizationHooks(t *testing.T) {
+	errNotAlice := errors.New("only alice may subscribe")
+	opts := DefaultOptions()
+	opts.AuthorizeSubscriber = func(r *http.Request, room string) error {
+		if r.Header.Get("X-User") != "alice" {
+			return errNotAlice
+		}
+		return nil
+	}
+	opts.AuthorizePublish = func(r *http.Request, room string) error {
+		if room != "open" {
+			return errors.New("read-only room")
+		}
+		return nil
+	}
+	_, ts := newTestServer(t, opts)
+	alice := http.Header{"X-User": {"alice"}}
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/open"
+	if _, res, err := websocket.DefaultDialer.Dial(url, nil); err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+		t.Errorf("subscribing as anyone: %v, want 403", err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, alice)
+	if err != nil {
+		t.Fatalf("subscribing as alice: %v", err)
+	}
+	conn.Close()
+	for _, path := range []string{"/sse/open", "/api/rooms/open/presence"} {
+		if code, body := request(t, http.MethodGet, ts.URL+path, "", nil); code != http.StatusForbidden || !strings.Contains(body, errNotAlice.Error()) {
+			t.Errorf("GET %s as anyone: %d %s, want 403 with the hook's error", path, code, body)
+		}
+	}
+	if code, body := request(t, http.MethodGet, ts.URL+"/api/rooms/open/presence", "", alice); code != http.StatusOK {
+		t.Errorf("presence as alice: %d %s", code, body)
+	}
+
+	if code, body := publish(t, ts, "open", "allowed", nil); code != http.StatusOK {
+		t.Errorf("publish to the open room: %d %s", code, body)
+	}
+	if code, body := publish(t, ts, "closed", "rejected", nil); code != http.StatusForbidden || !strings.Contains(body, "read-only room") {
+		t.Errorf("publish to another room: %d %s, want 403 with the hook's error", code, body)
+	}
+}
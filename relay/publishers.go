@@ -0,0 +1,143 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PublisherIPs tracks the IPs that recently published to a room.
+type PublisherIPs struct {
+	lastSeen map[string]time.Time
+	// max is the number of distinct IPs allowed within window, or zero for
+	// no limit.
+	max    int
+	window time.Duration
+	mu     sync.Mutex
+}
+
+func newPublisherIPs(max int, window time.Duration) *PublisherIPs {
+	return &PublisherIPs{
+		lastSeen: make(map[string]time.Time),
+		max:      max,
+		window:   window,
+	}
+}
+
+// allow records a publish from ip and reports whether it is permitted: IPs
+// already seen within the window always are, new ones only while fewer than
+// max distinct IPs have been seen.
+func (p *PublisherIPs) allow(ip string) bool {
+	if p.max <= 0 {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for seenIP, t := range p.lastSeen {
+		if now.Sub(t) > p.window {
+			delete(p.lastSeen, seenIP)
+		}
+	}
+
+	if _, ok := p.lastSeen[ip]; !ok && len(p.lastSeen) >= p.max {
+		return false
+	}
+	p.lastSeen[ip] = now
+	return true
+}
+
+// PublisherRooms tracks the rooms each publisher recently wrote to. A
+// publisher is identified by publisherKey.
+type PublisherRooms struct {
+	// lastWrite maps a publisher to the time it last wrote to each room.
+	lastWrite map[string]map[string]time.Time
+	lastPrune time.Time
+	// max is the number of distinct rooms a publisher may write to within
+	// window, or zero for no limit.
+	max    int
+	window time.Duration
+	mu     sync.Mutex
+}
+
+func newPublisherRooms(max int, window time.Duration) *PublisherRooms {
+	return &PublisherRooms{
+		lastWrite: make(map[string]map[string]time.Time),
+		max:       max,
+		window:    window,
+	}
+}
+
+// publisherKey identifies the publisher of r for PublisherRooms: by the token
+// it presented, if any, so that a token is capped wherever it is used from
+// and publishers behind one NAT aren't capped together, else by its IP. The
+// token is hashed, so that the tracking holds neither tokens nor their size.
+func publisherKey(r *http.Request) string {
+	if token := requestToken(r); token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + string(sum[:])
+	}
+	return "ip:" + remoteIP(r)
+}
+
+// admits reports whether publisher may write to room, without recording a
+// publish: rooms the publisher wrote to within the window always are, new
+// ones only while it has written to fewer than max. It is checked before a
+// publish, which is recorded with allow once accepted.
+func (p *PublisherRooms) admits(publisher, room string) bool {
+	return p.check(publisher, room, false)
+}
+
+// allow records a publish from publisher to room, once it has been accepted
+// otherwise, and reports whether it is permitted, as admits does.
+func (p *PublisherRooms) allow(publisher, room string) bool {
+	return p.check(publisher, room, true)
+}
+
+func (p *PublisherRooms) check(publisher, room string, record bool) bool {
+	if p.max <= 0 {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(p.lastPrune) > p.window {
+		for pub, rooms := range p.lastWrite {
+			p.prune(pub, rooms, now)
+		}
+		p.lastPrune = now
+	}
+
+	rooms := p.lastWrite[publisher]
+	if rooms == nil {
+		rooms = make(map[string]time.Time)
+	}
+	p.prune(publisher, rooms, now)
+	if _, ok := rooms[room]; !ok && len(rooms) >= p.max {
+		return false
+	}
+	if record {
+		rooms[room] = now
+		// Pruning may have dropped the publisher's entry.
+		p.lastWrite[publisher] = rooms
+	}
+	return true
+}
+
+// prune forgets the rooms publisher hasn't written to within the window, and
+// the publisher itself once none are left.
+func (p *PublisherRooms) prune(publisher string, rooms map[string]time.Time, now time.Time) {
+	for room, t := range rooms {
+		if now.Sub(t) > p.window {
+			delete(rooms, room)
+		}
+	}
+	if len(rooms) == 0 {
+		delete(p.lastWrite, publisher)
+	}
+}
@@ -0,0 +1,159 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPublisherIPs(t *testing.T) {
+	p := newPublisherIPs(2, 50*time.Millisecond)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.1"} {
+		if !p.allow(ip) {
+			t.Errorf("%s was rejected", ip)
+		}
+	}
+	if p.allow("192.0.2.3") {
+		t.Error("a third IP was allowed")
+	}
+
+	// Once the window has passed, the IPs seen are forgotten.
+	time.Sleep(60 * time.Millisecond)
+	if !p.allow("192.0.2.3") {
+		t.Error("a new IP was rejected after the window")
+	}
+}
+
+func TestMaxPublisherIPs(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxPublisherIPs = 2
+	opts.PublisherIPWindow = time.Hour
+	s, _ := newTestServer(t, opts)
+
+	for _, tt := range []struct {
+		ip   string
+		want int
+	}{
+		{"192.0.2.1", http.StatusOK},
+		{"192.0.2.2", http.StatusOK},
+		{"192.0.2.3", http.StatusForbidden},
+		{"192.0.2.1", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/capped?content=hello", nil)
+		r.RemoteAddr = tt.ip + ":1234"
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("publish from %s: status %d (%s), want %d", tt.ip, w.Code, w.Body, tt.want)
+		}
+	}
+}
+
+func TestPublisherRooms(t *testing.T) {
+	p := newPublisherRooms(2, 50*time.Millisecond)
+	// Checking a publish doesn't record it.
+	for _, room := range []string{"room3", "room4", "room5"} {
+		if !p.admits("192.0.2.1", room) {
+			t.Errorf("publishing to %s wasn't admitted", room)
+		}
+	}
+	for _, room := range []string{"room1", "room2", "room1"} {
+		if !p.allow("192.0.2.1", room) {
+			t.Errorf("publishing to %s was rejected", room)
+		}
+	}
+	if p.allow("192.0.2.1", "room3") {
+		t.Error("publishing to a third room was allowed")
+	}
+	// Other publishers are counted separately.
+	if !p.allow("192.0.2.2", "room3") {
+		t.Error("another publisher was rejected")
+	}
+
+	// Once the window has passed, the rooms written to are forgotten.
+	time.Sleep(60 * time.Millisecond)
+	if !p.allow("192.0.2.1", "room3") {
+		t.Error("a new room was rejected after the window")
+	}
+}
+
+func TestMaxPublisherRooms(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxPublisherRooms = 3
+	opts.PublisherRoomWindow = time.Hour
+	s, _ := newTestServer(t, opts)
+
+	publishFrom := func(ip, token, room string) int {
+		r := httptest.NewRequest(http.MethodPost, "/"+room+"?content=hello", nil)
+		r.RemoteAddr = ip + ":1234"
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// A token is capped wherever it is used from.
+	for i := range 10 {
+		room := fmt.Sprint("spray-", i)
+		want := http.StatusOK
+		if i >= opts.MaxPublisherRooms {
+			want = http.StatusForbidden
+		}
+		if code := publishFrom(fmt.Sprint("192.0.2.", i+1), "leaked", room); code != want {
+			t.Errorf("publish to %s: status %d, want %d", room, code, want)
+		}
+	}
+	if _, ok := s.rooms.lookupRoom("spray-3"); ok {
+		t.Error("a rejected publish created its room")
+	}
+
+	// Rooms already written to stay open to the token, and other tokens
+	// aren't affected, even from the same IP.
+	if code := publishFrom("198.51.100.1", "leaked", "spray-0"); code != http.StatusOK {
+		t.Errorf("publish to a room already written to: status %d", code)
+	}
+	if code := publishFrom("192.0.2.1", "other", "spray-9"); code != http.StatusOK {
+		t.Errorf("publish with another token from the same IP: status %d", code)
+	}
+
+	// Publishes without a token are capped by IP.
+	for i := range 4 {
+		want := http.StatusOK
+		if i >= opts.MaxPublisherRooms {
+			want = http.StatusForbidden
+		}
+		if code := publishFrom("203.0.113.1", "", fmt.Sprint("anonymous-", i)); code != want {
+			t.Errorf("anonymous publish %d: status %d, want %d", i, code, want)
+		}
+	}
+	if code := publishFrom("203.0.113.2", "", "anonymous-3"); code != http.StatusOK {
+		t.Errorf("anonymous publish from another IP: status %d", code)
+	}
+}
+
+func TestMaxPublisherRoomsRejected(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxPublisherRooms = 1
+	opts.PublisherRoomWindow = time.Hour
+	_, ts := newTestServer(t, opts)
+	if code, body := publish(t, ts, "locked", "first", url.Values{"token": {"owner"}}); code != http.StatusOK {
+		t.Fatalf("claiming the room: %d %s", code, body)
+	}
+
+	// Publishes rejected by a later check don't use up the cap.
+	header := http.Header{"Authorization": {"Bearer publisher"}}
+	if code, body := request(t, http.MethodPost, ts.URL+"/locked?content=denied", "", header); code != http.StatusForbidden {
+		t.Fatalf("publish with the wrong access token: %d %s, want 403", code, body)
+	}
+	if code, body := request(t, http.MethodPost, ts.URL+"/open?content=accepted", "", header); code != http.StatusOK {
+		t.Errorf("publish to another room: %d %s, want the rejected publish not counted", code, body)
+	}
+	if code, body := request(t, http.MethodPost, ts.URL+"/another?content=capped", "", header); code != http.StatusForbidden {
+		t.Errorf("publish to a second room: %d %s, want 403", code, body)
+	}
+}
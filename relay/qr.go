@@ -0,0 +1,39 @@
+package relay
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// qrSize is the width and height in pixels of generated QR codes.
+const qrSize = 256
+
+// roomURL returns the URL of the subscriber page for roomID as seen by the client of r.
+func (s *Server) roomURL(r *http.Request, roomID string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	u := url.URL{
+		Scheme:   scheme,
+		Host:     r.Host,
+		Path:     strings.TrimSuffix(s.opts.BasePath, "/") + "/",
+		Fragment: roomID,
+	}
+	return u.String()
+}
+
+// handleRoomQR serves a QR code for a room's subscriber page: GET /api/rooms/{roomID}/qr.png
+func (s *Server) handleRoomQR(w http.ResponseWriter, r *http.Request) {
+	png, err := qrcode.Encode(s.roomURL(r, r.PathValue("roomID")), qrcode.Medium, qrSize)
+	if err != nil {
+		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
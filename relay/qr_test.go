@@ -0,0 +1,47 @@
+package relay
+
+import (
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoomQR(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	res, err := http.Get(ts.URL + "/api/rooms/room1/qr.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", res.StatusCode)
+	}
+	if got := res.Header.Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type %q, want image/png", got)
+	}
+	img, err := png.Decode(res.Body)
+	if err != nil {
+		t.Fatalf("decoding the PNG: %v", err)
+	}
+	if size := img.Bounds().Size(); size.X != qrSize || size.Y != qrSize {
+		t.Errorf("size %v, want %dx%d", size, qrSize, qrSize)
+	}
+}
+
+func TestRoomURL(t *testing.T) {
+	opts := DefaultOptions()
+	opts.BasePath = "/relay/"
+	s, _ := newTestServer(t, opts)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/rooms/room1/qr.png", nil)
+	r.Host = "example.com"
+	if got, want := s.roomURL(r, "room1"), "http://example.com/relay/#room1"; got != want {
+		t.Errorf("roomURL = %q, want %q", got, want)
+	}
+
+	r.Header.Set("X-Forwarded-Proto", "https")
+	if got, want := s.roomURL(r, "room1"), "https://example.com/relay/#room1"; got != want {
+		t.Errorf("behind a TLS proxy, roomURL = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+var errQuotaExceeded = errors.New("too many connections for this token")
+
+// subscriberQuota caps the concurrent subscriptions, across all rooms, of the
+// subscribers sharing a token identity. The zero value is unlimited.
+type subscriberQuota struct {
+	identity string
+	max      int
+	// authenticated is set for subscribers that presented a valid JWT, who
+	// aren't subject to the anonymous connection limits.
+	authenticated bool
+}
+
+// quota returns the subscription quota of a subscriber JWT. Tokens are
+// identified by their subject, so that all of a tenant's tokens share its
+// quota, or else by their ID or, failing that, the token itself.
+func (c *subscriberClaims) quota(raw string) subscriberQuota {
+	if c.MaxConns <= 0 {
+		return subscriberQuota{}
+	}
+	identity := "sub:" + c.Subject
+	switch {
+	case c.Subject != "":
+	case c.ID != "":
+		identity = "jti:" + c.ID
+	default:
+		sum := sha256.Sum256([]byte(raw))
+		identity = "token:" + hex.EncodeToString(sum[:])
+	}
+	return subscriberQuota{identity: identity, max: c.MaxConns}
+}
+
+// TokenConnections counts the live subscriptions of each token identity.
+type TokenConnections struct {
+	counts map[string]int
+	mu     sync.Mutex
+}
+
+// acquire counts a subscription against q, reporting false if q is used up.
+func (tc *TokenConnections) acquire(q subscriberQuota) bool {
+	if q.max <= 0 {
+		return true
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.counts[q.identity] >= q.max {
+		return false
+	}
+	tc.counts[q.identity]++
+	return true
+}
+
+// release uncounts a subscription acquired against q.
+func (tc *TokenConnections) release(q subscriberQuota) {
+	if q.max <= 0 {
+		return
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.counts[q.identity]--; tc.counts[q.identity] <= 0 {
+		delete(tc.counts, q.identity)
+	}
+}
@@ -0,0 +1,131 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket holds up to burst tokens, refilled at rate per second. Each
+// publish takes one.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket up to now and takes a token from it, reporting
+// false if it is empty.
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// PublishLimiter rate-limits the publishes to a room. It belongs to the room,
+// so its state goes away along with idle rooms.
+type PublishLimiter struct {
+	// buckets maps a publisher IP, or the empty string unless perIP is set,
+	// to its token bucket.
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	// rate is the sustained publishes per second allowed, or zero for no
+	// limit, and burst the publishes allowed at once.
+	rate  float64
+	burst int
+	perIP bool
+	mu    sync.Mutex
+}
+
+func newPublishLimiter(rate float64, burst int, perIP bool) *PublishLimiter {
+	return &PublishLimiter{
+		buckets: make(map[string]*tokenBucket),
+		rate:    rate,
+		burst:   burst,
+		perIP:   perIP,
+	}
+}
+
+// allow reports whether a publish from ip is within the room's rate limit.
+func (l *PublishLimiter) allow(ip string) bool {
+	key := ""
+	if l.perIP {
+		key = ip
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return true
+	}
+
+	// A bucket that has had time to refill is no different from a new one.
+	now := time.Now()
+	refill := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	if now.Sub(l.lastPrune) > refill {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > refill {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	return b.take(now, l.rate, l.burst)
+}
+
+// setRate changes the limiter's rate and burst, as publish_rate and
+// publish_burst do for a room. Buckets keep their tokens.
+func (l *PublishLimiter) setRate(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate, l.burst = rate, max(burst, 1)
+}
+
+// limits returns the limiter's rate and burst.
+func (l *PublishLimiter) limits() (float64, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.rate, l.burst
+}
+
+// checkPublishRate applies the room's publish rate limit to a publish from
+// publisher to room, unless r comes from a trusted publisher. It responds
+// with 429 and reports false if the publish is over the limit.
+func (s *Server) checkPublishRate(w http.ResponseWriter, r *http.Request, room *Room, publisher string) bool {
+	if s.trustedPublisher(r) || room.publishLimiter.allow(publisher) {
+		return true
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Publish rate limit exceeded", http.StatusTooManyRequests)
+	return false
+}
+
+// trustedPublisher reports whether r carries one of TrustedPublisherTokens in
+// its X-Trusted-Publisher header, exempting it from publish rate limits.
+func (s *Server) trustedPublisher(r *http.Request) bool {
+	token := r.Header.Get("X-Trusted-Publisher")
+	if token == "" {
+		return false
+	}
+	trusted := false
+	for candidate := range strings.SplitSeq(s.opts.TrustedPublisherTokens, ",") {
+		if candidate = strings.TrimSpace(candidate); candidate != "" && subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			trusted = true
+		}
+	}
+	return trusted
+}
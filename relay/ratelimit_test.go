@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPublishLimiter(t *testing.T) {
+	l := newPublishLimiter(20, 2, true)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.2"} {
+		if !l.allow(ip) {
+			t.Errorf("publish from %s was rejected within the burst", ip)
+		}
+	}
+	if l.allow("192.0.2.1") {
+		t.Error("a publish past the burst was allowed")
+	}
+
+	// Tokens come back at the rate, and full buckets are dropped.
+	time.Sleep(120 * time.Millisecond)
+	if !l.allow("192.0.2.1") {
+		t.Error("a publish was rejected after the bucket refilled")
+	}
+	l.mu.Lock()
+	buckets := len(l.buckets)
+	l.mu.Unlock()
+	if buckets != 1 {
+		t.Errorf("%d buckets kept, want only the one in use", buckets)
+	}
+}
+
+func TestPublishRateLimit(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishRate = 1
+	opts.PublishBurst = 3
+	opts.TrustedPublisherTokens = "trusted"
+	s, _ := newTestServer(t, opts)
+
+	publishFrom := func(ip, room string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/"+room+"?content="+fmt.Sprint(time.Now().UnixNano()), nil)
+		r.RemoteAddr = ip + ":1234"
+		for key, values := range header {
+			r.Header[key] = values
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w
+	}
+	for i := range opts.PublishBurst {
+		if w := publishFrom("192.0.2.1", "limited", nil); w.Code != http.StatusOK {
+			t.Fatalf("publish %d within the burst: %d %s", i, w.Code, w.Body)
+		}
+	}
+	w := publishFrom("192.0.2.2", "limited", nil)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("publish past the burst: %d with Retry-After %q, want 429 and a Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// The limit is the room's, and trusted publishers are exempt from it.
+	if w := publishFrom("192.0.2.1", "other", nil); w.Code != http.StatusOK {
+		t.Errorf("publish to another room: %d %s", w.Code, w.Body)
+	}
+	if w := publishFrom("192.0.2.1", "limited", http.Header{"X-Trusted-Publisher": {"trusted"}}); w.Code != http.StatusOK {
+		t.Errorf("trusted publish: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestRoomPublishRate(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishRate = 1
+	opts.PublishBurst = 1
+	opts.TrustedPublisherTokens = "trusted, also-trusted"
+	_, ts := newTestServer(t, opts)
+	for room, meta := range map[string]string{
+		"strict": `{"publish_rate":0.01,"publish_burst":2}`,
+		"free":   `{"publish_rate":0}`,
+	} {
+		if code, body := admin(t, ts, http.MethodPut, "/api/rooms/"+room, meta); code != http.StatusCreated {
+			t.Fatalf("creating %s: %d %s", room, code, body)
+		}
+	}
+	for _, meta := range []string{`{"publish_rate":-1}`, `{"publish_burst":0}`} {
+		if code, body := admin(t, ts, http.MethodPost, "/api/rooms/strict/meta", meta); code != http.StatusBadRequest {
+			t.Errorf("setting %s: %d %s, want 400", meta, code, body)
+		}
+	}
+
+	for _, tt := range []struct {
+		room   string
+		header http.Header
+		want   []int
+	}{
+		// The room's burst replaces the server's.
+		{"strict", nil, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}},
+		{"free", nil, []int{http.StatusOK, http.StatusOK, http.StatusOK}},
+		{"strict", http.Header{"X-Trusted-Publisher": {"also-trusted"}}, []int{http.StatusOK, http.StatusOK}},
+		{"strict", http.Header{"X-Trusted-Publisher": {"guess"}}, []int{http.StatusTooManyRequests}},
+	} {
+		for i, want := range tt.want {
+			target := fmt.Sprintf("%s/%s?content=%d", ts.URL, tt.room, time.Now().UnixNano())
+			if code, body := request(t, http.MethodPost, target, "", tt.header); code != want {
+				t.Errorf("publish %d to %s with %v: %d %s, want %d", i, tt.room, tt.header, code, body, want)
+			}
+		}
+	}
+}
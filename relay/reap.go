@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"time"
+)
+
+// scheduleReap arranges for room to be checked for removal after the given
+// delay, unless a check is already pending. Rooms schedule a check when they
+// are created and whenever their last subscriber leaves.
+func (rm *RoomManager) scheduleReap(room *Room, after time.Duration) {
+	if !room.reapPending.CompareAndSwap(false, true) {
+		return
+	}
+	time.AfterFunc(after, func() {
+		rm.reap(room)
+	})
+}
+
+// reap removes room, stopping its goroutine, if it is idle: it has no
+// subscribers, counting those still being admitted, and it hasn't been looked
+// up, joined, left or published to for RoomIdleTimeout. Rooms with pending
+// publishes or scheduled messages are checked again later, and rooms that
+// are mirrored to or from, or that only the admin API may create, are kept.
+func (rm *RoomManager) reap(room *Room) {
+	room.reapPending.Store(false)
+
+	s := rm.shard(room.name)
+	s.mu.Lock()
+	// A room with subscribers is checked again once the last of them leaves.
+	if s.rooms[room.name] != room || room.members.Load() > 0 || rm.mirrored(room.name) || !rm.srv.autoCreates(room.name) {
+		s.mu.Unlock()
+		return
+	}
+	// Lookups update lastUsed under the shard lock, so a room about to be
+	// joined or published to is never removed from under its caller.
+	idleSince := time.Unix(0, max(room.lastUsed.Load(), room.lastActivity.Load()))
+	wait := time.Until(idleSince.Add(rm.srv.opts.RoomIdleTimeout))
+	if room.queued.Load() > 0 || room.schedule.len() > 0 || room.paused() {
+		wait = rm.srv.opts.RoomIdleTimeout
+	}
+	if wait > 0 {
+		s.mu.Unlock()
+		rm.scheduleReap(room, wait)
+		return
+	}
+	delete(s.rooms, room.name)
+	s.mu.Unlock()
+
+	rm.srv.announce(directoryEvent{Type: "room_deleted", Room: room.name})
+	room.close(0)
+}
+
+// mirrored reports whether the named room's broadcasts are mirrored to other
+// rooms, remote mirrors, webhooks or bridges, or other rooms' broadcasts are
+// mirrored to it.
+func (rm *RoomManager) mirrored(name string) bool {
+	if len(rm.srv.remoteMirrors.targets(name)) > 0 || len(rm.srv.webhooks.targets(name)) > 0 || rm.srv.bridges.bridged(name) {
+		return true
+	}
+
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	if len(rm.mirrors[name]) > 0 {
+		return true
+	}
+	for _, targets := range rm.mirrors {
+		if _, ok := targets[name]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReapIdleRoom(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	opts := DefaultOptions()
+	opts.RoomIdleTimeout = idle
+	s, ts := newTestServer(t, opts)
+
+	conn := dialWS(t, ts, "/ws/brief", nil)
+	room := waitForRoom(t, s, "brief")
+	if code, body := publish(t, ts, "brief", "kept", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+
+	// A room with a subscriber is kept however long it is quiet.
+	time.Sleep(2 * idle)
+	if current, ok := s.rooms.lookupRoom("brief"); !ok || current != room {
+		t.Fatal("a room with a subscriber was reaped")
+	}
+
+	// A subscriber reconnecting within the timeout finds the room as it was.
+	conn.Close()
+	eventually(t, "the subscriber to leave", func() bool { return room.members.Load() == 0 })
+	conn = dialWS(t, ts, "/ws/brief", nil)
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "kept" {
+		t.Fatalf("reconnecting: %q (%v), want the retained content", message, err)
+	}
+	if current, _ := s.rooms.lookupRoom("brief"); current != room {
+		t.Fatal("the room was replaced while a subscriber reconnected")
+	}
+
+	// Once the room is left idle it is removed and its goroutine returns.
+	conn.Close()
+	select {
+	case <-room.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the idle room's goroutine didn't return")
+	}
+	if _, ok := s.rooms.lookupRoom("brief"); ok {
+		t.Error("the idle room is still listed")
+	}
+	if got := latest(t, ts, "brief"); got != "" {
+		t.Errorf("latest = %q after the room was reaped", got)
+	}
+}
+
+func TestReapKeepsUsedRoom(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	opts := DefaultOptions()
+	opts.RoomIdleTimeout = idle
+	s, ts := newTestServer(t, opts)
+
+	// Publishing keeps a room without subscribers from being reaped.
+	if code, body := publish(t, ts, "busy", "first", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	room := waitForRoom(t, s, "busy")
+	deadline := time.Now().Add(3 * idle)
+	for i := 0; time.Now().Before(deadline); i++ {
+		time.Sleep(idle / 5)
+		if code, body := publish(t, ts, "busy", fmt.Sprint("tick ", i), nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+	}
+	if current, _ := s.rooms.lookupRoom("busy"); current != room {
+		t.Error("a room in use was reaped")
+	}
+}
@@ -0,0 +1,67 @@
+package relay
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ReconnectLimiter tracks when each client ID last connected.
+type ReconnectLimiter struct {
+	lastConnect map[string]time.Time
+	lastPrune   time.Time
+	// interval is the minimum time between two connections of a client ID.
+	interval time.Duration
+	mu       sync.Mutex
+}
+
+func newReconnectLimiter(interval time.Duration) *ReconnectLimiter {
+	return &ReconnectLimiter{
+		lastConnect: make(map[string]time.Time),
+		interval:    interval,
+	}
+}
+
+// allow records a connection from clientID if it is permitted, returning
+// zero, or otherwise how long the client must wait before reconnecting.
+func (l *ReconnectLimiter) allow(clientID string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) > l.interval {
+		for id, t := range l.lastConnect {
+			if now.Sub(t) >= l.interval {
+				delete(l.lastConnect, id)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	if t, ok := l.lastConnect[clientID]; ok {
+		if wait := l.interval - now.Sub(t); wait > 0 {
+			return wait
+		}
+	}
+	l.lastConnect[clientID] = now
+	return 0
+}
+
+// allowReconnect applies ReconnectInterval to the subscriber request r,
+// responding with 429 and a Retry-After hint and reporting false if the client
+// reconnects too soon.
+func (s *Server) allowReconnect(w http.ResponseWriter, r *http.Request) bool {
+	clientID := r.URL.Query().Get("client_id")
+	if s.opts.ReconnectInterval <= 0 || clientID == "" {
+		return true
+	}
+	wait := s.reconnects.allow(clientID)
+	if wait == 0 {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Reconnecting too fast", http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,47 @@
+package relay
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReconnectLimiter(t *testing.T) {
+	l := newReconnectLimiter(50 * time.Millisecond)
+	if wait := l.allow("a"); wait != 0 {
+		t.Fatalf("first connection told to wait %v", wait)
+	}
+	if wait := l.allow("a"); wait <= 0 || wait > 50*time.Millisecond {
+		t.Errorf("reconnection told to wait %v, want up to 50ms", wait)
+	}
+	if wait := l.allow("b"); wait != 0 {
+		t.Errorf("another client ID told to wait %v", wait)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if wait := l.allow("a"); wait != 0 {
+		t.Errorf("reconnection after the interval told to wait %v", wait)
+	}
+}
+
+func TestReconnectThrottling(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ReconnectInterval = time.Minute
+	_, ts := newTestServer(t, opts)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/room1?client_id=looping"
+
+	dialWS(t, ts, "/ws/room1?client_id=looping", nil).Close()
+	_, res, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || res == nil || res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("reconnecting at once: %v, want status 429", err)
+	}
+	if got := res.Header.Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After %q, want 60", got)
+	}
+
+	// Subscribers without a client ID aren't throttled.
+	dialWS(t, ts, "/ws/room1", nil)
+	dialWS(t, ts, "/ws/room1", nil)
+}
@@ -0,0 +1,63 @@
+package relay
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisBackplaneSharesRooms(t *testing.T) {
+	redis := miniredis.RunT(t)
+	var servers []*Server
+	var urls []string
+	for range 2 {
+		backplane, err := NewRedisBackplane("redis://"+redis.Addr(), "relay-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { backplane.Close() })
+		opts := DefaultOptions()
+		opts.Backplane = backplane
+		s, ts := newTestServer(t, opts)
+		servers = append(servers, s)
+		urls = append(urls, ts.URL)
+	}
+	eventually(t, "both instances to subscribe", func() bool {
+		return redis.PubSubNumSub("relay-test")["relay-test"] == 2
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, urls[0]+"/shared?content=hello", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("publish: %d", res.StatusCode)
+	}
+
+	eventually(t, "the other instance to get the message", func() bool {
+		code, body := request(t, http.MethodGet, urls[1]+"/api/rooms/shared/latest", "", nil)
+		return code == http.StatusOK && body == "hello"
+	})
+	// The instance it was published on ignores its own message rather
+	// than retaining it twice.
+	room := waitForRoom(t, servers[0], "shared")
+	var history int
+	room.do(func() {
+		history = len(room.history.messages)
+	})
+	if history != 1 {
+		t.Errorf("the publishing instance retained %d messages, want 1", history)
+	}
+}
+
+func TestNewRedisBackplaneRejectsInvalidURL(t *testing.T) {
+	if _, err := NewRedisBackplane("http://localhost", "relay"); err == nil {
+		t.Error("NewRedisBackplane accepted an http URL")
+	}
+	if _, err := NewRedisBackplane("redis://localhost", ""); err == nil {
+		t.Error("NewRedisBackplane accepted an empty channel")
+	}
+}
@@ -0,0 +1,5 @@
+// Package relaypb holds the relay's gRPC service, generated from relay.proto
+// and served by relay.Server.RegisterGRPC.
+package relaypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative relay.proto
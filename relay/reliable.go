@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+// ackEvent is what a WebSocket subscriber of a reliable room sends to
+// acknowledge every message up to and including Seq:
+// {"type":"ack","seq":42}
+type ackEvent struct {
+	Type string `json:"type"`
+	Seq  uint64 `json:"seq"`
+}
+
+// parseAck returns the sequence number a frame from a subscriber
+// acknowledges, reporting false if it isn't an acknowledgement.
+func parseAck(messageType int, message []byte) (uint64, bool) {
+	if messageType != websocket.TextMessage || !bytes.Contains(message, []byte(`"ack"`)) {
+		return 0, false
+	}
+	var ack ackEvent
+	if json.Unmarshal(message, &ack) != nil || ack.Type != "ack" || ack.Seq == 0 {
+		return 0, false
+	}
+	return ack.Seq, true
+}
+
+// ack records that the client has processed every message up to seq.
+// Acknowledgements only move forward.
+func (c *Client) ack(seq uint64) {
+	for {
+		acked := c.acked.Load()
+		if seq <= acked || c.acked.CompareAndSwap(acked, seq) {
+			return
+		}
+	}
+}
+
+// ackedPosition returns the sequence number a departing subscriber of a
+// reliable room is resumed from: that of the latest message it acknowledged,
+// so that whatever it didn't is replayed when it reconnects, whether it was
+// still queued, in flight or lost with the connection. It must be called on
+// the room's goroutine.
+func (r *Room) ackedPosition(client *Client) uint64 {
+	return min(client.acked.Load(), r.sequence)
+}
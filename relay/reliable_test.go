@@ -0,0 +1,92 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseAck(t *testing.T) {
+	for _, tt := range []struct {
+		messageType int
+		message     string
+		seq         uint64
+		ok          bool
+	}{
+		{websocket.TextMessage, `{"type":"ack","seq":42}`, 42, true},
+		{websocket.BinaryMessage, `{"type":"ack","seq":42}`, 0, false},
+		{websocket.TextMessage, `{"type":"ack","seq":0}`, 0, false},
+		{websocket.TextMessage, `{"type":"chat","text":"ack"}`, 0, false},
+		{websocket.TextMessage, `ack`, 0, false},
+	} {
+		if seq, ok := parseAck(tt.messageType, []byte(tt.message)); seq != tt.seq || ok != tt.ok {
+			t.Errorf("parseAck(%d, %s) = %d, %t, want %d, %t", tt.messageType, tt.message, seq, ok, tt.seq, tt.ok)
+		}
+	}
+}
+
+func TestReliableRoom(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HistorySize = 10
+	opts.ResumeWindow = time.Minute
+	opts.WSPublish = true
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	if code, body := admin(t, ts, http.MethodPut, "/api/rooms/orders", `{"reliable":true}`); code != http.StatusCreated {
+		t.Fatalf("creating the room: %d %s", code, body)
+	}
+	room := waitForRoom(t, s, "orders")
+	conn := dialWS(t, ts, "/ws/orders?client_id=bob", nil)
+	waitForClients(t, room, 1)
+
+	// Subscribers get numbered envelopes without asking for them.
+	var seqs []uint64
+	for i := range 3 {
+		if err := s.Publish("orders", fmt.Append(nil, "order ", i)); err != nil {
+			t.Fatal(err)
+		}
+		e := readEnvelope(t, conn)
+		if e.Content != fmt.Sprint("order ", i) || e.Seq == 0 {
+			t.Fatalf("envelope %+v, want order %d", e, i)
+		}
+		seqs = append(seqs, e.Seq)
+	}
+
+	// Acknowledging the first isn't published, even with WSPublish.
+	if err := conn.WriteJSON(ackEvent{Type: "ack", Seq: seqs[0]}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the acknowledgement", func() bool {
+		code, body := admin(t, ts, http.MethodGet, "/api/rooms/orders/clients", "")
+		var list struct {
+			Clients []clientInfo `json:"clients"`
+		}
+		if code != http.StatusOK || json.Unmarshal([]byte(body), &list) != nil {
+			t.Fatalf("listing clients: %d %s", code, body)
+		}
+		return len(list.Clients) == 1 && list.Clients[0].Acked == seqs[0]
+	})
+	if got := latest(t, ts, "orders"); got != "order 2" {
+		t.Errorf("latest = %q, want the acknowledgement not to be published", got)
+	}
+
+	// Reconnecting redelivers what wasn't acknowledged, although it was
+	// received.
+	conn.Close()
+	waitForClients(t, room, 0)
+	conn = dialWS(t, ts, "/ws/orders?client_id=bob", nil)
+	for _, want := range seqs[1:] {
+		if e := readEnvelope(t, conn); e.Seq != want {
+			t.Errorf("redelivered %+v, want seq %d", e, want)
+		}
+	}
+
+	// Subscribers can also present the last message they saw.
+	if e := readEnvelope(t, dialWS(t, ts, fmt.Sprint("/ws/orders?last_event_id=", seqs[1]), nil)); e.Seq != seqs[2] {
+		t.Errorf("after last_event_id=%d, replayed %+v first, want seq %d", seqs[1], e, seqs[2])
+	}
+}
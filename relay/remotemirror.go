@@ -0,0 +1,226 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// remoteMirrorQueue bounds the messages waiting to be sent to a remote
+	// mirror. Further messages are dropped, counting as failed deliveries.
+	remoteMirrorQueue = 256
+
+	// remoteMirrorTimeout bounds each delivery to a remote mirror.
+	remoteMirrorTimeout = 10 * time.Second
+
+	// mirrorHealthWindow is the number of recent deliveries a remote
+	// mirror's failure rate is computed over.
+	mirrorHealthWindow = 20
+
+	// mirrorHealthExpiry is how long after its last delivery a remote
+	// mirror's failures are forgotten, so that rejecting publishes to a
+	// failing mirror doesn't keep it failing for good.
+	mirrorHealthExpiry = 30 * time.Second
+)
+
+// remoteMirror delivers a room's broadcasts to an external URL, such as the
+// publish endpoint of a room on another relay, by POSTing each message from
+// a worker of its own.
+type remoteMirror struct {
+	url   string
+	queue chan publication
+	stop  chan struct{}
+
+	mu sync.Mutex
+	// failed holds the outcomes of the latest deliveries, up to
+	// mirrorHealthWindow, as a ring starting at next.
+	failed []bool
+	next   int
+	last   time.Time
+}
+
+// enqueue queues p's message for delivery, counting it as failed if the
+// queue is full. It never blocks the room.
+func (m *remoteMirror) enqueue(p publication) {
+	select {
+	case m.queue <- p:
+	default:
+		m.recordOutcome(false)
+	}
+}
+
+// run delivers the queued messages until the mirror is removed or the server
+// shuts down.
+func (m *remoteMirror) run(client *http.Client, shutdown <-chan struct{}) {
+	for {
+		select {
+		case p := <-m.queue:
+			m.recordOutcome(m.deliver(client, p) == nil)
+		case <-m.stop:
+			return
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// deliver POSTs p's message to the mirror's URL.
+func (m *remoteMirror) deliver(client *http.Client, p publication) error {
+	resp, err := client.Post(m.url, p.contentType, bytes.NewReader(p.message))
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", m.url, resp.Status)
+	}
+	return nil
+}
+
+func (m *remoteMirror) recordOutcome(ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.last = time.Now()
+	if len(m.failed) < mirrorHealthWindow {
+		m.failed = append(m.failed, !ok)
+		return
+	}
+	m.failed[m.next] = !ok
+	m.next = (m.next + 1) % mirrorHealthWindow
+}
+
+// failureRate returns the fraction of the latest deliveries that failed,
+// or 0 if there were none within mirrorHealthExpiry.
+func (m *remoteMirror) failureRate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.failed) == 0 || time.Since(m.last) > mirrorHealthExpiry {
+		return 0
+	}
+	failures := 0
+	for _, failed := range m.failed {
+		if failed {
+			failures++
+		}
+	}
+	return float64(failures) / float64(len(m.failed))
+}
+
+// RemoteMirrors holds the remote mirrors of each room, by room name.
+type RemoteMirrors struct {
+	mirrors  map[string]map[string]*remoteMirror
+	client   *http.Client
+	shutdown <-chan struct{}
+	mu       sync.RWMutex
+}
+
+func newRemoteMirrors(shutdown <-chan struct{}) *RemoteMirrors {
+	return &RemoteMirrors{
+		mirrors:  make(map[string]map[string]*remoteMirror),
+		client:   &http.Client{Timeout: remoteMirrorTimeout},
+		shutdown: shutdown,
+	}
+}
+
+// add mirrors the broadcasts to the named room to target, unless they
+// already are.
+func (rm *RemoteMirrors) add(room, target string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if rm.mirrors[room] == nil {
+		rm.mirrors[room] = make(map[string]*remoteMirror)
+	}
+	if rm.mirrors[room][target] != nil {
+		return
+	}
+	m := &remoteMirror{
+		url:   target,
+		queue: make(chan publication, remoteMirrorQueue),
+		stop:  make(chan struct{}),
+	}
+	rm.mirrors[room][target] = m
+	go m.run(rm.client, rm.shutdown)
+}
+
+// remove stops mirroring the named room's broadcasts to any remote mirror.
+func (rm *RemoteMirrors) remove(room string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	for _, m := range rm.mirrors[room] {
+		close(m.stop)
+	}
+	delete(rm.mirrors, room)
+}
+
+// targets returns the remote mirrors of the named room.
+func (rm *RemoteMirrors) targets(room string) []*remoteMirror {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	targets := make([]*remoteMirror, 0, len(rm.mirrors[room]))
+	for _, m := range rm.mirrors[room] {
+		targets = append(targets, m)
+	}
+	return targets
+}
+
+// urls returns the URLs the named room is mirrored to.
+func (rm *RemoteMirrors) urls(room string) []string {
+	var urls []string
+	for _, m := range rm.targets(room) {
+		urls = append(urls, m.url)
+	}
+	return urls
+}
+
+// failing returns the URL of a remote mirror of the named room whose recent
+// failure rate is at least threshold, if there is one.
+func (rm *RemoteMirrors) failing(room string, threshold float64) (string, bool) {
+	for _, m := range rm.targets(room) {
+		if m.failureRate() >= threshold {
+			return m.url, true
+		}
+	}
+	return "", false
+}
+
+// parseMirrorURL checks that a remote mirror's URL is an absolute HTTP URL.
+func parseMirrorURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url parameter %q", raw)
+	}
+	return nil
+}
+
+// checkMirrorHealth applies MirrorHealthGate to a publish to room whose
+// remote mirrors may be failing: with "warn" the response gets a Warning
+// header, and with "reject" the publish is rejected with 503. It reports
+// whether the publish may proceed.
+func (s *Server) checkMirrorHealth(w http.ResponseWriter, room *Room) bool {
+	if s.opts.MirrorHealthGate == "off" {
+		return true
+	}
+	target, failing := s.remoteMirrors.failing(room.name, s.opts.MirrorFailureThreshold)
+	if !failing {
+		return true
+	}
+	if s.opts.MirrorHealthGate == "reject" {
+		w.Header().Set("Retry-After", strconv.Itoa(int(mirrorHealthExpiry/time.Second)))
+		http.Error(w, "Mirror to "+target+" is failing", http.StatusServiceUnavailable)
+		return false
+	}
+	w.Header().Add("Warning", `299 - "remote mirror is failing"`)
+	return true
+}
@@ -0,0 +1,74 @@
+package relay
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMirrorHealthGate(t *testing.T) {
+	var failing atomic.Bool
+	var delivered atomic.Int64
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		delivered.Add(1)
+	}))
+	t.Cleanup(sink.Close)
+
+	for _, gate := range []string{"warn", "reject"} {
+		failing.Store(false)
+		delivered.Store(0)
+		opts := DefaultOptions()
+		opts.MirrorHealthGate = gate
+		opts.PublishRate = 0
+		s, ts := newTestServer(t, opts)
+		if code, body := admin(t, ts, http.MethodPost, "/api/rooms/gated/mirror-to?url="+url.QueryEscape(sink.URL), ""); code != http.StatusOK {
+			t.Fatalf("%s: mirroring: %d %s", gate, code, body)
+		}
+		// publishGated publishes content and returns the response.
+		publishGated := func(content string) *http.Response {
+			res, err := http.Post(ts.URL+"/gated?content="+url.QueryEscape(content), "text/plain", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			return res
+		}
+
+		// While the mirror delivers, publishes go through untouched.
+		if res := publishGated("healthy"); res.StatusCode != http.StatusOK || res.Header.Get("Warning") != "" {
+			t.Errorf("%s: publish with a healthy mirror: status %d, Warning %q", gate, res.StatusCode, res.Header.Get("Warning"))
+		}
+		eventually(t, "the mirror delivery", func() bool { return delivered.Load() == 1 })
+
+		// Once most of its recent deliveries fail, publishes surface it.
+		failing.Store(true)
+		publishGated("failing 1")
+		publishGated("failing 2")
+		eventually(t, "the mirror to be failing", func() bool {
+			_, failing := s.remoteMirrors.failing("gated", opts.MirrorFailureThreshold)
+			return failing
+		})
+		res := publishGated("degraded")
+		switch gate {
+		case "warn":
+			if res.StatusCode != http.StatusOK || res.Header.Get("Warning") == "" {
+				t.Errorf("warn: publish with a failing mirror: status %d, Warning %q, want 200 with a warning", res.StatusCode, res.Header.Get("Warning"))
+			}
+		case "reject":
+			if res.StatusCode != http.StatusServiceUnavailable || res.Header.Get("Retry-After") == "" {
+				t.Errorf("reject: publish with a failing mirror: status %d, Retry-After %q, want 503 with a retry hint", res.StatusCode, res.Header.Get("Retry-After"))
+			}
+			if got := latest(t, ts, "gated"); got != "failing 2" {
+				t.Errorf("reject: latest = %q, want the rejected publish left out", got)
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// resumeKey identifies a client ID's subscription to a room.
+type resumeKey struct {
+	room     string
+	clientID string
+}
+
+// resumePosition is the sequence number of the latest message broadcast to
+// a room that a departed client had been delivered.
+type resumePosition struct {
+	seq     uint64
+	expires time.Time
+}
+
+// ResumePositions holds the positions of departed subscribers that
+// identified themselves with a client ID, for ResumeWindow, so that a quick
+// reconnect picks up where they left off.
+type ResumePositions struct {
+	positions map[resumeKey]resumePosition
+	lastPrune time.Time
+	window    time.Duration
+	mu        sync.Mutex
+}
+
+func newResumePositions(window time.Duration) *ResumePositions {
+	return &ResumePositions{
+		positions: make(map[resumeKey]resumePosition),
+		window:    window,
+	}
+}
+
+// save records that clientID left room having been delivered everything up
+// to seq.
+func (rp *ResumePositions) save(room, clientID string, seq uint64) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rp.lastPrune) > rp.window {
+		for key, position := range rp.positions {
+			if now.After(position.expires) {
+				delete(rp.positions, key)
+			}
+		}
+		rp.lastPrune = now
+	}
+	rp.positions[resumeKey{room, clientID}] = resumePosition{seq: seq, expires: now.Add(rp.window)}
+}
+
+// take returns and forgets the position clientID left room at, reporting
+// false if there is none or it has expired.
+func (rp *ResumePositions) take(room, clientID string) (uint64, bool) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	key := resumeKey{room, clientID}
+	position, ok := rp.positions[key]
+	if !ok {
+		return 0, false
+	}
+	delete(rp.positions, key)
+	return position.seq, time.Now().Before(position.expires)
+}
+
+// saveResumePosition records the position of a client leaving the room, if
+// it identified itself with a client ID and was delivered every message it
+// was queued: one leaving with messages undelivered, such as a slow client
+// being dropped, gets the usual replay when it reconnects. In reliable rooms,
+// the position is that of the latest message a WebSocket client acknowledged.
+// Subscriber group members aren't replayed to, so they have no position. It
+// must be called on the room's goroutine, before the client's send buffer is
+// closed.
+func (r *Room) saveResumePosition(client *Client) {
+	if r.srv.opts.ResumeWindow <= 0 || client.clientID == "" || client.group != "" {
+		return
+	}
+	if r.reliable.Load() && !client.sse && !client.grpc {
+		r.srv.resumePositions.save(r.name, client.clientID, r.ackedPosition(client))
+		return
+	}
+	if len(client.send) > 0 || client.undelivered.Load() {
+		return
+	}
+	r.srv.resumePositions.save(r.name, client.clientID, r.sequence)
+}
+
+// resume drops the messages a reconnecting client was already delivered
+// from the history messages to replay to it, if it left the room within
+// ResumeWindow. It must be called on the room's goroutine.
+func (r *Room) resume(client *Client, messages []retainedMessage) []retainedMessage {
+	if r.srv.opts.ResumeWindow <= 0 || client.clientID == "" {
+		return messages
+	}
+	seq, ok := r.srv.resumePositions.take(r.name, client.clientID)
+	if !ok {
+		return messages
+	}
+	// The history is oldest first.
+	for len(messages) > 0 && messages[0].seq <= seq {
+		messages = messages[1:]
+	}
+	return messages
+}
@@ -0,0 +1,61 @@
+package relay
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestResumeWindow(t *testing.T) {
+	const window = 200 * time.Millisecond
+	opts := DefaultOptions()
+	opts.HistorySize = 10
+	opts.ResumeWindow = window
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	const path = "/ws/resumed?client_id=alice"
+	next := 0
+	// publishN publishes the next n numbered messages and returns them.
+	publishN := func(n int) []string {
+		var messages []string
+		for range n {
+			next++
+			message := fmt.Sprint("message ", next)
+			messages = append(messages, message)
+			if err := s.Publish("resumed", []byte(message)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return messages
+	}
+
+	conn := dialWS(t, ts, path, nil)
+	room := waitForRoom(t, s, "resumed")
+	waitForClients(t, room, 1)
+	first := publishN(2)
+	if got := readLines(t, conn, 2); !slices.Equal(got, first) {
+		t.Fatalf("received %q, want %q", got, first)
+	}
+	conn.Close()
+	eventually(t, "the subscriber to leave", func() bool { return room.members.Load() == 0 })
+
+	// Reconnecting within the window picks up exactly where it left off.
+	missed := publishN(2)
+	conn = dialWS(t, ts, path, nil)
+	waitForClients(t, room, 1)
+	live := publishN(1)
+	if got, want := readLines(t, conn, 3), slices.Concat(missed, live); !slices.Equal(got, want) {
+		t.Errorf("within the window, received %q, want %q", got, want)
+	}
+	conn.Close()
+	eventually(t, "the subscriber to leave", func() bool { return room.members.Load() == 0 })
+
+	// After the window, the position is gone and the history is replayed.
+	time.Sleep(window + 50*time.Millisecond)
+	all := slices.Concat(first, missed, live, publishN(1))
+	conn = dialWS(t, ts, path, nil)
+	if got := readLines(t, conn, len(all)); !slices.Equal(got, all) {
+		t.Errorf("after the window, received %q, want the whole history %q", got, all)
+	}
+}
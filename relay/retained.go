@@ -0,0 +1,66 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// retainedMessage is a message a room retains for replay, held compressed if
+// it is at least CompressRetained bytes and compression makes it smaller.
+type retainedMessage struct {
+	data []byte
+	// size is the message's uncompressed size, which history limits apply to.
+	size       int
+	compressed bool
+	// retainedAt is when the room retained the message, for ContentTTL.
+	retainedAt time.Time
+	// seq is the message's sequence number in the room, for Envelope, or 0
+	// if it was restored from an export.
+	seq uint64
+	// cacheControl is the Cache-Control directive the message was published
+	// with, sent on HTTP reads of it, if any.
+	cacheControl string
+	// sender is the connection ID of the WebSocket client that published the
+	// message, if one did, for envelopes.
+	sender string
+	// topic is the topic the message was tagged with, if any, so that it is
+	// only replayed to subscribers to it.
+	topic string
+	// expiresAt is when the message's TTL runs out, or zero if it was
+	// published without one.
+	expiresAt time.Time
+}
+
+// retain returns message in the form the room should hold it in.
+func (r *Room) retain(message []byte) retainedMessage {
+	m := retainedMessage{data: message, size: len(message), retainedAt: time.Now()}
+	if threshold := r.srv.opts.CompressRetained; threshold > 0 && len(message) >= threshold {
+		if zipped := gzipBytes(message); len(zipped) < len(message) {
+			m.data = zipped
+			m.compressed = true
+		}
+	}
+	return m
+}
+
+// content returns the message, decompressing it if needed.
+func (m retainedMessage) content() []byte {
+	if !m.compressed {
+		return m.data
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(m.data))
+	if err != nil {
+		// Compressed by retain, so this can't happen.
+		slog.Error("decompressing retained message", "err", err)
+		return nil
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, m.size))
+	if _, err := io.Copy(buf, zr); err != nil {
+		slog.Error("decompressing retained message", "err", err)
+		return nil
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompressRetained(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CompressRetained = 1024
+	opts.MaxContentSize = 1 << 20
+	s, ts := newTestServer(t, opts)
+
+	large := strings.Repeat("a retained line of text\n", 4096)
+	if code, body := request(t, http.MethodPost, ts.URL+"/compressed", large, nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	room := waitForRoom(t, s, "compressed")
+	var retained retainedMessage
+	room.do(func() { retained = room.lastContent })
+	if !retained.compressed || len(retained.data) >= len(large)/10 || retained.size != len(large) {
+		t.Errorf("retained %d bytes, compressed %t, for %d bytes of text", len(retained.data), retained.compressed, len(large))
+	}
+
+	// Replays decompress it.
+	conn := dialWS(t, ts, "/ws/compressed", nil)
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != large {
+		t.Errorf("replayed %d bytes (%v), want the %d published", len(message), err, len(large))
+	}
+	if got := latest(t, ts, "compressed"); got != large {
+		t.Errorf("latest returned %d bytes, want the %d published", len(got), len(large))
+	}
+
+	// Content below the threshold, or that doesn't compress, is kept as is.
+	random := make([]byte, 4096)
+	rand.Read(random)
+	for _, content := range [][]byte{[]byte("small"), random} {
+		if code, body := request(t, http.MethodPost, ts.URL+"/compressed", string(content), nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+		room.do(func() { retained = room.lastContent })
+		if retained.compressed || !bytes.Equal(retained.data, content) {
+			t.Errorf("retained %d bytes of content, compressed %t, want them as is", len(content), retained.compressed)
+		}
+	}
+}
@@ -0,0 +1,852 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// Room maintains the set of active clients and broadcasts messages to the clients.
+type Room struct {
+	// srv is the server the room belongs to.
+	srv     *Server
+	name    string
+	clients map[*Client]bool
+	// groups are the room's subscriber groups by name.
+	groups     map[string]*subscriberGroup
+	broadcast  chan publication
+	register   chan *Client
+	unregister chan *Client
+	exec       chan func()
+	// done is closed once the room has shut down and stopped processing events.
+	done chan struct{}
+	// stopped is set on the room's goroutine to make the event loop exit.
+	stopped bool
+	// metrics accumulates the room's metric updates when they are batched.
+	metrics metricsBatch
+
+	lastContent retainedMessage
+	// lastContentHash is the hex-encoded SHA-256 of lastContent.
+	lastContentHash string
+	// lastContentTime is when lastContent was published.
+	lastContentTime time.Time
+	// expiryTimer fires at nextExpiry, the earliest time a retained
+	// message's TTL runs out, to drop the expired messages. Both are only
+	// used on the room's goroutine.
+	expiryTimer *time.Timer
+	nextExpiry  time.Time
+	// sequence counts the messages broadcast to the room, and lastPublish is
+	// when the latest of them was.
+	sequence    uint64
+	lastPublish time.Time
+	// deltaBase is the latest message delta subscribers were sent, with its
+	// sequence number deltaSeq, or zero if they may not all have it.
+	deltaBase    []byte
+	deltaSeq     uint64
+	history      *History
+	schedule     *Schedule
+	publisherIPs *PublisherIPs
+	// dedupKeys remembers the dedup keys recently published to the room.
+	dedupKeys *DedupKeys
+	// publishLimiter enforces PublishRate.
+	publishLimiter *PublishLimiter
+
+	// priority orders rooms for load shedding: slow clients of lower-priority
+	// rooms are dropped first.
+	priority atomic.Int32
+
+	// latestOnly lets a newer broadcast preempt an in-progress fan-out, so
+	// clients not yet served skip straight to the newest message.
+	latestOnly atomic.Bool
+
+	// maxRetainBytes is the largest message the room retains, or zero for no
+	// limit. Larger messages are still broadcast live.
+	maxRetainBytes atomic.Int64
+
+	// maxContentSize is the largest message that may be published to the
+	// room, or zero for the server's limit alone.
+	maxContentSize atomic.Int64
+
+	// retainContentType, if set, is the only media type the room retains,
+	// e.g. application/json. Content of other types is still broadcast live.
+	retainContentType atomic.Pointer[string]
+
+	// compression enables permessage-deflate for new connections to the room,
+	// at compressionLevel, or the default level if it is zero.
+	compression      atomic.Bool
+	compressionLevel atomic.Int32
+	// slowClient overrides SlowClient for the room, if set.
+	slowClient atomic.Pointer[string]
+	// reliable delivers the room's messages at least once to WebSocket
+	// subscribers: they are sent in envelopes carrying sequence numbers for
+	// subscribers to acknowledge, and what a subscriber didn't acknowledge is
+	// replayed when it reconnects.
+	reliable atomic.Bool
+
+	// parallelFanOut spreads the fan-out of each broadcast across workers,
+	// trading strict cross-client delivery order for throughput in large rooms.
+	parallelFanOut atomic.Bool
+	// shards split the room's clients across the workers of parallel
+	// fan-outs, which send the clients they couldn't queue a message for on
+	// fanOutDone. Both are nil until the room's first parallel fan-out, and
+	// only used on the room's goroutine.
+	shards     []*fanOutShard
+	fanOutDone chan []*Client
+
+	// queueDepth caps the publishes waiting for the room to accept them, or
+	// is zero for no limit, and queued counts them.
+	queueDepth atomic.Int64
+	queued     atomic.Int64
+
+	// sendBuffer is the number of messages buffered for each new client of
+	// the room, or zero for sendBufferSize.
+	sendBuffer atomic.Int64
+
+	// pause holds back publishes while the room is paused.
+	pause pauseState
+
+	// persistence orders the persisting of retained content with Persister.
+	persistence persistence
+
+	// crashed is set once the room's event loop has panicked with RoomPanic
+	// set to close. It is only used on the room's goroutine.
+	crashed bool
+
+	// capturing is set while the room captures the messages broadcast to it
+	// into captured. Both are only used on the room's goroutine.
+	capturing bool
+	captured  []capturedMessage
+
+	// schema, if set, is the JSON Schema published content must match.
+	schema atomic.Pointer[roomSchema]
+
+	// accessToken is the shared secret the room's publishers and subscribers
+	// must present: nil until the room's first publish sets it, empty if that
+	// publish left the room open. It is held only in memory.
+	accessToken atomic.Pointer[string]
+	// subscribeToken, if set, is a token issued by issueTokens that lets
+	// subscribers in without letting them publish. The access token then
+	// serves as the publish token, and admits subscribers too.
+	subscribeToken atomic.Pointer[string]
+
+	// lastActivity is the Unix time in nanoseconds of the room's latest
+	// publish, join or leave.
+	lastActivity atomic.Int64
+
+	// lastUsed is the Unix time in nanoseconds of the room's latest lookup by
+	// name, which keeps it from being reaped while it is about to be used.
+	lastUsed atomic.Int64
+	// reapPending is set while a check for removing the idle room is scheduled.
+	reapPending atomic.Bool
+
+	// lastError describes the room's most recent error, such as a recovered
+	// panic or a dropped slow client, and errorCount counts them.
+	lastError  atomic.Pointer[string]
+	errorCount atomic.Int64
+
+	// members counts the room's subscribers across all transports, including
+	// those admitted but not registered yet, and anonymousMembers those among
+	// them without a valid JWT.
+	members          atomic.Int64
+	anonymousMembers atomic.Int64
+}
+
+func newRoom(s *Server, name string) *Room {
+	room := &Room{
+		srv:        s,
+		name:       name,
+		broadcast:  make(chan publication),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		exec:       make(chan func()),
+		done:       make(chan struct{}),
+		clients:    make(map[*Client]bool),
+		groups:     make(map[string]*subscriberGroup),
+		// The history is replayed into the client's send buffer, so it can't
+		// hold more messages than fit there.
+		history: newHistory(min(s.opts.HistorySize, sendBufferSize), s.opts.HistoryBytes, s.opts.HistoryPerPublisher, &s.historyBytes),
+		metrics: metricsBatch{counters: &s.metrics, batched: s.opts.MetricsFlushInterval > 0},
+	}
+	room.schedule = newSchedule(room)
+	room.publisherIPs = newPublisherIPs(s.opts.MaxPublisherIPs, s.opts.PublisherIPWindow)
+	room.dedupKeys = newDedupKeys(s.opts.DedupWindow)
+	room.publishLimiter = newPublishLimiter(s.opts.PublishRate, s.opts.PublishBurst, s.opts.PublishRatePerIP)
+	room.compression.Store(s.opts.Compression)
+	room.queueDepth.Store(s.opts.PublishQueueDepth)
+	return room
+}
+
+// welcomeEvent is the first message sent to WebSocket subscribers when
+// welcome messages are enabled.
+type welcomeEvent struct {
+	Type         string `json:"type"`
+	ConnectionID string `json:"connection_id"`
+}
+
+// statsEvent is sent to subscribers that ask for the room's statistics when
+// they join, ahead of the room's retained content.
+type statsEvent struct {
+	Type string `json:"type"`
+	// Clients is the number of subscribers, including the one joining.
+	Clients     int       `json:"clients"`
+	LastPublish time.Time `json:"last_publish,omitzero"`
+	Sequence    uint64    `json:"sequence"`
+	LastError   string    `json:"last_error,omitempty"`
+	ErrorCount  int64     `json:"error_count"`
+}
+
+// presenceEvent is the control message sent to subscribers when presence is enabled.
+type presenceEvent struct {
+	Type    string `json:"type"`
+	Clients int    `json:"clients"`
+}
+
+// run processes the room's events until it is closed. The event loop is
+// restarted if it panics, keeping the room's state, so one bad event doesn't
+// strand the room's clients. With RoomPanic set to close, the restarted loop
+// only serves to remove and close the room.
+func (r *Room) run() {
+	defer close(r.done)
+	defer r.stopFanOutShards()
+
+	var flush <-chan time.Time
+	if r.srv.opts.MetricsFlushInterval > 0 {
+		ticker := time.NewTicker(r.srv.opts.MetricsFlushInterval)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
+	defer r.metrics.flush()
+
+	for !r.loop(flush) {
+		if r.srv.opts.RoomPanic == "close" && !r.crashed {
+			r.crashed = true
+			go r.srv.rooms.removeRoom(r)
+		}
+	}
+}
+
+// loop processes events until the room stops, returning true, or an event
+// handler panics, returning false.
+func (r *Room) loop(flush <-chan time.Time) (stopped bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			r.srv.log.Error("room recovered from panic", "room", r.name, "panic", err, "stack", string(debug.Stack()))
+			r.recordError(fmt.Sprintf("recovered from panic: %v", err))
+		}
+	}()
+
+	for !r.stopped {
+		select {
+		case client := <-r.register:
+			if r.admitsSubscriber(client.accessToken) != nil {
+				// The room's access token was set after the client was
+				// authorized.
+				close(client.send)
+				break
+			}
+			client.lastMessage = time.Now()
+			r.lastActivity.Store(client.lastMessage.UnixNano())
+			r.expireContent(client.lastMessage)
+			replay := r.replay(client)
+			client.log().Debug("client registered", "transport", client.transport(), "remote_addr", client.remoteAddr, "replayed", len(replay))
+			if client.maxMessages > 0 {
+				client.uncounted.Store(int64(r.joinMessages(client, len(replay))))
+			}
+			if r.srv.opts.Presence && r.srv.opts.PresenceBaseline {
+				client.send <- client.encode(r.presence())
+			}
+			r.addClient(client)
+			r.joinGroup(client)
+			if client.wantsStats {
+				client.send <- client.encode(r.stats())
+			}
+			for _, message := range replay {
+				content := message.content()
+				if r.srv.opts.Envelope || client.envelope {
+					content = r.envelop(content, message.seq, message.retainedAt, message.sender, true).marshal()
+				}
+				client.send <- client.encodeEvent(content, message.seq)
+				client.deltaSeq = message.seq
+			}
+			if r.srv.opts.Presence {
+				skip := client
+				if r.srv.opts.PresenceSelfJoin {
+					skip = nil
+				}
+				r.fanOut(r.presence(), skip)
+			}
+			r.announceMembership("join", client)
+			r.announceClients()
+		case client := <-r.unregister:
+			if _, ok := r.clients[client]; ok {
+				r.remove(client)
+			}
+			if len(r.clients) == 0 && r.srv.opts.RoomIdleTimeout > 0 {
+				r.srv.rooms.scheduleReap(r, r.srv.opts.RoomIdleTimeout)
+			}
+		case p := <-r.broadcast:
+			if p.key != "" && !r.latestOnly.Load() {
+				r.publishPartitioned(p)
+				break
+			}
+			for p.message != nil {
+				p = r.publish(p)
+			}
+		case f := <-r.exec:
+			f()
+		case <-flush:
+			r.metrics.flush()
+		}
+	}
+	return true
+}
+
+// do runs f on the room's goroutine and waits for it to return, giving f safe
+// access to the room's state. It reports false, without running f, if the
+// room has shut down.
+func (r *Room) do(f func()) bool {
+	finished := make(chan struct{})
+	select {
+	case r.exec <- func() {
+		defer close(finished)
+		f()
+	}:
+	case <-r.done:
+		return false
+	}
+	<-finished
+	return true
+}
+
+// join registers client with the room, reporting false if the room has shut down.
+func (r *Room) join(client *Client) bool {
+	select {
+	case r.register <- client:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// leave unregisters client from the room.
+func (r *Room) leave(client *Client) {
+	select {
+	case r.unregister <- client:
+	case <-r.done:
+	}
+}
+
+// submit queues p for broadcast, reporting false if the room has shut down.
+func (r *Room) submit(p publication) bool {
+	select {
+	case r.broadcast <- p:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// trySubmit is like submit but reports false, without queuing p, if the
+// room's publish queue is already full.
+func (r *Room) trySubmit(p publication) bool {
+	depth := r.queueDepth.Load()
+	if n := r.queued.Add(1); depth > 0 && n > depth {
+		r.queued.Add(-1)
+		return false
+	}
+	defer r.queued.Add(-1)
+	r.submit(p)
+	return true
+}
+
+// shedSlow drops up to limit slow clients and returns the number dropped.
+func (r *Room) shedSlow(limit int) int {
+	dropped := 0
+	r.do(func() {
+		for client := range r.clients {
+			if dropped == limit {
+				break
+			}
+			// A client with a quarter of its buffer undelivered is slow.
+			if len(client.send) >= cap(client.send)/4 {
+				r.drop(client)
+				dropped++
+			}
+		}
+	})
+	return dropped
+}
+
+// evictIdle disconnects up to limit clients that haven't been sent a message
+// since cutoff and returns the number evicted.
+func (r *Room) evictIdle(limit int, cutoff time.Time) int {
+	evicted := 0
+	r.do(func() {
+		for client := range r.clients {
+			if evicted == limit {
+				break
+			}
+			if client.lastMessage.Before(cutoff) {
+				close(client.send)
+				r.deleteClient(client)
+				evicted++
+			}
+		}
+		if evicted > 0 {
+			r.announceClients()
+		}
+	})
+	return evicted
+}
+
+// closingEvent is the notice sent to subscribers of a room that is about to be closed.
+type closingEvent struct {
+	Type string `json:"type"`
+	// ReconnectIn is the number of milliseconds until the room closes.
+	ReconnectIn int64 `json:"reconnect_in_ms"`
+}
+
+// close shuts the room down. With a grace period, subscribers are first sent a
+// closing notice and given that long before being disconnected.
+func (r *Room) close(grace time.Duration) {
+	if grace > 0 {
+		notice, _ := json.Marshal(closingEvent{Type: "closing", ReconnectIn: grace.Milliseconds()})
+		r.do(func() {
+			r.fanOut(notice, nil)
+		})
+		time.Sleep(grace)
+	}
+
+	r.schedule.cancelAll()
+	r.do(func() {
+		for client := range r.clients {
+			close(client.send)
+			r.deleteClient(client)
+		}
+		r.history.clear()
+		if r.expiryTimer != nil {
+			r.expiryTimer.Stop()
+		}
+		r.stopped = true
+	})
+}
+
+// publication is a message queued for broadcast along with its publisher.
+type publication struct {
+	message []byte
+	// publisher identifies where the message came from, usually the
+	// publisher's IP, for per-publisher accounting.
+	publisher string
+	// key is the ordering key: messages with the same key reach each
+	// subscriber in order, while those with different keys may be fanned out
+	// in parallel. Unkeyed messages are ordered among themselves.
+	key string
+	// skip is a client the message isn't sent to: the WebSocket client that
+	// published it, if it opted out of its own echo.
+	skip *Client
+	// sender is the connection ID of the WebSocket client that published the
+	// message, for envelopes.
+	sender string
+	// contentType is the message's content type, for retainContentType.
+	contentType string
+	// out is the message as sent to subscribers, set by record, envelope its
+	// envelope, for subscribers that asked for one, and seq its sequence
+	// number.
+	out      []byte
+	envelope *envelope
+	seq      uint64
+	// persisted, if not nil, receives the outcome of persisting the message
+	// once the room retains it, for durable publishes.
+	persisted chan error
+	// picks are the subscriber group members the message goes to, set by
+	// record.
+	picks map[*Client]bool
+	// liveOnly delivers the message without retaining it, for mirrors that
+	// don't retain their copies.
+	liveOnly bool
+	// remote is set for messages from another instance through the
+	// backplane, which aren't shared again or mirrored.
+	remote bool
+	// origins are the instance IDs of the relays a message received over a
+	// bridge was broadcast on before, and via the bridge connection it was
+	// received on, which it isn't sent back over.
+	origins []string
+	via     *bridgeConn
+	// cacheControl is the Cache-Control directive HTTP reads of the message
+	// are served with, if it is retained.
+	cacheControl string
+	// requestID identifies the publish request in logs, if there was one.
+	requestID string
+	// topic is the topic the message is tagged with, if any: subscribers
+	// filtering on topics only receive it if it is one of theirs.
+	topic string
+	// ttl is how long the message is retained for, or 0 for as long as the
+	// room's limits allow.
+	ttl time.Duration
+}
+
+// publish retains p's message and delivers it to the room and its mirrors. In
+// latest-only rooms a newer broadcast may preempt the fan-out, in which case
+// the newer publication is returned so the caller can publish it in turn.
+func (r *Room) publish(p publication) (next publication) {
+	if !r.record(&p) {
+		return publication{}
+	}
+	if r.latestOnly.Load() {
+		// Subscribers may skip messages, so deltas can't be relied on.
+		r.resetDelta()
+		next = r.fanOutLatest(&encodedMessage{raw: p.out, envelope: p.envelope, eventID: p.seq, topic: p.topic}, p.skip, p.picks)
+	} else {
+		r.fanOutMessage(r.deltaMessage(p), p.skip, p.picks)
+	}
+	r.mirror(p)
+	return next
+}
+
+// publishVerbose publishes p like publish, without preemption, and returns
+// the number of clients it was queued for along with the connection IDs of up
+// to limit of them. It reports false if the room has shut down.
+func (r *Room) publishVerbose(p publication, limit int) (delivered int, ids []string, ok bool) {
+	ids = []string{}
+	ok = r.do(func() {
+		if !r.record(&p) {
+			return
+		}
+		r.fanOutMessage(r.deltaMessage(p), nil, p.picks)
+		r.mirror(p)
+
+		// Clients only join between events, and fanOut drops those it
+		// couldn't queue the message for, so the remaining recipients got it.
+		for client := range r.clients {
+			if !receives(client, p.topic, p.picks) {
+				continue
+			}
+			if delivered++; len(ids) < limit {
+				ids = append(ids, client.id)
+			}
+		}
+	})
+	return delivered, ids, ok
+}
+
+// record retains p's message, counts it as published and sets p.out,
+// reporting false if it duplicates the room's current content and must not
+// be broadcast.
+func (r *Room) record(p *publication) bool {
+	message := p.message
+	// Compare hashes rather than content, which may be compressed.
+	sum := sha256.Sum256(message)
+	hash := hex.EncodeToString(sum[:])
+	if hash == r.lastContentHash {
+		if p.persisted != nil {
+			// The content is already retained, and may still be persisting.
+			r.persist(message, r.lastContent.seq, p.persisted)
+		}
+		return false
+	}
+	r.sequence++
+	r.lastPublish = time.Now()
+	r.lastActivity.Store(r.lastPublish.UnixNano())
+	if limit := r.maxRetainBytes.Load(); !p.liveOnly && (limit == 0 || int64(len(message)) <= limit) && r.retainsContentType(p.contentType) {
+		retained := r.retain(message)
+		retained.retainedAt = r.lastPublish
+		retained.seq = r.sequence
+		retained.cacheControl = p.cacheControl
+		retained.sender = p.sender
+		retained.topic = p.topic
+		if p.ttl > 0 {
+			retained.expiresAt = r.lastPublish.Add(p.ttl)
+			r.expireAt(retained.expiresAt)
+		}
+		r.lastContent = retained
+		r.lastContentTime = r.lastPublish
+		r.lastContentHash = hash
+		r.history.add(retained, p.publisher)
+		if limit := r.srv.opts.MaxTotalHistoryBytes; limit > 0 && r.srv.historyBytes.Load() > int64(limit) {
+			go r.srv.evictHistory()
+		}
+		if r.srv.opts.Persister != nil {
+			r.persist(message, r.sequence, p.persisted)
+		}
+	} else if p.persisted != nil {
+		p.persisted <- errNotRetained
+	}
+	r.metrics.published(len(message))
+	r.srv.log.Debug("broadcast", "room", r.name, "seq", r.sequence, "size", len(message), "request_id", p.requestID, "clients", len(r.clients))
+	p.seq = r.sequence
+	p.envelope = r.envelop(message, r.sequence, r.lastPublish, p.sender, false)
+	p.out = r.wrap(message, p.envelope)
+	r.capture(p, r.sequence, r.lastPublish)
+	p.picks = r.groupPicks(p.skip, p.topic)
+	return true
+}
+
+// mirror forwards p to the rooms this room is mirrored to, its webhooks and
+// bridges, and the other instances sharing the backplane.
+func (r *Room) mirror(p publication) {
+	if p.remote {
+		return
+	}
+	// Durability is only awaited in the room published to.
+	p.persisted = nil
+	if r.srv.backplane != nil {
+		r.srv.backplane.share(r, p)
+	}
+	for target, retain := range r.srv.rooms.mirrorTargets(r.name) {
+		p.liveOnly = !retain
+		target.submitUnlessPaused(p)
+	}
+	for _, target := range r.srv.remoteMirrors.targets(r.name) {
+		target.enqueue(p)
+	}
+	for _, target := range r.srv.webhooks.targets(r.name) {
+		target.enqueue(p)
+	}
+	for _, target := range r.srv.bridges.targets(r.name) {
+		target.enqueue(p)
+	}
+}
+
+// compareAndPublish publishes p only if the hash of the room's retained
+// content equals expected (empty meaning no content). It returns the hash
+// current at the time of the comparison and whether the message was published.
+func (r *Room) compareAndPublish(p publication, expected string) (current string, ok bool) {
+	r.do(func() {
+		current = r.lastContentHash
+		if current != expected {
+			return
+		}
+		ok = true
+		for p.message != nil {
+			p = r.publish(p)
+		}
+	})
+	return current, ok
+}
+
+// publishToCurrent delivers message, tagged with topic, only to the clients
+// subscribed when it is processed: clients register on the room's goroutine,
+// so none can join while the fan-out is in progress. The message isn't
+// retained, replayed or mirrored. It reports false if the room has shut down.
+func (r *Room) publishToCurrent(message []byte, topic string) bool {
+	return r.do(func() {
+		r.metrics.published(len(message))
+		r.resetDelta()
+		e := r.envelop(message, 0, time.Now(), "", false)
+		r.fanOutMessage(&encodedMessage{raw: r.wrap(message, e), envelope: e, topic: topic}, nil, r.groupPicks(nil, topic))
+	})
+}
+
+// fanOutLatest behaves like fanOut but abandons the remaining clients as soon
+// as a newer broadcast is waiting, returning it.
+func (r *Room) fanOutLatest(m *encodedMessage, skip *Client, picks map[*Client]bool) publication {
+	now := time.Now()
+	for client := range r.clients {
+		select {
+		case next := <-r.broadcast:
+			return next
+		default:
+		}
+		if client == skip || !receives(client, m.topic, picks) {
+			continue
+		}
+		if !client.enqueue(m.forClient(client), now) {
+			r.drop(client)
+		}
+	}
+	return publication{}
+}
+
+// fanOut sends message to every client in the room except skip, dropping
+// clients whose send buffer is full.
+func (r *Room) fanOut(message []byte, skip *Client) {
+	r.fanOutMessage(&encodedMessage{raw: message}, skip, nil)
+}
+
+// fanOutMessage behaves like fanOut for a message that may carry a delta,
+// which only goes to the subscriber group members in picks.
+func (r *Room) fanOutMessage(m *encodedMessage, skip *Client, picks map[*Client]bool) {
+	if r.parallel() {
+		r.fanOutParallel(m, skip, picks)
+		return
+	}
+	now := time.Now()
+	for client := range r.clients {
+		if client == skip || !receives(client, m.topic, picks) {
+			continue
+		}
+		if !client.enqueue(m.forClient(client), now) {
+			r.drop(client)
+		}
+	}
+}
+
+// meta returns the room's current settings.
+func (r *Room) meta() roomMeta {
+	priority := r.priority.Load()
+	latestOnly := r.latestOnly.Load()
+	maxRetainBytes := r.maxRetainBytes.Load()
+	maxContentSize := r.maxContentSize.Load()
+	retainContentType := ""
+	if p := r.retainContentType.Load(); p != nil {
+		retainContentType = *p
+	}
+	compression := r.compression.Load()
+	compressionLevel := r.compressionLevel.Load()
+	parallelFanOut := r.parallelFanOut.Load()
+	queueDepth := r.queueDepth.Load()
+	sendBuffer := r.sendBuffer.Load()
+	slowClient := r.slowClientPolicy()
+	reliable := r.reliable.Load()
+	publishRate, publishBurst := r.publishLimiter.limits()
+	return roomMeta{
+		Priority:          &priority,
+		LatestOnly:        &latestOnly,
+		MaxRetainBytes:    &maxRetainBytes,
+		MaxContentSize:    &maxContentSize,
+		RetainContentType: &retainContentType,
+		Compression:       &compression,
+		CompressionLevel:  &compressionLevel,
+		ParallelFanOut:    &parallelFanOut,
+		QueueDepth:        &queueDepth,
+		SendBuffer:        &sendBuffer,
+		SlowClient:        &slowClient,
+		Reliable:          &reliable,
+		PublishRate:       &publishRate,
+		PublishBurst:      &publishBurst,
+	}
+}
+
+// applyMeta updates the settings present in meta.
+func (r *Room) applyMeta(meta roomMeta) {
+	if meta.Priority != nil {
+		r.priority.Store(*meta.Priority)
+	}
+	if meta.LatestOnly != nil {
+		r.latestOnly.Store(*meta.LatestOnly)
+	}
+	if meta.MaxRetainBytes != nil {
+		r.maxRetainBytes.Store(*meta.MaxRetainBytes)
+	}
+	if meta.MaxContentSize != nil {
+		r.maxContentSize.Store(*meta.MaxContentSize)
+	}
+	if meta.RetainContentType != nil {
+		// Validated, so only the media type is kept.
+		mediaType, _, _ := mime.ParseMediaType(*meta.RetainContentType)
+		r.retainContentType.Store(&mediaType)
+	}
+	if meta.Compression != nil {
+		r.compression.Store(*meta.Compression)
+	}
+	if meta.CompressionLevel != nil {
+		r.compressionLevel.Store(*meta.CompressionLevel)
+	}
+	if meta.ParallelFanOut != nil {
+		r.parallelFanOut.Store(*meta.ParallelFanOut)
+	}
+	if meta.QueueDepth != nil {
+		r.queueDepth.Store(*meta.QueueDepth)
+	}
+	if meta.SendBuffer != nil {
+		r.sendBuffer.Store(*meta.SendBuffer)
+	}
+	if meta.SlowClient != nil {
+		r.slowClient.Store(meta.SlowClient)
+	}
+	if meta.Reliable != nil {
+		r.reliable.Store(*meta.Reliable)
+	}
+	if meta.PublishRate != nil || meta.PublishBurst != nil {
+		rate, burst := r.publishLimiter.limits()
+		if meta.PublishRate != nil {
+			rate = *meta.PublishRate
+		}
+		if meta.PublishBurst != nil {
+			burst = *meta.PublishBurst
+		}
+		r.publishLimiter.setRate(rate, burst)
+	}
+}
+
+// admitsContentSize reports whether content of size bytes is within the
+// room's limit.
+func (r *Room) admitsContentSize(size int) bool {
+	limit := r.maxContentSize.Load()
+	return limit == 0 || int64(size) <= limit
+}
+
+// sendBufferSize returns the number of messages to buffer for a new client
+// of the room.
+func (r *Room) sendBufferSize() int {
+	if n := r.sendBuffer.Load(); n > 0 {
+		return int(n)
+	}
+	return sendBufferSize
+}
+
+// remove disconnects client, which is leaving the room or being kicked,
+// letting the remaining clients know. It must be called on the room's
+// goroutine.
+func (r *Room) remove(client *Client) {
+	client.log().Debug("client unregistered", "connected_for", time.Since(client.connectedAt), "bytes_sent", client.bytesSent.Load(), "kicked", client.kicked.Load())
+	r.lastActivity.Store(time.Now().UnixNano())
+	r.deleteClient(client)
+	r.saveResumePosition(client)
+	close(client.send)
+	if r.srv.opts.Presence {
+		r.fanOut(r.presence(), nil)
+	}
+	r.announceMembership("leave", client)
+	r.announceClients()
+}
+
+// drop disconnects a client that can't keep up with the room, under the
+// disconnect slow client policy.
+func (r *Room) drop(client *Client) {
+	client.log().Warn("dropped slow client", "queued", len(client.send), "bytes_sent", client.bytesSent.Load())
+	close(client.send)
+	r.deleteClient(client)
+	r.metrics.dropped()
+	r.recordError("dropped slow client " + client.id)
+	r.announceClients()
+}
+
+// recordError notes an error in the room for diagnostics.
+func (r *Room) recordError(message string) {
+	r.lastError.Store(&message)
+	r.errorCount.Add(1)
+}
+
+// errorStatus returns the room's most recent error, if any, and its error count.
+func (r *Room) errorStatus() (lastError string, count int64) {
+	if p := r.lastError.Load(); p != nil {
+		lastError = *p
+	}
+	return lastError, r.errorCount.Load()
+}
+
+// stats encodes the room's current statistics as a stats event.
+func (r *Room) stats() []byte {
+	lastError, errorCount := r.errorStatus()
+	message, _ := json.Marshal(statsEvent{
+		Type:        "stats",
+		Clients:     len(r.clients),
+		LastPublish: r.lastPublish,
+		Sequence:    r.sequence,
+		LastError:   lastError,
+		ErrorCount:  errorCount,
+	})
+	return message
+}
+
+// presence encodes the room's current subscriber count as a presence event.
+func (r *Room) presence() []byte {
+	message, _ := json.Marshal(presenceEvent{Type: "presence", Clients: len(r.clients)})
+	return message
+}
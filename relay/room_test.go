@@ -0,0 +1,188 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// publishWhileQueued publishes first on room's goroutine while second is
+// waiting to be broadcast, as when publishes arrive during a fan-out, and
+// returns what each of clients received.
+func publishWhileQueued(t *testing.T, room *Room, first, second string, clients []*Client) [][]string {
+	t.Helper()
+	room.do(func() {
+		go func() {
+			room.broadcast <- publication{message: []byte(second)}
+		}()
+		// Let the second publish block on the broadcast channel.
+		time.Sleep(20 * time.Millisecond)
+		for p := (publication{message: []byte(first)}); p.message != nil; {
+			p = room.publish(p)
+		}
+	})
+	// The second publish is received by the room's loop unless it preempted
+	// the first.
+	room.do(func() {})
+	var got [][]string
+	for _, client := range clients {
+		got = append(got, received(client))
+	}
+	return got
+}
+
+func TestLatestOnlyPreemptsFanOut(t *testing.T) {
+	for _, latestOnly := range []bool{false, true} {
+		s, _ := newTestServer(t, DefaultOptions())
+		room, err := s.rooms.openRoom("preempt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		room.latestOnly.Store(latestOnly)
+		clients := []*Client{joinTestClient(t, room, 16), joinTestClient(t, room, 16)}
+		for _, client := range clients {
+			received(client)
+		}
+
+		want := []string{"first", "second"}
+		if latestOnly {
+			// The fan-out of first is preempted before it reaches any
+			// client.
+			want = []string{"second"}
+		}
+		for i, got := range publishWhileQueued(t, room, "first", "second", clients) {
+			if !slices.Equal(got, want) {
+				t.Errorf("latest only %t: client %d got %q, want %q", latestOnly, i, got, want)
+			}
+		}
+		if content := string(room.lastContent.content()); content != "second" {
+			t.Errorf("latest only %t: retained %q, want the newest message", latestOnly, content)
+		}
+	}
+}
+
+func TestRoomRecoversFromPanic(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	s, _ := newTestServer(t, opts)
+	if err := s.Publish("panicky", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	room := waitForRoom(t, s, "panicky")
+	client := joinTestClient(t, room, 16)
+	received(client)
+
+	if !room.do(func() { panic("boom") }) {
+		t.Fatal("room closed")
+	}
+
+	// The room's loop restarted, keeping its clients.
+	if err := s.Publish("panicky", []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	room.do(func() {})
+	if got := received(client); !slices.Equal(got, []string{"after"}) {
+		t.Errorf("received %q after the panic, want [after]", got)
+	}
+	if current, _ := s.rooms.lookupRoom("panicky"); current != room {
+		t.Error("the room was replaced")
+	}
+}
+
+func TestRoomErrors(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	if code, body := publish(t, ts, "faulty", "first", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	room := waitForRoom(t, s, "faulty")
+	if lastError, count := room.errorStatus(); lastError != "" || count != 0 {
+		t.Fatalf("errors before any fault: %q, %d", lastError, count)
+	}
+
+	room.do(func() { panic("boom") })
+	room.do(func() {})
+	if lastError, count := room.errorStatus(); !strings.Contains(lastError, "boom") || count != 1 {
+		t.Errorf("after a panic: %q, %d, want the panic and a count of 1", lastError, count)
+	}
+
+	// A client with a full buffer is dropped at the next publish.
+	slow := joinTestClient(t, room, 0)
+	if code, body := publish(t, ts, "faulty", "second", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	room.do(func() {})
+	want := "dropped slow client " + slow.id
+	if lastError, count := room.errorStatus(); lastError != want || count != 2 {
+		t.Errorf("after dropping a client: %q, %d, want %q and a count of 2", lastError, count, want)
+	}
+
+	// Both the room listing and the stats event report them.
+	code, body := admin(t, ts, http.MethodGet, "/api/rooms", "")
+	if code != http.StatusOK {
+		t.Fatalf("listing rooms: %d %s", code, body)
+	}
+	var listing struct {
+		Rooms []roomInfo `json:"rooms"`
+	}
+	if err := json.Unmarshal([]byte(body), &listing); err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(listing.Rooms, func(info roomInfo) bool { return info.Name == "faulty" })
+	if i < 0 || listing.Rooms[i].LastError != want || listing.Rooms[i].ErrorCount != 2 {
+		t.Errorf("room listing %s, want faulty with its last error and a count of 2", body)
+	}
+
+	conn := dialWS(t, ts, "/ws/faulty?stats=1", nil)
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats statsEvent
+	if err := json.Unmarshal(message, &stats); err != nil || stats.LastError != want || stats.ErrorCount != 2 {
+		t.Errorf("stats %s, want the last error and a count of 2", message)
+	}
+}
+
+func TestRoomPanicClose(t *testing.T) {
+	opts := DefaultOptions()
+	opts.RoomPanic = "close"
+	s, ts := newTestServer(t, opts)
+	if code, body := publish(t, ts, "crashing", "before", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	conn := dialWS(t, ts, "/ws/crashing", nil)
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "before" {
+		t.Fatalf("replay %q (%v)", message, err)
+	}
+	room := waitForRoom(t, s, "crashing")
+	waitForClients(t, room, 1)
+
+	room.do(func() { panic("boom") })
+
+	// The room is torn down, disconnecting its subscriber, rather than
+	// carrying on in a state the panic may have left inconsistent.
+	select {
+	case <-room.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the room wasn't closed")
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNoStatusReceived) {
+		t.Errorf("subscriber: %v, want the connection closed", err)
+	}
+	if current, ok := s.rooms.lookupRoom("crashing"); ok && current == room {
+		t.Error("the crashed room is still open")
+	}
+
+	// The next publish opens a fresh room.
+	if code, body := publish(t, ts, "crashing", "after", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if current := waitForRoom(t, s, "crashing"); current == room {
+		t.Error("published to the crashed room")
+	}
+}
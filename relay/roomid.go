@@ -0,0 +1,48 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// maxRoomIDLength bounds the length of room names.
+const maxRoomIDLength = 128
+
+var errInvalidRoomID = errors.New("invalid room ID")
+
+// reservedRoomIDs are the frontend's files, which HandlePublish serves in
+// place of rooms of the same names.
+var reservedRoomIDs = []string{"index.html", "style.css", "app.js", "qrcode.min.js"}
+
+// validateRoomID checks that id is a usable room name: at most
+// maxRoomIDLength letters, digits, '-', '_' and '.', not starting with a dot
+// and not the name of one of the frontend's files. Every distinct name
+// creates a room, so names are checked before any room is looked up.
+func validateRoomID(id string) error {
+	switch {
+	case id == "":
+		return fmt.Errorf("%w: missing", errInvalidRoomID)
+	case len(id) > maxRoomIDLength:
+		return fmt.Errorf("%w: longer than %d characters", errInvalidRoomID, maxRoomIDLength)
+	case id[0] == '.':
+		return fmt.Errorf("%w: must not start with a dot", errInvalidRoomID)
+	case slices.Contains(reservedRoomIDs, id):
+		return fmt.Errorf("%w: %s is reserved for the frontend", errInvalidRoomID, id)
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("%w: may only contain letters, digits, '-', '_' and '.'", errInvalidRoomID)
+		}
+	}
+	return nil
+}
+
+// roomIDStatus returns the HTTP status for an error from resolveRoomID.
+func roomIDStatus(err error) int {
+	if errors.Is(err, errInvalidRoomID) {
+		return http.StatusBadRequest
+	}
+	return http.StatusForbidden
+}
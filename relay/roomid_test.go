@@ -0,0 +1,41 @@
+package relay
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestValidateRoomID(t *testing.T) {
+	for _, id := range []string{"room1", "Team_A-2", "v1.2", strings.Repeat("r", maxRoomIDLength)} {
+		if err := validateRoomID(id); err != nil {
+			t.Errorf("validateRoomID(%q) = %v", id, err)
+		}
+	}
+	for _, id := range []string{"", strings.Repeat("r", maxRoomIDLength+1), ".hidden", "..", "a b", "a%2Fb", "café", "index.html", "qrcode.min.js"} {
+		if err := validateRoomID(id); !errors.Is(err, errInvalidRoomID) {
+			t.Errorf("validateRoomID(%q) = %v, want errInvalidRoomID", id, err)
+		}
+	}
+}
+
+func TestInvalidRoomIDRejected(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	for _, id := range []string{strings.Repeat("r", maxRoomIDLength+1), ".hidden", "a%20b", "style.css"} {
+		code, body := request(t, http.MethodPost, ts.URL+"/"+id+"?"+url.Values{"content": {"hello"}}.Encode(), "", nil)
+		if code != http.StatusBadRequest || !strings.Contains(body, "invalid room ID") {
+			t.Errorf("publishing to %.20s: %d %s, want 400 explaining why", id, code, strings.TrimSpace(body))
+		}
+		_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/"+id, nil)
+		if err == nil || res == nil || res.StatusCode != http.StatusBadRequest {
+			t.Errorf("subscribing to %.20s: %v, want status 400", id, err)
+		}
+	}
+	if n := s.rooms.count(); n != 0 {
+		t.Errorf("%d rooms were created for invalid IDs", n)
+	}
+}
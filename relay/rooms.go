@@ -0,0 +1,329 @@
+package relay
+
+import (
+	"cmp"
+	"errors"
+	"hash/maphash"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// roomShards is the number of stripes the room map is split into.
+const roomShards = 64
+
+// RoomManager manages all the rooms
+type RoomManager struct {
+	srv *Server
+
+	// shards stripes the rooms by hashed name, so that access to different
+	// rooms rarely contends on the same lock.
+	shards [roomShards]roomShard
+	seed   maphash.Seed
+
+	// mirrors maps a room name to the names of the rooms its broadcasts are
+	// copied to, and whether each of them retains the copies.
+	mirrors map[string]map[string]bool
+	// mu guards mirrors.
+	mu sync.RWMutex
+}
+
+// roomShard holds the rooms whose names hash to it.
+type roomShard struct {
+	rooms map[string]*Room
+	mu    sync.RWMutex
+}
+
+func newRoomManager(s *Server) *RoomManager {
+	rm := &RoomManager{
+		srv:     s,
+		seed:    maphash.MakeSeed(),
+		mirrors: make(map[string]map[string]bool),
+	}
+	for i := range rm.shards {
+		rm.shards[i].rooms = make(map[string]*Room)
+	}
+	return rm
+}
+
+// shard returns the shard holding the named room.
+func (rm *RoomManager) shard(name string) *roomShard {
+	return &rm.shards[maphash.String(rm.seed, name)%roomShards]
+}
+
+func (rm *RoomManager) getRoom(name string) *Room {
+	s := rm.shard(name)
+	now := time.Now().UnixNano()
+
+	s.mu.RLock()
+	room, ok := s.rooms[name]
+	if ok {
+		room.lastUsed.Store(now)
+	}
+	s.mu.RUnlock()
+	if ok {
+		return room
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if room, ok := s.rooms[name]; ok {
+		room.lastUsed.Store(now)
+		return room
+	}
+
+	room = newRoom(rm.srv, name)
+	room.lastUsed.Store(now)
+	// Loaded while holding the lock, so the room can't be joined first.
+	room.load()
+	s.rooms[name] = room
+	go room.run()
+	if rm.srv.opts.RoomIdleTimeout > 0 {
+		rm.scheduleReap(room, rm.srv.opts.RoomIdleTimeout)
+	}
+	// Announced while holding the lock, so the room can't be joined first.
+	rm.srv.announce(directoryEvent{Type: "room_created", Room: name})
+	return room
+}
+
+// openRoom returns the named room for a subscriber or publisher. The room is
+// created if it doesn't exist only if its name matches AutoCreateRooms, and
+// there are fewer than MaxRooms; otherwise it must have been created through
+// the admin API.
+func (rm *RoomManager) openRoom(name string) (*Room, error) {
+	if rm.srv.autoCreates(name) {
+		if limit := rm.srv.opts.MaxRooms; limit > 0 {
+			if _, ok := rm.lookupRoom(name); !ok && rm.count() >= limit {
+				rm.srv.metrics.roomsRejected.Add(1)
+				return nil, errTooManyRooms
+			}
+		}
+		return rm.getRoom(name), nil
+	}
+
+	s := rm.shard(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	room, ok := s.rooms[name]
+	if !ok {
+		return nil, errRoomNotFound
+	}
+	room.lastUsed.Store(time.Now().UnixNano())
+	return room, nil
+}
+
+// autoCreates reports whether subscribers and publishers may create the
+// named room on first use.
+func (s *Server) autoCreates(name string) bool {
+	return s.autoCreateRooms == nil || s.autoCreateRooms.MatchString(name)
+}
+
+// addMirror makes every broadcast to room from also be broadcast to room to,
+// which retains the copies only if retain is set, or updates whether it does.
+// It refuses mirrors that would make a broadcast loop back to its source.
+func (rm *RoomManager) addMirror(from, to string, retain bool) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if rm.mirrorReachable(to, from) {
+		return errMirrorCycle
+	}
+	if rm.mirrors[from] == nil {
+		rm.mirrors[from] = make(map[string]bool)
+	}
+	rm.mirrors[from][to] = retain
+	return nil
+}
+
+// mirrorReachable reports whether broadcasts to room from eventually reach
+// room to through the configured mirrors. The caller must hold rm.mu.
+func (rm *RoomManager) mirrorReachable(from, to string) bool {
+	seen := map[string]bool{from: true}
+	queue := []string{from}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if name == to {
+			return true
+		}
+		for next := range rm.mirrors[name] {
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return false
+}
+
+// all returns a snapshot of the current rooms.
+func (rm *RoomManager) all() []*Room {
+	var rooms []*Room
+	for i := range rm.shards {
+		s := &rm.shards[i]
+		s.mu.RLock()
+		for _, room := range s.rooms {
+			rooms = append(rooms, room)
+		}
+		s.mu.RUnlock()
+	}
+	return rooms
+}
+
+// count returns the number of rooms.
+func (rm *RoomManager) count() int {
+	n := 0
+	for i := range rm.shards {
+		s := &rm.shards[i]
+		s.mu.RLock()
+		n += len(s.rooms)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// lookupRoom returns the named room without creating it.
+func (rm *RoomManager) lookupRoom(name string) (*Room, bool) {
+	s := rm.shard(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	room, ok := s.rooms[name]
+	return room, ok
+}
+
+// mirrorNames returns the names of the rooms the named room is mirrored to
+// that retain the copies, or that don't if retain is false.
+func (rm *RoomManager) mirrorNames(name string, retain bool) []string {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	var names []string
+	for target, retains := range rm.mirrors[name] {
+		if retains == retain {
+			names = append(names, target)
+		}
+	}
+	return names
+}
+
+// mirrorTargets returns the rooms that broadcasts to the named room are
+// mirrored to, and whether each of them retains the copies.
+func (rm *RoomManager) mirrorTargets(name string) map[*Room]bool {
+	rm.mu.RLock()
+	targets := maps.Clone(rm.mirrors[name])
+	rm.mu.RUnlock()
+
+	rooms := make(map[*Room]bool, len(targets))
+	for target, retain := range targets {
+		rooms[rm.getRoom(target)] = retain
+	}
+	return rooms
+}
+
+// shedSlowClients drops up to n slow clients, working through rooms from the
+// lowest priority to the highest, and returns the number of clients dropped.
+func (rm *RoomManager) shedSlowClients(n int) int {
+	rooms := rm.all()
+	slices.SortFunc(rooms, func(a, b *Room) int {
+		return cmp.Compare(a.priority.Load(), b.priority.Load())
+	})
+
+	dropped := 0
+	for _, room := range rooms {
+		if dropped >= n {
+			break
+		}
+		dropped += room.shedSlow(n - dropped)
+	}
+	return dropped
+}
+
+// evictIdleClients disconnects up to n clients idle for longer than
+// EvictIdleAfter, working through rooms from the lowest priority to the
+// highest, and returns the number of clients evicted.
+func (rm *RoomManager) evictIdleClients(n int) int {
+	rooms := rm.all()
+	slices.SortFunc(rooms, func(a, b *Room) int {
+		return cmp.Compare(a.priority.Load(), b.priority.Load())
+	})
+
+	cutoff := time.Now().Add(-rm.srv.opts.EvictIdleAfter)
+	evicted := 0
+	for _, room := range rooms {
+		if evicted >= n {
+			break
+		}
+		evicted += room.evictIdle(n-evicted, cutoff)
+	}
+	return evicted
+}
+
+// deleteRoom removes the named room along with its mirrors and closes it after
+// the grace period. It reports false if there is no such room.
+func (rm *RoomManager) deleteRoom(name string, grace time.Duration) bool {
+	s := rm.shard(name)
+	s.mu.Lock()
+	room, ok := s.rooms[name]
+	delete(s.rooms, name)
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	rm.forget(name)
+	rm.srv.unpersist(name)
+	go room.close(grace)
+	return true
+}
+
+// removeRoom removes room, unless it has been removed already, along with its
+// mirrors, and closes it.
+func (rm *RoomManager) removeRoom(room *Room) {
+	s := rm.shard(room.name)
+	s.mu.Lock()
+	if s.rooms[room.name] != room {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.rooms, room.name)
+	s.mu.Unlock()
+
+	rm.srv.log.Error("closing room after a panic", "room", room.name)
+	rm.forget(room.name)
+	room.close(0)
+}
+
+// forget drops the mirrors to and from the named room, which has been
+// removed, and its webhooks and bridges, and announces its removal.
+func (rm *RoomManager) forget(name string) {
+	rm.mu.Lock()
+	delete(rm.mirrors, name)
+	for _, targets := range rm.mirrors {
+		delete(targets, name)
+	}
+	rm.mu.Unlock()
+	rm.srv.remoteMirrors.remove(name)
+	rm.srv.webhooks.remove(name)
+	rm.srv.bridges.remove(name)
+
+	rm.srv.announce(directoryEvent{Type: "room_deleted", Room: name})
+}
+
+var (
+	errMirrorCycle  = errors.New("mirror would create a cycle")
+	errRoomNotFound = errors.New("room not found")
+	errTooManyRooms = errors.New("too many rooms")
+)
+
+// openRoomStatus maps an error from openRoom to its HTTP status code.
+func openRoomStatus(err error) int {
+	if errors.Is(err, errTooManyRooms) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusNotFound
+}
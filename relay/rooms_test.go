@@ -0,0 +1,305 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMirror(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	if code := mirrorTo(t, ts, "a", "b"); code != http.StatusOK {
+		t.Fatalf("mirroring a to b: %d", code)
+	}
+	if code, body := publish(t, ts, "a", "hello", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	eventually(t, "the message to be mirrored", func() bool {
+		return latest(t, ts, "b") == "hello"
+	})
+}
+
+// mirrorTo mirrors room from to room to on ts, returning the response's status.
+func mirrorTo(t *testing.T, ts *httptest.Server, from, to string) int {
+	t.Helper()
+	code, _ := admin(t, ts, http.MethodPost, "/api/rooms/"+from+"/mirror-to?room="+to, "")
+	return code
+}
+
+func TestMirrorCycleRejected(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	if code := mirrorTo(t, ts, "a", "b"); code != http.StatusOK {
+		t.Fatalf("mirroring a to b: %d", code)
+	}
+	if code := mirrorTo(t, ts, "b", "c"); code != http.StatusOK {
+		t.Fatalf("mirroring b to c: %d", code)
+	}
+	for _, mirror := range [][2]string{{"a", "a"}, {"b", "a"}, {"c", "a"}} {
+		if code := mirrorTo(t, ts, mirror[0], mirror[1]); code != http.StatusConflict {
+			t.Errorf("mirroring %s to %s = %d, want 409", mirror[0], mirror[1], code)
+		}
+	}
+}
+
+func TestMirrorWithoutRetaining(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	if code, body := publish(t, ts, "target", "own", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/source/mirror-to?room=target&retain=false", ""); code != http.StatusOK {
+		t.Fatalf("mirroring: %d %s", code, body)
+	}
+	conn := dialWS(t, ts, "/ws/target", nil)
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "own" {
+		t.Fatalf("replay %q (%v)", message, err)
+	}
+	room := waitForRoom(t, s, "target")
+	waitForClients(t, room, 1)
+
+	// The mirrored message is delivered live, but the target keeps its own
+	// content for later subscribers.
+	if code, body := publish(t, ts, "source", "mirrored", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "mirrored" {
+		t.Fatalf("received %q (%v), want the mirrored message", message, err)
+	}
+	if got := latest(t, ts, "target"); got != "own" {
+		t.Errorf("target retained %q, want its own content", got)
+	}
+	if _, message, err := dialWS(t, ts, "/ws/target", nil).ReadMessage(); err != nil || string(message) != "own" {
+		t.Errorf("later subscriber replayed %q (%v), want the target's own content", message, err)
+	}
+	if got := latest(t, ts, "source"); got != "mirrored" {
+		t.Errorf("source retained %q", got)
+	}
+
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/source/mirror-to?room=target&retain=maybe", ""); code != http.StatusBadRequest {
+		t.Errorf("an invalid retain parameter: %d %s, want 400", code, body)
+	}
+}
+
+// isMember reports whether client is registered with room.
+func isMember(room *Room, client *Client) bool {
+	var ok bool
+	room.do(func() {
+		ok = room.clients[client]
+	})
+	return ok
+}
+
+func TestShedSlowClientsByPriority(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/important/priority?level=5", ""); code != http.StatusOK {
+		t.Fatalf("setting the priority: %d %s", code, body)
+	}
+	var slow []*Client
+	for _, name := range []string{"important", "bulk"} {
+		room, err := s.rooms.openRoom(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := joinTestClient(t, room, 4)
+		// A client with a quarter of its buffer undelivered is slow.
+		client.send <- []byte("queued")
+		slow = append(slow, client)
+	}
+
+	if dropped := s.rooms.shedSlowClients(1); dropped != 1 {
+		t.Fatalf("shed %d clients, want 1", dropped)
+	}
+	if !isMember(slow[0].room, slow[0]) {
+		t.Error("the client of the higher-priority room was shed")
+	}
+	if isMember(slow[1].room, slow[1]) {
+		t.Error("the client of the lower-priority room wasn't shed")
+	}
+}
+
+func TestEvictIdleClients(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxConnections = 2
+	opts.ShedThreshold = 1
+	opts.EvictIdleAfter = 100 * time.Millisecond
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+
+	idle := dialWS(t, ts, "/ws/idle", nil)
+	active := dialWS(t, ts, "/ws/active", nil)
+	activeRoom := waitForRoom(t, s, "active")
+	eventually(t, "both subscribers to connect", func() bool { return s.connections.Load() == 2 })
+
+	// Keep one subscriber busy past the idle cutoff. Repeated content isn't
+	// broadcast, so each message differs.
+	for i, deadline := 0, time.Now().Add(150*time.Millisecond); time.Now().Before(deadline); i++ {
+		if err := s.Publish("active", fmt.Append(nil, "tick ", i)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	dialWS(t, ts, "/ws/new", nil)
+	newRoom := waitForRoom(t, s, "new")
+	eventually(t, "the new subscriber to join", func() bool { return newRoom.members.Load() == 1 })
+
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := idle.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNoStatusReceived) {
+		t.Errorf("the idle subscriber: %v, want it closed", err)
+	}
+	if activeRoom.members.Load() != 1 {
+		t.Error("the active subscriber was evicted")
+	}
+	active.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := active.ReadMessage(); err != nil {
+		t.Errorf("the active subscriber: %v", err)
+	}
+}
+
+func TestAutoCreateRooms(t *testing.T) {
+	opts := DefaultOptions()
+	opts.AutoCreateRooms = `team-[a-z]+`
+	s, ts := newTestServer(t, opts)
+
+	// Rooms matching the pattern are created on first use, by either side.
+	if code, body := publish(t, ts, "team-red", "hello", nil); code != http.StatusOK {
+		t.Errorf("publishing to a matching room: %d %s", code, body)
+	}
+	dialWS(t, ts, "/ws/team-blue", nil)
+	waitForRoom(t, s, "team-blue")
+
+	// The pattern must match the whole name.
+	for _, name := range []string{"adhoc", "team-red-2"} {
+		if code, _ := publish(t, ts, name, "hello", nil); code != http.StatusNotFound {
+			t.Errorf("publishing to %s: status %d, want 404", name, code)
+		}
+		_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/"+name, nil)
+		if err == nil || res == nil || res.StatusCode != http.StatusNotFound {
+			t.Errorf("subscribing to %s: %v, want status 404", name, err)
+		}
+		if _, ok := s.rooms.lookupRoom(name); ok {
+			t.Errorf("room %s was created", name)
+		}
+	}
+
+	// Created through the admin API, the room can be used.
+	if code, body := admin(t, ts, http.MethodPut, "/api/rooms/adhoc", ""); code != http.StatusCreated {
+		t.Fatalf("creating adhoc: %d %s", code, body)
+	}
+	if code, body := publish(t, ts, "adhoc", "hello", nil); code != http.StatusOK {
+		t.Errorf("publishing to the created room: %d %s", code, body)
+	}
+	dialWS(t, ts, "/ws/adhoc", nil)
+}
+
+// BenchmarkGetRoom looks up 1000 existing rooms from parallel goroutines,
+// with the rooms spread over the room map's shards as usual, and with all of
+// them in one shard, as with a single lock.
+func BenchmarkGetRoom(b *testing.B) {
+	for _, spread := range []bool{true, false} {
+		b.Run(fmt.Sprintf("spread=%t", spread), func(b *testing.B) {
+			s, _ := newTestServer(b, DefaultOptions())
+			rm := s.rooms
+			var names []string
+			for i := 0; len(names) < 1000; i++ {
+				name := fmt.Sprint("room", i)
+				if spread || rm.shard(name) == &rm.shards[0] {
+					names = append(names, name)
+					rm.getRoom(name)
+				}
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					rm.getRoom(names[i%len(names)])
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkCreateRoom creates rooms under distinct names from parallel
+// goroutines, with the names spread over the room map's shards as usual, and
+// with all of them in one shard, as with a single lock. Run it with -cpu 1,4,8
+// to see how creation scales under each.
+func BenchmarkCreateRoom(b *testing.B) {
+	for _, spread := range []bool{true, false} {
+		b.Run(fmt.Sprintf("spread=%t", spread), func(b *testing.B) {
+			s, _ := newTestServer(b, DefaultOptions())
+			rm := s.rooms
+			names := make([]string, 0, b.N)
+			for i := 0; len(names) < b.N; i++ {
+				name := fmt.Sprint("room", i)
+				if spread || rm.shard(name) == &rm.shards[0] {
+					names = append(names, name)
+				}
+			}
+
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					rm.getRoom(names[next.Add(1)-1])
+				}
+			})
+			b.StopTimer()
+			if n := rm.count(); n != b.N {
+				b.Fatalf("%d rooms, want %d", n, b.N)
+			}
+		})
+	}
+}
+
+func TestSubscriberLimits(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxRoomClients = 2
+	opts.MaxConnections = 2
+	opts.MaxRooms = 2
+	s, ts := newTestServer(t, opts)
+	dialWS(t, ts, "/ws/a", nil)
+	dialWS(t, ts, "/ws/a", nil)
+	waitForClients(t, waitForRoom(t, s, "a"), 2)
+
+	// Subscribers over a limit complete the handshake, so that they get the
+	// reason, then are told to try again later.
+	for _, tt := range []struct {
+		room, reason string
+	}{
+		{"a", errRoomFull.Error()},
+		{"b", errTooManyConnections.Error()},
+		{"c", errTooManyRooms.Error()},
+	} {
+		_, _, err := dialWS(t, ts, "/ws/"+tt.room, nil).ReadMessage()
+		if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != websocket.CloseTryAgainLater || closeErr.Text != tt.reason {
+			t.Errorf("subscribing to %s: %v, want a 1013 close with %q", tt.room, err, tt.reason)
+		}
+	}
+	// Room b was created before its subscriber was turned away, so there
+	// is no room left for c, whoever asks.
+	if code, body := publish(t, ts, "c", "hello", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("publish to a new room: %d %s, want 503", code, body)
+	}
+	if code, body := request(t, http.MethodGet, ts.URL+"/sse/c", "", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("SSE subscription to a new room: %d %s, want 503", code, body)
+	}
+	// Rooms created through the admin API don't count.
+	if code, body := admin(t, ts, http.MethodPut, "/api/rooms/c", `{}`); code != http.StatusCreated {
+		t.Errorf("creating a room through the admin API: %d %s", code, body)
+	}
+
+	for name, want := range map[string]int64{
+		"relay_room_full_rejections_total":  1,
+		"relay_connection_rejections_total": 1,
+		"relay_rooms_rejected_total":        3,
+	} {
+		if got := metricValue(t, ts.URL, name); got != want {
+			t.Errorf("%s = %d, want %d", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package relay
+
+import (
+	"cmp"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errTooManyScheduled = errors.New("too many scheduled messages")
+
+// scheduledMessage is a message held back until its delivery time.
+type scheduledMessage struct {
+	id        uint64
+	deliverAt time.Time
+	content   []byte
+	publisher string
+	// contentType is the content's type, for retainContentType.
+	contentType  string
+	cacheControl string
+	topic        string
+	// ttl counts from the message's delivery.
+	ttl   time.Duration
+	timer *time.Timer
+}
+
+// Schedule holds a room's messages that are waiting for their delivery time.
+type Schedule struct {
+	room    *Room
+	pending map[uint64]*scheduledMessage
+	mu      sync.Mutex
+}
+
+func newSchedule(room *Room) *Schedule {
+	return &Schedule{
+		room:    room,
+		pending: make(map[uint64]*scheduledMessage),
+	}
+}
+
+// add schedules content of the given type, Cache-Control directive and topic
+// from publisher to be broadcast to the room at deliverAt and returns its ID.
+func (s *Schedule) add(content []byte, publisher, contentType, cacheControl, topic string, ttl time.Duration, deliverAt time.Time) (uint64, error) {
+	if s.room.srv.scheduledCount.Add(1) > int64(s.room.srv.opts.MaxScheduled) {
+		s.room.srv.scheduledCount.Add(-1)
+		return 0, errTooManyScheduled
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg := &scheduledMessage{
+		id:           s.room.srv.lastScheduledID.Add(1),
+		deliverAt:    deliverAt,
+		content:      content,
+		publisher:    publisher,
+		contentType:  contentType,
+		cacheControl: cacheControl,
+		topic:        topic,
+		ttl:          ttl,
+	}
+	msg.timer = time.AfterFunc(time.Until(deliverAt), func() {
+		if s.remove(msg.id) {
+			s.room.submitUnlessPaused(publication{message: msg.content, publisher: msg.publisher, contentType: msg.contentType, cacheControl: msg.cacheControl, topic: msg.topic, ttl: msg.ttl})
+		}
+	})
+	s.pending[msg.id] = msg
+	return msg.id, nil
+}
+
+// remove takes the message with the given ID off the schedule, reporting
+// whether it was still pending.
+func (s *Schedule) remove(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pending[id]; !ok {
+		return false
+	}
+	delete(s.pending, id)
+	s.room.srv.scheduledCount.Add(-1)
+	return true
+}
+
+// cancel takes the message with the given ID off the schedule before its
+// delivery, reporting whether it was still pending.
+func (s *Schedule) cancel(id uint64) bool {
+	s.mu.Lock()
+	msg, ok := s.pending[id]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	msg.timer.Stop()
+	// The timer may have fired already, in which case remove fails for one
+	// of the two callers and only the other wins.
+	return s.remove(id)
+}
+
+// scheduledInfo describes a pending scheduled message.
+type scheduledInfo struct {
+	ID        uint64    `json:"id"`
+	DeliverAt time.Time `json:"deliver_at"`
+	Size      int       `json:"size"`
+}
+
+// list returns the pending messages in order of delivery.
+func (s *Schedule) list() []scheduledInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]scheduledInfo, 0, len(s.pending))
+	for _, msg := range s.pending {
+		list = append(list, scheduledInfo{ID: msg.id, DeliverAt: msg.deliverAt, Size: len(msg.content)})
+	}
+	slices.SortFunc(list, func(a, b scheduledInfo) int {
+		if c := a.DeliverAt.Compare(b.DeliverAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return list
+}
+
+// len returns the number of pending messages.
+func (s *Schedule) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.pending)
+}
+
+// cancelAll drops every pending message, e.g. when the room goes away.
+func (s *Schedule) cancelAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, msg := range s.pending {
+		msg.timer.Stop()
+		delete(s.pending, id)
+		s.room.srv.scheduledCount.Add(-1)
+	}
+}
+
+// handleListScheduled lists a room's pending scheduled messages in order of
+// delivery: GET /api/rooms/{roomID}/scheduled
+func (s *Server) handleListScheduled(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	room, ok := s.rooms.lookupRoom(roomID)
+	if !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "scheduled": room.schedule.list()})
+}
+
+// handleCancelScheduled cancels a pending scheduled message:
+// DELETE /api/rooms/{roomID}/scheduled/{id}
+func (s *Server) handleCancelScheduled(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid scheduled message ID", http.StatusBadRequest)
+		return
+	}
+	roomID := r.PathValue("roomID")
+	room, ok := s.rooms.lookupRoom(roomID)
+	if !ok || !room.schedule.cancel(id) {
+		http.Error(w, "Scheduled message not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "cancelled": id})
+}
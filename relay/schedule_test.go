@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deliverAt returns the deliver_at parameter for a delivery after d.
+func deliverAt(d time.Duration) url.Values {
+	return url.Values{"deliver_at": {time.Now().Add(d).Format(time.RFC3339Nano)}}
+}
+
+func TestScheduledPublish(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+
+	const delay = 300 * time.Millisecond
+	start := time.Now()
+	if code, body := publish(t, ts, "scheduled", "later", deliverAt(delay)); code != http.StatusAccepted {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if got := latest(t, ts, "scheduled"); got != "" {
+		t.Fatalf("delivered %q before its time", got)
+	}
+	eventually(t, "the scheduled message", func() bool { return latest(t, ts, "scheduled") == "later" })
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("delivered after %v, want at least %v", elapsed, delay)
+	}
+}
+
+func TestScheduledPublishLimit(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxScheduled = 1
+	s, ts := newTestServer(t, opts)
+
+	if code, body := publish(t, ts, "scheduled", "one", deliverAt(time.Hour)); code != http.StatusAccepted {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if code, _ := publish(t, ts, "scheduled", "two", deliverAt(time.Hour)); code != http.StatusTooManyRequests {
+		t.Errorf("publish beyond MaxScheduled: status %d, want 429", code)
+	}
+
+	// Deleting the room cancels its scheduled messages.
+	if code, body := admin(t, ts, http.MethodDelete, "/api/rooms/scheduled?grace=0s", ""); code != http.StatusAccepted {
+		t.Fatalf("deleting the room: %d %s", code, body)
+	}
+	eventually(t, "the scheduled message to be cancelled", func() bool { return s.scheduledCount.Load() == 0 })
+}
+
+func TestCancelScheduled(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	conn := dialWS(t, ts, "/ws/scheduled", nil)
+	room := waitForRoom(t, s, "scheduled")
+	waitForClients(t, room, 1)
+
+	start := time.Now()
+	for _, m := range []struct {
+		content string
+		delay   time.Duration
+	}{
+		{"kept", 300 * time.Millisecond},
+		{"cancelled", 200 * time.Millisecond},
+	} {
+		if code, body := publish(t, ts, "scheduled", m.content, deliverAt(m.delay)); code != http.StatusAccepted {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+	}
+
+	// They are listed in order of delivery.
+	code, body := admin(t, ts, http.MethodGet, "/api/rooms/scheduled/scheduled", "")
+	if code != http.StatusOK {
+		t.Fatalf("listing: %d %s", code, body)
+	}
+	var listing struct {
+		Scheduled []scheduledInfo `json:"scheduled"`
+	}
+	if err := json.Unmarshal([]byte(body), &listing); err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Scheduled) != 2 || listing.Scheduled[0].ID != 2 || listing.Scheduled[0].Size != len("cancelled") || listing.Scheduled[1].ID != 1 || !listing.Scheduled[0].DeliverAt.Before(listing.Scheduled[1].DeliverAt) {
+		t.Fatalf("listing %s, want cancelled then kept", body)
+	}
+
+	if code, body := admin(t, ts, http.MethodDelete, "/api/rooms/scheduled/scheduled/2", ""); code != http.StatusOK {
+		t.Fatalf("cancelling: %d %s", code, body)
+	}
+	for _, path := range []string{"/api/rooms/scheduled/scheduled/2", "/api/rooms/other/scheduled/1"} {
+		if code, _ := admin(t, ts, http.MethodDelete, path, ""); code != http.StatusNotFound {
+			t.Errorf("DELETE %s: status %d, want 404", path, code)
+		}
+	}
+	if code, body := admin(t, ts, http.MethodGet, "/api/rooms/scheduled/scheduled", ""); code != http.StatusOK || strings.Contains(body, `"id":2`) {
+		t.Errorf("listing after cancelling: %d %s", code, body)
+	}
+
+	// Only the message that wasn't cancelled is delivered.
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "kept" {
+		t.Fatalf("received %q (%v), want kept", message, err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("delivered after %v", elapsed)
+	}
+	if code, body := admin(t, ts, http.MethodGet, "/api/rooms/scheduled/scheduled", ""); code != http.StatusOK || !strings.Contains(body, `"scheduled":[]`) {
+		t.Errorf("listing after delivery: %d %s, want none pending", code, body)
+	}
+}
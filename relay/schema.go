@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// maxSchemaSize bounds the schema documents accepted by the admin API.
+const maxSchemaSize = 1 << 20
+
+// roomSchema is a JSON Schema that content published to a room must match.
+type roomSchema struct {
+	source   json.RawMessage
+	compiled *jsonschema.Schema
+}
+
+// compileSchema compiles a JSON Schema document. References to external
+// documents are not resolved.
+func compileSchema(source []byte) (*roomSchema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	c := jsonschema.NewCompiler()
+	c.UseLoader(jsonschema.SchemeURLLoader{})
+	if err := c.AddResource("schema.json", doc); err != nil {
+		return nil, err
+	}
+	compiled, err := c.Compile("schema.json")
+	if err != nil {
+		return nil, err
+	}
+	return &roomSchema{source: source, compiled: compiled}, nil
+}
+
+var errContentNotJSON = errors.New("content is not valid JSON")
+
+// validate checks content against the schema. Mismatches are reported as a
+// *jsonschema.ValidationError.
+func (s *roomSchema) validate(content []byte) error {
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(content))
+	if err != nil {
+		return errContentNotJSON
+	}
+	return s.compiled.Validate(instance)
+}
+
+// checkSchema validates content against the room's schema, if it has one,
+// responding with 422 and the validation details and reporting false if the
+// content doesn't conform.
+func checkSchema(w http.ResponseWriter, room *Room, content []byte) bool {
+	schema := room.schema.Load()
+	if schema == nil {
+		return true
+	}
+	err := schema.validate(content)
+	if err == nil {
+		return true
+	}
+	response := map[string]any{"error": err.Error()}
+	var validationErr *jsonschema.ValidationError
+	if errors.As(err, &validationErr) {
+		response["error"] = "content does not match the room's schema"
+		response["details"] = validationErr.BasicOutput()
+	}
+	writeJSON(w, http.StatusUnprocessableEntity, response)
+	return false
+}
+
+// handleGetRoomSchema returns a room's schema: GET /api/rooms/{roomID}/schema
+func (s *Server) handleGetRoomSchema(w http.ResponseWriter, r *http.Request) {
+	room, ok := s.rooms.lookupRoom(r.PathValue("roomID"))
+	if !ok || room.schema.Load() == nil {
+		http.Error(w, "No schema", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(room.schema.Load().source)
+}
+
+// handlePutRoomSchema sets the JSON Schema that content published to a room
+// must match: PUT /api/rooms/{roomID}/schema
+func (s *Server) handlePutRoomSchema(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	source, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSchemaSize))
+	if err != nil {
+		http.Error(w, "Error reading schema: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	schema, err := compileSchema(source)
+	if err != nil {
+		http.Error(w, "Invalid schema: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.rooms.getRoom(roomID).schema.Store(schema)
+
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "schema": schema.source})
+}
+
+// handleDeleteRoomSchema lets a room accept any content again:
+// DELETE /api/rooms/{roomID}/schema
+func (s *Server) handleDeleteRoomSchema(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	if room, ok := s.rooms.lookupRoom(roomID); ok {
+		room.schema.Store(nil)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "schema": nil})
+}
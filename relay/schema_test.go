@@ -0,0 +1,47 @@
+package relay
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testSchema = `{
+	"type": "object",
+	"properties": {"temperature": {"type": "number"}},
+	"required": ["temperature"]
+}`
+
+func TestRoomSchema(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	if code, body := admin(t, ts, http.MethodPut, "/api/rooms/sensors/schema", `{"type": 5}`); code != http.StatusBadRequest {
+		t.Errorf("registering an invalid schema: %d %s, want 400", code, body)
+	}
+	if code, body := admin(t, ts, http.MethodPut, "/api/rooms/sensors/schema", testSchema); code != http.StatusOK {
+		t.Fatalf("registering the schema: %d %s", code, body)
+	}
+
+	if code, body := publish(t, ts, "sensors", `{"temperature": 21.5}`, nil); code != http.StatusOK {
+		t.Errorf("conforming publish: %d %s", code, body)
+	}
+	for _, content := range []string{`{"temperature": "warm"}`, `{}`} {
+		code, body := publish(t, ts, "sensors", content, nil)
+		if code != http.StatusUnprocessableEntity || !strings.Contains(body, `"details"`) {
+			t.Errorf("publishing %s: %d %s, want 422 with details", content, code, body)
+		}
+	}
+	if code, body := publish(t, ts, "sensors", `not json`, nil); code != http.StatusUnprocessableEntity {
+		t.Errorf("publishing invalid JSON: %d %s, want 422", code, body)
+	}
+	if got := latest(t, ts, "sensors"); got != `{"temperature": 21.5}` {
+		t.Errorf("latest = %q", got)
+	}
+
+	// Without the schema anything goes again.
+	if code, body := admin(t, ts, http.MethodDelete, "/api/rooms/sensors/schema", ""); code != http.StatusOK {
+		t.Fatalf("deleting the schema: %d %s", code, body)
+	}
+	if code, body := publish(t, ts, "sensors", `not json`, nil); code != http.StatusOK {
+		t.Errorf("publish after deleting the schema: %d %s", code, body)
+	}
+}
@@ -0,0 +1,370 @@
+package relay
+
+import (
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a message to the peer.
+	writeWait = 10 * time.Second
+
+	// Default time allowed to read the next pong message from the peer, for
+	// WSPongTimeout.
+	pongWait = 60 * time.Second
+
+	// Period of pings with the default pong timeout.
+	pingPeriod = (pongWait * 9) / 10
+
+	// Number of messages buffered for each client, unless its room sets
+	// send_buffer.
+	sendBufferSize = 256
+
+	// Largest send_buffer a room may set.
+	maxSendBufferSize = 65536
+
+	// Size beyond which no further messages are added to a batched frame.
+	maxBatchSize = 64 << 10
+
+	// Lowest delivery rate, in messages per second, a subscriber may ask for
+	// or MaxClientRate may set, so that no message waits over 10s to be sent.
+	minClientRate = 0.1
+
+	// Maximum number of connection IDs listed in a verbose publish response.
+	maxDeliveredIDs = 100
+
+	// Maximum size of a publish body or stream line when MaxContentSize
+	// is unset.
+	defaultMaxContentSize = 1 << 20
+)
+
+// Server is a relay: it manages rooms and serves their subscribers and
+// publishers. Servers are independent of each other, so several may run in
+// one process with different options.
+type Server struct {
+	opts     Options
+	upgrader websocket.Upgrader
+	// static serves the frontend, or is nil if there is none.
+	static http.Handler
+
+	rooms            *RoomManager
+	clientIndex      *ClientIndex
+	tagGauges        *TagGauges
+	tokenConnections *TokenConnections
+	publisherRooms   *PublisherRooms
+	reconnects       *ReconnectLimiter
+	resumePositions  *ResumePositions
+	roomStreams      *RoomStreams
+	publishSessions  *PublishSessions
+	remoteMirrors    *RemoteMirrors
+	webhooks         *Webhooks
+	bridges          *Bridges
+
+	// id identifies this instance to the other relay instances, on the
+	// backplane and across bridges.
+	id string
+
+	// backplane is nil unless Backplane is set.
+	backplane *backplane
+
+	// autoCreateRooms is the compiled AutoCreateRooms, or nil if unset.
+	autoCreateRooms *regexp.Regexp
+
+	// directory holds the room that directory events are broadcast to,
+	// created on first use.
+	directory struct {
+		once sync.Once
+		room *Room
+	}
+
+	// connections counts the live subscriber connections across all rooms
+	// and transports, sseConnections the SSE ones among them, and
+	// wsConnections the WebSocket connections whose write pumps are running.
+	connections    atomic.Int64
+	sseConnections atomic.Int64
+	wsConnections  atomic.Int64
+	// anonymousConnections counts the connections among them without a
+	// valid JWT.
+	anonymousConnections atomic.Int64
+
+	// shuttingDown is set once a graceful shutdown has begun, and
+	// shutdownStarted is closed at the same time for those waiting on it.
+	shuttingDown    atomic.Bool
+	shutdownStarted chan struct{}
+
+	// maintenance is set while the public endpoints are paused, responding
+	// with 503 and maintenanceMessage.
+	maintenance        atomic.Bool
+	maintenanceMessage atomic.Pointer[string]
+
+	// scheduledCount is the number of scheduled messages pending across all
+	// rooms, and lastScheduledID the ID of the most recently scheduled one.
+	scheduledCount  atomic.Int64
+	lastScheduledID atomic.Uint64
+
+	// historyBytes is the size of the messages retained in all rooms'
+	// histories, and evictingHistory is set while evictHistory runs.
+	historyBytes    atomic.Int64
+	evictingHistory atomic.Bool
+
+	// persisting counts the rooms' goroutines writing to Persister.
+	persisting sync.WaitGroup
+
+	metrics metricCounters
+
+	log *slog.Logger
+}
+
+// NewServer returns a server with the given options. It starts the
+// background work the options call for, such as sending metrics to StatsD,
+// which runs until the server is shut down.
+func NewServer(opts Options) (*Server, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		opts: opts,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  opts.ReadBufferSize,
+			WriteBufferSize: opts.WriteBufferSize,
+		},
+		clientIndex: &ClientIndex{
+			byIP: make(map[string]map[*Client]bool),
+		},
+		tagGauges: newTagGauges(opts.MaxTagValues),
+		tokenConnections: &TokenConnections{
+			counts: make(map[string]int),
+		},
+		publisherRooms:  newPublisherRooms(opts.MaxPublisherRooms, opts.PublisherRoomWindow),
+		reconnects:      newReconnectLimiter(opts.ReconnectInterval),
+		resumePositions: newResumePositions(opts.ResumeWindow),
+		roomStreams:     newRoomStreams(opts.MaxRoomStreams),
+		publishSessions: newPublishSessions(opts.MaxSessionBytes, opts.PublishSessionTimeout),
+		shutdownStarted: make(chan struct{}),
+		id:              newConnectionID(),
+	}
+	s.log = opts.Logger
+	if s.log == nil {
+		s.log = slog.Default()
+	}
+	s.remoteMirrors = newRemoteMirrors(s.shutdownStarted)
+	s.webhooks = newWebhooks(s.shutdownStarted)
+	s.bridges = newBridges(s)
+	s.upgrader.CheckOrigin = s.checkOrigin
+	s.static = newStaticHandler(opts)
+	if opts.WriteBufferPool {
+		s.upgrader.WriteBufferPool = &sync.Pool{}
+	}
+	s.maintenance.Store(opts.Maintenance)
+	s.maintenanceMessage.Store(&opts.MaintenanceMessage)
+	if opts.AutoCreateRooms != "" {
+		// Validated, so this can't panic. Names must match in full.
+		s.autoCreateRooms = regexp.MustCompile("^(?:" + opts.AutoCreateRooms + ")$")
+	}
+	s.rooms = newRoomManager(s)
+
+	if opts.DebugVars {
+		if err := s.publishDebugVars(); err != nil {
+			return nil, fmt.Errorf("debug vars: %w", err)
+		}
+	}
+	if opts.StatsDAddr != "" {
+		if err := s.startStatsD(opts.StatsDAddr); err != nil {
+			return nil, fmt.Errorf("StatsD: %w", err)
+		}
+	}
+	if opts.RetainMaxAge > 0 || opts.ContentTTL > 0 {
+		go s.sweepRetainedContent()
+	}
+	if opts.Backplane != nil {
+		s.backplane = newBackplane(s)
+		s.backplane.start()
+	}
+	return s, nil
+}
+
+// Register adds the server's endpoints to mux, and its management endpoints,
+// such as the admin API and metrics, to adminMux. They may be the same mux.
+func (s *Server) Register(mux, adminMux *http.ServeMux) {
+	// Subscriber endpoint: /ws/{roomID}
+	mux.HandleFunc("/ws/", s.unlessMaintenance(s.ServeWS))
+
+	// Health check, reporting maintenance and shutdown: /healthz
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+
+	// Prometheus metrics, served without authentication on the admin
+	// listener: /metrics
+	if s.opts.MetricsPath != "" {
+		adminMux.HandleFunc("GET "+s.opts.MetricsPath, s.handleMetrics)
+	}
+
+	// expvar variables, served without authentication on the admin
+	// listener: /debug/vars
+	if s.opts.DebugVars {
+		adminMux.Handle("GET /debug/vars", expvar.Handler())
+	}
+
+	// Runtime profiles, served without authentication on the admin
+	// listener: /debug/pprof/
+	if s.opts.Pprof {
+		adminMux.HandleFunc("GET /debug/pprof/", pprof.Index)
+		adminMux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+		adminMux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+		adminMux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+		adminMux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+		adminMux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+		// Not taken for publishes on a separate public listener.
+		if mux != adminMux {
+			mux.Handle("/debug/pprof/", http.NotFoundHandler())
+		}
+	}
+
+	// Server-Sent Events subscriber endpoint: /sse/{roomID}
+	mux.HandleFunc("GET /sse/{roomID}", s.unlessMaintenance(s.ServeSSE))
+
+	// QR code of a room's subscriber page: /api/rooms/{roomID}/qr.png
+	mux.HandleFunc("GET /api/rooms/{roomID}/qr.png", s.unlessMaintenance(s.handleRoomQR))
+
+	// Retained content snapshot for polling clients: /api/rooms/{roomID}/latest
+	mux.HandleFunc("GET /api/rooms/{roomID}/latest", s.unlessMaintenance(s.handleLatest))
+
+	// Subscriber count: /api/rooms/{roomID}/count
+	mux.HandleFunc("GET /api/rooms/{roomID}/count", s.unlessMaintenance(s.handleRoomCount))
+
+	// Subscriber count and names: /api/rooms/{roomID}/presence
+	mux.HandleFunc("GET /api/rooms/{roomID}/presence", s.unlessMaintenance(s.handlePresence))
+
+	// History snapshot, optionally filtered: /api/rooms/{roomID}/replay
+	mux.HandleFunc("GET /api/rooms/{roomID}/replay", s.unlessMaintenance(s.handleReplay))
+
+	// Rooms locked with separate publish and subscribe tokens: /api/rooms
+	mux.HandleFunc("POST /api/rooms", s.unlessMaintenance(s.handleIssueRoomTokens))
+
+	// Streaming publisher endpoint, one message per line: /api/rooms/{roomID}/stream
+	mux.HandleFunc("POST /api/rooms/{roomID}/stream", s.unlessMaintenance(s.handlePublishStream))
+
+	// Multi-part publishes: /api/rooms/{roomID}/sessions/...
+	mux.HandleFunc("POST /api/rooms/{roomID}/sessions", s.unlessMaintenance(s.handleOpenSession))
+	mux.HandleFunc("POST /api/rooms/{roomID}/sessions/{id}/parts", s.unlessMaintenance(s.handleSessionPart))
+	mux.HandleFunc("POST /api/rooms/{roomID}/sessions/{id}/commit", s.unlessMaintenance(s.handleCommitSession))
+	mux.HandleFunc("DELETE /api/rooms/{roomID}/sessions/{id}", s.unlessMaintenance(s.handleAbortSession))
+
+	// Admin API: /api/rooms/{roomID}/...
+	adminMux.HandleFunc("GET /api/rooms", s.requireAdmin(s.handleListRooms))
+	adminMux.HandleFunc("POST /api/rooms/{roomID}/mirror-to", s.requireAdmin(s.handleMirrorTo))
+	adminMux.HandleFunc("POST /api/rooms/{roomID}/webhooks", s.requireAdmin(s.handleAddWebhook))
+	adminMux.HandleFunc("GET /api/rooms/{roomID}/webhooks", s.requireAdmin(s.handleListWebhooks))
+	adminMux.HandleFunc("DELETE /api/rooms/{roomID}/webhooks/{id}", s.requireAdmin(s.handleDeleteWebhook))
+	adminMux.HandleFunc("POST /api/rooms/{roomID}/bridges", s.requireAdmin(s.handleAddBridge))
+	adminMux.HandleFunc("GET /api/rooms/{roomID}/bridges", s.requireAdmin(s.handleListBridges))
+	adminMux.HandleFunc("DELETE /api/rooms/{roomID}/bridges/{id}", s.requireAdmin(s.handleDeleteBridge))
+	adminMux.HandleFunc("PUT /api/rooms/{roomID}", s.requireAdmin(s.handleCreateRoom))
+	adminMux.HandleFunc("DELETE /api/rooms/{roomID}", s.requireAdmin(s.handleDeleteRoom))
+	adminMux.HandleFunc("GET /api/rooms/{roomID}/token", s.requireAdmin(s.handleRoomToken))
+	adminMux.HandleFunc("POST /api/rooms/{roomID}/meta", s.requireAdmin(s.handleRoomMeta))
+	adminMux.HandleFunc("POST /api/rooms/{roomID}/priority", s.requireAdmin(s.handleRoomPriority))
+	adminMux.HandleFunc("POST /api/rooms/{roomID}/latest-only", s.requireAdmin(s.handleRoomLatestOnly))
+	adminMux.HandleFunc("POST /api/rooms/{roomID}/command", s.requireAdmin(s.handleRoomCommand))
+	adminMux.HandleFunc("GET /api/rooms/{roomID}/schema", s.requireAdmin(s.handleGetRoomSchema))
+	adminMux.HandleFunc("PUT /api/rooms/{roomID}/schema", s.requireAdmin(s.handlePutRoomSchema))
+	adminMux.HandleFunc("DELETE /api/rooms/{roomID}/schema", s.requireAdmin(s.handleDeleteRoomSchema))
+	adminMux.HandleFunc("GET /api/rooms/{roomID}/scheduled", s.requireAdmin(s.handleListScheduled))
+	adminMux.HandleFunc("DELETE /api/rooms/{roomID}/scheduled/{id}", s.requireAdmin(s.handleCancelScheduled))
+	adminMux.HandleFunc("POST /api/rooms/{roomID}/capture", s.requireAdmin(s.handleStartCapture))
+	adminMux.HandleFunc("DELETE /api/rooms/{roomID}/capture", s.requireAdmin(s.handleStopCapture))
+	adminMux.HandleFunc("POST /api/rooms/{roomID}/playback", s.requireAdmin(s.handlePlayback))
+	adminMux.HandleFunc("POST /api/rooms/{roomID}/pause", s.requireAdmin(s.handlePauseRoom))
+	adminMux.HandleFunc("POST /api/rooms/{roomID}/resume", s.requireAdmin(s.handleResumeRoom))
+	adminMux.HandleFunc("GET /api/rooms/{roomID}/clients", s.requireAdmin(s.handleRoomClients))
+	adminMux.HandleFunc("DELETE /api/rooms/{roomID}/clients/{id}", s.requireAdmin(s.handleKickClient))
+	adminMux.HandleFunc("GET /admin/clients", s.requireAdmin(s.handleClientsByIP))
+	adminMux.HandleFunc("POST /admin/notice", s.requireAdmin(s.handleNotice))
+	adminMux.HandleFunc("GET /admin/export", s.requireAdmin(s.handleExport))
+	adminMux.HandleFunc("POST /admin/import", s.requireAdmin(s.handleImport))
+	adminMux.HandleFunc("POST /admin/maintenance", s.requireAdmin(s.handleMaintenance))
+
+	// Publisher endpoint: /{roomID}?content=...
+	// We use a catch-all pattern or specific handler.
+	// Since http.HandleFunc matches prefixes, "/" will match everything not matched by others.
+	// But we need to be careful not to capture /ws/ if we defined it.
+	// The specific pattern "/ws/" takes precedence over "/".
+	mux.HandleFunc("/", s.unlessMaintenance(s.cors(s.HandlePublish)))
+}
+
+// Handler returns a handler serving all of the server's endpoints, public and
+// management alike.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	s.Register(mux, mux)
+	return mux
+}
+
+// checkOrigin decides whether a WebSocket upgrade is allowed based on its Origin header.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	if r.Header.Get("Origin") == "" {
+		// Native (non-browser) clients usually don't send an Origin.
+		return s.opts.AllowMissingOrigin
+	}
+	return s.originAllowed(r)
+}
+
+// originAllowed reports whether r's origin matches AllowedOrigins, or is the
+// relay's own origin if it is empty, or whether any origin is allowed.
+func (s *Server) originAllowed(r *http.Request) bool {
+	if s.opts.AllowAnyOrigin {
+		return true
+	}
+	origin := strings.ToLower(r.Header.Get("Origin"))
+	if strings.TrimSpace(s.opts.AllowedOrigins) == "" {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for allowed := range strings.SplitSeq(s.opts.AllowedOrigins, ",") {
+		allowed = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(allowed), "/"))
+		if matched, _ := path.Match(allowed, origin); matched || allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// cors applies AllowedOrigins to browser requests to a publish endpoint:
+// those from other origins are rejected with 403, and the others get CORS
+// headers, with preflight requests answered directly. Requests without an
+// Origin header, from native clients, pass through.
+func (s *Server) cors(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !s.originAllowed(r) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Signature, X-Timestamp, X-Trusted-Publisher")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
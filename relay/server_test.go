@@ -0,0 +1,408 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testAdminToken is the AdminToken of the servers newTestServer starts.
+const testAdminToken = "test-admin-token"
+
+// newTestServer starts a relay serving opts over HTTP, shut down when the test
+// ends.
+func newTestServer(t testing.TB, opts Options) (*Server, *httptest.Server) {
+	t.Helper()
+	if opts.AdminToken == "" {
+		opts.AdminToken = testAdminToken
+	}
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx, ts.Config)
+		ts.Close()
+	})
+	return s, ts
+}
+
+// publish publishes content to room with the extra query parameters in query,
+// and returns the response's status and body.
+func publish(t testing.TB, ts *httptest.Server, room, content string, query url.Values) (int, string) {
+	t.Helper()
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("content", content)
+	return request(t, http.MethodPost, ts.URL+"/"+room+"?"+query.Encode(), "", nil)
+}
+
+// request sends a request with body and header to target, and returns the
+// response's status and body.
+func request(t testing.TB, method, target, body string, header http.Header) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, target, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, target, err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading the body: %v", method, target, err)
+	}
+	return res.StatusCode, string(b)
+}
+
+// adminHeader returns the headers authenticating a request as the admin of a
+// server started by newTestServer.
+func adminHeader() http.Header {
+	return http.Header{"Authorization": {"Bearer " + testAdminToken}}
+}
+
+// eventually fails the test if cond doesn't hold within a few seconds.
+func eventually(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitForRoom waits for the room named name to be opened and returns it.
+func waitForRoom(t testing.TB, s *Server, name string) *Room {
+	t.Helper()
+	var room *Room
+	eventually(t, "room "+name, func() bool {
+		var ok bool
+		room, ok = s.rooms.lookupRoom(name)
+		return ok
+	})
+	return room
+}
+
+// waitForClients waits for room to have registered n clients. Unlike
+// room.members, which counts subscribers as soon as they are admitted, this
+// ensures they get the messages published next.
+func waitForClients(t testing.TB, room *Room, n int) {
+	t.Helper()
+	eventually(t, "the subscribers to join", func() bool {
+		var registered int
+		room.do(func() { registered = len(room.clients) })
+		return registered == n
+	})
+}
+
+// dialWS connects to the WebSocket endpoint at path on ts, e.g. "/ws/room1",
+// with dialer, or websocket.DefaultDialer if it is nil. The connection is
+// closed when the test ends.
+func dialWS(t testing.TB, ts *httptest.Server, path string, dialer *websocket.Dialer) *websocket.Conn {
+	t.Helper()
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	conn, res, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+path, nil)
+	if err != nil {
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+		}
+		t.Fatalf("dialing %s: %v (status %d)", path, err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// joinTestClient registers a client without a connection with room, with a
+// send buffer of size buffer, and waits for the room to have registered it.
+func joinTestClient(t testing.TB, room *Room, buffer int) *Client {
+	t.Helper()
+	client := &Client{
+		room:        room,
+		send:        make(chan []byte, buffer),
+		id:          newConnectionID(),
+		ip:          "192.0.2.1",
+		remoteAddr:  "192.0.2.1:1234",
+		connectedAt: time.Now(),
+	}
+	if !room.join(client) {
+		t.Fatal("room closed")
+	}
+	room.do(func() {})
+	return client
+}
+
+// received returns the messages queued for client, without waiting.
+func received(client *Client) []string {
+	var messages []string
+	for {
+		select {
+		case message, ok := <-client.send:
+			if !ok {
+				return messages
+			}
+			messages = append(messages, string(message))
+		default:
+			return messages
+		}
+	}
+}
+
+// admin sends an admin API request to ts, and returns the response's status
+// and body.
+func admin(t testing.TB, ts *httptest.Server, method, path, body string) (int, string) {
+	t.Helper()
+	return request(t, method, ts.URL+path, body, adminHeader())
+}
+
+// latest returns the retained content of room on ts, or "" if it has none.
+func latest(t testing.TB, ts *httptest.Server, room string) string {
+	t.Helper()
+	code, body := request(t, http.MethodGet, ts.URL+"/api/rooms/"+room+"/latest", "", nil)
+	if code != http.StatusOK {
+		return ""
+	}
+	return body
+}
+
+func TestMissingOrigin(t *testing.T) {
+	for _, allow := range []bool{true, false} {
+		opts := DefaultOptions()
+		opts.AllowMissingOrigin = allow
+		s, ts := newTestServer(t, opts)
+
+		r := httptest.NewRequest(http.MethodGet, "/ws/room1", nil)
+		if got := s.checkOrigin(r); got != allow {
+			t.Errorf("AllowMissingOrigin=%t: checkOrigin without an Origin = %t", allow, got)
+		}
+		// An Origin that is present is checked either way.
+		r.Header.Set("Origin", "https://evil.example")
+		if s.checkOrigin(r) {
+			t.Errorf("AllowMissingOrigin=%t: checkOrigin accepted a foreign origin", allow)
+		}
+
+		// The default dialer sends no Origin.
+		conn, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/room1", nil)
+		if allow {
+			if err != nil {
+				t.Errorf("dialing without an Origin: %v", err)
+			} else {
+				conn.Close()
+			}
+		} else if err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+			t.Errorf("dialing without an Origin: %v, want status 403", err)
+		}
+	}
+}
+
+func TestSeparateAdminMux(t *testing.T) {
+	opts := DefaultOptions()
+	opts.AdminToken = testAdminToken
+	opts.Pprof = true
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux, adminMux := http.NewServeMux(), http.NewServeMux()
+	s.Register(mux, adminMux)
+	public, private := httptest.NewServer(mux), httptest.NewServer(adminMux)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx, public.Config, private.Config)
+		public.Close()
+		private.Close()
+	})
+
+	for _, tt := range []struct {
+		ts     *httptest.Server
+		path   string
+		header http.Header
+		want   int
+	}{
+		{private, "/metrics", nil, http.StatusOK},
+		{private, "/admin/clients?ip=127.0.0.1", adminHeader(), http.StatusOK},
+		{private, "/debug/pprof/", nil, http.StatusOK},
+		{private, "/debug/pprof/goroutine?debug=1", nil, http.StatusOK},
+		{private, "/debug/pprof/cmdline", nil, http.StatusOK},
+		{public, "/healthz", nil, http.StatusOK},
+		{public, "/debug/pprof/", nil, http.StatusNotFound},
+		{public, "/debug/pprof/goroutine?debug=1", nil, http.StatusNotFound},
+		{public, "/debug/pprof/cmdline", nil, http.StatusNotFound},
+	} {
+		if code, body := request(t, http.MethodGet, tt.ts.URL+tt.path, "", tt.header); code != tt.want {
+			t.Errorf("GET %s: %d %s, want %d", tt.path, code, body, tt.want)
+		}
+	}
+	// Management endpoints aren't served publicly, where "/" publishes.
+	for _, path := range []string{"/metrics", "/admin/clients?ip=127.0.0.1"} {
+		if code, body := request(t, http.MethodGet, public.URL+path, "", adminHeader()); code == http.StatusOK {
+			t.Errorf("GET %s on the public listener: %d %s", path, code, body)
+		}
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	for _, tt := range []struct {
+		allowed string
+		origin  string
+		want    bool
+	}{
+		// httptest.NewRequest's Host is example.com.
+		{"", "http://example.com", true},
+		{"", "https://evil.example", false},
+		{"*", "https://evil.example", true},
+		{"https://app.example.com, https://admin.example.com/", "https://admin.example.com", true},
+		{"https://app.example.com", "HTTPS://APP.EXAMPLE.COM", true},
+		{"https://app.example.com", "http://app.example.com", false},
+		{"https://*.example.com", "https://team.example.com", true},
+		{"https://*.example.com", "https://example.com.evil.example", false},
+	} {
+		opts := DefaultOptions()
+		opts.AllowedOrigins = tt.allowed
+		s, _ := newTestServer(t, opts)
+		r := httptest.NewRequest(http.MethodGet, "/ws/room1", nil)
+		r.Header.Set("Origin", tt.origin)
+		if got := s.checkOrigin(r); got != tt.want {
+			t.Errorf("AllowedOrigins %q: checkOrigin(%s) = %t, want %t", tt.allowed, tt.origin, got, tt.want)
+		}
+	}
+
+	// Upgrades from other origins are rejected with 403.
+	opts := DefaultOptions()
+	opts.AllowedOrigins = "https://app.example.com"
+	_, ts := newTestServer(t, opts)
+	target := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/room1"
+	_, res, err := websocket.DefaultDialer.Dial(target, http.Header{"Origin": {"https://evil.example"}})
+	if err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+		t.Errorf("dialing from another origin: %v, want status 403", err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(target, http.Header{"Origin": {"https://app.example.com"}})
+	if err != nil {
+		t.Fatalf("dialing from an allowed origin: %v", err)
+	}
+	conn.Close()
+}
+
+func TestIndependentServers(t *testing.T) {
+	// Two servers in one process, with their handlers mounted on plain
+	// muxes, share neither rooms nor settings.
+	var servers []*httptest.Server
+	for _, maxMessage := range []int64{512, 4096} {
+		opts := DefaultOptions()
+		opts.WSPublish = true
+		opts.MaxWSMessageSize = maxMessage
+		s, err := NewServer(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/ws/", s.ServeWS)
+		mux.HandleFunc("/", s.HandlePublish)
+		ts := httptest.NewServer(mux)
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			s.Shutdown(ctx, ts.Config)
+			ts.Close()
+		})
+		servers = append(servers, ts)
+	}
+	small, large := servers[0], servers[1]
+
+	if code, body := publish(t, small, "shared", "only on small", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	smallConn, largeConn := dialWS(t, small, "/ws/shared", nil), dialWS(t, large, "/ws/shared", nil)
+	if _, message, err := smallConn.ReadMessage(); err != nil || string(message) != "only on small" {
+		t.Errorf("small server replayed %q (%v)", message, err)
+	}
+
+	message := strings.Repeat("x", 1024)
+	for _, conn := range []*websocket.Conn{smallConn, largeConn} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := smallConn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("small server: %v, want the message rejected as too big", err)
+	}
+	// The large server's room never saw the small server's publish, so the
+	// client's own message is the first it receives.
+	if _, got, err := largeConn.ReadMessage(); err != nil || string(got) != message {
+		t.Errorf("large server: received %.20q (%v), want the client's message", got, err)
+	}
+}
+
+func TestPublishCORS(t *testing.T) {
+	opts := DefaultOptions()
+	opts.AllowedOrigins = "https://*.example.com"
+	_, ts := newTestServer(t, opts)
+	send := func(ts *httptest.Server, method, origin string, header http.Header) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+"/cors?content="+url.QueryEscape(method+" from "+origin), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := send(ts, http.MethodPost, "https://app.example.com", nil)
+	if res.StatusCode != http.StatusOK || res.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" || res.Header.Get("Vary") != "Origin" {
+		t.Errorf("publish from an allowed origin: status %d, headers %v", res.StatusCode, res.Header)
+	}
+	if res := send(ts, http.MethodPost, "https://evil.example", nil); res.StatusCode != http.StatusForbidden {
+		t.Errorf("publish from another origin: status %d, want 403", res.StatusCode)
+	}
+	// Native clients send no Origin, and get no CORS headers.
+	if res := send(ts, http.MethodPost, "", nil); res.StatusCode != http.StatusOK || res.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("publish without an Origin: status %d, headers %v", res.StatusCode, res.Header)
+	}
+	res = send(ts, http.MethodOptions, "https://app.example.com", http.Header{"Access-Control-Request-Method": {http.MethodPost}})
+	if res.StatusCode != http.StatusNoContent || !strings.Contains(res.Header.Get("Access-Control-Allow-Methods"), http.MethodPost) || !strings.Contains(res.Header.Get("Access-Control-Allow-Headers"), "Authorization") {
+		t.Errorf("preflight: status %d, headers %v", res.StatusCode, res.Header)
+	}
+
+	// AllowAnyOrigin overrides AllowedOrigins for publishes and upgrades.
+	opts.AllowAnyOrigin = true
+	s, ts := newTestServer(t, opts)
+	if res := send(ts, http.MethodPost, "https://evil.example", nil); res.StatusCode != http.StatusOK || res.Header.Get("Access-Control-Allow-Origin") != "https://evil.example" {
+		t.Errorf("AllowAnyOrigin: publish from another origin: status %d, headers %v", res.StatusCode, res.Header)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/ws/cors", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	if !s.checkOrigin(r) {
+		t.Error("AllowAnyOrigin: checkOrigin rejected a foreign origin")
+	}
+}
@@ -0,0 +1,299 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxPublishSessions bounds the publish sessions open at once.
+const maxPublishSessions = 1000
+
+var (
+	errSessionNotFound = errors.New("publish session not found")
+	errSessionTooLarge = errors.New("publish session too large")
+	errTooManySessions = errors.New("too many publish sessions")
+)
+
+// publishSession assembles a message from parts uploaded separately, which
+// is published as a whole once committed.
+type publishSession struct {
+	room        string
+	contentType string
+	content     []byte
+	// timer drops the session if it isn't committed in time.
+	timer *time.Timer
+}
+
+// PublishSessions holds the open publish sessions by ID.
+type PublishSessions struct {
+	sessions map[string]*publishSession
+	maxBytes int
+	timeout  time.Duration
+	mu       sync.Mutex
+}
+
+func newPublishSessions(maxBytes int, timeout time.Duration) *PublishSessions {
+	return &PublishSessions{
+		sessions: make(map[string]*publishSession),
+		maxBytes: maxBytes,
+		timeout:  timeout,
+	}
+}
+
+// open starts a session assembling a message of contentType for room and
+// returns its ID.
+func (ps *PublishSessions) open(room, contentType string) (string, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if len(ps.sessions) >= maxPublishSessions {
+		return "", errTooManySessions
+	}
+	id := newConnectionID()
+	ps.sessions[id] = &publishSession{
+		room:        room,
+		contentType: contentType,
+		timer:       time.AfterFunc(ps.timeout, func() { ps.abort(room, id) }),
+	}
+	return id, nil
+}
+
+// add appends part to the content of session id of room and returns the
+// resulting size. A part taking the content past maxBytes aborts the session
+// with errSessionTooLarge.
+func (ps *PublishSessions) add(room, id string, part []byte) (int, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	session, ok := ps.sessions[id]
+	if !ok || session.room != room {
+		return 0, errSessionNotFound
+	}
+	if len(session.content)+len(part) > ps.maxBytes {
+		session.timer.Stop()
+		delete(ps.sessions, id)
+		return 0, errSessionTooLarge
+	}
+	session.content = append(session.content, part...)
+	return len(session.content), nil
+}
+
+// take removes session id of room, to be committed, reporting whether it was
+// open.
+func (ps *PublishSessions) take(room, id string) (*publishSession, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	session, ok := ps.sessions[id]
+	if !ok || session.room != room {
+		return nil, false
+	}
+	session.timer.Stop()
+	delete(ps.sessions, id)
+	return session, true
+}
+
+// commit removes session id of room like take, once verify accepts its
+// content. A session whose content verify rejects stays open, so requests
+// that fail to commit it can't discard it either.
+func (ps *PublishSessions) commit(room, id string, verify func(content []byte) error) (*publishSession, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	session, ok := ps.sessions[id]
+	if !ok || session.room != room {
+		return nil, errSessionNotFound
+	}
+	if err := verify(session.content); err != nil {
+		return nil, err
+	}
+	session.timer.Stop()
+	delete(ps.sessions, id)
+	return session, nil
+}
+
+// abort discards session id of room, reporting whether it was open.
+func (ps *PublishSessions) abort(room, id string) bool {
+	_, ok := ps.take(room, id)
+	return ok
+}
+
+// handleOpenSession opens a publish session: POST /api/rooms/{roomID}/sessions
+// The message's parts are then uploaded to /sessions/{id}/parts in order and
+// published together with /sessions/{id}/commit. The content type of the
+// message is that of this request, if any.
+func (s *Server) handleOpenSession(w http.ResponseWriter, r *http.Request) {
+	roomID, err := s.resolveRoomID(r.PathValue("roomID"))
+	if err != nil {
+		http.Error(w, err.Error(), roomIDStatus(err))
+		return
+	}
+	if !s.authorizeSessionRequest(w, r, roomID, nil) {
+		return
+	}
+	id, err := s.publishSessions.open(roomID, publishContentType(r, nil, true))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"room": roomID, "session": id})
+}
+
+// handleSessionPart appends the request body to a publish session's content:
+// POST /api/rooms/{roomID}/sessions/{id}/parts
+// A part taking the content past MaxSessionBytes aborts the session with 413.
+func (s *Server) handleSessionPart(w http.ResponseWriter, r *http.Request) {
+	roomID, err := s.resolveRoomID(r.PathValue("roomID"))
+	if err != nil {
+		http.Error(w, err.Error(), roomIDStatus(err))
+		return
+	}
+	id := r.PathValue("id")
+
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(s.opts.PublishBodyTimeout))
+	// Reading one byte past the limit tells a part that is too large on its
+	// own from one that fits.
+	part, err := io.ReadAll(io.LimitReader(r.Body, int64(s.publishSessions.maxBytes)+1))
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		http.Error(w, "Timed out reading the request body", http.StatusRequestTimeout)
+		return
+	case err != nil:
+		http.Error(w, "Error reading the request body", http.StatusBadRequest)
+		return
+	}
+
+	if !s.authorizeSessionRequest(w, r, roomID, part) {
+		return
+	}
+	size, err := s.publishSessions.add(roomID, id, part)
+	switch {
+	case errors.Is(err, errSessionTooLarge):
+		http.Error(w, "Publish session too large, aborted", http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "session": id, "size": size})
+}
+
+// handleCommitSession publishes the content assembled by a publish session
+// and closes the session: POST /api/rooms/{roomID}/sessions/{id}/commit
+// The message is checked like any other publish.
+func (s *Server) handleCommitSession(w http.ResponseWriter, r *http.Request) {
+	roomID, err := s.resolveRoomID(r.PathValue("roomID"))
+	if err != nil {
+		http.Error(w, err.Error(), roomIDStatus(err))
+		return
+	}
+	if err := s.authorizePublish(r, roomID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// The commit is signed over the assembled content, which it publishes.
+	session, err := s.publishSessions.commit(roomID, r.PathValue("id"), func(content []byte) error {
+		return s.verifyPublishSignature(r, content)
+	})
+	switch {
+	case errors.Is(err, errSessionNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	content := session.content
+	if len(content) == 0 {
+		http.Error(w, "Missing content", http.StatusBadRequest)
+		return
+	}
+	if s.opts.MaxContentSize > 0 && len(content) > s.opts.MaxContentSize {
+		http.Error(w, "Content too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	publisher := remoteIP(r)
+	if !s.publisherRooms.admits(publisherKey(r), roomID) {
+		http.Error(w, "Too many distinct rooms for this publisher", http.StatusForbidden)
+		return
+	}
+	room, err := s.rooms.openRoom(roomID)
+	if err != nil {
+		http.Error(w, err.Error(), openRoomStatus(err))
+		return
+	}
+	if err := room.claimAccessToken(requestToken(r)); err != nil {
+		http.Error(w, err.Error(), accessTokenStatus(err))
+		return
+	}
+	if !room.publisherIPs.allow(publisher) {
+		http.Error(w, "Too many distinct publishers for this room", http.StatusForbidden)
+		return
+	}
+	if !s.checkPublishRate(w, r, room, publisher) || !checkContentSize(w, room, len(content)) || !checkSchema(w, room, content) || !s.checkRetention(w, room, len(content), session.contentType) || !s.checkMirrorHealth(w, room) {
+		return
+	}
+	if !s.publisherRooms.allow(publisherKey(r), roomID) {
+		http.Error(w, "Too many distinct rooms for this publisher", http.StatusForbidden)
+		return
+	}
+	p := publication{message: content, publisher: publisher, contentType: session.contentType}
+	if !checkPaused(w, room, p, true) {
+		return
+	}
+	if !room.trySubmit(p) {
+		http.Error(w, "Publish queue full", http.StatusTooManyRequests)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Published to " + roomID))
+}
+
+// authorizeSessionRequest runs the checks of a publish on a request opening,
+// adding a part to or aborting a publish session of roomID, whose body is
+// body: its
+// signature, AuthorizePublish and the room's access token, which it doesn't
+// claim. It reports whether they passed, having responded otherwise.
+func (s *Server) authorizeSessionRequest(w http.ResponseWriter, r *http.Request, roomID string, body []byte) bool {
+	if err := s.verifyPublishSignature(r, body); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	if err := s.authorizePublish(r, roomID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	if room, ok := s.rooms.lookupRoom(roomID); ok {
+		if err := room.checkAccessToken(requestToken(r)); err != nil {
+			http.Error(w, err.Error(), accessTokenStatus(err))
+			return false
+		}
+	}
+	return true
+}
+
+// handleAbortSession discards a publish session:
+// DELETE /api/rooms/{roomID}/sessions/{id}
+func (s *Server) handleAbortSession(w http.ResponseWriter, r *http.Request) {
+	roomID, err := s.resolveRoomID(r.PathValue("roomID"))
+	if err != nil {
+		http.Error(w, err.Error(), roomIDStatus(err))
+		return
+	}
+	if !s.authorizeSessionRequest(w, r, roomID, nil) {
+		return
+	}
+	id := r.PathValue("id")
+	if !s.publishSessions.abort(roomID, id) {
+		http.Error(w, errSessionNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "aborted": id})
+}
@@ -0,0 +1,160 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openSession opens a publish session for room on ts, sending header, and
+// returns its URL.
+func openSession(t testing.TB, ts *httptest.Server, room string, header http.Header) string {
+	t.Helper()
+	code, body := request(t, http.MethodPost, ts.URL+"/api/rooms/"+room+"/sessions", "", header)
+	if code != http.StatusCreated {
+		t.Fatalf("opening a session: %d %s", code, body)
+	}
+	var opened struct {
+		Session string `json:"session"`
+	}
+	if err := json.Unmarshal([]byte(body), &opened); err != nil {
+		t.Fatal(err)
+	}
+	return ts.URL + "/api/rooms/" + room + "/sessions/" + opened.Session
+}
+
+func TestPublishSession(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	session := openSession(t, ts, "assembled", nil)
+	for _, part := range []string{"first half, ", "second half"} {
+		if code, body := request(t, http.MethodPost, session+"/parts", part, nil); code != http.StatusOK {
+			t.Fatalf("adding a part: %d %s", code, body)
+		}
+	}
+	if got := latest(t, ts, "assembled"); got != "" {
+		t.Fatalf("published %q before the commit", got)
+	}
+	if code, body := request(t, http.MethodPost, session+"/commit", "", nil); code != http.StatusOK {
+		t.Fatalf("committing: %d %s", code, body)
+	}
+	if got := latest(t, ts, "assembled"); got != "first half, second half" {
+		t.Errorf("latest = %q, want the assembled parts", got)
+	}
+	if code, _ := request(t, http.MethodPost, session+"/commit", "", nil); code != http.StatusNotFound {
+		t.Errorf("committing again: status %d, want 404", code)
+	}
+}
+
+func TestPublishSessionTooLarge(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxSessionBytes = 10
+	_, ts := newTestServer(t, opts)
+
+	session := openSession(t, ts, "capped", nil)
+	if code, body := request(t, http.MethodPost, session+"/parts", "123456", nil); code != http.StatusOK {
+		t.Fatalf("adding a part: %d %s", code, body)
+	}
+	if code, body := request(t, http.MethodPost, session+"/parts", "789012", nil); code != http.StatusRequestEntityTooLarge || !strings.Contains(body, "aborted") {
+		t.Errorf("a part past the cap: %d %s, want 413", code, body)
+	}
+	// The session is gone, along with what it had assembled.
+	if code, _ := request(t, http.MethodPost, session+"/parts", "1", nil); code != http.StatusNotFound {
+		t.Errorf("adding to the aborted session: status %d, want 404", code)
+	}
+	if code, _ := request(t, http.MethodPost, session+"/commit", "", nil); code != http.StatusNotFound {
+		t.Errorf("committing the aborted session: status %d, want 404", code)
+	}
+	if got := latest(t, ts, "capped"); got != "" {
+		t.Errorf("latest = %q, want nothing published", got)
+	}
+
+	// A single part over the cap aborts the session too.
+	session = openSession(t, ts, "capped", nil)
+	if code, body := request(t, http.MethodPost, session+"/parts", strings.Repeat("x", 11), nil); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("a part over the cap: %d %s, want 413", code, body)
+	}
+	if code, _ := request(t, http.MethodPost, session+"/commit", "", nil); code != http.StatusNotFound {
+		t.Errorf("committing the aborted session: status %d, want 404", code)
+	}
+}
+
+func TestPublishSessionSignature(t *testing.T) {
+	const key = "test-hmac-key"
+	opts := DefaultOptions()
+	opts.PublishHMACKey = key
+	_, ts := newTestServer(t, opts)
+	sign := func(target, body string) http.Header {
+		return signPublish(key, http.MethodPost, strings.TrimPrefix(target, ts.URL), body, time.Now())
+	}
+
+	if code, body := request(t, http.MethodPost, ts.URL+"/api/rooms/signed/sessions", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("opening an unsigned session: %d %s, want 401", code, body)
+	}
+
+	// Every request of a session is signed, the commit over the whole
+	// message.
+	session := openSession(t, ts, "signed", sign(ts.URL+"/api/rooms/signed/sessions", ""))
+	if code, body := request(t, http.MethodPost, session+"/parts", "unsigned", nil); code != http.StatusUnauthorized {
+		t.Errorf("adding an unsigned part: %d %s, want 401", code, body)
+	}
+	for _, part := range []string{"first half, ", "second half"} {
+		if code, body := request(t, http.MethodPost, session+"/parts", part, sign(session+"/parts", part)); code != http.StatusOK {
+			t.Fatalf("adding a signed part: %d %s", code, body)
+		}
+	}
+	if code, body := request(t, http.MethodDelete, session, "", nil); code != http.StatusUnauthorized {
+		t.Errorf("discarding the session unsigned: %d %s, want 401", code, body)
+	}
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+	}{
+		{"missing", nil},
+		{"over the last part", sign(session+"/commit", "second half")},
+	} {
+		if code, body := request(t, http.MethodPost, session+"/commit", "", tt.header); code != http.StatusUnauthorized {
+			t.Errorf("committing with the signature %s: %d %s, want 401", tt.name, code, body)
+		}
+		if got := latest(t, ts, "signed"); got != "" {
+			t.Fatalf("latest = %q after an unsigned commit, want nothing published", got)
+		}
+	}
+
+	// Failed commits leave the session open.
+	if code, body := request(t, http.MethodPost, session+"/commit", "", sign(session+"/commit", "first half, second half")); code != http.StatusOK {
+		t.Fatalf("committing: %d %s", code, body)
+	}
+	if got := latest(t, ts, "signed"); got != "first half, second half" {
+		t.Errorf("latest = %q, want the signed message", got)
+	}
+}
+
+func TestPublishSessionAccessToken(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	bearer := http.Header{"Authorization": {"Bearer secret"}}
+	session := openSession(t, ts, "locked", nil)
+	if code, body := publish(t, ts, "locked", "first", url.Values{"token": {"secret"}}); code != http.StatusOK {
+		t.Fatalf("claiming the room: %d %s", code, body)
+	}
+
+	// Once the room is locked, each request of a session needs its token.
+	if code, body := request(t, http.MethodPost, ts.URL+"/api/rooms/locked/sessions", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("opening a session without the token: %d %s, want 401", code, body)
+	}
+	if code, body := request(t, http.MethodPost, session+"/parts", "sneaked in", nil); code != http.StatusUnauthorized {
+		t.Errorf("adding a part without the token: %d %s, want 401", code, body)
+	}
+	if code, body := request(t, http.MethodPost, session+"/parts", "with the token", bearer); code != http.StatusOK {
+		t.Fatalf("adding a part with the token: %d %s", code, body)
+	}
+	if code, body := request(t, http.MethodPost, session+"/commit", "", bearer); code != http.StatusOK {
+		t.Fatalf("committing: %d %s", code, body)
+	}
+	if code, got := request(t, http.MethodGet, ts.URL+"/api/rooms/locked/latest", "", bearer); code != http.StatusOK || got != "with the token" {
+		t.Errorf("latest = %d %q, want only the part sent with the token", code, got)
+	}
+}
@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// Shutdown stops the HTTP servers serving s from accepting connections, ends
+// SSE streams and waits for in-flight publishes to complete. It then closes
+// every room, which sends WebSocket subscribers a going-away close frame once
+// they've been sent the messages already queued for them, and waits for the
+// messages the rooms retained to be persisted. Connections still open when
+// ctx is done are closed forcibly. The server can't be used again
+// afterwards.
+func (s *Server) Shutdown(ctx context.Context, servers ...*http.Server) {
+	if !s.shuttingDown.CompareAndSwap(false, true) {
+		return
+	}
+	close(s.shutdownStarted)
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Go(func() {
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+			}
+		})
+	}
+	wg.Wait()
+
+	for _, room := range append(s.rooms.all(), s.directoryRoom()) {
+		wg.Go(func() {
+			room.close(0)
+		})
+	}
+	wg.Wait()
+
+	// Let the messages the rooms retained reach the Persister.
+	persisted := make(chan struct{})
+	go func() {
+		s.persisting.Wait()
+		close(persisted)
+	}()
+	select {
+	case <-persisted:
+	case <-ctx.Done():
+		s.log.Warn("shutdown: gave up waiting for messages to be persisted")
+	}
+
+	// Hijacked connections aren't tracked by the servers, so wait for the
+	// write pumps to finish their close handshakes.
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for s.wsConnections.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.log.Warn("shutdown: force-closing remaining WebSocket connections", "connections", s.wsConnections.Load())
+			s.clientIndex.closeConnections()
+			return
+		}
+	}
+}
+
+// closeHandshake sends the client a close frame, going-away during a
+// shutdown and try-again-later during maintenance, and waits up to
+// CloseTimeout for the client to answer it before the connection is dropped.
+func (c *Client) closeHandshake() {
+	var message []byte
+	if c.room.srv.shuttingDown.Load() {
+		message = websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	} else if c.room.srv.maintenance.Load() {
+		message = websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "maintenance")
+	} else if c.kicked.Load() {
+		message = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "kicked by an administrator")
+	}
+	c.sendClose(message)
+}
+
+// sendClose sends the client a close frame with the given payload and waits
+// up to CloseTimeout for the client to answer it.
+func (c *Client) sendClose(message []byte) {
+	if err := c.conn.WriteMessage(websocket.CloseMessage, message); err != nil {
+		return
+	}
+
+	timer := time.NewTimer(c.room.srv.opts.CloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-c.readDone:
+	case <-timer.C:
+	}
+}
+
+// closeConnections closes the underlying connection of every WebSocket client.
+func (ci *ClientIndex) closeConnections() {
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+
+	for _, clients := range ci.byIP {
+		for c := range clients {
+			if c.conn != nil {
+				c.conn.Close()
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdownCloseTimeout(t *testing.T) {
+	const closeTimeout = 500 * time.Millisecond
+	for _, unresponsive := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.CloseTimeout = closeTimeout
+		s, ts := newTestServer(t, opts)
+
+		// A responsive client reads, and so answers the close frame.
+		responsive := dialWS(t, ts, "/ws/closing", nil)
+		closed := make(chan error, 1)
+		go func() {
+			for {
+				if _, _, err := responsive.ReadMessage(); err != nil {
+					closed <- err
+					return
+				}
+			}
+		}()
+		// An unresponsive one never reads.
+		clients := 1
+		if unresponsive {
+			dialWS(t, ts, "/ws/closing", nil)
+			clients++
+		}
+		waitForClients(t, waitForRoom(t, s, "closing"), clients)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		start := time.Now()
+		s.Shutdown(ctx, ts.Config)
+		elapsed := time.Since(start)
+		cancel()
+
+		if err := <-closed; !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("unresponsive %t: the responsive client got %v, want a going-away close", unresponsive, err)
+		}
+		if unresponsive {
+			// Shutdown gives up on the client after CloseTimeout.
+			if elapsed < closeTimeout-50*time.Millisecond || elapsed > closeTimeout+time.Second {
+				t.Errorf("shutdown with an unresponsive client took %v, want about %v", elapsed, closeTimeout)
+			}
+		} else if elapsed > closeTimeout/2 {
+			t.Errorf("shutdown with only a responsive client took %v", elapsed)
+		}
+		if n := s.wsConnections.Load(); n != 0 {
+			t.Errorf("unresponsive %t: %d connections left open", unresponsive, n)
+		}
+	}
+}
+
+func TestShutdownGoingAway(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	conn := dialWS(t, ts, "/ws/draining", nil)
+	room := waitForRoom(t, s, "draining")
+	waitForClients(t, room, 1)
+
+	// Messages queued before the shutdown are delivered ahead of the close.
+	for i := range 5 {
+		if err := s.Publish("draining", []byte(fmt.Sprint("message ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.Shutdown(ctx, ts.Config)
+
+	for i := range 5 {
+		if _, message, err := conn.ReadMessage(); err != nil || string(message) != fmt.Sprint("message ", i) {
+			t.Fatalf("message %d: %q (%v)", i, message, err)
+		}
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("after the messages: %v, want a going-away close", err)
+	}
+
+	// New subscribers and publishers are turned away.
+	if _, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/draining", nil); err == nil {
+		t.Error("a subscriber connected after the shutdown")
+	}
+	if err := s.Publish("draining", []byte("late")); err == nil {
+		t.Error("a publish was accepted after the shutdown")
+	}
+}
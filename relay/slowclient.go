@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"encoding/json"
+	"slices"
+)
+
+// slowClientPolicies are what a room can do with a subscriber whose send
+// buffer is full: disconnect it, drop its oldest queued message or the new
+// one, or coalesce what is queued into the new message.
+var slowClientPolicies = []string{"disconnect", "drop_oldest", "drop_newest", "coalesce"}
+
+func validSlowClientPolicy(policy string) bool {
+	return slices.Contains(slowClientPolicies, policy)
+}
+
+// droppedEvent tells a subscriber that messages meant for it were dropped
+// because it wasn't keeping up.
+type droppedEvent struct {
+	Type    string `json:"type"`
+	Dropped int    `json:"dropped"`
+}
+
+// slowClientPolicy returns the room's current slow client policy.
+func (r *Room) slowClientPolicy() string {
+	if p := r.slowClient.Load(); p != nil {
+		return *p
+	}
+	return r.srv.opts.SlowClient
+}
+
+// overflow applies the room's slow client policy to message, which doesn't
+// fit in the client's full send buffer, reporting false if the client must
+// be disconnected.
+func (c *Client) overflow(message []byte) bool {
+	switch c.room.slowClientPolicy() {
+	case "drop_newest":
+		c.dropped++
+	case "drop_oldest":
+		// The room is the only sender, so the freed slot stays free.
+		select {
+		case <-c.send:
+			c.dropped++
+		default:
+		}
+		c.send <- message
+	case "coalesce":
+		for len(c.send) > 0 {
+			select {
+			case <-c.send:
+				c.dropped++
+			default:
+			}
+		}
+		c.warnDropped()
+		c.send <- message
+	default:
+		return false
+	}
+	c.undelivered.Store(true)
+	return true
+}
+
+// warnDropped queues a droppedEvent for the messages dropped since the
+// client was last warned, if there is room for it ahead of one more message.
+func (c *Client) warnDropped() {
+	if c.dropped == 0 || len(c.send) >= cap(c.send)-1 {
+		return
+	}
+	event, _ := json.Marshal(droppedEvent{Type: "messages_dropped", Dropped: c.dropped})
+	c.send <- event
+	c.dropped = 0
+}
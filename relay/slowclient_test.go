@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestSlowClientPolicies(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	dropped := func(n int) string { return fmt.Sprintf(`{"type":"messages_dropped","dropped":%d}`, n) }
+
+	for _, tt := range []struct {
+		policy string
+		// full is what a subscriber with a buffer of two holds after three
+		// messages, and then what it gets after a fourth.
+		full, then []string
+	}{
+		{"drop_newest", []string{"1", "2"}, []string{dropped(1), "4"}},
+		{"drop_oldest", []string{"2", "3"}, []string{dropped(1), "4"}},
+		{"coalesce", []string{dropped(2), "3"}, []string{"4"}},
+		{"disconnect", []string{"1", "2"}, nil},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			name := "slow-" + tt.policy
+			if code, body := admin(t, ts, http.MethodPut, "/api/rooms/"+name, `{"slow_client":"`+tt.policy+`"}`); code != http.StatusCreated {
+				t.Fatalf("creating the room: %d %s", code, body)
+			}
+			room := waitForRoom(t, s, name)
+			client := joinTestClient(t, room, 2)
+			publishSync := func(contents ...string) {
+				t.Helper()
+				for _, content := range contents {
+					if err := s.Publish(name, []byte(content)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				room.do(func() {})
+			}
+
+			publishSync("1", "2", "3")
+			if got := received(client); !slices.Equal(got, tt.full) {
+				t.Errorf("with a full buffer, received %q, want %q", got, tt.full)
+			}
+			var joined bool
+			room.do(func() { joined = room.clients[client] })
+			if joined != (tt.policy != "disconnect") {
+				t.Errorf("subscriber still in the room: %t", joined)
+			}
+			if !joined {
+				return
+			}
+			// The subscriber is told how many messages it missed once its
+			// buffer has room.
+			publishSync("4")
+			if got := received(client); !slices.Equal(got, tt.then) {
+				t.Errorf("once the buffer had room, received %q, want %q", got, tt.then)
+			}
+		})
+	}
+
+	if code, body := admin(t, ts, http.MethodPut, "/api/rooms/slow-invalid", `{"slow_client":"ignore"}`); code != http.StatusBadRequest {
+		t.Errorf("an unknown policy: %d %s, want 400", code, body)
+	}
+	opts.SlowClient = "ignore"
+	if err := opts.validate(); err == nil {
+		t.Error("validate accepted an unknown slow client policy")
+	}
+}
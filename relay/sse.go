@@ -0,0 +1,233 @@
+package relay
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var errTooManySSEConnections = errors.New("too many SSE connections")
+
+// ServeSSE streams a room's broadcasts as Server-Sent Events: GET /sse/{roomID}
+// SSE subscribers are registered with the room like WebSocket clients and
+// count against the same limits.
+func (s *Server) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	roomID, err := s.resolveRoomID(r.PathValue("roomID"))
+	if err != nil {
+		http.Error(w, err.Error(), roomIDStatus(err))
+		return
+	}
+
+	quota, err := s.authorizeSubscriber(r, roomID)
+	if err != nil {
+		http.Error(w, err.Error(), authStatus(err))
+		return
+	}
+
+	template, err := s.subscriberTemplate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	group, err := requestGroup(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name, err := requestPresenceName(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	topics, err := requestTopics(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	maxStale, err := requestMaxStale(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tags, err := s.connectionTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lastEventID, err := requestLastEventID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.allowReconnect(w, r) {
+		return
+	}
+
+	if n := s.sseConnections.Add(1); s.opts.MaxSSEConnections > 0 && n > int64(s.opts.MaxSSEConnections) {
+		s.sseConnections.Add(-1)
+		s.metrics.connectionRejections.Add(1)
+		http.Error(w, errTooManySSEConnections.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer s.sseConnections.Add(-1)
+
+	room, err := s.rooms.openRoom(roomID)
+	if err != nil {
+		http.Error(w, err.Error(), openRoomStatus(err))
+		return
+	}
+	if err := room.admitsSubscriber(requestToken(r)); err != nil {
+		http.Error(w, err.Error(), accessTokenStatus(err))
+		return
+	}
+	if !s.tokenConnections.acquire(quota) {
+		http.Error(w, errQuotaExceeded.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer s.tokenConnections.release(quota)
+	if err := s.admit(room, quota); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer s.release(room, quota)
+
+	// The stream outlives the server's read and write timeouts; writes get
+	// their own deadlines below.
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	client := &Client{
+		room:        room,
+		send:        make(chan []byte, room.sendBufferSize()),
+		id:          newConnectionID(),
+		ip:          remoteIP(r),
+		remoteAddr:  r.RemoteAddr,
+		connectedAt: time.Now(),
+		wantsStats:  r.URL.Query().Get("stats") == "1",
+		template:    template,
+		delta:       r.URL.Query().Get("delta") == "1",
+		group:       group,
+		name:        name,
+		topics:      topics,
+		maxStale:    maxStale,
+		tags:        tags,
+		accessToken: requestToken(r),
+		clientID:    r.URL.Query().Get("client_id"),
+		envelope:    wantsEnvelope(r),
+		sse:         true,
+		lastEventID: lastEventID,
+	}
+	if !room.join(client) {
+		// The room was closed while the client was connecting.
+		return
+	}
+	s.clientIndex.add(client)
+	s.tagGauges.add(client.tags)
+	defer func() {
+		room.leave(client)
+		s.clientIndex.remove(client)
+		s.tagGauges.remove(client.tags)
+	}()
+
+	client.streamEvents(r.Context(), w, rc)
+}
+
+// streamEvents writes the client's messages as events until the room drops the
+// client, the request is canceled or a write fails. Comments are sent during
+// quiet periods to keep proxies from closing the stream.
+func (c *Client) streamEvents(ctx context.Context, w io.Writer, rc *http.ResponseController) {
+	var ticker *time.Ticker
+	var keepalive <-chan time.Time
+	if c.room.srv.opts.SSEKeepalive > 0 {
+		ticker = time.NewTicker(c.room.srv.opts.SSEKeepalive)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	idle := newIdleTimer(c.room.srv.opts.SubscriberIdleTimeout)
+	defer idle.stop()
+	for {
+		var err error
+		select {
+		case message, ok := <-c.send:
+			if !ok {
+				return
+			}
+			rc.SetWriteDeadline(time.Now().Add(writeWait))
+			var n int
+			n, err = w.Write(message)
+			c.bytesSent.Add(int64(n))
+			if ticker != nil {
+				ticker.Reset(c.room.srv.opts.SSEKeepalive)
+			}
+			idle.reset()
+		case <-keepalive:
+			rc.SetWriteDeadline(time.Now().Add(writeWait))
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		case <-idle.C:
+			return
+		case <-ctx.Done():
+			return
+		case <-c.room.srv.shutdownStarted:
+			return
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			c.undelivered.Store(true)
+			return
+		}
+	}
+}
+
+// sseEvent returns message as a single event, one data field per line, with
+// id as the event's ID unless it is zero.
+func sseEvent(message []byte, id uint64) []byte {
+	var buf bytes.Buffer
+	if id != 0 {
+		buf.WriteString("id: " + strconv.FormatUint(id, 10) + "\n")
+	}
+	for line := range bytes.Lines(message) {
+		buf.WriteString("data: ")
+		buf.Write(bytes.TrimRight(line, "\r\n"))
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// requestLastEventID returns the ID of the last event an SSE subscriber
+// received before reconnecting, from the Last-Event-ID header browsers send
+// when they reconnect or the last_event_id query parameter, or 0 if it sent
+// none.
+func requestLastEventID(r *http.Request) (uint64, error) {
+	v := cmp.Or(r.Header.Get("Last-Event-ID"), r.URL.Query().Get("last_event_id"))
+	if v == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid Last-Event-ID")
+	}
+	return id, nil
+}
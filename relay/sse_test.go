@@ -0,0 +1,198 @@
+package relay
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// openSSE subscribes to the SSE endpoint at path on ts, e.g. "/sse/room1", and
+// returns the response, whose body is closed when the test ends.
+func openSSE(t testing.TB, ts *httptest.Server, path string) *http.Response {
+	t.Helper()
+	res, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+// readEvent reads the data of the next event from an SSE stream, skipping
+// comments and other fields.
+func readEvent(t testing.TB, stream *bufio.Reader) string {
+	t.Helper()
+	_, data := readEventWithID(t, stream)
+	return data
+}
+
+// readEventWithID reads the ID and data of the next event from an SSE stream,
+// skipping comments and other fields. The ID is "" if the event has none.
+func readEventWithID(t testing.TB, stream *bufio.Reader) (id, data string) {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading an event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && lines != nil {
+			return id, strings.Join(lines, "\n")
+		}
+		if v, ok := strings.CutPrefix(line, "data: "); ok {
+			lines = append(lines, v)
+		} else if v, ok := strings.CutPrefix(line, "id: "); ok {
+			id = v
+		}
+	}
+}
+
+func TestSSE(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	res := openSSE(t, ts, "/sse/events")
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, Content-Type %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	room := waitForRoom(t, s, "events")
+	waitForClients(t, room, 1)
+
+	if code, body := publish(t, ts, "events", "line one\nline two", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if got, want := readEvent(t, bufio.NewReader(res.Body)), "line one\nline two"; got != want {
+		t.Errorf("event data %q, want %q", got, want)
+	}
+}
+
+func TestRoomLimitAcrossTransports(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxRoomClients = 2
+	s, ts := newTestServer(t, opts)
+	room := "mixed"
+
+	sse := openSSE(t, ts, "/sse/"+room)
+	if sse.StatusCode != http.StatusOK {
+		t.Fatalf("SSE subscriber: status %d", sse.StatusCode)
+	}
+	dialWS(t, ts, "/ws/"+room, nil)
+	r := waitForRoom(t, s, room)
+	eventually(t, "both subscribers to join", func() bool { return r.members.Load() == 2 })
+
+	// The room is full for either transport.
+	if res := openSSE(t, ts, "/sse/"+room); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("third subscriber over SSE: status %d, want 503", res.StatusCode)
+	}
+	// WebSocket subscribers are turned away with a close frame.
+	_, _, err := dialWS(t, ts, "/ws/"+room, nil).ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Errorf("third subscriber over WebSocket: %v, want a try again later close", err)
+	}
+
+	// Leaving over SSE makes room for a WebSocket subscriber.
+	sse.Body.Close()
+	eventually(t, "the SSE subscriber to leave", func() bool { return r.members.Load() == 1 })
+	dialWS(t, ts, "/ws/"+room, nil)
+}
+
+func TestMaxSSEConnections(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxSSEConnections = 2
+	s, ts := newTestServer(t, opts)
+
+	for i := range 2 {
+		if res := openSSE(t, ts, "/sse/room1"); res.StatusCode != http.StatusOK {
+			t.Fatalf("SSE subscriber %d: status %d", i, res.StatusCode)
+		}
+	}
+	if res := openSSE(t, ts, "/sse/room2"); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("SSE subscriber beyond the cap: status %d, want 503", res.StatusCode)
+	}
+	// WebSocket subscribers aren't subject to it.
+	dialWS(t, ts, "/ws/room1", nil)
+	room := waitForRoom(t, s, "room1")
+	eventually(t, "the WebSocket subscriber to join", func() bool { return room.members.Load() == 3 })
+}
+
+func TestSSEKeepalive(t *testing.T) {
+	const keepalive = 50 * time.Millisecond
+	opts := DefaultOptions()
+	opts.SSEKeepalive = keepalive
+	_, ts := newTestServer(t, opts)
+	stream := bufio.NewReader(openSSE(t, ts, "/sse/quiet").Body)
+
+	start := time.Now()
+	for i := 1; i <= 3; i++ {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != ": keepalive\n" {
+			t.Fatalf("line %q during a quiet period, want a keepalive comment", line)
+		}
+		if elapsed := time.Since(start); elapsed < time.Duration(i)*keepalive-10*time.Millisecond {
+			t.Errorf("keepalive %d after %v, want one every %v", i, elapsed, keepalive)
+		}
+		// Skip the blank line ending the comment.
+		stream.ReadString('\n')
+	}
+}
+
+func TestSSELastEventID(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HistorySize = 10
+	opts.PublishRate = 0
+	_, ts := newTestServer(t, opts)
+	for _, content := range []string{"one", "two", "three"} {
+		if code, body := publish(t, ts, "resumable", content, nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+	}
+
+	// Events carry their sequence number as their ID.
+	stream := bufio.NewReader(openSSE(t, ts, "/sse/resumable").Body)
+	var ids []string
+	for _, want := range []string{"one", "two", "three"} {
+		id, data := readEventWithID(t, stream)
+		if data != want || id == "" {
+			t.Fatalf("event %q with ID %q, want %q with an ID", data, id, want)
+		}
+		ids = append(ids, id)
+	}
+
+	// Reconnecting after an event replays only the history after it, whether
+	// the ID comes from EventSource's header or the query.
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/sse/resumable", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", ids[0])
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	resumed := bufio.NewReader(res.Body)
+	for i, want := range []string{"two", "three"} {
+		if id, data := readEventWithID(t, resumed); data != want || id != ids[i+1] {
+			t.Errorf("resuming after %s: event %q with ID %s, want %q with ID %s", ids[0], data, id, want, ids[i+1])
+		}
+	}
+	if id, data := readEventWithID(t, bufio.NewReader(openSSE(t, ts, "/sse/resumable?last_event_id="+ids[1]).Body)); data != "three" || id != ids[2] {
+		t.Errorf("resuming with last_event_id=%s: event %q with ID %s, want three", ids[1], data, id)
+	}
+
+	// An ID beyond the room's latest, from before a restart, gets the whole
+	// history.
+	if data := readEvent(t, bufio.NewReader(openSSE(t, ts, "/sse/resumable?last_event_id=1000").Body)); data != "one" {
+		t.Errorf("resuming from an unknown ID: first event %q, want one", data)
+	}
+	if res := openSSE(t, ts, "/sse/resumable?last_event_id=latest"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("an invalid ID: status %d, want 400", res.StatusCode)
+	}
+}
@@ -0,0 +1,156 @@
+package relay
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// maxImportSize bounds the state document accepted by /admin/import.
+const maxImportSize = 256 << 20
+
+// relayState is the exported state of the relay: its rooms with their retained
+// content and settings. Client connections are not part of it.
+type relayState struct {
+	Rooms []roomState `json:"rooms"`
+}
+
+// roomState is the exported state of a single room.
+type roomState struct {
+	Name        string   `json:"name"`
+	LastContent []byte   `json:"last_content,omitempty"`
+	History     [][]byte `json:"history,omitempty"`
+	Meta        roomMeta `json:"meta"`
+	MirrorTo    []string `json:"mirror_to,omitempty"`
+	// MirrorToLive are the mirror targets that don't retain the copies.
+	MirrorToLive []string `json:"mirror_to_live,omitempty"`
+	// MirrorToURLs are the room's remote mirrors.
+	MirrorToURLs []string `json:"mirror_to_urls,omitempty"`
+	// Bridges are the bridges the room dials to upstream relays.
+	Bridges []bridgeConfig `json:"bridges,omitempty"`
+	// Schema is the room's JSON Schema, if it has one.
+	Schema json.RawMessage `json:"schema,omitempty"`
+}
+
+// state returns a snapshot of the room's retained content and settings.
+func (r *Room) state() roomState {
+	state := roomState{
+		Name:         r.name,
+		Meta:         r.meta(),
+		MirrorTo:     r.srv.rooms.mirrorNames(r.name, true),
+		MirrorToLive: r.srv.rooms.mirrorNames(r.name, false),
+		MirrorToURLs: r.srv.remoteMirrors.urls(r.name),
+		Bridges:      r.srv.bridges.configs(r.name),
+	}
+	if schema := r.schema.Load(); schema != nil {
+		state.Schema = schema.source
+	}
+	var lastContent retainedMessage
+	var history []retainedMessage
+	r.do(func() {
+		r.expireContent(time.Now())
+		lastContent = r.lastContent
+		history = slices.Clone(r.history.messages)
+	})
+	state.LastContent = lastContent.content()
+	for _, message := range history {
+		state.History = append(state.History, message.content())
+	}
+	return state
+}
+
+// restore replaces the room's retained content and settings with state.
+func (r *Room) restore(state roomState) {
+	r.applyMeta(state.Meta)
+	r.schema.Store(nil)
+	if len(state.Schema) > 0 {
+		// Validated by handleImport.
+		schema, _ := compileSchema(state.Schema)
+		r.schema.Store(schema)
+	}
+	r.do(func() {
+		r.lastContent = r.retain(state.LastContent)
+		r.lastContentTime = time.Now()
+		r.lastContentHash = ""
+		if len(state.LastContent) > 0 {
+			sum := sha256.Sum256(state.LastContent)
+			r.lastContentHash = hex.EncodeToString(sum[:])
+		}
+		r.history.clear()
+		// Publishers aren't exported, so restored messages count against
+		// no publisher's quota.
+		for _, message := range state.History {
+			r.history.add(r.retain(message), "")
+		}
+	})
+}
+
+// handleExport serves the relay's state as JSON: GET /admin/export
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	state := relayState{Rooms: []roomState{}}
+	for _, room := range s.rooms.all() {
+		state.Rooms = append(state.Rooms, room.state())
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="relay-state.json"`)
+	writeJSON(w, http.StatusOK, state)
+}
+
+// handleImport recreates rooms from a document produced by /admin/export:
+// POST /admin/import
+// Existing rooms named in the document have their retained content replaced.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	var state relayState
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportSize)).Decode(&state); err != nil {
+		http.Error(w, "Invalid state: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, room := range state.Rooms {
+		if room.Name == "" {
+			http.Error(w, "Invalid state: room without a name", http.StatusBadRequest)
+			return
+		}
+		if err := room.Meta.validate(); err != nil {
+			http.Error(w, "Invalid state: "+room.Name+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(room.Schema) > 0 {
+			if _, err := compileSchema(room.Schema); err != nil {
+				http.Error(w, "Invalid state: "+room.Name+": invalid schema: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, bridge := range room.Bridges {
+			if err := bridge.validate(); err != nil {
+				http.Error(w, "Invalid state: "+room.Name+": bridge: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	for _, room := range state.Rooms {
+		s.rooms.getRoom(room.Name).restore(room)
+	}
+	// Mirrors are added once every room exists; ones that would form a cycle
+	// with mirrors already configured here are skipped.
+	for _, room := range state.Rooms {
+		for _, target := range room.MirrorTo {
+			s.rooms.addMirror(room.Name, target, true)
+		}
+		for _, target := range room.MirrorToLive {
+			s.rooms.addMirror(room.Name, target, false)
+		}
+		for _, target := range room.MirrorToURLs {
+			s.remoteMirrors.add(room.Name, target)
+		}
+		for _, bridge := range room.Bridges {
+			s.bridges.add(room.Name, bridge.URL, cmp.Or(bridge.Direction, "both"))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"rooms": len(state.Rooms)})
+}
@@ -0,0 +1,76 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HistorySize = 5
+	opts.PublishRate = 0
+	_, from := newTestServer(t, opts)
+	for _, m := range []struct{ room, content string }{{"alpha", "a1"}, {"alpha", "a2"}, {"beta", "b1"}} {
+		if code, body := publish(t, from, m.room, m.content, nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+	}
+	if code, body := admin(t, from, http.MethodPost, "/api/rooms/beta/meta", `{"max_retain_bytes":100}`); code != http.StatusOK {
+		t.Fatalf("setting beta's meta: %d %s", code, body)
+	}
+
+	if code, _ := request(t, http.MethodGet, from.URL+"/admin/export", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("export without the admin token: status %d, want 401", code)
+	}
+	code, state := admin(t, from, http.MethodGet, "/admin/export", "")
+	if code != http.StatusOK {
+		t.Fatalf("export: %d %s", code, state)
+	}
+
+	to, ts := newTestServer(t, opts)
+	if code, body := admin(t, ts, http.MethodPost, "/admin/import", state); code != http.StatusOK {
+		t.Fatalf("import: %d %s", code, body)
+	}
+	for room, want := range map[string]string{"alpha": "a2", "beta": "b1"} {
+		if got := latest(t, ts, room); got != want {
+			t.Errorf("%s: latest = %q, want %q", room, got, want)
+		}
+	}
+
+	code, body := request(t, http.MethodGet, ts.URL+"/api/rooms/alpha/replay", "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("replay: %d %s", code, body)
+	}
+	var replay struct {
+		Messages []string `json:"messages"`
+	}
+	if err := json.Unmarshal([]byte(body), &replay); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a1", "a2"}; !slices.Equal(replay.Messages, want) {
+		t.Errorf("alpha's history = %q, want %q", replay.Messages, want)
+	}
+
+	beta, ok := to.rooms.lookupRoom("beta")
+	if !ok {
+		t.Fatal("beta wasn't restored")
+	}
+	if got := beta.maxRetainBytes.Load(); got != 100 {
+		t.Errorf("beta's max_retain_bytes = %d, want 100", got)
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	for _, state := range []string{
+		`not json`,
+		`{"rooms":[{"last_content":"aGk="}]}`,
+		`{"rooms":[{"name":"room1","meta":{"max_retain_bytes":-1}}]}`,
+	} {
+		if code, body := admin(t, ts, http.MethodPost, "/admin/import", state); code != http.StatusBadRequest {
+			t.Errorf("importing %s: %d %s, want 400", state, code, body)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package relay
+
+import (
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// frontendFiles are the files of the frontend served next to its page at /.
+// Other paths name rooms.
+var frontendFiles = []string{"index.html", "style.css", "app.js", "qrcode.min.js"}
+
+// newStaticHandler returns the handler serving the frontend: from StaticDir
+// if it is set, else from Static, or nil if there is neither.
+func newStaticHandler(opts Options) http.Handler {
+	files := opts.Static
+	if opts.StaticDir != "" {
+		files = os.DirFS(opts.StaticDir)
+	}
+	if files == nil {
+		return nil
+	}
+	return http.FileServerFS(files)
+}
+
+// servesStatic reports whether the request is for the frontend rather than a
+// room.
+func (s *Server) servesStatic(r *http.Request) bool {
+	if s.static == nil {
+		return false
+	}
+	return r.URL.Path == "/" || slices.Contains(frontendFiles, strings.TrimPrefix(r.URL.Path, "/"))
+}
@@ -0,0 +1,59 @@
+package relay
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestStatic(t *testing.T) {
+	embedded := fstest.MapFS{
+		"index.html": {Data: []byte("<h1>embedded</h1>")},
+		"app.js":     {Data: []byte("// embedded")},
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>on disk</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		static    fstest.MapFS
+		staticDir string
+		index     string
+	}{
+		{"embedded", embedded, "", "<h1>embedded</h1>"},
+		{"directory", embedded, dir, "<h1>on disk</h1>"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Static = tt.static
+			opts.StaticDir = tt.staticDir
+			_, ts := newTestServer(t, opts)
+			for _, path := range []string{"/", "/index.html"} {
+				if code, body := request(t, http.MethodGet, ts.URL+path, "", nil); code != http.StatusOK || body != tt.index {
+					t.Errorf("GET %s: %d %q, want %q", path, code, body, tt.index)
+				}
+			}
+		})
+	}
+
+	// Other paths still name rooms.
+	opts := DefaultOptions()
+	opts.Static = embedded
+	_, ts := newTestServer(t, opts)
+	if code, body := request(t, http.MethodGet, ts.URL+"/app.js", "", nil); code != http.StatusOK || body != "// embedded" {
+		t.Errorf("GET /app.js: %d %q", code, body)
+	}
+	if code, body := publish(t, ts, "index", "not a file", nil); code != http.StatusOK {
+		t.Errorf("publish to a room: %d %s", code, body)
+	}
+
+	// Without either, there is no frontend.
+	_, ts = newTestServer(t, DefaultOptions())
+	if code, body := request(t, http.MethodGet, ts.URL+"/", "", nil); code == http.StatusOK {
+		t.Errorf("GET / without a frontend: %d %q", code, body)
+	}
+}
@@ -0,0 +1,228 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var errLineTooLong = errors.New("line too long")
+
+// RoomStreams counts the streaming publishes to each room, by name, so that
+// the count survives the room being reaped and recreated mid-stream.
+type RoomStreams struct {
+	counts map[string]int
+	max    int
+	mu     sync.Mutex
+}
+
+func newRoomStreams(max int) *RoomStreams {
+	return &RoomStreams{
+		counts: make(map[string]int),
+		max:    max,
+	}
+}
+
+// acquire counts a stream to room, reporting false if the room already has
+// the maximum number of streams.
+func (rs *RoomStreams) acquire(room string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.max > 0 && rs.counts[room] >= rs.max {
+		return false
+	}
+	rs.counts[room]++
+	return true
+}
+
+// release uncounts a stream acquired for room.
+func (rs *RoomStreams) release(room string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.counts[room]--; rs.counts[room] <= 0 {
+		delete(rs.counts, room)
+	}
+}
+
+// handlePublishStream publishes each line of the request body as a message,
+// as the lines arrive: POST /api/rooms/{roomID}/stream
+// Empty lines are skipped. The stream may stay open for as long as the
+// producer keeps sending a line at least every StreamIdleTimeout.
+func (s *Server) handlePublishStream(w http.ResponseWriter, r *http.Request) {
+	roomID, err := s.resolveRoomID(r.PathValue("roomID"))
+	if err != nil {
+		http.Error(w, err.Error(), roomIDStatus(err))
+		return
+	}
+
+	// The lines are published as they arrive, so the signature can't cover
+	// the body.
+	if err := s.verifyPublishSignature(r, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := s.authorizePublish(r, roomID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	publisher, publisherID := remoteIP(r), publisherKey(r)
+	if !s.publisherRooms.admits(publisherID, roomID) {
+		http.Error(w, "Too many distinct rooms for this publisher", http.StatusForbidden)
+		return
+	}
+
+	room, err := s.rooms.openRoom(roomID)
+	if err != nil {
+		http.Error(w, err.Error(), openRoomStatus(err))
+		return
+	}
+	if err := room.claimAccessToken(requestToken(r)); err != nil {
+		http.Error(w, err.Error(), accessTokenStatus(err))
+		return
+	}
+	if !room.publisherIPs.allow(publisher) {
+		http.Error(w, "Too many distinct publishers for this room", http.StatusForbidden)
+		return
+	}
+
+	// Every line of the stream shares the stream's ordering key and topic, and
+	// is logged with the stream's request ID.
+	reqID := requestID(w, r)
+	key := r.URL.Query().Get("key")
+	if len(key) > maxOrderingKeyLength {
+		http.Error(w, "Invalid key parameter", http.StatusBadRequest)
+		return
+	}
+	topic, err := requestTopic(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl, err := requestTTL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.roomStreams.acquire(roomID) {
+		http.Error(w, "Too many streaming publishes to this room", http.StatusTooManyRequests)
+		return
+	}
+	defer s.roomStreams.release(roomID)
+
+	limit := s.contentLimit()
+	// Every line is retained as content of the stream's type.
+	contentType := publishContentType(r, nil, true)
+
+	// The stream outlives the server's read and write timeouts; reads get
+	// their own deadlines below.
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	br := bufio.NewReader(r.Body)
+
+	// A shutdown interrupts the read in progress, so that the stream doesn't
+	// hold up the server; a partial line is never published then.
+	go func() {
+		select {
+		case <-s.shutdownStarted:
+			rc.SetReadDeadline(time.Now())
+		case <-r.Context().Done():
+		}
+	}()
+
+	published := 0
+	for {
+		var deadline time.Time
+		if s.opts.StreamIdleTimeout > 0 {
+			deadline = time.Now().Add(s.opts.StreamIdleTimeout)
+		}
+		rc.SetReadDeadline(deadline)
+		if s.shuttingDown.Load() {
+			http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		line, err := readLine(br, limit)
+		if errors.Is(err, errLineTooLong) {
+			http.Error(w, "Line too long", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil && err != io.EOF && s.shuttingDown.Load() {
+			http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		complete := bytes.HasSuffix(line, []byte("\n"))
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) > 0 && (complete || s.opts.StreamPartialLine == "publish") {
+			// Looked up again for every line, so that a long stream keeps an
+			// otherwise idle room from being reaped.
+			if room, err = s.rooms.openRoom(roomID); err != nil {
+				http.Error(w, err.Error(), openRoomStatus(err))
+				return
+			}
+			// A line over the room's publish rate or content size limit,
+			// that doesn't match the room's schema, that the room won't retain under
+			// RequireRetention set to reject, that goes past MaxPublisherRooms,
+			// or that finds the room's publish queue full or the room paused
+			// without room in its buffer ends the stream; the lines before it
+			// have been published.
+			if !s.checkPublishRate(w, r, room, publisher) || !checkContentSize(w, room, len(line)) || !checkSchema(w, room, line) || !s.checkRetention(w, room, len(line), contentType) || !s.checkMirrorHealth(w, room) {
+				return
+			}
+			if !s.publisherRooms.allow(publisherID, roomID) {
+				http.Error(w, "Too many distinct rooms for this publisher", http.StatusForbidden)
+				return
+			}
+			p := publication{message: line, publisher: publisher, key: key, contentType: contentType, topic: topic, ttl: ttl, requestID: reqID}
+			if held, err := room.hold(p, true); err != nil {
+				pausedError(w, err)
+				return
+			} else if !held && !room.trySubmit(p) {
+				http.Error(w, "Publish queue full", http.StatusTooManyRequests)
+				return
+			}
+			published++
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			http.Error(w, fmt.Sprintf("Stream idle for too long, %d lines published", published), http.StatusRequestTimeout)
+			return
+		}
+		if err != nil {
+			// The producer disconnected; there's no one to respond to.
+			return
+		}
+	}
+
+	rc.SetWriteDeadline(time.Now().Add(writeWait))
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "published": published})
+}
+
+// readLine reads up to and including the next newline, returning what was
+// read along with any error. It fails with errLineTooLong if the line exceeds
+// limit bytes.
+func readLine(br *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(bytes.TrimRight(line, "\r\n")) > limit {
+			return nil, errLineTooLong
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestStreamPartialLine(t *testing.T) {
+	for _, tt := range []struct {
+		policy, body string
+		want         []string
+	}{
+		{"publish", "one\ntwo\n", []string{"one", "two"}},
+		{"publish", "one\ntwo", []string{"one", "two"}},
+		{"discard", "one\ntwo\n", []string{"one", "two"}},
+		{"discard", "one\ntwo", []string{"one"}},
+	} {
+		opts := DefaultOptions()
+		opts.StreamPartialLine = tt.policy
+		opts.PublishRate = 0
+		s, ts := newTestServer(t, opts)
+		room, err := s.rooms.openRoom("stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := joinTestClient(t, room, 16)
+
+		if code, body := request(t, http.MethodPost, ts.URL+"/api/rooms/stream/stream", tt.body, nil); code != http.StatusOK {
+			t.Fatalf("%s %q: %d %s", tt.policy, tt.body, code, body)
+		}
+		room.do(func() {})
+		if got := received(client); !slices.Equal(got, tt.want) {
+			t.Errorf("%s %q: published %q, want %q", tt.policy, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestMaxRoomStreams(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxRoomStreams = 2
+	s, ts := newTestServer(t, opts)
+	streams := func() int {
+		s.roomStreams.mu.Lock()
+		defer s.roomStreams.mu.Unlock()
+		return s.roomStreams.counts["capped"]
+	}
+
+	// Each stream stays open until its producer closes the body.
+	var producers []*io.PipeWriter
+	done := make(chan int, 2)
+	for range 2 {
+		body, producer := io.Pipe()
+		producers = append(producers, producer)
+		t.Cleanup(func() { producer.Close() })
+		go func() {
+			res, err := http.Post(ts.URL+"/api/rooms/capped/stream", "text/plain", body)
+			if err != nil {
+				done <- 0
+				return
+			}
+			res.Body.Close()
+			done <- res.StatusCode
+		}()
+	}
+	eventually(t, "both streams to start", func() bool { return streams() == 2 })
+
+	if code, body := request(t, http.MethodPost, ts.URL+"/api/rooms/capped/stream", "line\n", nil); code != http.StatusTooManyRequests {
+		t.Errorf("stream past the cap: %d %s, want 429", code, body)
+	}
+	// Other rooms have caps of their own.
+	if code, body := request(t, http.MethodPost, ts.URL+"/api/rooms/other/stream", "line\n", nil); code != http.StatusOK {
+		t.Errorf("stream to another room: %d %s", code, body)
+	}
+
+	// Ending a stream frees its place.
+	producers[0].Close()
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("ended stream: status %d", code)
+	}
+	eventually(t, "the stream to be released", func() bool { return streams() == 1 })
+	if code, body := request(t, http.MethodPost, ts.URL+"/api/rooms/capped/stream", "line\n", nil); code != http.StatusOK {
+		t.Errorf("stream after one ended: %d %s", code, body)
+	}
+}
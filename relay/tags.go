@@ -0,0 +1,144 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxTagValueLength bounds the length of a tag value.
+	maxTagValueLength = 64
+
+	// otherTagValue stands in for tag values beyond MaxTagValues.
+	otherTagValue = "other"
+)
+
+var errInvalidTag = errors.New("invalid tag parameter")
+
+// allowedTagKeys returns the keys in TagKeys.
+func (s *Server) allowedTagKeys() []string {
+	var keys []string
+	for key := range strings.SplitSeq(s.opts.TagKeys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// connectionTags returns the tags a subscriber's request carries, e.g.
+// ?platform=ios&version=1.2, or nil if it has none. Values must be short and
+// limited to letters, digits, '.', '_' and '-'.
+func (s *Server) connectionTags(r *http.Request) (map[string]string, error) {
+	var tags map[string]string
+	query := r.URL.Query()
+	for _, key := range s.allowedTagKeys() {
+		if !query.Has(key) {
+			continue
+		}
+		value := query.Get(key)
+		if !validTagValue(value) {
+			return nil, errInvalidTag
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[key] = s.tagGauges.value(key, value)
+	}
+	return tags, nil
+}
+
+func validTagValue(value string) bool {
+	if value == "" || len(value) > maxTagValueLength {
+		return false
+	}
+	for _, c := range value {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// TagGauges counts the live connections carrying each tag value.
+type TagGauges struct {
+	// counts maps a tag key to the connection count of each of its values.
+	// Values stay once seen, so that their gauges drop back to zero rather
+	// than disappearing.
+	counts map[string]map[string]int64
+	// maxValues is the number of distinct values counted per key.
+	maxValues int
+	mu        sync.Mutex
+}
+
+func newTagGauges(maxValues int) *TagGauges {
+	return &TagGauges{
+		counts:    make(map[string]map[string]int64),
+		maxValues: maxValues,
+	}
+}
+
+// value returns the value to record for tag key: value itself, or "other"
+// once key has maxValues distinct values.
+func (g *TagGauges) value(key, value string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	values := g.counts[key]
+	if values == nil {
+		values = make(map[string]int64)
+		g.counts[key] = values
+	}
+	if _, ok := values[value]; ok {
+		return value
+	}
+	if len(values) >= g.maxValues {
+		value = otherTagValue
+	}
+	if _, ok := values[value]; !ok {
+		values[value] = 0
+	}
+	return value
+}
+
+// add counts a connection with the given tags.
+func (g *TagGauges) add(tags map[string]string) {
+	g.update(tags, 1)
+}
+
+// remove uncounts a connection with the given tags.
+func (g *TagGauges) remove(tags map[string]string) {
+	g.update(tags, -1)
+}
+
+func (g *TagGauges) update(tags map[string]string, delta int64) {
+	if len(tags) == 0 {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for key, value := range tags {
+		g.counts[key][value] += delta
+	}
+}
+
+// statsdLines returns the gauges in DogStatsD format, tagged with key:value.
+func (g *TagGauges) statsdLines(prefix string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var lines []string
+	for key, values := range g.counts {
+		for value, n := range values {
+			lines = append(lines, fmt.Sprintf("%sclients_tagged:%d|g|#%s:%s", prefix, n, key, value))
+		}
+	}
+	slices.Sort(lines)
+	return lines
+}
@@ -0,0 +1,89 @@
+package relay
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConnectionTags(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TagKeys = "platform, version"
+	opts.MaxTagValues = 2
+	s, ts := newTestServer(t, opts)
+
+	conn := dialWS(t, ts, "/ws/tagged?platform=ios&version=1.2&other=ignored", nil)
+	dialWS(t, ts, "/ws/tagged?platform=android", nil)
+	dialWS(t, ts, "/ws/tagged?platform=web", nil)
+	room := waitForRoom(t, s, "tagged")
+	eventually(t, "the subscribers to join", func() bool { return room.members.Load() == 3 })
+
+	code, body := admin(t, ts, http.MethodGet, "/admin/clients?ip=127.0.0.1", "")
+	if code != http.StatusOK {
+		t.Fatalf("GET /admin/clients: %d %s", code, body)
+	}
+	var listing struct {
+		Clients []clientInfo `json:"clients"`
+	}
+	if err := json.Unmarshal([]byte(body), &listing); err != nil {
+		t.Fatal(err)
+	}
+	var tags []map[string]string
+	for _, client := range listing.Clients {
+		tags = append(tags, client.Tags)
+	}
+	// Values past MaxTagValues are counted as "other".
+	for _, want := range []map[string]string{
+		{"platform": "ios", "version": "1.2"},
+		{"platform": "android"},
+		{"platform": "other"},
+	} {
+		if !slices.ContainsFunc(tags, func(got map[string]string) bool { return maps.Equal(got, want) }) {
+			t.Errorf("client tags %v, missing %v", tags, want)
+		}
+	}
+
+	assertGauges := func(want ...string) {
+		t.Helper()
+		lines := s.tagGauges.statsdLines("relay.")
+		for _, line := range want {
+			if !slices.Contains(lines, line) {
+				t.Errorf("gauges %q, missing %q", lines, line)
+			}
+		}
+	}
+	assertGauges(
+		"relay.clients_tagged:1|g|#platform:android",
+		"relay.clients_tagged:1|g|#platform:ios",
+		"relay.clients_tagged:1|g|#platform:other",
+		"relay.clients_tagged:1|g|#version:1.2",
+	)
+
+	// Gauges drop back to zero as tagged subscribers leave.
+	conn.Close()
+	eventually(t, "the tagged subscriber to leave", func() bool {
+		return slices.Contains(s.tagGauges.statsdLines("relay."), "relay.clients_tagged:0|g|#platform:ios")
+	})
+	assertGauges(
+		"relay.clients_tagged:0|g|#platform:ios",
+		"relay.clients_tagged:0|g|#version:1.2",
+		"relay.clients_tagged:1|g|#platform:android",
+	)
+}
+
+func TestConnectionTagsInvalid(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TagKeys = "platform"
+	_, ts := newTestServer(t, opts)
+	for _, query := range []string{"platform=", "platform=a%20b", "platform=" + strings.Repeat("x", maxTagValueLength+1)} {
+		_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/tagged?"+query, nil)
+		if err == nil || res == nil || res.StatusCode != http.StatusBadRequest {
+			t.Errorf("dialing with %s: %v, want status 400", query, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+var errUnknownTemplate = errors.New("unknown template")
+
+// Template renders messages for the subscribers that select it with
+// ?template=NAME. Both *text/template.Template and *html/template.Template
+// implement it.
+type Template interface {
+	Execute(w io.Writer, data any) error
+}
+
+// subscriberTemplate returns the name of the template the request selects,
+// or "" if it selects none.
+func (s *Server) subscriberTemplate(r *http.Request) (string, error) {
+	name := r.URL.Query().Get("template")
+	if name == "" {
+		return "", nil
+	}
+	if _, ok := s.opts.Templates[name]; !ok {
+		return "", errUnknownTemplate
+	}
+	return name, nil
+}
+
+// render returns message rendered with the named template, with the decoded
+// JSON as its data. Messages that aren't JSON, or that the template fails to
+// render, are returned unchanged.
+func (s *Server) render(name string, message []byte) []byte {
+	d := json.NewDecoder(bytes.NewReader(message))
+	d.UseNumber()
+	var data any
+	if err := d.Decode(&data); err != nil || d.More() {
+		return message
+	}
+	var buf bytes.Buffer
+	if err := s.opts.Templates[name].Execute(&buf, data); err != nil {
+		return message
+	}
+	return buf.Bytes()
+}
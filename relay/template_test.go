@@ -0,0 +1,50 @@
+package relay
+
+import (
+	"bufio"
+	"html/template"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSubscriberTemplate(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Templates = map[string]Template{
+		"card": template.Must(template.New("card").Parse(`<div class="card">{{.title}}: {{.count}}</div>`)),
+	}
+	s, ts := newTestServer(t, opts)
+	rendered := dialWS(t, ts, "/ws/cards?template=card", nil)
+	raw := dialWS(t, ts, "/ws/cards", nil)
+	stream := bufio.NewReader(openSSE(t, ts, "/sse/cards?template=card").Body)
+	room := waitForRoom(t, s, "cards")
+	waitForClients(t, room, 3)
+
+	for _, tt := range []struct {
+		content, rendered string
+	}{
+		{`{"title":"<b>Sales</b>","count":12345678901}`, `<div class="card">&lt;b&gt;Sales&lt;/b&gt;: 12345678901</div>`},
+		// Content that isn't JSON goes through as is.
+		{"plain text", "plain text"},
+	} {
+		if code, body := publish(t, ts, "cards", tt.content, nil); code != http.StatusOK {
+			t.Fatalf("publish: %d %s", code, body)
+		}
+		if _, message, err := rendered.ReadMessage(); err != nil || string(message) != tt.rendered {
+			t.Errorf("templated subscriber received %q (%v), want %q", message, err, tt.rendered)
+		}
+		if _, message, err := raw.ReadMessage(); err != nil || string(message) != tt.content {
+			t.Errorf("raw subscriber received %q (%v), want %q", message, err, tt.content)
+		}
+		if got := readEvent(t, stream); got != tt.rendered {
+			t.Errorf("templated SSE subscriber received %q, want %q", got, tt.rendered)
+		}
+	}
+
+	_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/cards?template=missing", nil)
+	if err == nil || res == nil || res.StatusCode != http.StatusBadRequest {
+		t.Errorf("selecting an unknown template: %v, want status 400", err)
+	}
+}
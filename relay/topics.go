@@ -0,0 +1,56 @@
+package relay
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	// maxTopicLength bounds the length of a topic.
+	maxTopicLength = 64
+
+	// maxSubscriberTopics bounds the topics a subscriber can filter on.
+	maxSubscriberTopics = 32
+)
+
+var (
+	errInvalidTopic  = errors.New("invalid topic parameter")
+	errInvalidTopics = errors.New("invalid topics parameter")
+)
+
+// requestTopic returns the topic a publish tags its message with,
+// ?topic=NAME, or "" for none.
+func requestTopic(r *http.Request) (string, error) {
+	topic := r.URL.Query().Get("topic")
+	if len(topic) > maxTopicLength || strings.Contains(topic, ",") {
+		return "", errInvalidTopic
+	}
+	return topic, nil
+}
+
+// requestTopics returns the topics a subscribe request filters the room's
+// messages on, ?topics=NAME,NAME, or nil to receive every message.
+func requestTopics(r *http.Request) (map[string]bool, error) {
+	if !r.URL.Query().Has("topics") {
+		return nil, nil
+	}
+	topics := make(map[string]bool)
+	for topic := range strings.SplitSeq(r.URL.Query().Get("topics"), ",") {
+		if topic == "" || len(topic) > maxTopicLength {
+			return nil, errInvalidTopics
+		}
+		topics[topic] = true
+	}
+	if len(topics) > maxSubscriberTopics {
+		return nil, errInvalidTopics
+	}
+	return topics, nil
+}
+
+// wantsTopic reports whether the client receives messages tagged with topic.
+// Untagged messages, which include events such as presence updates, go to
+// every client.
+func (c *Client) wantsTopic(topic string) bool {
+	return topic == "" || c.topics == nil || c.topics[topic]
+}
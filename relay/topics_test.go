@@ -0,0 +1,70 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTopics(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HistorySize = 10
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	publishAll := func(messages [][2]string) {
+		t.Helper()
+		for _, m := range messages {
+			query := url.Values{}
+			if m[1] != "" {
+				query.Set("topic", m[1])
+			}
+			if code, body := publish(t, ts, "market", m[0], query); code != http.StatusOK {
+				t.Fatalf("publish: %d %s", code, body)
+			}
+		}
+	}
+
+	publishAll([][2]string{{"price 1", "prices"}, {"news 1", "news"}, {"untagged 1", ""}})
+	subscribers := map[string][]string{
+		"?topics=prices":      {"price 1", "untagged 1", "price 2", "untagged 2"},
+		"?topics=prices,news": {"price 1", "news 1", "untagged 1", "price 2", "news 2", "untagged 2"},
+		"":                    {"price 1", "news 1", "untagged 1", "price 2", "news 2", "untagged 2"},
+	}
+	conns := make(map[string]*websocket.Conn, len(subscribers))
+	for query := range subscribers {
+		conns[query] = dialWS(t, ts, "/ws/market"+query, nil)
+	}
+	waitForClients(t, waitForRoom(t, s, "market"), len(subscribers))
+
+	// Subscribers filtering on topics only get theirs, in the replay and
+	// live, along with untagged messages.
+	publishAll([][2]string{{"price 2", "prices"}, {"news 2", "news"}, {"untagged 2", ""}})
+	for query, want := range subscribers {
+		if got := readLines(t, conns[query], len(want)); !slices.Equal(got, want) {
+			t.Errorf("subscriber with %q received %q, want %q", query, got, want)
+		}
+	}
+
+	for _, target := range []string{
+		"/market?content=x&topic=a,b",
+		"/market?content=x&topic=" + strings.Repeat("t", maxTopicLength+1),
+	} {
+		if code, body := request(t, http.MethodPost, ts.URL+target, "", nil); code != http.StatusBadRequest {
+			t.Errorf("POST %.40s: %d %s, want 400", target, code, body)
+		}
+	}
+	tooMany := make([]string, maxSubscriberTopics+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprint("topic", i)
+	}
+	for _, topics := range []string{"a,,b", strings.Join(tooMany, ",")} {
+		if res := openSSE(t, ts, "/sse/market?topics="+topics); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("subscribing with topics=%.40s: status %d, want 400", topics, res.StatusCode)
+		}
+	}
+}
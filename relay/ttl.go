@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var errInvalidTTL = errors.New("invalid ttl parameter")
+
+// requestTTL returns how long a published message is retained for, from
+// ?ttl=DURATION or the X-Message-TTL header, either a duration such as "30s"
+// or a number of seconds, or 0 to retain it as long as the room's limits
+// allow.
+func requestTTL(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("ttl")
+	if v == "" {
+		v = r.Header.Get("X-Message-TTL")
+	}
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || seconds > int64(time.Duration(1<<63-1)/time.Second) {
+			return 0, errInvalidTTL
+		}
+		d = time.Duration(seconds) * time.Second
+	}
+	if d <= 0 {
+		return 0, errInvalidTTL
+	}
+	return d, nil
+}
+
+// expired reports whether the message was published with a TTL that has run
+// out at now.
+func (m retainedMessage) expired(now time.Time) bool {
+	return !m.expiresAt.IsZero() && !now.Before(m.expiresAt)
+}
+
+// expireAt makes the room expire its content at t, unless its expiry timer
+// already fires before then. It must be called on the room's goroutine.
+func (r *Room) expireAt(t time.Time) {
+	if !r.nextExpiry.IsZero() && !t.Before(r.nextExpiry) {
+		return
+	}
+	r.nextExpiry = t
+	if r.expiryTimer == nil {
+		r.expiryTimer = time.AfterFunc(time.Until(t), r.expireOnTimer)
+	} else {
+		r.expiryTimer.Reset(time.Until(t))
+	}
+}
+
+// expireOnTimer drops the messages whose TTL has run out on the room's
+// goroutine, and sets the expiry timer for the next of those that remain.
+func (r *Room) expireOnTimer() {
+	r.do(func() {
+		r.expireContent(time.Now())
+		r.nextExpiry = time.Time{}
+		for _, m := range r.history.messages {
+			if !m.expiresAt.IsZero() {
+				r.expireAt(m.expiresAt)
+			}
+		}
+		if !r.lastContent.expiresAt.IsZero() {
+			r.expireAt(r.lastContent.expiresAt)
+		}
+	})
+}
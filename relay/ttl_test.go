@@ -0,0 +1,78 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRequestTTL(t *testing.T) {
+	for _, tt := range []struct {
+		query, header string
+		want          time.Duration
+		ok            bool
+	}{
+		{"", "", 0, true},
+		{"30s", "", 30 * time.Second, true},
+		{"", "90", 90 * time.Second, true},
+		{"", "1m30s", 90 * time.Second, true},
+		// The query wins over the header.
+		{"5s", "90", 5 * time.Second, true},
+		{"0s", "", 0, false},
+		{"-1s", "", 0, false},
+		{"", "soon", 0, false},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/room?ttl="+url.QueryEscape(tt.query), nil)
+		if tt.header != "" {
+			r.Header.Set("X-Message-TTL", tt.header)
+		}
+		got, err := requestTTL(r)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("ttl %q, X-Message-TTL %q: %v, %v, want %v", tt.query, tt.header, got, err, tt.want)
+		}
+	}
+}
+
+func TestMessageTTL(t *testing.T) {
+	const ttl = 100 * time.Millisecond
+	opts := DefaultOptions()
+	opts.HistorySize = 10
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	if code, body := publish(t, ts, "codes", "kept", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if code, body := publish(t, ts, "codes", "one-time code", url.Values{"ttl": {ttl.String()}}); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if got := readLines(t, dialWS(t, ts, "/ws/codes", nil), 2); !slices.Equal(got, []string{"kept", "one-time code"}) {
+		t.Errorf("replay before the TTL ran out: %q", got)
+	}
+
+	// Once the TTL runs out, the message is dropped from /latest and the
+	// history, even without further publishes.
+	eventually(t, "the message to expire", func() bool { return latest(t, ts, "codes") != "one-time code" })
+	if got := latest(t, ts, "codes"); got != "" {
+		t.Errorf("latest = %q after the latest message expired, want none", got)
+	}
+	conn := dialWS(t, ts, "/ws/codes", nil)
+	waitForClients(t, waitForRoom(t, s, "codes"), 2)
+	if code, body := publish(t, ts, "codes", "live", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if got := readLines(t, conn, 2); !slices.Equal(got, []string{"kept", "live"}) {
+		t.Errorf("replay after the TTL ran out, then a live message: %q", got)
+	}
+
+	for _, query := range []url.Values{
+		{"ttl": {"never"}},
+		{"ttl": {"1s"}, "audience": {"current"}},
+	} {
+		if code, body := publish(t, ts, "codes", "rejected", query); code != http.StatusBadRequest {
+			t.Errorf("publish with %v: %d %s, want 400", query, code, body)
+		}
+	}
+}
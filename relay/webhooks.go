@@ -0,0 +1,299 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// webhookQueue bounds the messages waiting to be delivered to a webhook.
+	// Further messages are dropped, counting as failed deliveries.
+	webhookQueue = 256
+
+	// webhookTimeout bounds each attempt at delivering to a webhook.
+	webhookTimeout = 10 * time.Second
+
+	// webhookAttempts is how many times a message is POSTed to a webhook
+	// before it is given up on.
+	webhookAttempts = 5
+
+	// webhookBackoff is the wait before the first retry of a failed
+	// delivery. It doubles with every further retry.
+	webhookBackoff = time.Second
+
+	// maxWebhookRequestSize bounds the body of a webhook subscription.
+	maxWebhookRequestSize = 16 << 10
+)
+
+var errWebhookNotFound = errors.New("webhook not found")
+
+// webhook delivers a room's broadcasts to a backend service's HTTP callback,
+// POSTing each message from a worker of its own and retrying failed
+// deliveries with exponential backoff. With a secret, each request is signed
+// so the service can tell it came from the relay.
+type webhook struct {
+	id     string
+	url    string
+	secret string
+	queue  chan publication
+	stop   chan struct{}
+
+	delivered atomic.Int64
+	failed    atomic.Int64
+}
+
+// webhookStatus describes a webhook in the webhook API. The secret is never
+// shown.
+type webhookStatus struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	Signed    bool   `json:"signed"`
+	Delivered int64  `json:"delivered"`
+	Failed    int64  `json:"failed"`
+	Queued    int    `json:"queued"`
+}
+
+func (h *webhook) status() webhookStatus {
+	return webhookStatus{
+		ID:        h.id,
+		URL:       h.url,
+		Signed:    h.secret != "",
+		Delivered: h.delivered.Load(),
+		Failed:    h.failed.Load(),
+		Queued:    len(h.queue),
+	}
+}
+
+// enqueue queues p's message for delivery, counting it as failed if the
+// queue is full. It never blocks the room.
+func (h *webhook) enqueue(p publication) {
+	select {
+	case h.queue <- p:
+	default:
+		h.failed.Add(1)
+	}
+}
+
+// run delivers the queued messages of the named room, in order, until the
+// webhook is removed or the server shuts down.
+func (h *webhook) run(room string, client *http.Client, shutdown <-chan struct{}) {
+	for {
+		select {
+		case p := <-h.queue:
+			if h.deliverWithRetries(room, client, p, shutdown) {
+				h.delivered.Add(1)
+			} else {
+				h.failed.Add(1)
+			}
+		case <-h.stop:
+			return
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// deliverWithRetries POSTs p's message until it is accepted, a delivery is
+// rejected as one that would never succeed, or webhookAttempts have failed.
+// It reports whether the message was delivered.
+func (h *webhook) deliverWithRetries(room string, client *http.Client, p publication, shutdown <-chan struct{}) bool {
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := h.deliver(room, client, p)
+		if err == nil {
+			return true
+		}
+		if !retry || attempt == webhookAttempts {
+			return false
+		}
+		select {
+		case <-time.After(backoff):
+		case <-h.stop:
+			return false
+		case <-shutdown:
+			return false
+		}
+		backoff *= 2
+	}
+}
+
+// deliver POSTs p's message to the webhook's URL, reporting whether a failed
+// delivery is worth retrying: client errors other than 408 and 429 aren't.
+func (h *webhook) deliver(room string, client *http.Client, p publication) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(p.message))
+	if err != nil {
+		return false, err
+	}
+	if p.contentType != "" {
+		req.Header.Set("Content-Type", p.contentType)
+	}
+	req.Header.Set("X-Relay-Room", room)
+	req.Header.Set("X-Relay-Webhook", h.id)
+	if p.seq > 0 {
+		req.Header.Set("X-Relay-Sequence", strconv.FormatUint(p.seq, 10))
+	}
+	if p.topic != "" {
+		req.Header.Set("X-Relay-Topic", p.topic)
+	}
+	if h.secret != "" {
+		req.Header.Set("X-Relay-Signature", "sha256="+signWebhook(h.secret, p.message))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("%s: %s", h.url, resp.Status)
+	}
+	return false, nil
+}
+
+// signWebhook returns the hex-encoded HMAC-SHA256 of body with secret.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Webhooks holds the webhooks of each room, by room name and webhook ID.
+type Webhooks struct {
+	hooks    map[string]map[string]*webhook
+	client   *http.Client
+	shutdown <-chan struct{}
+	mu       sync.RWMutex
+}
+
+func newWebhooks(shutdown <-chan struct{}) *Webhooks {
+	return &Webhooks{
+		hooks:    make(map[string]map[string]*webhook),
+		client:   &http.Client{Timeout: webhookTimeout},
+		shutdown: shutdown,
+	}
+}
+
+// add delivers the broadcasts to the named room to url, signed with secret
+// if it isn't empty, and returns the new webhook.
+func (wh *Webhooks) add(room, url, secret string) *webhook {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	if wh.hooks[room] == nil {
+		wh.hooks[room] = make(map[string]*webhook)
+	}
+	h := &webhook{
+		id:     newConnectionID(),
+		url:    url,
+		secret: secret,
+		queue:  make(chan publication, webhookQueue),
+		stop:   make(chan struct{}),
+	}
+	wh.hooks[room][h.id] = h
+	go h.run(room, wh.client, wh.shutdown)
+	return h
+}
+
+// delete removes the named room's webhook with the given ID. Messages still
+// queued for it are dropped.
+func (wh *Webhooks) delete(room, id string) error {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	h, ok := wh.hooks[room][id]
+	if !ok {
+		return errWebhookNotFound
+	}
+	close(h.stop)
+	delete(wh.hooks[room], id)
+	if len(wh.hooks[room]) == 0 {
+		delete(wh.hooks, room)
+	}
+	return nil
+}
+
+// remove stops delivering the named room's broadcasts to any webhook.
+func (wh *Webhooks) remove(room string) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	for _, h := range wh.hooks[room] {
+		close(h.stop)
+	}
+	delete(wh.hooks, room)
+}
+
+// targets returns the webhooks of the named room.
+func (wh *Webhooks) targets(room string) []*webhook {
+	wh.mu.RLock()
+	defer wh.mu.RUnlock()
+
+	targets := make([]*webhook, 0, len(wh.hooks[room]))
+	for _, h := range wh.hooks[room] {
+		targets = append(targets, h)
+	}
+	return targets
+}
+
+// handleAddWebhook subscribes an HTTP callback to a room's broadcasts:
+// POST /api/rooms/{roomID}/webhooks with {"url":"...","secret":"..."}
+// The secret is optional; with it, every delivery is signed.
+func (s *Server) handleAddWebhook(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	var req struct {
+		URL    string `json:"url"`
+		Secret string `json:"secret"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebhookRequestSize)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := parseMirrorURL(req.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.rooms.getRoom(roomID)
+	h := s.webhooks.add(roomID, req.URL, req.Secret)
+	writeJSON(w, http.StatusCreated, map[string]any{"room": roomID, "webhook": h.status()})
+}
+
+// handleListWebhooks lists a room's webhooks with their delivery counts:
+// GET /api/rooms/{roomID}/webhooks
+func (s *Server) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	webhooks := []webhookStatus{}
+	for _, h := range s.webhooks.targets(roomID) {
+		webhooks = append(webhooks, h.status())
+	}
+	slices.SortFunc(webhooks, func(a, b webhookStatus) int {
+		return strings.Compare(a.URL+a.ID, b.URL+b.ID)
+	})
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "webhooks": webhooks})
+}
+
+// handleDeleteWebhook unsubscribes a webhook from a room's broadcasts:
+// DELETE /api/rooms/{roomID}/webhooks/{id}
+func (s *Server) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomID")
+	if err := s.webhooks.delete(roomID, r.PathValue("id")); err != nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"room": roomID, "deleted": r.PathValue("id")})
+}
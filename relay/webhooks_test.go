@@ -0,0 +1,160 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookDelivery is a request received by a test webhook endpoint.
+type webhookDelivery struct {
+	header http.Header
+	body   string
+}
+
+// webhookEndpoint starts an HTTP callback that answers each delivery with the
+// next of statuses, and 200 once they run out, and sends what it receives on
+// the returned channel.
+func webhookEndpoint(t testing.TB, statuses ...int) (*httptest.Server, <-chan webhookDelivery) {
+	t.Helper()
+	deliveries := make(chan webhookDelivery, 16)
+	var attempts atomic.Int64
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- webhookDelivery{header: r.Header, body: string(body)}
+		if n := int(attempts.Add(1)); n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+		}
+	}))
+	t.Cleanup(endpoint.Close)
+	return endpoint, deliveries
+}
+
+// nextDelivery waits for the next delivery to a test webhook endpoint.
+func nextDelivery(t testing.TB, deliveries <-chan webhookDelivery) webhookDelivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a webhook delivery")
+		return webhookDelivery{}
+	}
+}
+
+// listWebhooks returns the webhooks of room on ts.
+func listWebhooks(t testing.TB, ts *httptest.Server, room string) []webhookStatus {
+	t.Helper()
+	code, body := admin(t, ts, http.MethodGet, "/api/rooms/"+room+"/webhooks", "")
+	if code != http.StatusOK {
+		t.Fatalf("listing webhooks: %d %s", code, body)
+	}
+	var list struct {
+		Webhooks []webhookStatus `json:"webhooks"`
+	}
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		t.Fatal(err)
+	}
+	return list.Webhooks
+}
+
+func TestWebhooks(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	// The first attempt fails, and the delivery is retried.
+	endpoint, deliveries := webhookEndpoint(t, http.StatusServiceUnavailable)
+
+	code, body := admin(t, ts, http.MethodPost, "/api/rooms/orders/webhooks", `{"url":"`+endpoint.URL+`","secret":"s3cret"}`)
+	if code != http.StatusCreated {
+		t.Fatalf("adding a webhook: %d %s", code, body)
+	}
+	if strings.Contains(body, "s3cret") {
+		t.Errorf("the response %s shows the secret", body)
+	}
+	var added struct {
+		Webhook webhookStatus `json:"webhook"`
+	}
+	if err := json.Unmarshal([]byte(body), &added); err != nil {
+		t.Fatal(err)
+	}
+
+	content := `{"order":1}`
+	if code, body := request(t, http.MethodPost, ts.URL+"/orders", content, http.Header{"Content-Type": {"application/json"}}); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	first, retried := nextDelivery(t, deliveries), nextDelivery(t, deliveries)
+	if retried.body != content || first.body != content {
+		t.Errorf("delivered %q then %q, want the content twice", first.body, retried.body)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(content))
+	for header, want := range map[string]string{
+		"Content-Type":      "application/json",
+		"X-Relay-Room":      "orders",
+		"X-Relay-Webhook":   added.Webhook.ID,
+		"X-Relay-Sequence":  "1",
+		"X-Relay-Signature": "sha256=" + hex.EncodeToString(mac.Sum(nil)),
+	} {
+		if got := retried.header.Get(header); got != want {
+			t.Errorf("%s: %q, want %q", header, got, want)
+		}
+	}
+	eventually(t, "the delivery to be counted", func() bool {
+		hooks := listWebhooks(t, ts, "orders")
+		return len(hooks) == 1 && hooks[0].Delivered == 1 && hooks[0].Failed == 0 && hooks[0].Signed
+	})
+
+	// Once deleted, a webhook gets nothing more.
+	if code, body := admin(t, ts, http.MethodDelete, "/api/rooms/orders/webhooks/"+added.Webhook.ID, ""); code != http.StatusOK {
+		t.Fatalf("deleting the webhook: %d %s", code, body)
+	}
+	if code, _ := admin(t, ts, http.MethodDelete, "/api/rooms/orders/webhooks/"+added.Webhook.ID, ""); code != http.StatusNotFound {
+		t.Errorf("deleting the webhook again: status %d, want 404", code)
+	}
+	if hooks := listWebhooks(t, ts, "orders"); len(hooks) != 0 {
+		t.Errorf("webhooks after the delete: %+v", hooks)
+	}
+	if code, body := publish(t, ts, "orders", "after the delete", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	select {
+	case d := <-deliveries:
+		t.Errorf("a deleted webhook got %q", d.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookRejected(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions())
+	endpoint, deliveries := webhookEndpoint(t, http.StatusBadRequest)
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/orders/webhooks", `{"url":"`+endpoint.URL+`"}`); code != http.StatusCreated {
+		t.Fatalf("adding a webhook: %d %s", code, body)
+	}
+	if code, body := admin(t, ts, http.MethodPost, "/api/rooms/orders/webhooks", `{"url":"not a url"}`); code != http.StatusBadRequest {
+		t.Errorf("adding a webhook with an invalid URL: %d %s, want 400", code, body)
+	}
+
+	// A client error other than 408 or 429 isn't retried.
+	if code, body := publish(t, ts, "orders", "rejected", nil); code != http.StatusOK {
+		t.Fatalf("publish: %d %s", code, body)
+	}
+	if d := nextDelivery(t, deliveries); d.header.Get("X-Relay-Signature") != "" {
+		t.Errorf("an unsigned webhook sent X-Relay-Signature %q", d.header.Get("X-Relay-Signature"))
+	}
+	eventually(t, "the delivery to fail", func() bool {
+		hooks := listWebhooks(t, ts, "orders")
+		return len(hooks) == 1 && hooks[0].Failed == 1 && !hooks[0].Signed
+	})
+	select {
+	case <-deliveries:
+		t.Error("a rejected delivery was retried")
+	case <-time.After(webhookBackoff + 200*time.Millisecond):
+	}
+}
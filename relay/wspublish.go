@@ -0,0 +1,63 @@
+package relay
+
+import (
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// publish broadcasts a message the client sent to its room, retaining it like
+// an HTTP publish. Messages to the room directory, or that fail the room's
+// access token, publisher or rate limits or schema, or the client's own rate
+// limit, are dropped and recorded as room errors. Submitting waits while the
+// room is busy, so a client that floods the room is throttled through its own
+// connection rather than queuing without bound, and the room's goroutine
+// never waits on a client's reader.
+func (c *Client) publish(messageType int, message []byte) {
+	room := c.room
+	if room.name == directoryRoomName {
+		return
+	}
+	reject := func(reason string) {
+		room.recordError("rejected message from client " + c.id + ": " + reason)
+	}
+	if messageType == websocket.TextMessage && !utf8.Valid(message) {
+		reject("invalid UTF-8")
+		return
+	}
+	if room.checkAccessToken(c.accessToken) != nil {
+		reject("missing or wrong access token")
+		return
+	}
+	if !room.publisherIPs.allow(c.ip) {
+		reject("too many distinct publishers")
+		return
+	}
+	if rate := room.srv.opts.WSPublishRate; rate > 0 && !c.publishBucket.take(time.Now(), rate, room.srv.opts.WSPublishBurst) {
+		reject("client publish rate exceeded")
+		return
+	}
+	if !room.publishLimiter.allow(c.ip) {
+		reject("publish rate exceeded")
+		return
+	}
+	if !room.admitsContentSize(len(message)) {
+		reject("content too large")
+		return
+	}
+	if schema := room.schema.Load(); schema != nil && schema.validate(message) != nil {
+		reject("content does not match the room's schema")
+		return
+	}
+
+	p := publication{message: message, publisher: c.ip, sender: c.id, contentType: frameContentType(messageType)}
+	if c.noEcho {
+		p.skip = c
+	}
+	if held, err := room.hold(p, true); err != nil {
+		reject(err.Error())
+	} else if !held && !room.trySubmit(p) {
+		reject("publish queue full")
+	}
+}
@@ -0,0 +1,156 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWSPublish(t *testing.T) {
+	opts := DefaultOptions()
+	opts.WSPublish = true
+	opts.MaxWSMessageSize = 4096
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	echoed := dialWS(t, ts, "/ws/notepad", nil)
+	quiet := dialWS(t, ts, "/ws/notepad?echo=0", nil)
+	room := waitForRoom(t, s, "notepad")
+	waitForClients(t, room, 2)
+
+	read := func(conn *websocket.Conn, want string) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, message, err := conn.ReadMessage(); err != nil || string(message) != want {
+			t.Fatalf("received %.20q (%v), want %.20q", message, err, want)
+		}
+	}
+	send := func(conn *websocket.Conn, message string) {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A client with echo=0 doesn't get its own messages back, so the first
+	// it reads is the other client's.
+	send(quiet, "from quiet")
+	read(echoed, "from quiet")
+	large := strings.Repeat("x", 2048)
+	send(echoed, large)
+	read(echoed, large)
+	read(quiet, large)
+	if got := latest(t, ts, "notepad"); got != large {
+		t.Errorf("latest = %.20q, want the client's message", got)
+	}
+
+	// A client flooding the room is throttled through its own connection,
+	// while the room keeps serving the others.
+	const flood = 200
+	go func() {
+		for i := range flood {
+			if quiet.WriteMessage(websocket.TextMessage, fmt.Append(nil, "flood ", i)) != nil {
+				return
+			}
+		}
+	}()
+	for i := range flood {
+		read(echoed, fmt.Sprint("flood ", i))
+	}
+	if !room.do(func() {}) {
+		t.Fatal("room closed")
+	}
+}
+
+func TestWSPublishDisabled(t *testing.T) {
+	s, ts := newTestServer(t, DefaultOptions())
+	conn := dialWS(t, ts, "/ws/readonly", nil)
+	room := waitForRoom(t, s, "readonly")
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("ignored")); err != nil {
+		t.Fatal(err)
+	}
+	// Give the server time to read the message.
+	time.Sleep(50 * time.Millisecond)
+	room.do(func() {})
+	if got := latest(t, ts, "readonly"); got != "" {
+		t.Errorf("latest = %q, want nothing published", got)
+	}
+}
+
+func TestWSPublishMode(t *testing.T) {
+	opts := DefaultOptions()
+	opts.WSPublish = true
+	opts.WSPublishOptIn = true
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	writer := dialWS(t, ts, "/ws/modes?mode=rw", nil)
+	reader := dialWS(t, ts, "/ws/modes?mode=r", nil)
+	unset := dialWS(t, ts, "/ws/modes", nil)
+	room := waitForRoom(t, s, "modes")
+	waitForClients(t, room, 3)
+
+	// With WSPublishOptIn, only the client that opted in with mode=rw
+	// publishes; what the others send is discarded.
+	for _, tt := range []struct {
+		conn    *websocket.Conn
+		message string
+	}{
+		{reader, "from mode=r"},
+		{unset, "from no mode"},
+		{writer, "from mode=rw"},
+	} {
+		if err := tt.conn.WriteMessage(websocket.TextMessage, []byte(tt.message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, conn := range []*websocket.Conn{writer, reader, unset} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, message, err := conn.ReadMessage(); err != nil || string(message) != "from mode=rw" {
+			t.Errorf("received %q (%v), want only the mode=rw client's message", message, err)
+		}
+	}
+	if _, errors := room.errorStatus(); errors != 0 {
+		t.Errorf("%d room errors, want the discarded messages not to count", errors)
+	}
+
+	if code, body := request(t, http.MethodGet, ts.URL+"/ws/modes?mode=w", "", nil); code != http.StatusBadRequest {
+		t.Errorf("mode=w: %d %s, want 400", code, body)
+	}
+}
+
+func TestWSPublishRate(t *testing.T) {
+	opts := DefaultOptions()
+	opts.WSPublish = true
+	opts.WSPublishRate = 0.1
+	opts.WSPublishBurst = 2
+	opts.PublishRate = 0
+	s, ts := newTestServer(t, opts)
+	chatty := dialWS(t, ts, "/ws/chat?echo=0", nil)
+	other := dialWS(t, ts, "/ws/chat", nil)
+	room := waitForRoom(t, s, "chat")
+	waitForClients(t, room, 2)
+
+	// The chatty client's burst goes through, the rest of its messages are
+	// dropped as room errors, and the other client isn't held back.
+	for i := range 5 {
+		if err := chatty.WriteMessage(websocket.TextMessage, fmt.Append(nil, "chatty ", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "the excess messages to be dropped", func() bool {
+		_, errors := room.errorStatus()
+		return errors == 3
+	})
+	if err := other.WriteMessage(websocket.TextMessage, []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{"chatty 0", "chatty 1", "other"} {
+		if _, message, err := other.ReadMessage(); err != nil || string(message) != want {
+			t.Errorf("received %q (%v), want %q", message, err, want)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// publicFiles is the frontend, bundled into the binary so that it can be
+// deployed on its own. -static-dir serves an on-disk copy instead.
+//
+//go:embed public
+var publicFiles embed.FS
+
+// frontend returns the embedded frontend files.
+func frontend() fs.FS {
+	// The directory is embedded, so this can't fail.
+	files, _ := fs.Sub(publicFiles, "public")
+	return files
+}
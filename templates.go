@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"relay/relay"
+)
+
+// templateDir holds the templates subscribers can select with ?template=NAME,
+// one per file named NAME.EXT.
+var templateDir = flag.String("template-dir", "", "directory of message templates subscribers can select with ?template=NAME, from files NAME.html (HTML-escaped) or NAME.tmpl")
+
+// loadTemplates parses the templates in dir, keyed by file name without its
+// extension. Files ending in .html are parsed as html/template, so values are
+// escaped for their context, and others as text/template.
+func loadTemplates(dir string) (map[string]relay.Template, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	templates := make(map[string]relay.Template)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		ext := filepath.Ext(entry.Name())
+		name := strings.TrimSuffix(entry.Name(), ext)
+		if ext == ".html" {
+			templates[name], err = htmltemplate.ParseFiles(path)
+		} else {
+			templates[name], err = template.ParseFiles(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return templates, nil
+}
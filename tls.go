@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	// tlsCert and tlsKey make the relay serve HTTPS and WSS itself, for pages
+	// served over HTTPS, without a TLS-terminating proxy in front of it.
+	tlsCert = flag.String("tls-cert", "", "TLS certificate file; with -tls-key, serve HTTPS and WSS on -addr")
+	tlsKey  = flag.String("tls-key", "", "TLS private key file for -tls-cert")
+
+	// tlsRedirectAddr is an address on which plain HTTP requests are
+	// redirected to HTTPS.
+	tlsRedirectAddr = flag.String("tls-redirect-addr", "", "with TLS, also listen on this address and redirect HTTP requests to HTTPS (e.g. :80)")
+
+	// autocertHosts makes the relay obtain and renew certificates for these
+	// hostnames from Let's Encrypt instead of loading -tls-cert.
+	autocertHosts = flag.String("autocert-hosts", "", "comma-separated hostnames to obtain and renew Let's Encrypt certificates for, serving HTTPS and WSS on -addr (instead of -tls-cert)")
+	autocertCache = flag.String("autocert-cache", "autocert-cache", "directory to cache -autocert-hosts certificates and the ACME account key in")
+	autocertEmail = flag.String("autocert-email", "", "contact address given to Let's Encrypt for -autocert-hosts, for notices about certificate problems")
+)
+
+// tlsEnabled reports whether the relay serves TLS itself.
+func tlsEnabled() bool {
+	return *tlsCert != "" || *autocertHosts != ""
+}
+
+// newCertManager returns the manager obtaining certificates for
+// -autocert-hosts, or nil without them.
+func newCertManager() *autocert.Manager {
+	if *autocertHosts == "" {
+		return nil
+	}
+	var hosts []string
+	for host := range strings.SplitSeq(*autocertHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(*autocertCache),
+		Email:      *autocertEmail,
+	}
+}
+
+// redirectToHTTPS redirects requests to the same host and URI over HTTPS, on
+// the port of -addr.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if _, port, err := net.SplitHostPort(*addr); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}